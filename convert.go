@@ -0,0 +1,93 @@
+package session
+
+import (
+	"encoding/gob"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// Converter converts the values of a type to the form stored in the
+// sessions and back, see RegisterConverter.
+type Converter struct {
+	// ToStore returns the stored form of v, e.g. a string.
+	ToStore func(v interface{}) (interface{}, error)
+	// FromStore returns the value of the stored form.
+	FromStore func(stored interface{}) (interface{}, error)
+}
+
+// convertedValue is a value stored converted, with the name of its type to
+// find its converter back.
+type convertedValue struct {
+	Type  string
+	Value interface{}
+}
+
+var converters = struct {
+	sync.RWMutex
+	byType map[reflect.Type]string
+	byName map[string]Converter
+}{byType: make(map[reflect.Type]string), byName: make(map[string]Converter)}
+
+// RegisterConverter makes the session store (Store) keep the values of the
+// type of example in the form returned by c.ToStore, and Get convert them
+// back with c.FromStore. E.g. a type with unexported fields, which gob can't
+// encode, stored as a string by every provider. Register the converters once,
+// at init, in every process sharing the sessions. The stored form must be
+// encodable by the providers, e.g. a basic type or one registered with
+// RegisterType. JSONCodec keeps the stored form without its type, so it
+// isn't converted back.
+func RegisterConverter(example interface{}, c Converter) {
+	t := reflect.TypeOf(example)
+	name := t.String()
+	if t.PkgPath() != "" {
+		name = t.PkgPath() + "." + t.Name()
+	}
+	converters.Lock()
+	defer converters.Unlock()
+	converters.byType[t] = name
+	converters.byName[name] = c
+}
+
+// toStored returns the stored form of value, itself unless its type has a
+// converter.
+func toStored(value interface{}) (interface{}, error) {
+	converters.RLock()
+	name, ok := converters.byType[reflect.TypeOf(value)]
+	c := converters.byName[name]
+	converters.RUnlock()
+	if !ok {
+		return value, nil
+	}
+	stored, err := c.ToStore(value)
+	if err != nil {
+		return nil, err
+	}
+	return convertedValue{Type: name, Value: stored}, nil
+}
+
+// fromStored returns the value of stored, converted back if it was stored
+// converted. A value which can't be converted back is logged and nil.
+func fromStored(stored interface{}) interface{} {
+	cv, ok := stored.(convertedValue)
+	if !ok {
+		return stored
+	}
+	converters.RLock()
+	c, ok := converters.byName[cv.Type]
+	converters.RUnlock()
+	if !ok {
+		log.Printf("session: no converter registered for %s", cv.Type)
+		return nil
+	}
+	value, err := c.FromStore(cv.Value)
+	if err != nil {
+		log.Printf("session: can't convert back a value of %s: %v", cv.Type, err)
+		return nil
+	}
+	return value
+}
+
+func init() {
+	gob.Register(convertedValue{})
+}
@@ -0,0 +1,119 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Device is the client of a session as told by its User-Agent, e.g. for a
+// "your active devices" page. Unknown fields are empty.
+type Device struct {
+	Browser string
+	OS      string
+	Mobile  bool
+}
+
+// browserRules and osRules match the User-Agent tokens in order, the first
+// match wins: e.g. Edge also claims to be Chrome and Safari, and iOS to be
+// Mac OS X.
+var (
+	browserRules = []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"Edge/", "Edge"}, {"OPR/", "Opera"}, {"Opera", "Opera"},
+		{"Firefox/", "Firefox"}, {"FxiOS/", "Firefox"}, {"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"MSIE ", "Internet Explorer"},
+		{"Trident/", "Internet Explorer"},
+	}
+	osRules = []struct{ token, name string }{
+		{"Windows", "Windows"}, {"iPhone", "iOS"}, {"iPad", "iOS"}, {"iPod", "iOS"},
+		{"Mac OS X", "macOS"}, {"Macintosh", "macOS"}, {"Android", "Android"},
+		{"CrOS", "Chrome OS"}, {"Linux", "Linux"},
+	}
+)
+
+// ParseUserAgent returns the browser and OS of the User-Agent ua, as far as
+// its usual tokens tell them.
+func ParseUserAgent(ua string) Device {
+	var d Device
+	for _, r := range browserRules {
+		if strings.Contains(ua, r.token) {
+			d.Browser = r.name
+			break
+		}
+	}
+	for _, r := range osRules {
+		if strings.Contains(ua, r.token) {
+			d.OS = r.name
+			break
+		}
+	}
+	d.Mobile = strings.Contains(ua, "Mobi") || d.OS == "iOS" && !strings.Contains(ua, "iPad")
+	return d
+}
+
+// DeviceSession is a live session of a user, as listed by UserDevices.
+type DeviceSession struct {
+	SID       string
+	Device    Device
+	ClientIP  string
+	CreatedAt time.Time
+	// LastSeen is the last request of the session, see Meta.LastAccessed.
+	LastSeen time.Time
+}
+
+// UserDevices returns the live sessions bound to userID with Store.SetUserID,
+// with the device and last request of each, most recently seen first.
+// Sessions started before devices were recorded have theirs parsed from the
+// User-Agent of their metadata.
+func (manager *Manager) UserDevices(userID string) ([]DeviceSession, error) {
+	var devices []DeviceSession
+	for _, sid := range manager.UserSessions(userID) {
+		raw, err := manager.read(context.Background(), sid)
+		if err != nil {
+			return nil, err
+		}
+		meta := getMeta(raw)
+		device := meta.Device
+		if device == (Device{}) {
+			device = ParseUserAgent(meta.UserAgent)
+		}
+		devices = append(devices, DeviceSession{
+			SID:       sid,
+			Device:    device,
+			ClientIP:  meta.ClientIP,
+			CreatedAt: meta.CreatedAt,
+			LastSeen:  meta.LastAccessed,
+		})
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].LastSeen.After(devices[j].LastSeen)
+	})
+	return devices, nil
+}
+
+// RevokeUserSession destroys the session sid of userID, e.g. a device the
+// user signs out of from the list of UserDevices. A sid not bound to userID
+// is refused, so a user can't revoke the sessions of others.
+func (manager *Manager) RevokeUserSession(userID, sid string) error {
+	manager.users.lock.Lock()
+	defer manager.users.lock.Unlock()
+	owner, indexed := manager.users.users[sid]
+	if !indexed && userID != "" && manager.provider.Exist(sid) {
+		// bound in another process, as told by its metadata.
+		raw, err := manager.read(context.Background(), sid)
+		if err != nil {
+			return err
+		}
+		owner = getMeta(raw).UserID
+	}
+	if userID == "" || owner != userID {
+		return fmt.Errorf("session: session %s is not a session of user %s", sid, userID)
+	}
+	if err := manager.destroy(context.Background(), sid); err != nil {
+		return err
+	}
+	manager.users.unbindLocked(sid)
+	return nil
+}
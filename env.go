@@ -0,0 +1,105 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// NewManagerFromEnv Create new Manager from environment variables named
+// prefix_ and the config field in upper snake case, e.g. with prefix SESSION:
+//
+//	SESSION_PROVIDER=redis
+//	SESSION_COOKIE_NAME=MacrossSessionId
+//	SESSION_GC_LIFETIME=3600
+//	SESSION_PROVIDER_CONFIG=127.0.0.1:6379
+//	SESSION_LEGACY_COOKIE_NAMES=sid,PHPSESSID
+//
+// The provider and the cookie name are required, lists are comma separated.
+func NewManagerFromEnv(prefix string) (*Manager, error) {
+	provider := os.Getenv(prefix + "_PROVIDER")
+	if provider == "" {
+		return nil, fmt.Errorf("session: environment variable %s_PROVIDER is required", prefix)
+	}
+	if os.Getenv(prefix+"_COOKIE_NAME") == "" {
+		return nil, fmt.Errorf("session: environment variable %s_COOKIE_NAME is required", prefix)
+	}
+	config := map[string]interface{}{}
+	t := reflect.TypeOf(managerConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		key := prefix + "_" + upperSnake(name)
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		v, err := parseEnvValue(field.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("session: environment variable %s: %v", key, err)
+		}
+		config[name] = v
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewManager(provider, string(b))
+}
+
+// configFromFile returns the json config read from the file of a config
+// "@/path/to/config.json", other configs as they are.
+func configFromFile(config string) (string, error) {
+	if !strings.HasPrefix(config, "@") {
+		return config, nil
+	}
+	path := config[1:]
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("session: config file: %v", err)
+	}
+	if !json.Valid(b) {
+		return "", fmt.Errorf("session: config file %s is not valid json", path)
+	}
+	return string(b), nil
+}
+
+// parseEnvValue converts value to the type of a config field.
+func parseEnvValue(t reflect.Type, value string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Ptr:
+		return parseEnvValue(t.Elem(), value)
+	case reflect.Int, reflect.Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Slice:
+		if value == "" {
+			return []string{}, nil
+		}
+		return strings.Split(value, ","), nil
+	}
+	return nil, fmt.Errorf("unsupported config type %v", t)
+}
+
+// upperSnake turns a config field name into its environment variable name,
+// e.g. cookieName into COOKIE_NAME and sessionIDLength into SESSION_ID_LENGTH.
+func upperSnake(name string) string {
+	runes := []rune(name)
+	var b []rune
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b = append(b, '_')
+		}
+		b = append(b, unicode.ToUpper(r))
+	}
+	return string(b)
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// setenv sets the environment variables and returns a func restoring them.
+func setenv(vars map[string]string) func() {
+	for k, v := range vars {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range vars {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestNewManagerFromEnv(t *testing.T) {
+	defer setenv(map[string]string{
+		"SESSION_PROVIDER":            "memory",
+		"SESSION_COOKIE_NAME":         "MacrossSessionId",
+		"SESSION_GC_LIFETIME":         "3600",
+		"SESSION_SECURE":              "true",
+		"SESSION_SAME_SITE":           "strict",
+		"SESSION_SESSION_ID_LENGTH":   "32",
+		"SESSION_EXPOSE_SID_HEADER":   "1",
+		"SESSION_COOKIE_PERSISTENT":   "false",
+		"SESSION_LEGACY_COOKIE_NAMES": "sid,PHPSESSID",
+	})()
+	manager, err := NewManagerFromEnv("SESSION")
+	if err != nil {
+		t.Fatal("NewManagerFromEnv:", err)
+	}
+	cf := manager.config
+	if cf.CookieName != "MacrossSessionId" || cf.GcLifetime != 3600 || cf.MaxLifetime != 3600 ||
+		!cf.Secure || cf.SameSite != "strict" || cf.SessionIDLength != 32 || !cf.ExposeSIDHeader {
+		t.Fatalf("config %+v doesn't match the environment", cf)
+	}
+	if cf.CookiePersistent == nil || *cf.CookiePersistent {
+		t.Fatal("cookiePersistent not read")
+	}
+	if !reflect.DeepEqual(cf.LegacyCookieNames, []string{"sid", "PHPSESSID"}) {
+		t.Fatalf("legacyCookieNames %v", cf.LegacyCookieNames)
+	}
+}
+
+func TestNewManagerFromEnvErrors(t *testing.T) {
+	for _, c := range []struct {
+		vars map[string]string
+		want string
+	}{
+		{map[string]string{"APP_COOKIE_NAME": "sid"}, "session: environment variable APP_PROVIDER is required"},
+		{map[string]string{"APP_PROVIDER": "memory"}, "session: environment variable APP_COOKIE_NAME is required"},
+		{map[string]string{"APP_PROVIDER": "memory", "APP_COOKIE_NAME": "sid", "APP_GC_LIFETIME": "1h"},
+			`session: environment variable APP_GC_LIFETIME: strconv.ParseInt: parsing "1h": invalid syntax`},
+	} {
+		restore := setenv(c.vars)
+		_, err := NewManagerFromEnv("APP")
+		restore()
+		if err == nil || err.Error() != c.want {
+			t.Fatalf("error %v, want %s", err, c.want)
+		}
+	}
+}
+
+func TestUpperSnake(t *testing.T) {
+	for name, want := range map[string]string{
+		"cookieName":      "COOKIE_NAME",
+		"sessionIDLength": "SESSION_ID_LENGTH",
+		"exposeSIDHeader": "EXPOSE_SID_HEADER",
+		"cacheTTL":        "CACHE_TTL",
+		"domain":          "DOMAIN",
+	} {
+		if got := upperSnake(name); got != want {
+			t.Fatalf("upperSnake(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNewManagerConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.json")
+	config := `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"` + filepath.ToSlash(dir) + `"}`
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := NewManager("file", "@"+path)
+	if err != nil {
+		t.Fatal("NewManager of a config file:", err)
+	}
+	if manager.config.CookieName != "MacrossSessionId" || manager.config.GcLifetime != 3600 {
+		t.Fatalf("config %+v doesn't match the file", manager.config)
+	}
+	store, _ := manager.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	if store, _ = manager.Read("aaaa"); store.Get("user") != "insionng" {
+		t.Fatal("manager of a config file doesn't keep sessions")
+	}
+
+	if _, err = NewManager("file", "@"+filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatal("missing config file accepted")
+	}
+	if err = ioutil.WriteFile(path, []byte(`{"cookieName":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewManager("file", "@"+path); err == nil {
+		t.Fatal("invalid json config file accepted")
+	}
+}
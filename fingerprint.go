@@ -0,0 +1,114 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Fingerprint returns a hash of the user values of the session, equal for
+// equal values whatever the order they were set in, e.g. to tell cheaply
+// whether a handler changed the session. Pointers hash as the values they
+// point to. The metadata isn't hashed, so a read-only request keeps the
+// fingerprint. It's empty if the provider can't list the session keys.
+func (s store) Fingerprint() string {
+	if _, ok := s.RawStore.(keyer); !ok {
+		return ""
+	}
+	var entries [][]byte
+	for _, key := range s.Keys() {
+		buf := bytes.NewBuffer(nil)
+		writeCanonical(buf, reflect.ValueOf(key))
+		buf.WriteByte('=')
+		writeCanonical(buf, reflect.ValueOf(s.RawStore.Get(key)))
+		entries = append(entries, buf.Bytes())
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i], entries[j]) < 0
+	})
+	h := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%d:%s;", len(entry), entry)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+
+// writeCanonical writes v to buf in an encoding that depends only on its
+// type and contents: map entries are sorted and pointers followed.
+func writeCanonical(buf *bytes.Buffer, v reflect.Value) {
+	if !v.IsValid() {
+		buf.WriteString("nil")
+		return
+	}
+	buf.WriteString(v.Type().String())
+	if v.Type().Implements(binaryMarshalerType) && v.CanInterface() {
+		if v.Kind() != reflect.Ptr || !v.IsNil() {
+			// e.g. time.Time, whose fields hold a location pointer.
+			if b, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary(); err == nil {
+				buf.WriteString(strconv.Quote(string(b)))
+				return
+			}
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("(nil)")
+			return
+		}
+		buf.WriteByte('(')
+		writeCanonical(buf, v.Elem())
+		buf.WriteByte(')')
+	case reflect.Map:
+		entries := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			entry := bytes.NewBuffer(nil)
+			writeCanonical(entry, key)
+			entry.WriteByte(':')
+			writeCanonical(entry, v.MapIndex(key))
+			entries = append(entries, entry.String())
+		}
+		sort.Strings(entries)
+		buf.WriteByte('{')
+		for _, entry := range entries {
+			buf.WriteString(strconv.Quote(entry))
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('}')
+	case reflect.Struct:
+		buf.WriteByte('{')
+		for i := 0; i < v.NumField(); i++ {
+			writeCanonical(buf, v.Field(i))
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('}')
+	case reflect.Slice, reflect.Array:
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			writeCanonical(buf, v.Index(i))
+			buf.WriteByte(',')
+		}
+		buf.WriteByte(']')
+	case reflect.String:
+		buf.WriteString(strconv.Quote(v.String()))
+	case reflect.Bool:
+		buf.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		buf.WriteString(strconv.FormatFloat(v.Float(), 'g', -1, 64))
+	case reflect.Complex64, reflect.Complex128:
+		fmt.Fprint(buf, v.Complex())
+	default:
+		// chan, func: not storable, only their type counts.
+	}
+}
@@ -0,0 +1,52 @@
+package session
+
+import (
+	"container/list"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"`+testCookieName+`","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pder := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}
+	pder.Init(3600, "")
+	newStore := func(sid string) store {
+		raw, _ := pder.Read(sid)
+		setMeta(raw, Meta{CreatedAt: time.Now(), ClientIP: sid})
+		return store{RawStore: raw, Manager: manager}
+	}
+	type basket struct {
+		Items map[string]int
+		Owner *string
+	}
+	owner, owner2 := "insionng", "insionng"
+	at := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	a, b := newStore("aaaa"), newStore("bbbb")
+	a.Set("cart", basket{Items: map[string]int{"apple": 2, "pear": 1, "plum": 3}, Owner: &owner})
+	a.Set("at", at)
+	a.Set(1, "one")
+	b.Set(1, "one")
+	b.Set("at", at.In(time.UTC))
+	b.Set("cart", basket{Items: map[string]int{"plum": 3, "pear": 1, "apple": 2}, Owner: &owner2})
+	if a.Fingerprint() == "" || a.Fingerprint() != b.Fingerprint() {
+		t.Fatalf("equal sessions fingerprinted %q and %q", a.Fingerprint(), b.Fingerprint())
+	}
+
+	before := b.Fingerprint()
+	b.Set("cart", basket{Items: map[string]int{"plum": 3, "pear": 1, "apple": 3}, Owner: &owner2})
+	if b.Fingerprint() == before {
+		t.Fatal("changed value kept the fingerprint")
+	}
+	b.Set("cart", basket{Items: map[string]int{"plum": 3, "pear": 1, "apple": 2}, Owner: &owner2})
+	if b.Fingerprint() != before {
+		t.Fatal("restored value changed the fingerprint")
+	}
+	b.Set(1, 1)
+	if b.Fingerprint() == before {
+		t.Fatal("value of another type kept the fingerprint")
+	}
+}
@@ -0,0 +1,34 @@
+package firestore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const datastoreScope = "https://www.googleapis.com/auth/datastore"
+
+// credentials returns the token source of the credentials file path, a
+// service account key or the gcloud user credentials, or of the application
+// default credentials when it's empty. The tokens are requested with client.
+func credentials(path string, client *http.Client) (oauth2.TokenSource, error) {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	var creds *google.Credentials
+	var err error
+	if path == "" {
+		creds, err = google.FindDefaultCredentials(ctx, datastoreScope)
+	} else {
+		var b []byte
+		if b, err = ioutil.ReadFile(path); err == nil {
+			creds, err = google.CredentialsFromJSON(ctx, b, datastoreScope)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("session: firestore credentials: %v", err)
+	}
+	return creds.TokenSource, nil
+}
@@ -0,0 +1,543 @@
+// Package firestore provides a session provider storing the sessions in a
+// Google Cloud Firestore (native mode) collection, for apps hosted on GCP.
+//
+// Each session is a document keyed by its sid, holding the encoded values
+// and an expires timestamp. Expired sessions are never served and are deleted
+// by the gc sweep, or by a TTL policy on the expires field of the collection.
+//
+// Requests are authenticated by golang.org/x/oauth2/google with the
+// credentials file of the config, or the application default credentials:
+// $GOOGLE_APPLICATION_CREDENTIALS, the gcloud application-default login, then
+// the metadata server of the instance. With $FIRESTORE_EMULATOR_HOST set the
+// emulator is used instead.
+package firestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+	"golang.org/x/oauth2"
+)
+
+var firestorepder = &Provider{}
+
+const defaultEndpoint = "https://firestore.googleapis.com/v1"
+
+// SessionStore firestore session store
+type SessionStore struct {
+	p           *Provider
+	sid         string
+	lock        sync.RWMutex
+	values      map[interface{}]interface{}
+	maxLifetime int64  // already spread by the expiry jitter
+	lazy        bool   // skip the write of unchanged sessions
+	stored      []byte // encoded values as read, compared by lazy releases
+}
+
+// Set value in firestore session
+func (fs *SessionStore) Set(key, value interface{}) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.values[key] = value
+	return nil
+}
+
+// Get value in firestore session
+func (fs *SessionStore) Get(key interface{}) interface{} {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	if v, ok := fs.values[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// Delete value in firestore session
+func (fs *SessionStore) Delete(key interface{}) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	delete(fs.values, key)
+	return nil
+}
+
+// Flush clear all values in firestore session
+func (fs *SessionStore) Flush() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.values = make(map[interface{}]interface{})
+	return nil
+}
+
+// SetAll replaces all values of firestore session
+func (fs *SessionStore) SetAll(values map[interface{}]interface{}) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.values = values
+	return nil
+}
+
+// Keys returns the keys of all values in the session
+func (fs *SessionStore) Keys() []interface{} {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	keys := make([]interface{}, 0, len(fs.values))
+	for k := range fs.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ID get firestore session id
+func (fs *SessionStore) ID() string {
+	return fs.sid
+}
+
+// Release save session values to its document
+func (fs *SessionStore) Release(ctx *macross.Context) error {
+	return fs.ReleaseContext(context.Background(), ctx)
+}
+
+// ReleaseContext saves the session values to its document, the request is
+// cancelled once ctx is done.
+func (fs *SessionStore) ReleaseContext(ctx context.Context, c *macross.Context) error {
+	fs.lock.RLock()
+	if fs.lazy && session.Unchanged(fs.p.codec, fs.stored, fs.values) {
+		fs.lock.RUnlock()
+		return nil
+	}
+	b, err := fs.p.codec.Encode(fs.values)
+	fs.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if fs.lazy {
+		fs.lock.Lock()
+		fs.stored = b
+		fs.lock.Unlock()
+	}
+	return fs.p.put(ctx, fs.sid, b, fs.maxLifetime)
+}
+
+// Config firestore session provider config
+type Config struct {
+	ProjectID string `json:"projectID"`
+	// Database is the firestore database, "(default)" by default.
+	Database string `json:"database"`
+	// Collection holds the session documents only, "sessions" by default.
+	Collection string `json:"collection"`
+	// CredentialsFile is a service account key file, the application
+	// default credentials are looked up when empty.
+	CredentialsFile string `json:"credentialsFile"`
+	// Endpoint is the url of the firestore rest api, https://firestore.googleapis.com/v1
+	// by default, or the emulator of $FIRESTORE_EMULATOR_HOST.
+	Endpoint string `json:"endpoint"`
+	// TTLPolicy tells a TTL policy on the expires field deletes the expired
+	// sessions, GC doesn't sweep the collection then.
+	TTLPolicy bool `json:"ttlPolicy"`
+	// Codec encodes the session values, session.GobCodec by default.
+	Codec session.Codec `json:"-"`
+	// Client sends the requests, http.DefaultClient by default.
+	Client *http.Client `json:"-"`
+}
+
+// Provider firestore session provider
+type Provider struct {
+	maxLifetime int64
+	config      Config
+	jitter      int   // expiry jitter percentage
+	skew        int64 // tolerated clock skew in seconds
+	lazy        bool  // skip the write of unchanged sessions
+	codec       session.Codec
+	client      *http.Client
+	auth        oauth2.TokenSource
+	now         func() time.Time
+}
+
+// Init init firestore session with a json Config, e.g.
+// {"projectID":"my-project","collection":"sessions"}
+func (p *Provider) Init(maxLifetime int64, config string) error {
+	var cf Config
+	if err := json.Unmarshal([]byte(config), &cf); err != nil {
+		return fmt.Errorf("session: firestore config: %v", err)
+	}
+	return p.InitWithConfig(maxLifetime, cf)
+}
+
+// InitWithConfig init firestore session with a Config.
+func (p *Provider) InitWithConfig(maxLifetime int64, cfg interface{}) error {
+	var cf Config
+	switch v := cfg.(type) {
+	case Config:
+		cf = v
+	case *Config:
+		cf = *v
+	default:
+		return fmt.Errorf("session: firestore provider does not support config %T", cfg)
+	}
+	if cf.ProjectID == "" {
+		return errors.New("session: firestore projectID is empty")
+	}
+	if cf.Database == "" {
+		cf.Database = "(default)"
+	}
+	if cf.Collection == "" {
+		cf.Collection = "sessions"
+	}
+	client := cf.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var auth oauth2.TokenSource
+	if host := os.Getenv("FIRESTORE_EMULATOR_HOST"); cf.Endpoint == "" && host != "" {
+		// the emulator accepts the owner token, which bypasses the security rules.
+		cf.Endpoint = "http://" + host + "/v1"
+		auth = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "owner"})
+	} else {
+		var err error
+		if auth, err = credentials(cf.CredentialsFile, client); err != nil {
+			return err
+		}
+	}
+	if cf.Endpoint == "" {
+		cf.Endpoint = defaultEndpoint
+	}
+	cf.Endpoint = strings.TrimSuffix(cf.Endpoint, "/")
+	codec := cf.Codec
+	if codec == nil {
+		codec = session.GobCodec{}
+	}
+	p.maxLifetime = maxLifetime
+	p.config = cf
+	p.codec = codec
+	p.client = client
+	p.auth = auth
+	p.now = time.Now
+	return nil
+}
+
+// SetExpiryJitter spread the session expiries by ±percent% of the lifetime
+func (p *Provider) SetExpiryJitter(percent int) {
+	p.jitter = percent
+}
+
+// Retryable opts in to the retries of the manager for network errors.
+func (p *Provider) Retryable(err error) bool {
+	return session.IsTransient(err)
+}
+
+// SetLazyRelease skips writing back the sessions left unchanged.
+func (p *Provider) SetLazyRelease(lazy bool) {
+	p.lazy = lazy
+}
+
+// SetClockSkew keeps sessions seconds longer, as their expiries are written
+// with the clocks of other servers.
+func (p *Provider) SetClockSkew(seconds int64) {
+	p.skew = seconds
+}
+
+// value is a firestore typed value, of the types used by the documents.
+type value struct {
+	BytesValue     *string `json:"bytesValue,omitempty"`
+	TimestampValue string  `json:"timestampValue,omitempty"`
+}
+
+type document struct {
+	Name   string           `json:"name,omitempty"`
+	Fields map[string]value `json:"fields"`
+}
+
+// expires returns the expiry of the document, zero if it has none.
+func (d *document) expires() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, d.Fields["expires"].TimestampValue)
+	return t
+}
+
+// values returns the encoded values of the document.
+func (d *document) values() ([]byte, error) {
+	data := d.Fields["values"].BytesValue
+	if data == nil {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(*data)
+}
+
+// documents returns the resource name of the documents of the database.
+func (p *Provider) documents() string {
+	return "projects/" + p.config.ProjectID + "/databases/" + p.config.Database + "/documents"
+}
+
+// name returns the resource name of the document of session sid.
+func (p *Provider) name(sid string) string {
+	return p.documents() + "/" + p.config.Collection + "/" + sid
+}
+
+// newDocument returns the document of session sid holding b, expiring in lifetime seconds.
+func (p *Provider) newDocument(sid string, b []byte, lifetime int64) *document {
+	data := base64.StdEncoding.EncodeToString(b)
+	expires := p.now().Add(time.Duration(lifetime) * time.Second).UTC().Format(time.RFC3339Nano)
+	return &document{Name: p.name(sid), Fields: map[string]value{
+		"values":  {BytesValue: &data},
+		"expires": {TimestampValue: expires},
+	}}
+}
+
+// do sends an authenticated request on the resource name, body is encoded as json.
+func (p *Provider) do(ctx context.Context, method, name string, query url.Values, body interface{}) (*http.Response, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	u := p.config.Endpoint + "/" + name
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := p.auth.Token()
+	if err != nil {
+		return nil, err
+	}
+	token.SetAuthHeader(req)
+	return p.client.Do(req)
+}
+
+func statusError(method, name string, resp *http.Response) error {
+	return fmt.Errorf("session: firestore %s %q: %s", method, name, resp.Status)
+}
+
+// expired reports an expiry passed, written with the clock of another
+// server maybe, and the clock skew.
+func (p *Provider) expired(expires time.Time) bool {
+	return !expires.IsZero() && p.now().Unix() >= expires.Unix()+p.skew
+}
+
+// get returns the document of session sid, nil if it doesn't exist or expired.
+// fields limits the fields read, all by default.
+func (p *Provider) get(sid string, fields ...string) (*document, error) {
+	name := p.name(sid)
+	resp, err := p.do(context.Background(), "GET", name, url.Values{"mask.fieldPaths": fields}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode/100 != 2:
+		return nil, statusError("GET", name, resp)
+	}
+	var doc document
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if p.expired(doc.expires()) {
+		return nil, nil
+	}
+	return &doc, nil
+}
+
+func (p *Provider) put(ctx context.Context, sid string, b []byte, lifetime int64) error {
+	doc := p.newDocument(sid, b, lifetime)
+	resp, err := p.do(ctx, "PATCH", doc.Name, nil, doc)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return statusError("PATCH", doc.Name, resp)
+	}
+	return nil
+}
+
+func (p *Provider) delete(name string) error {
+	resp, err := p.do(context.Background(), "DELETE", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return statusError("DELETE", name, resp)
+	}
+	return nil
+}
+
+func (p *Provider) newStore(sid string, doc *document) *SessionStore {
+	values := make(map[interface{}]interface{})
+	var b []byte
+	if doc != nil {
+		var err error
+		b, err = doc.values()
+		if err == nil && len(b) > 0 {
+			var kv map[interface{}]interface{}
+			if kv, err = p.codec.Decode(b); err == nil {
+				values = kv
+			}
+		}
+		if err != nil {
+			log.Printf("session: can't decode firestore session %s: %v", sid, err)
+		}
+	}
+	return &SessionStore{p: p, sid: sid, values: values, maxLifetime: session.Jitter(p.maxLifetime, p.jitter, sid), lazy: p.lazy, stored: b}
+}
+
+// Read read firestore session by sid
+func (p *Provider) Read(sid string) (macross.RawStore, error) {
+	doc, err := p.get(sid)
+	if err != nil {
+		return nil, err
+	}
+	return p.newStore(sid, doc), nil
+}
+
+// Exist check firestore session exist by sid
+func (p *Provider) Exist(sid string) bool {
+	doc, err := p.get(sid, "expires")
+	return err == nil && doc != nil
+}
+
+// Regenerate moves the session document to the new sid in one commit,
+// a missing old session starts a fresh one.
+func (p *Provider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	doc, err := p.get(oldsid)
+	if err != nil {
+		return nil, err
+	}
+	store := p.newStore(sid, doc)
+	if doc == nil {
+		return store, nil
+	}
+	b, err := doc.values()
+	if err != nil {
+		return nil, err
+	}
+	commit := map[string]interface{}{"writes": []map[string]interface{}{
+		{"update": p.newDocument(sid, b, store.maxLifetime)},
+		{"delete": p.name(oldsid)},
+	}}
+	resp, err := p.do(context.Background(), "POST", p.documents()+":commit", nil, commit)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, statusError("POST", p.documents()+":commit", resp)
+	}
+	return store, nil
+}
+
+// Destory delete firestore session by id
+func (p *Provider) Destory(sid string) error {
+	return p.delete(p.name(sid))
+}
+
+// listResult is the response of a documents list.
+type listResult struct {
+	Documents     []document `json:"documents"`
+	NextPageToken string     `json:"nextPageToken"`
+}
+
+// walk calls f with the name and expiry of each session document.
+func (p *Provider) walk(f func(name string, expires time.Time) error) error {
+	name := p.documents() + "/" + p.config.Collection
+	query := url.Values{"pageSize": {"300"}, "mask.fieldPaths": {"expires"}}
+	for {
+		resp, err := p.do(context.Background(), "GET", name, query, nil)
+		if err != nil {
+			return err
+		}
+		var result listResult
+		if resp.StatusCode/100 != 2 {
+			err = statusError("GET", name, resp)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for i := range result.Documents {
+			if err = f(result.Documents[i].Name, result.Documents[i].expires()); err != nil {
+				return err
+			}
+		}
+		if result.NextPageToken == "" {
+			return nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// GC deletes the expired session documents, unless a TTL policy does.
+func (p *Provider) GC() {
+	if _, err := p.Sweep(); err != nil {
+		log.Printf("session: firestore gc: %v", err)
+	}
+}
+
+// Sweep deletes the expired session documents and returns how many,
+// none with a TTL policy.
+func (p *Provider) Sweep() (removed int, err error) {
+	if p.config.TTLPolicy {
+		return 0, nil
+	}
+	err = p.walk(func(name string, expires time.Time) error {
+		if !p.expired(expires) {
+			return nil
+		}
+		if err := p.delete(name); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// Count returns the number of unexpired sessions, listing the whole collection.
+func (p *Provider) Count() int {
+	n := 0
+	err := p.walk(func(name string, expires time.Time) error {
+		if !p.expired(expires) {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("session: firestore count: %v", err)
+	}
+	return n
+}
+
+// DestroyAll delete all documents of the session collection.
+func (p *Provider) DestroyAll() error {
+	return p.walk(func(name string, expires time.Time) error {
+		return p.delete(name)
+	})
+}
+
+func init() {
+	session.Register("firestore", firestorepder)
+}
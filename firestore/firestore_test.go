@@ -0,0 +1,330 @@
+package firestore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFirestore is a minimal firestore rest api, like the emulator it takes the owner token.
+type fakeFirestore struct {
+	lock sync.Mutex
+	docs map[string]document
+}
+
+func (ff *fakeFirestore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer owner" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/v1/")
+	switch {
+	case r.Method == "POST" && strings.HasSuffix(name, ":commit"):
+		var commit struct {
+			Writes []struct {
+				Update *document `json:"update"`
+				Delete string    `json:"delete"`
+			} `json:"writes"`
+		}
+		json.NewDecoder(r.Body).Decode(&commit)
+		for _, write := range commit.Writes {
+			if write.Update != nil {
+				ff.docs[write.Update.Name] = *write.Update
+			} else {
+				delete(ff.docs, write.Delete)
+			}
+		}
+		w.Write([]byte("{}"))
+	case r.Method == "GET" && strings.Count(name, "/") == 5:
+		// a collection, listed by pages of pageSize documents,
+		// the page token is the cursor of the last document listed.
+		var names []string
+		for k := range ff.docs {
+			if strings.HasPrefix(k, name+"/") && k > r.URL.Query().Get("pageToken") {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		size, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+		var result listResult
+		for i := 0; i < len(names) && i < size; i++ {
+			result.Documents = append(result.Documents, ff.docs[names[i]])
+		}
+		if size < len(names) {
+			result.NextPageToken = names[size-1]
+		}
+		json.NewEncoder(w).Encode(result)
+	case r.Method == "GET":
+		doc, ok := ff.docs[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	case r.Method == "PATCH":
+		var doc document
+		json.NewDecoder(r.Body).Decode(&doc)
+		doc.Name = name
+		ff.docs[name] = doc
+		json.NewEncoder(w).Encode(doc)
+	case r.Method == "DELETE":
+		delete(ff.docs, name)
+		w.Write([]byte("{}"))
+	}
+}
+
+// newTestProvider returns a provider on the emulator of $FIRESTORE_EMULATOR_HOST,
+// or on a fake firestore.
+func newTestProvider(t *testing.T, maxLifetime int64) (*Provider, *fakeFirestore, func()) {
+	var ff *fakeFirestore
+	closeServer := func() {}
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		ff = &fakeFirestore{docs: map[string]document{}}
+		server := httptest.NewServer(ff)
+		os.Setenv("FIRESTORE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+		closeServer = func() {
+			server.Close()
+			os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+		}
+	}
+	p := &Provider{}
+	if err := p.Init(maxLifetime, `{"projectID":"macross-test","collection":"sessions"}`); err != nil {
+		t.Fatal("Init:", err)
+	}
+	return p, ff, func() {
+		p.DestroyAll()
+		closeServer()
+	}
+}
+
+func TestReadWriteDestroy(t *testing.T) {
+	p, _, cleanup := newTestProvider(t, 3600)
+	defer cleanup()
+
+	store, err := p.Read("aaaa")
+	if err != nil {
+		t.Fatal("Read:", err)
+	}
+	if p.Exist("aaaa") {
+		t.Fatal("session exists before Release")
+	}
+	store.Set("user", "insionng")
+	if err = store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	if !p.Exist("aaaa") {
+		t.Fatal("released session doesn't exist")
+	}
+	store, _ = p.Read("aaaa")
+	if store.Get("user") != "insionng" {
+		t.Fatal("value not read back")
+	}
+	if p.Count() != 1 {
+		t.Fatalf("Count = %d, want 1", p.Count())
+	}
+
+	store, err = p.Regenerate("aaaa", "bbbb")
+	if err != nil {
+		t.Fatal("Regenerate:", err)
+	}
+	if store.Get("user") != "insionng" || p.Exist("aaaa") || !p.Exist("bbbb") {
+		t.Fatal("session not moved to the regenerated sid")
+	}
+	if store, _ = p.Read("bbbb"); store.Get("user") != "insionng" {
+		t.Fatal("regenerated session not read back")
+	}
+
+	if err = p.Destory("bbbb"); err != nil {
+		t.Fatal("Destory:", err)
+	}
+	if p.Exist("bbbb") {
+		t.Fatal("destroyed session exists")
+	}
+	if store, _ = p.Read("bbbb"); store.Get("user") != nil {
+		t.Fatal("destroyed session read back")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	p, ff, cleanup := newTestProvider(t, 60)
+	defer cleanup()
+	for i := 0; i < 400; i++ {
+		store, _ := p.Read("s" + strconv.Itoa(i))
+		store.Set("user", "insionng")
+		store.Release(nil)
+	}
+
+	now := time.Now()
+	p.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if p.Exist("s0") {
+		t.Fatal("expired session exists")
+	}
+	if store, _ := p.Read("s0"); store.Get("user") != nil {
+		t.Fatal("expired session read back")
+	}
+
+	p.config.TTLPolicy = true
+	p.GC()
+	if ff != nil && len(ff.docs) != 400 {
+		t.Fatal("gc swept the collection of a ttl policy")
+	}
+	p.config.TTLPolicy = false
+	p.GC()
+	p.now = time.Now
+	if n := p.Count(); n != 0 {
+		t.Fatalf("%d expired sessions left by gc", n)
+	}
+}
+
+// request is a request recorded by the fake firestore.
+type request struct {
+	method, path, query string
+	body                map[string]interface{}
+}
+
+func TestRESTRequests(t *testing.T) {
+	p, ff, cleanup := newTestProvider(t, 3600)
+	defer cleanup()
+	if ff == nil {
+		t.Skip("requests of the emulator aren't recorded")
+	}
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		json.Unmarshal(b, &body)
+		requests = append(requests, request{r.Method, r.URL.Path, r.URL.RawQuery, body})
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		ff.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	p.config.Endpoint = server.URL + "/v1"
+	p.now = func() time.Time { return time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	store, _ := p.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	p.Exist("aaaa")
+	p.Regenerate("aaaa", "bbbb")
+	p.Destory("bbbb")
+	p.Count()
+
+	// the requests of the firestore v1 rest reference, e.g. documents.patch
+	// on the resource name of the document.
+	doc := "projects/macross-test/databases/(default)/documents/sessions/"
+	encoded, _ := p.codec.Encode(map[interface{}]interface{}{"user": "insionng"})
+	fields := map[string]interface{}{
+		"values":  map[string]interface{}{"bytesValue": base64.StdEncoding.EncodeToString(encoded)},
+		"expires": map[string]interface{}{"timestampValue": "2026-01-01T01:00:00Z"},
+	}
+	want := []request{
+		{"GET", "/v1/" + doc + "aaaa", "", nil},
+		{"PATCH", "/v1/" + doc + "aaaa", "", map[string]interface{}{"name": doc + "aaaa", "fields": fields}},
+		{"GET", "/v1/" + doc + "aaaa", "mask.fieldPaths=expires", nil},
+		{"GET", "/v1/" + doc + "aaaa", "", nil},
+		{"POST", "/v1/projects/macross-test/databases/(default)/documents:commit", "", map[string]interface{}{"writes": []interface{}{
+			map[string]interface{}{"update": map[string]interface{}{"name": doc + "bbbb", "fields": fields}},
+			map[string]interface{}{"delete": doc + "aaaa"},
+		}}},
+		{"DELETE", "/v1/" + doc + "bbbb", "", nil},
+		{"GET", "/v1/projects/macross-test/databases/(default)/documents/sessions", "mask.fieldPaths=expires&pageSize=300", nil},
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Fatalf("requests\n%v\nwant\n%v", requests, want)
+	}
+}
+
+func TestInitConfig(t *testing.T) {
+	host := os.Getenv("FIRESTORE_EMULATOR_HOST")
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "127.0.0.1:8080")
+	defer os.Setenv("FIRESTORE_EMULATOR_HOST", host)
+	p := &Provider{}
+	if err := p.Init(3600, `{"projectID":"macross-test"}`); err != nil {
+		t.Fatal(err)
+	}
+	if p.config.Endpoint != "http://127.0.0.1:8080/v1" {
+		t.Fatalf("emulator endpoint %q", p.config.Endpoint)
+	}
+	if name := p.name("aaaa"); name != "projects/macross-test/databases/(default)/documents/sessions/aaaa" {
+		t.Fatalf("document name %q", name)
+	}
+	if err := p.Init(3600, `{"collection":"sessions"}`); err == nil {
+		t.Fatal("config without a project accepted")
+	}
+	if err := p.Init(3600, `not json`); err == nil {
+		t.Fatal("bad json accepted")
+	}
+	if err := p.Init(3600, `{"projectID":"macross-test","endpoint":"http://127.0.0.1:1","credentialsFile":"/nonexistent"}`); err == nil {
+		t.Fatal("missing credentials file accepted")
+	}
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig) != nil ||
+			!strings.Contains(string(claims), `"iss":"sessions@macross-test.iam.gserviceaccount.com"`) ||
+			!strings.Contains(string(claims), `"scope":"`+datastoreScope+`"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"ya29.token","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	b, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "sessions@macross-test.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		"token_uri":    server.URL,
+	})
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(b)
+	f.Close()
+	auth, err := credentials(f.Name(), http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if token, err := auth.Token(); err != nil || token.AccessToken != "ya29.token" {
+			t.Fatalf("token %v, %v", token, err)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("token requested %d times, want it cached", requests)
+	}
+}
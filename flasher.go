@@ -0,0 +1,235 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"log"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+const (
+	// flashOrderKey lists the flash categories in the order they were added.
+	flashOrderKey = "_order"
+	// flashPathKey holds the path the flash is bound to by FlashFor.
+	flashPathKey = "_path"
+	// contextFlashValuesKey holds the flash values delivered to the request.
+	contextFlashValuesKey = "_SESSION_FLASH_VALUES"
+	// contextFlashOrderKey holds the categories added by AddFlash during the
+	// request, stored under flashOrderKey with the flash only.
+	contextFlashOrderKey = "_SESSION_FLASH_ORDER"
+)
+
+// FlashOptions configures the cookie-based flash store used by Flasher.
+type FlashOptions struct {
+	// SecurityKey signs the flash cookie, a random key is generated if empty.
+	SecurityKey string
+	// BlockKey encrypts the flash cookie (aes), a random key is generated if empty.
+	BlockKey string
+	// MaxAge is the flash cookie lifetime in seconds, default 60.
+	MaxAge int
+}
+
+var defaultFlashOptions = FlashOptions{MaxAge: 60}
+
+// Flasher Macross flash middleware that needs no session provider.
+// flash messages are kept in a short-lived signed cookie named COOKIE_FLASH_KEY,
+// which is cleared by the next request that reads it.
+func Flasher(op ...FlashOptions) macross.Handler {
+	option := defaultFlashOptions
+	if len(op) > 0 {
+		option = op[0]
+	}
+	if option.MaxAge <= 0 {
+		option.MaxAge = defaultFlashOptions.MaxAge
+	}
+	if option.SecurityKey == "" {
+		option.SecurityKey = string(generateRandomKey(20))
+	}
+	if option.BlockKey == "" {
+		option.BlockKey = string(generateRandomKey(16))
+	}
+	block, err := aes.NewCipher([]byte(option.BlockKey))
+	if err != nil {
+		log.Fatalln("Flasher() aes.NewCipher() errors:", err)
+	}
+
+	return func(c *macross.Context) error {
+		var has bool
+		if cookie, err := c.Cookie(COOKIE_FLASH_KEY); err == nil && cookie.Value() != "" {
+			vals, err := decodeFlashCookie(block, option, cookie.Value())
+			// a flash bound to another path is kept for that request.
+			if err != nil || flashMatches(c, vals) {
+				if err == nil && len(vals) > 0 {
+					c.Flash = newFlashFromValues(c, vals)
+					c.Set(CONTEXT_FLASH_KEY, *c.Flash)
+					has = true
+				}
+				// the flash has been delivered (or is invalid), clear it.
+				expired := new(macross.Cookie)
+				expired.SetName(COOKIE_FLASH_KEY)
+				expired.SetPath("/")
+				expired.SetHTTPOnly(true)
+				expired.SetExpire(time.Now())
+				setCookie(c, expired)
+			}
+		}
+
+		if !has {
+			c.Flash = NewFlash(c)
+			c.Set(CONTEXT_FLASH_KEY, *c.Flash)
+		}
+		err := c.Next()
+
+		// only messages added during this request are carried to the next one.
+		if c.Flash != nil && hasFlashMessages(c.Flash.Values) {
+			str, e := encodeCookie(block, option.SecurityKey, COOKIE_FLASH_KEY,
+				map[interface{}]interface{}{COOKIE_FLASH_KEY: flashValues(c).Encode()})
+			if e != nil {
+				return e
+			}
+			cookie := new(macross.Cookie)
+			cookie.SetName(COOKIE_FLASH_KEY)
+			cookie.SetValue(url.QueryEscape(str))
+			cookie.SetPath("/")
+			cookie.SetHTTPOnly(true)
+			cookie.SetExpire(time.Now().Add(time.Duration(option.MaxAge) * time.Second))
+			setCookie(c, cookie)
+		}
+		return err
+	}
+}
+
+// AddFlash adds a flash message of the given category ("error", "warning",
+// "info", "success") to be shown on the next request.
+// It works with both Sessioner and Flasher.
+func AddFlash(c *macross.Context, category, msg string) {
+	if c.Flash == nil {
+		c.Flash = NewFlash(c)
+	}
+	switch category {
+	case "error":
+		c.Flash.ErrorMsg = msg
+	case "warning":
+		c.Flash.WarningMsg = msg
+	case "info":
+		c.Flash.InfoMsg = msg
+	case "success":
+		c.Flash.SuccessMsg = msg
+	}
+	if c.Flash.Values == nil {
+		c.Flash.Values = url.Values{}
+	}
+	if _, ok := c.Flash.Values[category]; !ok && category != flashOrderKey {
+		order, _ := c.Get(contextFlashOrderKey).([]string)
+		c.Set(contextFlashOrderKey, append(order, category))
+	}
+	c.Flash.Values.Set(category, msg)
+}
+
+// flashValues returns the flash values of the request c to store, with the
+// categories in the order AddFlash added them.
+func flashValues(c *macross.Context) url.Values {
+	order, _ := c.Get(contextFlashOrderKey).([]string)
+	if len(order) == 0 {
+		return c.Flash.Values
+	}
+	vals := make(url.Values, len(c.Flash.Values)+1)
+	for k, v := range c.Flash.Values {
+		vals[k] = v
+	}
+	vals[flashOrderKey] = order
+	return vals
+}
+
+// FlashFor binds the flash messages of this request to the next request of
+// path, e.g. the target of a redirect: requests to other paths, such as
+// background requests racing the redirect, neither see nor consume them.
+// It works with both Sessioner and Flasher.
+func FlashFor(c *macross.Context, path string) {
+	if c.Flash == nil {
+		c.Flash = NewFlash(c)
+	}
+	if c.Flash.Values == nil {
+		c.Flash.Values = url.Values{}
+	}
+	c.Flash.Values.Set(flashPathKey, path)
+}
+
+// flashMatches reports whether the flash vals is delivered to the request c,
+// of the path it's bound to by FlashFor if any.
+func flashMatches(c *macross.Context, vals url.Values) bool {
+	path := vals.Get(flashPathKey)
+	return path == "" || path == string(c.Path())
+}
+
+// hasFlashMessages reports whether the flash vals holds messages,
+// beyond the keys of the package.
+func hasFlashMessages(vals url.Values) bool {
+	for key := range vals {
+		if key != flashOrderKey && key != flashPathKey {
+			return true
+		}
+	}
+	return false
+}
+
+// FlashMessage is a flash message and its category.
+type FlashMessage struct {
+	Category string
+	Message  string
+}
+
+// AllFlashes returns the flash messages delivered to this request, of every
+// category in the order they were added, so a template can render them alike.
+// Messages set on c.Flash without AddFlash follow, sorted by category.
+func AllFlashes(c *macross.Context) []FlashMessage {
+	vals, _ := c.Get(contextFlashValuesKey).(url.Values)
+	var flashes []FlashMessage
+	listed := map[string]bool{flashOrderKey: true, flashPathKey: true}
+	for _, category := range vals[flashOrderKey] {
+		if msg := vals.Get(category); msg != "" && !listed[category] {
+			flashes = append(flashes, FlashMessage{category, msg})
+		}
+		listed[category] = true
+	}
+	var rest []string
+	for category := range vals {
+		if !listed[category] && vals.Get(category) != "" {
+			rest = append(rest, category)
+		}
+	}
+	sort.Strings(rest)
+	for _, category := range rest {
+		flashes = append(flashes, FlashMessage{category, vals.Get(category)})
+	}
+	return flashes
+}
+
+// newFlashFromValues rebuilds a flash bound to ctx from its encoded values,
+// which are kept for AllFlashes.
+func newFlashFromValues(ctx *macross.Context, vals url.Values) *macross.Flash {
+	ctx.Set(contextFlashValuesKey, vals)
+	flash := NewFlash(ctx)
+	flash.ErrorMsg = vals.Get("error")
+	flash.WarningMsg = vals.Get("warning")
+	flash.InfoMsg = vals.Get("info")
+	flash.SuccessMsg = vals.Get("success")
+	return flash
+}
+
+func decodeFlashCookie(block cipher.Block, option FlashOptions, value string) (url.Values, error) {
+	str, err := url.QueryUnescape(value)
+	if err != nil {
+		return nil, err
+	}
+	maps, err := decodeCookie(block, option.SecurityKey, COOKIE_FLASH_KEY, str, int64(option.MaxAge))
+	if err != nil {
+		return nil, err
+	}
+	encoded, _ := maps[COOKIE_FLASH_KEY].(string)
+	return url.ParseQuery(encoded)
+}
@@ -0,0 +1,170 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+	"github.com/valyala/fasthttp"
+)
+
+// doRequest runs a GET request for path through m with the given request cookies.
+func doRequest(m *macross.Macross, path string, cookies map[string]string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI(path)
+	for k, v := range cookies {
+		ctx.Request.Header.SetCookie(k, v)
+	}
+	m.ServeHTTP(ctx)
+	return ctx
+}
+
+// responseCookie returns the named Set-Cookie of the response, or nil.
+func responseCookie(ctx *fasthttp.RequestCtx, name string) *fasthttp.Cookie {
+	cookie := new(fasthttp.Cookie)
+	cookie.SetKey(name)
+	if !ctx.Response.Header.Cookie(cookie) {
+		return nil
+	}
+	return cookie
+}
+
+func TestFlasherWithoutProvider(t *testing.T) {
+	var got string
+	m := macross.New()
+	m.Use(Flasher(FlashOptions{SecurityKey: "flashkey", BlockKey: "0123456789abcdef"}))
+	m.Get("/set", func(c *macross.Context) error {
+		AddFlash(c, "info", "saved")
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got = c.Flash.InfoMsg
+		return nil
+	})
+
+	// request N sets the flash.
+	ctx := doRequest(m, "/set", nil)
+	cookie := responseCookie(ctx, COOKIE_FLASH_KEY)
+	if cookie == nil || len(cookie.Value()) == 0 {
+		t.Fatal("flash cookie not written")
+	}
+	if !cookie.Expire().After(time.Now()) {
+		t.Fatal("flash cookie should be short-lived, not expired")
+	}
+
+	// request N+1 shows the flash and clears the cookie.
+	ctx = doRequest(m, "/get", map[string]string{COOKIE_FLASH_KEY: string(cookie.Value())})
+	if got != "saved" {
+		t.Fatalf("flash not delivered, got %q", got)
+	}
+	cleared := responseCookie(ctx, COOKIE_FLASH_KEY)
+	if cleared == nil || cleared.Expire().After(time.Now()) {
+		t.Fatal("flash cookie not cleared after delivery")
+	}
+
+	// request N+2 has nothing left to show.
+	got = ""
+	doRequest(m, "/get", nil)
+	if got != "" {
+		t.Fatalf("flash delivered twice, got %q", got)
+	}
+}
+
+func TestFlasherRejectsTamperedCookie(t *testing.T) {
+	var got string
+	m := macross.New()
+	m.Use(Flasher(FlashOptions{SecurityKey: "flashkey", BlockKey: "0123456789abcdef"}))
+	m.Get("/get", func(c *macross.Context) error {
+		got = c.Flash.InfoMsg
+		return nil
+	})
+	doRequest(m, "/get", map[string]string{COOKIE_FLASH_KEY: "bm90LXNpZ25lZA=="})
+	if got != "" {
+		t.Fatalf("tampered flash accepted, got %q", got)
+	}
+}
+
+func TestAllFlashes(t *testing.T) {
+	var got []FlashMessage
+	m := macross.New()
+	m.Use(Flasher(FlashOptions{SecurityKey: "flashkey", BlockKey: "0123456789abcdef"}))
+	m.Get("/set", func(c *macross.Context) error {
+		AddFlash(c, "error", "failed")
+		AddFlash(c, "info", "retried")
+		AddFlash(c, "quota", "90% used")
+		c.Flash.Warning("slow", false)
+		if _, ok := c.Flash.Values[flashOrderKey]; ok {
+			t.Error("flash order visible in the flash values")
+		}
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got = AllFlashes(c)
+		return nil
+	})
+
+	ctx := doRequest(m, "/set", nil)
+	doRequest(m, "/get", map[string]string{COOKIE_FLASH_KEY: string(responseCookie(ctx, COOKIE_FLASH_KEY).Value())})
+	want := []FlashMessage{{"error", "failed"}, {"info", "retried"}, {"quota", "90% used"}, {"warning", "slow"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("AllFlashes = %v, want %v", got, want)
+	}
+
+	doRequest(m, "/get", nil)
+	if len(got) != 0 {
+		t.Fatalf("AllFlashes without a flash = %v", got)
+	}
+}
+
+func TestFlashFor(t *testing.T) {
+	var got string
+	handlers := func(m *macross.Macross) {
+		m.Get("/save", func(c *macross.Context) error {
+			AddFlash(c, "success", "saved")
+			FlashFor(c, "/dashboard")
+			return nil
+		})
+		for _, path := range []string{"/dashboard", "/poll"} {
+			m.Get(path, func(c *macross.Context) error {
+				got = c.Flash.SuccessMsg
+				return nil
+			})
+		}
+	}
+
+	// the session flash.
+	m := newTestApp(t, Options{})
+	handlers(m)
+	cookies := sessionCookies(t, doRequest(m, "/save", nil))
+	doRequest(m, "/poll", cookies)
+	if got != "" {
+		t.Fatalf("flash for /dashboard delivered to /poll: %q", got)
+	}
+	doRequest(m, "/dashboard", cookies)
+	if got != "saved" {
+		t.Fatalf("flash not delivered to /dashboard after /poll, got %q", got)
+	}
+	got = ""
+	doRequest(m, "/dashboard", cookies)
+	if got != "" {
+		t.Fatalf("flash delivered twice, got %q", got)
+	}
+
+	// the cookie flash of Flasher.
+	m = macross.New()
+	m.Use(Flasher(FlashOptions{SecurityKey: "flashkey", BlockKey: "0123456789abcdef"}))
+	handlers(m)
+	flash := map[string]string{COOKIE_FLASH_KEY: string(responseCookie(doRequest(m, "/save", nil), COOKIE_FLASH_KEY).Value())}
+	ctx := doRequest(m, "/poll", flash)
+	if got != "" || responseCookie(ctx, COOKIE_FLASH_KEY) != nil {
+		t.Fatalf("flash for /dashboard consumed by /poll: %q", got)
+	}
+	ctx = doRequest(m, "/dashboard", flash)
+	if got != "saved" {
+		t.Fatalf("flash cookie not delivered to /dashboard, got %q", got)
+	}
+	if cleared := responseCookie(ctx, COOKIE_FLASH_KEY); cleared == nil || cleared.Expire().After(time.Now()) {
+		t.Fatal("flash cookie not cleared on delivery")
+	}
+}
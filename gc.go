@@ -0,0 +1,247 @@
+package session
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when the session gc runs next.
+type Schedule interface {
+	// Next returns the first gc time after t, the zero time to stop.
+	Next(t time.Time) time.Time
+}
+
+// Every returns a Schedule running the gc every d, never if d isn't positive.
+func Every(d time.Duration) Schedule {
+	return intervalSchedule(d)
+}
+
+type intervalSchedule time.Duration
+
+func (is intervalSchedule) Next(t time.Time) time.Time {
+	if is <= 0 {
+		return time.Time{}
+	}
+	return t.Add(time.Duration(is))
+}
+
+// cronSchedule is a parsed cron expression, each field a bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// with both day fields restricted, a day matching either runs, as in cron.
+	domStar, dowStar bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a standard five fields cron expression
+// (minute hour day-of-month month day-of-week) into a Schedule,
+// e.g. "30 3 * * *" runs the gc at 3:30 every night.
+// Fields take *, values, ranges a-b, steps */n or a-b/n and lists of them,
+// the @hourly, @daily, @weekly, @monthly and @yearly shorthands are accepted too.
+// The times are those of the clock's location.
+func ParseCron(expr string) (Schedule, error) {
+	if d, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("session: cron expression %q needs 5 fields", expr)
+	}
+	cs := &cronSchedule{}
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&cs.minute, 0, 59},
+		{&cs.hour, 0, 23},
+		{&cs.dom, 1, 31},
+		{&cs.month, 1, 12},
+		{&cs.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		set, err := parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, fmt.Errorf("session: cron expression %q: %v", expr, err)
+		}
+		*b.set = set
+	}
+	if cs.dow&(1<<7) != 0 {
+		// 7 is sunday too.
+		cs.dow |= 1
+	}
+	cs.domStar = strings.HasPrefix(fields[2], "*")
+	cs.dowStar = strings.HasPrefix(fields[4], "*")
+	return cs, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("bad range %q", rng)
+			}
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", rng)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				// "a/n" runs from a to the end.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (cs *cronSchedule) dayMatches(t time.Time) bool {
+	dom := cs.dom&(1<<uint(t.Day())) != 0
+	dow := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first matching minute after t, skipping whole months,
+// days and hours which don't match. It gives up after five years,
+// e.g. for "0 0 30 2 *".
+func (cs *cronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case cs.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !cs.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case cs.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case cs.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Timer is a pending gc run of a Clock.
+type Timer interface {
+	Stop() bool
+}
+
+// Clock is the time source scheduling the gc, replace it to drive the gc in tests.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after d.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// SetGCSchedule replaces the gc schedule configured by gcInterval or gcCron,
+// running gc is rescheduled at once.
+func (manager *Manager) SetGCSchedule(schedule Schedule) {
+	manager.gcLock.Lock()
+	manager.schedule = schedule
+	running := manager.gcRunning
+	manager.gcLock.Unlock()
+	if running {
+		manager.scheduleGC()
+	}
+}
+
+// SetClock replaces the clock scheduling the gc, nil restores the real time.
+// Set it before the gc starts.
+func (manager *Manager) SetClock(clock Clock) {
+	if clock == nil {
+		clock = realClock{}
+	}
+	manager.gcLock.Lock()
+	manager.clock = clock
+	manager.gcLock.Unlock()
+}
+
+// StopGC cancels the scheduled gc runs, GC starts them again.
+func (manager *Manager) StopGC() {
+	manager.gcLock.Lock()
+	defer manager.gcLock.Unlock()
+	manager.gcRunning = false
+	manager.stopTimer()
+}
+
+// stopTimer cancels the pending gc run, the caller must hold gcLock.
+func (manager *Manager) stopTimer() {
+	manager.gcGen++
+	if manager.gcTimer != nil {
+		manager.gcTimer.Stop()
+		manager.gcTimer = nil
+	}
+}
+
+// scheduleGC replaces the pending gc run by the next one of the schedule,
+// it does nothing once StopGC was called.
+func (manager *Manager) scheduleGC() {
+	manager.gcLock.Lock()
+	defer manager.gcLock.Unlock()
+	if !manager.gcRunning {
+		return
+	}
+	manager.stopTimer()
+	now := manager.clock.Now()
+	next := manager.schedule.Next(now)
+	if next.IsZero() {
+		return
+	}
+	gen := manager.gcGen
+	manager.gcTimer = manager.clock.AfterFunc(next.Sub(now), func() {
+		// a timer firing while being stopped or replaced must not run.
+		manager.gcLock.Lock()
+		current := manager.gcGen == gen
+		manager.gcLock.Unlock()
+		if current {
+			manager.collect()
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package session
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock runs the timers synchronously as Advance moves the time.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (ft *fakeTimer) Stop() bool {
+	stopped := ft.stopped
+	ft.stopped = true
+	return !stopped
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	timer := &fakeTimer{at: fc.now.Add(d), f: f}
+	fc.timers = append(fc.timers, timer)
+	return timer
+}
+
+// Advance moves the time by d, firing the timers due on the way in order.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.lock.Lock()
+	end := fc.now.Add(d)
+	for {
+		sort.SliceStable(fc.timers, func(i, j int) bool { return fc.timers[i].at.Before(fc.timers[j].at) })
+		if len(fc.timers) == 0 || fc.timers[0].at.After(end) {
+			break
+		}
+		timer := fc.timers[0]
+		fc.timers = fc.timers[1:]
+		if timer.stopped {
+			continue
+		}
+		timer.stopped = true
+		fc.now = timer.at
+		fc.lock.Unlock()
+		timer.f()
+		fc.lock.Lock()
+	}
+	fc.now = end
+	fc.lock.Unlock()
+}
+
+// gcRecorder records when the provider gc runs.
+type gcRecorder struct {
+	Provider
+	clock *fakeClock
+	runs  []time.Time
+	onGC  func() // called during each run
+}
+
+func (gr *gcRecorder) GC() {
+	gr.runs = append(gr.runs, gr.clock.Now())
+	if gr.onGC != nil {
+		gr.onGC()
+	}
+}
+
+func newGCManager(t *testing.T, config string, start time.Time) (*Manager, *fakeClock, *gcRecorder) {
+	manager, err := NewManager("memory", config)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	clock := &fakeClock{now: start}
+	recorder := &gcRecorder{Provider: manager.provider, clock: clock}
+	manager.provider = recorder
+	manager.SetClock(clock)
+	return manager, clock, recorder
+}
+
+func assertRuns(t *testing.T, got []time.Time, want ...time.Time) {
+	if len(got) != len(want) {
+		t.Fatalf("gc ran at %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Fatalf("gc ran at %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGCInterval(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	manager, clock, recorder := newGCManager(t, `{"cookieName":"MacrossSessionId","gcLifetime":3600,"gcInterval":60}`, start)
+
+	manager.GC()
+	clock.Advance(59 * time.Second)
+	assertRuns(t, recorder.runs, start)
+	clock.Advance(time.Second)
+	clock.Advance(2 * time.Minute)
+	assertRuns(t, recorder.runs, start, start.Add(time.Minute), start.Add(2*time.Minute), start.Add(3*time.Minute))
+
+	// gcLifetime is the default interval.
+	manager, clock, recorder = newGCManager(t, `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, start)
+	manager.GC()
+	clock.Advance(2 * time.Hour)
+	assertRuns(t, recorder.runs, start, start.Add(time.Hour), start.Add(2*time.Hour))
+
+	manager.StopGC()
+	clock.Advance(2 * time.Hour)
+	if len(recorder.runs) != 3 {
+		t.Fatal("gc ran after StopGC")
+	}
+
+	// StopGC during a run keeps the gc from being rescheduled.
+	manager.GC()
+	recorder.onGC = manager.StopGC
+	clock.Advance(time.Hour)
+	clock.Advance(2 * time.Hour)
+	if len(recorder.runs) != 5 {
+		t.Fatalf("gc ran %d times after StopGC during a run, want 5", len(recorder.runs))
+	}
+}
+
+func TestGCCron(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	manager, clock, recorder := newGCManager(t, `{"cookieName":"MacrossSessionId","gcLifetime":3600,"gcCron":"30 3 * * *"}`, start)
+
+	manager.GC()
+	clock.Advance(48 * time.Hour)
+	assertRuns(t, recorder.runs, start,
+		time.Date(2026, 1, 2, 3, 30, 0, 0, time.UTC),
+		time.Date(2026, 1, 3, 3, 30, 0, 0, time.UTC))
+
+	// a schedule set while running replaces the pending run.
+	manager.SetGCSchedule(Every(time.Minute))
+	clock.Advance(time.Minute)
+	if len(recorder.runs) != 4 || !recorder.runs[3].Equal(start.Add(48*time.Hour+time.Minute)) {
+		t.Fatalf("replaced schedule not applied, gc ran at %v", recorder.runs)
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	// 2026-01-02 is a friday.
+	from := time.Date(2026, 1, 2, 10, 7, 30, 0, time.UTC)
+	for _, c := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2026, 1, 2, 10, 15, 0, 0, time.UTC)},
+		{"* * * * *", time.Date(2026, 1, 2, 10, 8, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2026, 1, 2, 11, 0, 0, 0, time.UTC)},
+		{"0 3 * * 1-5", time.Date(2026, 1, 5, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		// both day fields restricted: the 13th or a friday, whichever first.
+		{"0 0 13 * 5", time.Date(2026, 1, 9, 0, 0, 0, 0, time.UTC)},
+		{"30 2 29 2 *", time.Date(2028, 2, 29, 2, 30, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 1, 2, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		schedule, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		if next := schedule.Next(from); !next.Equal(c.next) {
+			t.Fatalf("%q: next run at %v, want %v", c.expr, next, c.next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "* * 0 * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Fatalf("bad cron expression %q accepted", expr)
+		}
+	}
+}
+
+func TestGCConfigValidation(t *testing.T) {
+	for _, config := range []string{
+		`{"cookieName":"MacrossSessionId","gcLifetime":3600,"gcInterval":-1}`,
+		`{"cookieName":"MacrossSessionId","gcLifetime":3600,"gcInterval":60,"gcCron":"* * * * *"}`,
+		`{"cookieName":"MacrossSessionId","gcLifetime":3600,"gcCron":"every day"}`,
+	} {
+		if _, err := NewManager("memory", config); err == nil {
+			t.Fatalf("config %s accepted", config)
+		}
+	}
+}
+
+func TestGCNow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager, err := NewManagerWithConfig("file", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, FileConfig{SavePath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// write releases sessions sids at now+offset.
+	write := func(offset time.Duration, sids ...string) {
+		filepder.now = func() time.Time { return now.Add(offset) }
+		for _, sid := range sids {
+			store, _ := manager.Read(sid)
+			store.Set("user", "insionng")
+			store.Release(nil)
+		}
+		filepder.now = nil
+	}
+
+	write(-2*time.Hour, "aaaa", "bbbb")
+	write(-time.Minute, "cccc")
+	if removed, err := manager.GCNow(); err != nil || removed != 2 {
+		t.Fatalf("GCNow removed %d sessions, %v, want 2", removed, err)
+	}
+	if !manager.provider.Exist("cccc") || manager.provider.Exist("aaaa") {
+		t.Fatal("gc removed the wrong sessions")
+	}
+
+	// a provider not counting its removals.
+	write(-2*time.Hour, "dddd")
+	manager.provider = struct{ Provider }{manager.provider}
+	if removed, err := manager.GCNow(); err != nil || removed != 1 {
+		t.Fatalf("GCNow removed %d sessions, %v, want 1", removed, err)
+	}
+}
+
+func TestMemoryGC(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	pder := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element), now: clock.Now}
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"gcInterval":600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pder.Init(3600, "")
+	manager.provider = pder
+	manager.SetClock(clock)
+
+	for _, sid := range []string{"aaaa", "bbbb", "cccc"} {
+		pder.Read(sid)
+	}
+	clock.Advance(30 * time.Minute)
+	pder.Read("dddd")
+
+	manager.GC()
+	defer manager.StopGC()
+	clock.Advance(40 * time.Minute)
+	if n := pder.Count(); n != 1 {
+		t.Fatalf("%d sessions after the first lifetime, want 1", n)
+	}
+	if pder.Exist("aaaa") || !pder.Exist("dddd") {
+		t.Fatal("gc removed the wrong sessions")
+	}
+	clock.Advance(40 * time.Minute)
+	if n := pder.Count(); n != 0 {
+		t.Fatalf("%d sessions after their lifetime, want 0", n)
+	}
+}
@@ -0,0 +1,309 @@
+// Package redistest provides a fake redis server for the tests of the
+// redis backed session packages.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is a minimal in-process redis server speaking RESP,
+// it implements just the commands used by the session providers.
+type Server struct {
+	ln     net.Listener
+	lock   sync.Mutex
+	data   map[string]string
+	hashes map[string]map[string]string
+	expire map[string]time.Time
+	calls  map[string]int
+	last   map[string][]string // arguments of the last call of each command
+}
+
+// Start starts a Server on a free local port.
+func Start(tb testing.TB) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal("listen:", err)
+	}
+	fr := &Server{ln: ln, data: map[string]string{}, hashes: map[string]map[string]string{}, expire: map[string]time.Time{}, calls: map[string]int{}, last: map[string][]string{}}
+	go fr.serve()
+	return fr
+}
+
+// Addr returns the address the server listens on.
+func (fr *Server) Addr() string { return fr.ln.Addr().String() }
+
+// Close stops the server.
+func (fr *Server) Close() { fr.ln.Close() }
+
+// Calls returns how many times cmd was received.
+func (fr *Server) Calls(cmd string) int {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return fr.calls[cmd]
+}
+
+// LastArgs returns the arguments of the last call of cmd.
+func (fr *Server) LastArgs(cmd string) []string {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return fr.last[cmd]
+}
+
+func (fr *Server) serve() {
+	for {
+		conn, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fr.handle(conn)
+	}
+}
+
+func (fr *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, fr.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func integer(n int) string { return fmt.Sprintf(":%d\r\n", n) }
+
+func (fr *Server) get(key string) (string, bool) {
+	fr.purge(key)
+	v, ok := fr.data[key]
+	return v, ok
+}
+
+// hash returns the hash key, nil if it doesn't exist.
+func (fr *Server) hash(key string) map[string]string {
+	fr.purge(key)
+	return fr.hashes[key]
+}
+
+// purge deletes key once expired.
+func (fr *Server) purge(key string) {
+	if t, ok := fr.expire[key]; ok && time.Now().After(t) {
+		delete(fr.data, key)
+		delete(fr.hashes, key)
+		delete(fr.expire, key)
+	}
+}
+
+// exists reports whether key holds a string or a hash.
+func (fr *Server) exists(key string) bool {
+	_, ok := fr.get(key)
+	return ok || fr.hash(key) != nil
+}
+
+func (fr *Server) exec(args []string) string {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	cmd := strings.ToUpper(args[0])
+	fr.calls[cmd]++
+	fr.last[cmd] = args[1:]
+	switch cmd {
+	case "PING", "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if v, ok := fr.get(args[1]); ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case "SET":
+		var secs int
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "EX":
+				if i+1 < len(args) {
+					secs, _ = strconv.Atoi(args[i+1])
+					i++
+				}
+			case "NX":
+				nx = true
+			}
+		}
+		if _, ok := fr.get(args[1]); ok && nx {
+			return "$-1\r\n"
+		}
+		fr.data[args[1]] = args[2]
+		delete(fr.expire, args[1])
+		if secs > 0 {
+			fr.expire[args[1]] = time.Now().Add(time.Duration(secs) * time.Second)
+		}
+		return "+OK\r\n"
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, k := range args[1:] {
+			if v, ok := fr.get(k); ok {
+				reply += bulk(v)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "INCR":
+		v, _ := fr.get(args[1])
+		n, err := strconv.Atoi(v)
+		if v != "" && err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		fr.data[args[1]] = strconv.Itoa(n + 1)
+		return integer(n + 1)
+	case "SETEX":
+		secs, _ := strconv.Atoi(args[2])
+		fr.data[args[1]] = args[3]
+		fr.expire[args[1]] = time.Now().Add(time.Duration(secs) * time.Second)
+		return "+OK\r\n"
+	case "EXISTS":
+		if fr.exists(args[1]) {
+			return integer(1)
+		}
+		return integer(0)
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if fr.exists(k) {
+				n++
+			}
+			delete(fr.data, k)
+			delete(fr.hashes, k)
+			delete(fr.expire, k)
+		}
+		return integer(n)
+	case "RENAME":
+		if !fr.exists(args[1]) {
+			return "-ERR no such key\r\n"
+		}
+		delete(fr.data, args[2])
+		delete(fr.hashes, args[2])
+		if v, ok := fr.data[args[1]]; ok {
+			fr.data[args[2]] = v
+		} else {
+			fr.hashes[args[2]] = fr.hashes[args[1]]
+		}
+		delete(fr.data, args[1])
+		delete(fr.hashes, args[1])
+		delete(fr.expire, args[2])
+		if t, ok := fr.expire[args[1]]; ok {
+			fr.expire[args[2]] = t
+			delete(fr.expire, args[1])
+		}
+		return "+OK\r\n"
+	case "HGETALL":
+		h := fr.hash(args[1])
+		reply := fmt.Sprintf("*%d\r\n", 2*len(h))
+		for field, v := range h {
+			reply += bulk(field) + bulk(v)
+		}
+		return reply
+	case "HSET", "HSETNX":
+		h := fr.hash(args[1])
+		if h == nil {
+			h = map[string]string{}
+			fr.hashes[args[1]] = h
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; ok && cmd == "HSETNX" {
+				continue
+			} else if !ok {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return integer(n)
+	case "HDEL":
+		h := fr.hash(args[1])
+		n := 0
+		for _, field := range args[2:] {
+			if _, ok := h[field]; ok {
+				delete(h, field)
+				n++
+			}
+		}
+		if h != nil && len(h) == 0 {
+			delete(fr.hashes, args[1])
+			delete(fr.expire, args[1])
+		}
+		return integer(n)
+	case "EXPIRE":
+		if !fr.exists(args[1]) {
+			return integer(0)
+		}
+		secs, _ := strconv.Atoi(args[2])
+		fr.expire[args[1]] = time.Now().Add(time.Duration(secs) * time.Second)
+		return integer(1)
+	case "SCAN":
+		// a single pass over all keys matching the "MATCH prefix*" pattern.
+		prefix := ""
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				prefix = strings.TrimSuffix(args[i+1], "*")
+			}
+		}
+		var keys []string
+		for k := range fr.data {
+			if _, ok := fr.get(k); ok && strings.HasPrefix(k, prefix) {
+				keys = append(keys, bulk(k))
+			}
+		}
+		for k := range fr.hashes {
+			if fr.hash(k) != nil && strings.HasPrefix(k, prefix) {
+				keys = append(keys, bulk(k))
+			}
+		}
+		return "*2\r\n" + bulk("0") + fmt.Sprintf("*%d\r\n", len(keys)) + strings.Join(keys, "")
+	case "TTL":
+		if !fr.exists(args[1]) {
+			return integer(-2)
+		}
+		t, ok := fr.expire[args[1]]
+		if !ok {
+			return integer(-1)
+		}
+		return integer(int(time.Until(t).Seconds() + 0.5))
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
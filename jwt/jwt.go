@@ -0,0 +1,517 @@
+// Package jwt provides a stateless session provider, the session being a
+// JSON Web Token carried in its cookie: the values are the token claims,
+// Release signs them again and writes the cookie, no server keeps sessions.
+//
+// Tokens are signed with HS256 (a shared secret) or RS256 (an rsa key pair,
+// other services can verify them with the public key only), and optionally
+// encrypted as a JWE ("dir" key management, AES-GCM) so clients can't read
+// the claims. As with the cookie provider, set enableSetCookie to false so the
+// manager doesn't write a sid cookie under the same name:
+//
+//	session.Options{Provider: "jwt", Config: `{"cookieName":"MacrossSessionId","enableSetCookie":false,"gcLifetime":3600,` +
+//		`"providerConfig":"{\"cookieName\":\"MacrossSessionId\",\"algorithm\":\"HS256\",\"secret\":\"Macrossjwtsecret\"}"}`}
+//
+// Claims go through encoding/json, so values are read back as json types,
+// e.g. float64 for numbers. The exp, iat and jti claims are kept by the
+// provider. Values of keys which aren't strings, such as the keys the session
+// package keeps its flash messages, saved input and metadata under, aren't
+// claims: they are gob encoded into the private claim "_session", their types
+// registered with gob. A stateless session can't be revoked before it
+// expires, Destory only drops its cookie.
+package jwt
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+)
+
+var jwtpder = &Provider{}
+
+var (
+	// ErrInvalidToken is returned for a token that is malformed, signed with
+	// another key or algorithm, or tampered with.
+	ErrInvalidToken = errors.New("session: invalid jwt")
+	// ErrTokenExpired is returned for a token past its exp claim.
+	ErrTokenExpired = errors.New("session: jwt expired")
+)
+
+// privateClaim holds the gob encoded values of the keys which aren't strings.
+const privateClaim = "_session"
+
+// reserved are the claims kept by the provider.
+var reserved = map[string]bool{"exp": true, "iat": true, "jti": true, privateClaim: true}
+
+// SessionStore jwt session store, holding the claims of the token.
+type SessionStore struct {
+	p      *Provider
+	sid    string
+	lock   sync.RWMutex
+	claims map[string]interface{}
+	// private holds the values of the keys which aren't strings.
+	private map[interface{}]interface{}
+}
+
+// Set claim key, which can't be a reserved claim. Keys which aren't strings
+// are kept in the private claim.
+func (st *SessionStore) Set(key, value interface{}) error {
+	name, ok := key.(string)
+	if ok && reserved[name] {
+		return fmt.Errorf("session: jwt claim %s is kept by the provider", name)
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if !ok {
+		st.private[key] = value
+		return nil
+	}
+	st.claims[name] = value
+	return nil
+}
+
+// Get claim key
+func (st *SessionStore) Get(key interface{}) interface{} {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	if name, ok := key.(string); ok {
+		return st.claims[name]
+	}
+	return st.private[key]
+}
+
+// Delete claim key
+func (st *SessionStore) Delete(key interface{}) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if name, ok := key.(string); ok {
+		delete(st.claims, name)
+	} else {
+		delete(st.private, key)
+	}
+	return nil
+}
+
+// Flush clear all claims
+func (st *SessionStore) Flush() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.claims = make(map[string]interface{})
+	st.private = make(map[interface{}]interface{})
+	return nil
+}
+
+// Keys returns the names of all claims in the session, and the keys kept
+// in the private claim.
+func (st *SessionStore) Keys() []interface{} {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	keys := make([]interface{}, 0, len(st.claims)+len(st.private))
+	for k := range st.claims {
+		keys = append(keys, k)
+	}
+	for k := range st.private {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ID returns the session id, the jti claim.
+func (st *SessionStore) ID() string {
+	return st.sid
+}
+
+// Release signs the claims into a new token and writes it in the cookie.
+// Without a request there is no cookie to write and nothing is saved.
+func (st *SessionStore) Release(ctx *macross.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	st.lock.RLock()
+	token, err := st.p.encode(st.sid, st.claims, st.private)
+	st.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	cookie := new(macross.Cookie)
+	cookie.SetName(st.p.config.CookieName)
+	cookie.SetValue(token)
+	cookie.SetPath("/")
+	cookie.SetHTTPOnly(true)
+	cookie.SetSecure(st.p.config.Secure)
+	cookie.SetExpire(st.p.now().Add(time.Duration(st.p.maxAge()) * time.Second))
+	session.SetCookie(ctx, cookie)
+	return nil
+}
+
+// Config jwt session provider config
+type Config struct {
+	CookieName string `json:"cookieName"`
+	Secure     bool   `json:"secure"`
+	// MaxAge is the lifetime in seconds of the tokens and their cookie,
+	// the session max lifetime by default.
+	MaxAge int `json:"maxAge"`
+	// Algorithm signs the tokens, HS256 (default) or RS256.
+	Algorithm string `json:"algorithm"`
+	// Secret is the HS256 key.
+	Secret string `json:"secret"`
+	// PrivateKey is the pem encoded RS256 rsa private key (PKCS #1 or #8).
+	PrivateKey string `json:"privateKey"`
+	// PublicKey is the pem encoded RS256 rsa public key, taken from the
+	// private key by default. Without a private key tokens are only verified.
+	PublicKey string `json:"publicKey"`
+	// EncryptionKey encrypts the tokens with A128GCM or A256GCM when set,
+	// 16 or 32 bytes.
+	EncryptionKey string `json:"encryptionKey"`
+}
+
+// Provider jwt session provider
+type Provider struct {
+	maxLifetime int64
+	config      Config
+	secret      []byte
+	private     *rsa.PrivateKey
+	public      *rsa.PublicKey
+	aead        cipher.AEAD
+	enc         string // the jwe content encryption
+	now         func() time.Time
+}
+
+// Init init jwt session provider with a json Config, e.g.
+// {"cookieName":"MacrossSessionId","algorithm":"HS256","secret":"..."}
+func (p *Provider) Init(maxLifetime int64, config string) error {
+	var cf Config
+	if err := json.Unmarshal([]byte(config), &cf); err != nil {
+		return fmt.Errorf("session: jwt config: %v", err)
+	}
+	return p.InitWithConfig(maxLifetime, cf)
+}
+
+// InitWithConfig init jwt session provider with a Config.
+func (p *Provider) InitWithConfig(maxLifetime int64, cfg interface{}) error {
+	var cf Config
+	switch v := cfg.(type) {
+	case Config:
+		cf = v
+	case *Config:
+		cf = *v
+	default:
+		return fmt.Errorf("session: jwt provider does not support config %T", cfg)
+	}
+	if cf.CookieName == "" {
+		return errors.New("session: jwt cookie name is empty")
+	}
+	if cf.Algorithm == "" {
+		cf.Algorithm = "HS256"
+	}
+	p.secret, p.private, p.public, p.aead = nil, nil, nil, nil
+	switch cf.Algorithm {
+	case "HS256":
+		if cf.Secret == "" {
+			return errors.New("session: jwt HS256 needs a secret")
+		}
+		p.secret = []byte(cf.Secret)
+	case "RS256":
+		if err := p.parseKeys(cf.PrivateKey, cf.PublicKey); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("session: unsupported jwt algorithm %q", cf.Algorithm)
+	}
+	if cf.EncryptionKey != "" {
+		switch len(cf.EncryptionKey) {
+		case 16:
+			p.enc = "A128GCM"
+		case 32:
+			p.enc = "A256GCM"
+		default:
+			return fmt.Errorf("session: jwt encryption key of %d bytes, want 16 or 32", len(cf.EncryptionKey))
+		}
+		block, err := aes.NewCipher([]byte(cf.EncryptionKey))
+		if err != nil {
+			return err
+		}
+		if p.aead, err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	p.maxLifetime = maxLifetime
+	p.config = cf
+	p.now = time.Now
+	return nil
+}
+
+// parseKeys reads the RS256 key pair, at least one of them is needed.
+func (p *Provider) parseKeys(private, public string) error {
+	if private != "" {
+		block, _ := pem.Decode([]byte(private))
+		if block == nil {
+			return errors.New("session: jwt private key isn't pem encoded")
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			k, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err8 != nil {
+				return fmt.Errorf("session: jwt private key: %v", err)
+			}
+			var ok bool
+			if key, ok = k.(*rsa.PrivateKey); !ok {
+				return fmt.Errorf("session: jwt private key is a %T, not rsa", k)
+			}
+		}
+		p.private, p.public = key, &key.PublicKey
+	}
+	if public != "" {
+		block, _ := pem.Decode([]byte(public))
+		if block == nil {
+			return errors.New("session: jwt public key isn't pem encoded")
+		}
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("session: jwt public key: %v", err)
+		}
+		key, ok := k.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("session: jwt public key is a %T, not rsa", k)
+		}
+		p.public = key
+	}
+	if p.public == nil {
+		return errors.New("session: jwt RS256 needs a private or a public key")
+	}
+	return nil
+}
+
+// maxAge returns the token lifetime in seconds.
+func (p *Provider) maxAge() int64 {
+	if p.config.MaxAge > 0 {
+		return int64(p.config.MaxAge)
+	}
+	return p.maxLifetime
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns the signature of the signing input.
+func (p *Provider) sign(input string) ([]byte, error) {
+	if p.secret != nil {
+		mac := hmac.New(sha256.New, p.secret)
+		mac.Write([]byte(input))
+		return mac.Sum(nil), nil
+	}
+	if p.private == nil {
+		return nil, errors.New("session: jwt RS256 without a private key only verifies tokens")
+	}
+	sum := sha256.Sum256([]byte(input))
+	return rsa.SignPKCS1v15(rand.Reader, p.private, crypto.SHA256, sum[:])
+}
+
+// verify checks the signature of the signing input.
+func (p *Provider) verify(input string, sig []byte) bool {
+	if p.secret != nil {
+		mac := hmac.New(sha256.New, p.secret)
+		mac.Write([]byte(input))
+		return hmac.Equal(sig, mac.Sum(nil))
+	}
+	sum := sha256.Sum256([]byte(input))
+	return rsa.VerifyPKCS1v15(p.public, crypto.SHA256, sum[:], sig) == nil
+}
+
+// encode returns the token of session sid with claims and the private values,
+// valid for maxAge from now.
+func (p *Provider) encode(sid string, claims map[string]interface{}, private map[interface{}]interface{}) (string, error) {
+	all := make(map[string]interface{}, len(claims)+4)
+	for k, v := range claims {
+		all[k] = v
+	}
+	if len(private) > 0 {
+		b, err := session.EncodeGob(private)
+		if err != nil {
+			return "", err
+		}
+		all[privateClaim] = b64(b)
+	}
+	now := p.now().Unix()
+	all["jti"], all["iat"], all["exp"] = sid, now, now+p.maxAge()
+	header, err := json.Marshal(map[string]string{"alg": p.config.Algorithm, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(all)
+	if err != nil {
+		return "", err
+	}
+	input := b64(header) + "." + b64(payload)
+	sig, err := p.sign(input)
+	if err != nil {
+		return "", err
+	}
+	token := input + "." + b64(sig)
+	if p.aead == nil {
+		return token, nil
+	}
+	return p.encrypt(token)
+}
+
+// encrypt wraps token in a compact jwe.
+func (p *Provider) encrypt(token string) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "dir", "enc": p.enc, "cty": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	protected := b64(header)
+	iv := make([]byte, p.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return "", err
+	}
+	sealed := p.aead.Seal(nil, iv, []byte(token), []byte(protected))
+	n := len(sealed) - p.aead.Overhead()
+	return protected + ".." + b64(iv) + "." + b64(sealed[:n]) + "." + b64(sealed[n:]), nil
+}
+
+// decrypt returns the token wrapped in a compact jwe.
+func (p *Provider) decrypt(jwe string) (string, error) {
+	parts := strings.Split(jwe, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return "", ErrInvalidToken
+	}
+	var header struct{ Alg, Enc string }
+	if err := decodePart(parts[0], &header); err != nil || header.Alg != "dir" || header.Enc != p.enc {
+		return "", ErrInvalidToken
+	}
+	iv, err1 := base64.RawURLEncoding.DecodeString(parts[2])
+	ciphertext, err2 := base64.RawURLEncoding.DecodeString(parts[3])
+	tag, err3 := base64.RawURLEncoding.DecodeString(parts[4])
+	if err1 != nil || err2 != nil || err3 != nil || len(iv) != p.aead.NonceSize() {
+		return "", ErrInvalidToken
+	}
+	token, err := p.aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	return string(token), nil
+}
+
+func decodePart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// decode verifies token and returns its claims.
+func (p *Provider) decode(token string) (map[string]interface{}, error) {
+	if p.aead != nil {
+		var err error
+		if token, err = p.decrypt(token); err != nil {
+			return nil, err
+		}
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct{ Alg string }
+	// the algorithm is the configured one, never the one the token claims.
+	if err := decodePart(parts[0], &header); err != nil || header.Alg != p.config.Algorithm {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !p.verify(parts[0]+"."+parts[1], sig) {
+		return nil, ErrInvalidToken
+	}
+	var claims map[string]interface{}
+	if err = decodePart(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if p.now().Unix() >= int64(exp) {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// newStore returns the session of token, a new session sid when token isn't valid.
+func (p *Provider) newStore(token, sid string) *SessionStore {
+	claims, err := p.decode(token)
+	if err != nil {
+		return &SessionStore{p: p, sid: sid, claims: make(map[string]interface{}), private: make(map[interface{}]interface{})}
+	}
+	if jti, ok := claims["jti"].(string); ok && sid == token {
+		sid = jti
+	}
+	private := make(map[interface{}]interface{})
+	if encoded, ok := claims[privateClaim].(string); ok {
+		b, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err == nil {
+			private, err = session.DecodeGob(b)
+		}
+		if err != nil {
+			// the token is authentic, its values have types this build doesn't register.
+			log.Printf("session: can't decode the private claim of jwt session %s: %v", sid, err)
+			private = make(map[interface{}]interface{})
+		}
+	}
+	for name := range reserved {
+		delete(claims, name)
+	}
+	return &SessionStore{p: p, sid: sid, claims: claims, private: private}
+}
+
+// Read returns the session of the token sid,
+// or a new session with id sid if it isn't a valid token.
+func (p *Provider) Read(sid string) (macross.RawStore, error) {
+	return p.newStore(sid, sid), nil
+}
+
+// Exist reports whether sid is a valid unexpired token.
+func (p *Provider) Exist(sid string) bool {
+	_, err := p.decode(sid)
+	return err == nil
+}
+
+// Regenerate returns the claims of the token oldsid as session sid.
+func (p *Provider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	return p.newStore(oldsid, sid), nil
+}
+
+// Destory Implement method, a token can't be revoked.
+func (p *Provider) Destory(sid string) error {
+	return nil
+}
+
+// GC Implement method, no used.
+func (p *Provider) GC() {
+}
+
+// Count Implement method, return 0.
+func (p *Provider) Count() int {
+	return 0
+}
+
+func init() {
+	session.Register("jwt", jwtpder)
+}
@@ -0,0 +1,259 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+	"github.com/valyala/fasthttp"
+)
+
+const cookieName = "MacrossSessionId"
+
+// release releases store in a request and returns the token of its cookie.
+func release(t *testing.T, store macross.RawStore) string {
+	m := macross.New()
+	m.Get("/", func(c *macross.Context) error {
+		return store.Release(c)
+	})
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	m.ServeHTTP(ctx)
+	cookie := new(fasthttp.Cookie)
+	cookie.SetKey(cookieName)
+	if !ctx.Response.Header.Cookie(cookie) {
+		t.Fatal("token cookie not written")
+	}
+	return string(cookie.Value())
+}
+
+func rsaPEM(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func testConfigs(t *testing.T) map[string]Config {
+	return map[string]Config{
+		"HS256":     {CookieName: cookieName, Secret: "Macrossjwtsecret"},
+		"RS256":     {CookieName: cookieName, Algorithm: "RS256", PrivateKey: rsaPEM(t)},
+		"encrypted": {CookieName: cookieName, Secret: "Macrossjwtsecret", EncryptionKey: "0123456789abcdef0123456789abcdef"},
+	}
+}
+
+func TestClaimRoundTrip(t *testing.T) {
+	for name, cf := range testConfigs(t) {
+		p := &Provider{}
+		if err := p.InitWithConfig(3600, cf); err != nil {
+			t.Fatal(name, "InitWithConfig:", err)
+		}
+		store, _ := p.Read("aaaa")
+		store.Set("user", "insionng")
+		store.Set("roles", []string{"admin"})
+		token := release(t, store)
+		if cf.EncryptionKey != "" && strings.Count(token, ".") != 4 {
+			t.Fatalf("%s: token %q isn't a jwe", name, token)
+		}
+
+		if !p.Exist(token) {
+			t.Fatalf("%s: released token doesn't exist", name)
+		}
+		store, _ = p.Read(token)
+		if store.ID() != "aaaa" {
+			t.Fatalf("%s: session id %q read from the jti, want aaaa", name, store.ID())
+		}
+		if store.Get("user") != "insionng" {
+			t.Fatalf("%s: claim not read back", name)
+		}
+		if roles, _ := store.Get("roles").([]interface{}); len(roles) != 1 || roles[0] != "admin" {
+			t.Fatalf("%s: roles read back as %v", name, store.Get("roles"))
+		}
+		if store.Get("exp") != nil {
+			t.Fatalf("%s: reserved claim exposed", name)
+		}
+
+		store, _ = p.Regenerate(token, "bbbb")
+		if store.ID() != "bbbb" || store.Get("user") != "insionng" {
+			t.Fatalf("%s: claims not kept by Regenerate", name)
+		}
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	p := &Provider{}
+	p.InitWithConfig(60, Config{CookieName: cookieName, Secret: "Macrossjwtsecret"})
+	store, _ := p.Read("aaaa")
+	store.Set("user", "insionng")
+	token := release(t, store)
+
+	now := time.Now()
+	p.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if _, err := p.decode(token); err != ErrTokenExpired {
+		t.Fatalf("decode of an expired token: %v", err)
+	}
+	if p.Exist(token) {
+		t.Fatal("expired token exists")
+	}
+	if store, _ = p.Read(token); store.Get("user") != nil {
+		t.Fatal("expired token read back")
+	}
+}
+
+func TestTamperedToken(t *testing.T) {
+	for name, cf := range testConfigs(t) {
+		p := &Provider{}
+		p.InitWithConfig(3600, cf)
+		store, _ := p.Read("aaaa")
+		store.Set("user", "insionng")
+		token := release(t, store)
+
+		parts := strings.Split(token, ".")
+		// change a claim, or the ciphertext of a jwe.
+		i := 1
+		if len(parts) == 5 {
+			i = 3
+		}
+		b, _ := base64.RawURLEncoding.DecodeString(parts[i])
+		b = []byte(strings.Replace(string(b), "insionng", "root", 1))
+		if len(parts) == 5 {
+			b[0] ^= 1
+		}
+		parts[i] = base64.RawURLEncoding.EncodeToString(b)
+		tampered := strings.Join(parts, ".")
+		if p.Exist(tampered) {
+			t.Fatalf("%s: tampered token accepted", name)
+		}
+		if store, _ = p.Read(tampered); store.Get("user") != nil {
+			t.Fatalf("%s: tampered token read back", name)
+		}
+	}
+
+	// an unsigned token, or one signed with another secret.
+	p := &Provider{}
+	p.InitWithConfig(3600, Config{CookieName: cookieName, Secret: "Macrossjwtsecret"})
+	other := &Provider{}
+	other.InitWithConfig(3600, Config{CookieName: cookieName, Secret: "othersecret"})
+	token, _ := other.encode("aaaa", map[string]interface{}{"user": "insionng"}, nil)
+	parts := strings.Split(token, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + "."
+	for _, token := range []string{token, none} {
+		if p.Exist(token) {
+			t.Fatalf("token %q accepted", token)
+		}
+	}
+}
+
+func TestInitConfig(t *testing.T) {
+	for _, config := range []string{
+		`not json`,
+		`{"secret":"Macrossjwtsecret"}`,
+		`{"cookieName":"sid"}`,
+		`{"cookieName":"sid","algorithm":"RS256"}`,
+		`{"cookieName":"sid","algorithm":"ES256","secret":"Macrossjwtsecret"}`,
+		`{"cookieName":"sid","secret":"Macrossjwtsecret","encryptionKey":"short"}`,
+	} {
+		if err := (&Provider{}).Init(3600, config); err == nil {
+			t.Fatalf("config %s accepted", config)
+		}
+	}
+}
+
+func TestManagerSession(t *testing.T) {
+	manager, err := session.NewManager("jwt", `{"cookieName":"`+cookieName+`","enableSetCookie":false,"gcLifetime":3600,`+
+		`"providerConfig":"{\"cookieName\":\"`+cookieName+`\",\"secret\":\"Macrossjwtsecret\"}"}`)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	var got interface{}
+	m := macross.New()
+	m.Use(func(c *macross.Context) error {
+		sess, err := manager.Start(c)
+		if err != nil {
+			return err
+		}
+		c.Session = sess
+		defer sess.Release(c)
+		return c.Next()
+	})
+	m.Get("/set", func(c *macross.Context) error {
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got = c.Session.Get("user")
+		return nil
+	})
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/set")
+	m.ServeHTTP(ctx)
+	cookie := new(fasthttp.Cookie)
+	cookie.SetKey(cookieName)
+	ctx.Response.Header.Cookie(cookie)
+
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/get")
+	ctx.Request.Header.SetCookie(cookieName, string(cookie.Value()))
+	m.ServeHTTP(ctx)
+	if got != "insionng" {
+		t.Fatalf("claim read back as %v", got)
+	}
+}
+
+func TestSessionerMeta(t *testing.T) {
+	session.GlobalManager = nil
+	defer func() { session.GlobalManager = nil }()
+	m := macross.New()
+	m.Use(session.Sessioner(session.Options{Provider: "jwt", Config: `{"cookieName":"` + cookieName + `","enableSetCookie":false,"gcLifetime":3600,` +
+		`"providerConfig":"{\"cookieName\":\"` + cookieName + `\",\"secret\":\"Macrossjwtsecret\"}"}`}))
+	var user string
+	var flashes []session.FlashMessage
+	m.Get("/login", func(c *macross.Context) error {
+		session.AddFlash(c, "info", "welcome")
+		if err := session.GetStore(c).SetUserID("insionng"); err != nil {
+			return err
+		}
+		// released again by the middleware, the response keeps one cookie.
+		return c.Session.Release(c)
+	})
+	m.Get("/home", func(c *macross.Context) error {
+		user = session.GetStore(c).UserID()
+		flashes = session.AllFlashes(c)
+		return nil
+	})
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/login")
+	m.ServeHTTP(ctx)
+	var tokens []string
+	ctx.Response.Header.VisitAllCookie(func(k, v []byte) {
+		if string(k) == cookieName {
+			tokens = append(tokens, string(v))
+		}
+	})
+	if len(tokens) != 1 {
+		t.Fatalf("%d Set-Cookie of the token, want 1", len(tokens))
+	}
+	cookie := new(fasthttp.Cookie)
+	cookie.SetKey(cookieName)
+	ctx.Response.Header.Cookie(cookie)
+
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/home")
+	ctx.Request.Header.SetCookie(cookieName, string(cookie.Value()))
+	m.ServeHTTP(ctx)
+	if user != "insionng" {
+		t.Fatalf("user binding read back as %q", user)
+	}
+	if len(flashes) != 1 || flashes[0].Message != "welcome" {
+		t.Fatalf("flash read back as %v", flashes)
+	}
+}
@@ -0,0 +1,47 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// ExtendLifetime keeps the session alive for d from now even if it's idle,
+// past its max lifetime and idleTimeout, e.g. during a long upload, without
+// changing the lifetime of the other sessions. Afterwards it expires as usual.
+// The provider must be an ExpiryProvider (memory, redis).
+func (s store) ExtendLifetime(d time.Duration) error {
+	ep, ok := s.Manager.provider.(ExpiryProvider)
+	if !ok {
+		return fmt.Errorf("session: provider %T can't extend the lifetime of a session", s.Manager.provider)
+	}
+	meta := getMeta(s.RawStore)
+	meta.KeepUntil = time.Now().Add(d)
+	if err := setMeta(s.RawStore, meta); err != nil {
+		return err
+	}
+	if d <= s.Manager.lifetime() {
+		return nil
+	}
+	return ep.SetExpiry(s.ID(), d)
+}
+
+// lifetime returns the max lifetime of the sessions.
+func (manager *Manager) lifetime() time.Duration {
+	return time.Duration(manager.config.MaxLifetime) * time.Second
+}
+
+// keepAlive extends again the lifetime of session s kept alive by
+// ExtendLifetime, after its release refreshed its usual lifetime.
+func (manager *Manager) keepAlive(s macross.RawStore) {
+	d := getMeta(s).KeepUntil.Sub(time.Now())
+	ep, ok := manager.provider.(ExpiryProvider)
+	if !ok || d <= manager.lifetime() {
+		return
+	}
+	if err := ep.SetExpiry(s.ID(), d); err != nil {
+		log.Printf("session: can't extend the lifetime of %s: %v", s.ID(), err)
+	}
+}
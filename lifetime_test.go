@@ -0,0 +1,50 @@
+package session
+
+import (
+	"container/list"
+	"testing"
+	"time"
+)
+
+func TestExtendLifetime(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	pder := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element), now: clock.Now}
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pder.Init(3600, "")
+	manager.provider = pder
+
+	raw, _ := pder.Read("aaaa")
+	pder.Read("bbbb")
+	s := store{RawStore: raw, Manager: manager}
+	if err = s.ExtendLifetime(3 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if keep := s.Meta().KeepUntil; keep.Before(time.Now().Add(3*time.Hour - time.Minute)) {
+		t.Fatalf("KeepUntil %v", keep)
+	}
+
+	// past the max lifetime, only the extended session is left.
+	clock.Advance(2 * time.Hour)
+	pder.Sweep()
+	if !pder.Exist("aaaa") || pder.Exist("bbbb") {
+		t.Fatal("extended session expired with its max lifetime")
+	}
+	if sids, _ := pder.SIDs(); len(sids) != 1 || sids[0] != "aaaa" {
+		t.Fatalf("SIDs %v, want the extended session", sids)
+	}
+
+	// then it expires as usual.
+	clock.Advance(2 * time.Hour)
+	pder.Sweep()
+	if pder.Exist("aaaa") {
+		t.Fatal("extended session kept past its extension")
+	}
+
+	manager.provider = struct{ Provider }{pder}
+	if err = s.ExtendLifetime(3 * time.Hour); err == nil {
+		t.Fatal("lifetime extended by a provider without SetExpiry")
+	}
+}
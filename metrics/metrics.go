@@ -0,0 +1,75 @@
+// Package metrics exposes the session Stats to monitoring, as expvar
+// variables or in the prometheus text format.
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/macross-contrib/session"
+)
+
+// Publish publishes the stats of m as the expvar variable name,
+// served as json at /debug/vars with the expvar handler.
+func Publish(name string, m *session.Manager) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Stats()
+	}))
+}
+
+// activityVars is the json of the expvar variables published by PublishActivity.
+type activityVars struct {
+	Active    int        `json:"active"`
+	Created   uint64     `json:"created"`
+	Destroyed uint64     `json:"destroyed"`
+	Expired   uint64     `json:"expired"`
+	LastGC    *time.Time `json:"last_gc"`
+}
+
+// PublishActivity publishes the session activity of m as the expvar variable
+// name, e.g. "session": the active sessions, the totals of those created,
+// destroyed and expired, and the last gc time, null before the first gc.
+// Nothing is published until it's called.
+func PublishActivity(name string, m *session.Manager) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		a := m.Activity()
+		vars := activityVars{
+			Active:    a.Active,
+			Created:   a.Created,
+			Destroyed: a.Destroyed,
+			Expired:   a.Expired,
+		}
+		if !a.LastGC.IsZero() {
+			vars.LastGC = &a.LastGC
+		}
+		return vars
+	}))
+}
+
+// WriteText writes stats in the prometheus text exposition format.
+func WriteText(w io.Writer, stats session.Stats) error {
+	for _, c := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"session_cookie_decode_failures_total", "Session cookies which failed to decode.", stats.CookieDecodeFailures},
+		{"session_cookie_signature_mismatches_total", "Session cookies with an invalid signature.", stats.CookieSignatureMismatches},
+		{"session_cookies_oversized_total", "Sessions too large for their cookies.", stats.CookiesOversized},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns a handler serving the stats of m to prometheus scrapes.
+func Handler(m *session.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(w, m.Stats())
+	})
+}
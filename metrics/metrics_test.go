@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+	"github.com/valyala/fasthttp"
+)
+
+func newCookieManager(t *testing.T) *session.Manager {
+	manager, err := session.NewManager("cookie", `{"cookieName":"MacrossSessionId","enableSetCookie":false,"gcLifetime":3600,"providerConfig":"{\"cookieName\":\"MacrossSessionId\",\"securityKey\":\"Macrosscookiehashkey\"}"}`)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	return manager
+}
+
+func TestHandler(t *testing.T) {
+	manager := newCookieManager(t)
+	before := manager.Stats().CookieDecodeFailures
+	manager.Read("corrupt")
+
+	rec := httptest.NewRecorder()
+	Handler(manager).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := "session_cookie_decode_failures_total " + strconv.FormatUint(before+1, 10) + "\n"
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("metrics %q lack %q", rec.Body.String(), want)
+	}
+	if !strings.Contains(rec.Body.String(), "# TYPE session_cookies_oversized_total counter\n") {
+		t.Fatal("counter type missing")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	manager := newCookieManager(t)
+	Publish("session_test", manager)
+	var stats session.Stats
+	if err := json.Unmarshal([]byte(expvar.Get("session_test").String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats != manager.Stats() {
+		t.Fatalf("published %+v, want %+v", stats, manager.Stats())
+	}
+}
+
+// activity returns the expvar variable name published by PublishActivity.
+func activity(t *testing.T, name string) map[string]interface{} {
+	var vars map[string]interface{}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	return vars
+}
+
+func TestPublishActivity(t *testing.T) {
+	manager, err := session.NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	PublishActivity("session_activity_test", manager)
+	if vars := activity(t, "session_activity_test"); vars["created"] != 0.0 || vars["last_gc"] != nil {
+		t.Fatalf("activity of a new manager: %v", vars)
+	}
+
+	m := macross.New()
+	m.Get("/login", func(c *macross.Context) error {
+		_, err := manager.Start(c)
+		return err
+	})
+	m.Get("/logout", func(c *macross.Context) error {
+		return manager.Destory(c)
+	})
+	var cookies []string
+	for i := 0; i < 3; i++ {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/login")
+		m.ServeHTTP(ctx)
+		cookie := new(fasthttp.Cookie)
+		cookie.SetKey("MacrossSessionId")
+		if !ctx.Response.Header.Cookie(cookie) {
+			t.Fatal("session cookie not written")
+		}
+		cookies = append(cookies, string(cookie.Value()))
+	}
+	vars := activity(t, "session_activity_test")
+	if vars["created"] != 3.0 || vars["active"] != 3.0 || vars["destroyed"] != 0.0 {
+		t.Fatalf("activity after 3 sessions: %v", vars)
+	}
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/logout")
+	ctx.Request.Header.SetCookie("MacrossSessionId", cookies[0])
+	m.ServeHTTP(ctx)
+	vars = activity(t, "session_activity_test")
+	if vars["destroyed"] != 1.0 || vars["active"] != 2.0 {
+		t.Fatalf("activity after a logout: %v", vars)
+	}
+
+	if _, err = manager.GCNow(); err != nil {
+		t.Fatal("GCNow:", err)
+	}
+	if vars = activity(t, "session_activity_test"); vars["last_gc"] == nil {
+		t.Fatalf("gc not published: %v", vars)
+	}
+}
@@ -0,0 +1,166 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// MigratingProvider serves sessions from a new provider, moving over on first
+// use the sessions still only found in the old one, until the end of the
+// migration window. Afterwards the old provider isn't read anymore and can be
+// retired, with a window of the max lifetime its remaining sessions expired anyway.
+type MigratingProvider struct {
+	Provider
+	old   Provider
+	until time.Time
+}
+
+// NewMigratingProvider returns a provider migrating the sessions of old to p until until.
+func NewMigratingProvider(p, old Provider, until time.Time) *MigratingProvider {
+	return &MigratingProvider{Provider: p, old: old, until: until}
+}
+
+// migrating reports whether the old provider is still read.
+func (mp *MigratingProvider) migrating() bool {
+	return time.Now().Before(mp.until)
+}
+
+// migrate moves session sid from the old provider to the new one if it's only found there.
+func (mp *MigratingProvider) migrate(sid string) error {
+	if !mp.migrating() || mp.Provider.Exist(sid) || !mp.old.Exist(sid) {
+		return nil
+	}
+	from, err := mp.old.Read(sid)
+	if err != nil {
+		return err
+	}
+	k, ok := from.(keyer)
+	if !ok {
+		return fmt.Errorf("session: can't migrate from %T, it doesn't list its keys", from)
+	}
+	to, err := mp.Provider.Read(sid)
+	if err != nil {
+		return err
+	}
+	for _, key := range k.Keys() {
+		if err = to.Set(key, from.Get(key)); err != nil {
+			return err
+		}
+	}
+	if err = to.Release(nil); err != nil {
+		return err
+	}
+	return mp.old.Destory(sid)
+}
+
+// Read returns session sid of the new provider, migrated from the old one first if needed.
+func (mp *MigratingProvider) Read(sid string) (macross.RawStore, error) {
+	if err := mp.migrate(sid); err != nil {
+		return nil, err
+	}
+	return mp.Provider.Read(sid)
+}
+
+// Exist checks both providers during the migration.
+func (mp *MigratingProvider) Exist(sid string) bool {
+	return mp.Provider.Exist(sid) || mp.migrating() && mp.old.Exist(sid)
+}
+
+// Regenerate migrates oldsid before regenerating it in the new provider.
+func (mp *MigratingProvider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	if err := mp.migrate(oldsid); err != nil {
+		return nil, err
+	}
+	return mp.Provider.Regenerate(oldsid, sid)
+}
+
+// Destory deletes the session from both providers.
+func (mp *MigratingProvider) Destory(sid string) error {
+	if mp.migrating() {
+		if err := mp.old.Destory(sid); err != nil {
+			return err
+		}
+	}
+	return mp.Provider.Destory(sid)
+}
+
+// DestroyAll deletes all sessions of both providers.
+func (mp *MigratingProvider) DestroyAll() error {
+	for _, p := range []Provider{mp.old, mp.Provider} {
+		dp, ok := p.(DestroyAllProvider)
+		if !ok {
+			return fmt.Errorf("session: provider %T does not support DestroyAll", p)
+		}
+		if err := dp.DestroyAll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetExpiry extends the lifetime of the session in the new provider, where
+// Retryable retries the errors either provider retries.
+func (mp *MigratingProvider) Retryable(err error) bool {
+	return retryable(mp.Provider, err) || retryable(mp.old, err)
+}
+
+// it was migrated when read.
+func (mp *MigratingProvider) SetExpiry(sid string, d time.Duration) error {
+	return setExpiry(mp.Provider, sid, d)
+}
+
+// Count counts the sessions of both providers during the migration.
+func (mp *MigratingProvider) Count() int {
+	if mp.migrating() {
+		return mp.Provider.Count() + mp.old.Count()
+	}
+	return mp.Provider.Count()
+}
+
+// SIDs lists the sessions of both providers during the migration.
+func (mp *MigratingProvider) SIDs() ([]string, error) {
+	sids, err := listSIDs(mp.Provider)
+	if err != nil || !mp.migrating() {
+		return sids, err
+	}
+	old, err := listSIDs(mp.old)
+	if err != nil {
+		return nil, err
+	}
+	return append(sids, old...), nil
+}
+
+// GC runs the gc of both providers during the migration.
+func (mp *MigratingProvider) GC() {
+	if _, err := mp.Sweep(); err != nil {
+		log.Printf("session: gc: %v", err)
+	}
+}
+
+// Sweep runs the gc of both providers during the migration and returns how
+// many sessions they removed, counted by those which are a SweepProvider.
+func (mp *MigratingProvider) Sweep() (removed int, err error) {
+	if mp.migrating() {
+		if removed, err = sweep(mp.old); err != nil {
+			return removed, err
+		}
+	}
+	n, err := sweep(mp.Provider)
+	return removed + n, err
+}
+
+// RebindProvider switches the manager to p, an initialized provider, e.g. for
+// a blue/green swap of the session storage. Sessions missing in p are read
+// from the current provider and written forward to p on their next use,
+// during migrationWindow seconds (the max lifetime by default).
+// Call it at startup, before serving requests.
+func (manager *Manager) RebindProvider(p Provider) {
+	window := manager.config.MigrationWindow
+	if window == 0 {
+		window = manager.config.MaxLifetime
+	}
+	manager.provider = NewMigratingProvider(p, manager.provider, time.Now().Add(time.Duration(window)*time.Second))
+}
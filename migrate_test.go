@@ -0,0 +1,49 @@
+package session
+
+import (
+	"container/list"
+	"testing"
+	"time"
+)
+
+func TestRebindProvider(t *testing.T) {
+	manager, cleanup := newFileManager(t)
+	defer cleanup()
+	old := manager.provider
+	store, _ := old.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+
+	next := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}
+	next.Init(3600, "")
+	manager.RebindProvider(next)
+
+	if !manager.provider.Exist("aaaa") {
+		t.Fatal("session of the old provider doesn't exist")
+	}
+	store, err := manager.Read("aaaa")
+	if err != nil {
+		t.Fatal("Read:", err)
+	}
+	if store.Get("user") != "insionng" {
+		t.Fatal("session of the old provider not served")
+	}
+	if !next.Exist("aaaa") || old.Exist("aaaa") {
+		t.Fatal("session not migrated to the new provider")
+	}
+	if store, _ = next.Read("aaaa"); store.Get("user") != "insionng" {
+		t.Fatal("migrated session lost its values")
+	}
+
+	// past the window the old provider isn't read anymore.
+	store, _ = old.Read("bbbb")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	manager.provider.(*MigratingProvider).until = time.Now()
+	if manager.provider.Exist("bbbb") {
+		t.Fatal("old provider read after the migration window")
+	}
+	if store, _ = manager.Read("bbbb"); store.Get("user") != nil || !old.Exist("bbbb") {
+		t.Fatal("session migrated after the migration window")
+	}
+}
@@ -0,0 +1,225 @@
+// Package mock provides a session provider recording the calls it gets,
+// for tests asserting how the manager and the middlewares use providers.
+//
+//	p := mock.New()
+//	session.Register("mock", p)
+//	manager, _ := session.NewManager("mock", `{"cookieName":"sid","gcLifetime":3600}`)
+//	...
+//	if n := len(p.CallsTo("Read")); n != 1 {
+//		t.Fatalf("%d reads", n)
+//	}
+package mock
+
+import (
+	"sync"
+
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+)
+
+var _ session.Provider = (*Provider)(nil)
+
+// Call is a recorded call, Args holds its session ids.
+type Call struct {
+	Method string
+	Args   []string
+}
+
+// Provider is an in-memory session provider recording every call,
+// the Release of its stores included.
+type Provider struct {
+	lock        sync.Mutex
+	calls       []Call
+	sessions    map[string]map[interface{}]interface{}
+	maxLifetime int64
+	config      string
+}
+
+// New returns an empty Provider.
+func New() *Provider {
+	return &Provider{sessions: make(map[string]map[interface{}]interface{})}
+}
+
+func (p *Provider) record(method string, args ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.calls = append(p.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the recorded calls in order.
+func (p *Provider) Calls() []Call {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]Call(nil), p.calls...)
+}
+
+// CallsTo returns the recorded calls of method in order.
+func (p *Provider) CallsTo(method string) []Call {
+	var calls []Call
+	for _, call := range p.Calls() {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the recorded calls, the sessions are kept.
+func (p *Provider) Reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.calls = nil
+}
+
+// Init records the config.
+func (p *Provider) Init(maxLifetime int64, config string) error {
+	p.lock.Lock()
+	p.maxLifetime = maxLifetime
+	p.config = config
+	p.lock.Unlock()
+	p.record("Init", config)
+	return nil
+}
+
+// snapshot returns a copy of the values of sid, nil if it doesn't exist.
+func (p *Provider) snapshot(sid string) map[interface{}]interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	values, ok := p.sessions[sid]
+	if !ok {
+		return nil
+	}
+	copied := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	return copied
+}
+
+func (p *Provider) newStore(sid string) *Store {
+	values := p.snapshot(sid)
+	if values == nil {
+		values = make(map[interface{}]interface{})
+	}
+	return &Store{p: p, sid: sid, values: values}
+}
+
+// Read records and returns the session sid, empty if it doesn't exist.
+func (p *Provider) Read(sid string) (macross.RawStore, error) {
+	p.record("Read", sid)
+	return p.newStore(sid), nil
+}
+
+// Exist records and reports whether sid was released, without copying it.
+func (p *Provider) Exist(sid string) bool {
+	p.record("Exist", sid)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.sessions[sid]
+	return ok
+}
+
+// Regenerate records and moves the session oldsid to sid.
+func (p *Provider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	p.record("Regenerate", oldsid, sid)
+	p.lock.Lock()
+	if values, ok := p.sessions[oldsid]; ok {
+		p.sessions[sid] = values
+		delete(p.sessions, oldsid)
+	}
+	p.lock.Unlock()
+	return p.newStore(sid), nil
+}
+
+// Destory records and deletes the session sid.
+func (p *Provider) Destory(sid string) error {
+	p.record("Destory", sid)
+	p.lock.Lock()
+	delete(p.sessions, sid)
+	p.lock.Unlock()
+	return nil
+}
+
+// Count records and returns the number of sessions.
+func (p *Provider) Count() int {
+	p.record("Count")
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.sessions)
+}
+
+// GC records the call, sessions never expire.
+func (p *Provider) GC() {
+	p.record("GC")
+}
+
+// Store is a session of the mock Provider,
+// its values are saved to the provider on Release.
+type Store struct {
+	p      *Provider
+	sid    string
+	lock   sync.RWMutex
+	values map[interface{}]interface{}
+}
+
+// Set value in the session.
+func (st *Store) Set(key, value interface{}) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.values[key] = value
+	return nil
+}
+
+// Get value from the session.
+func (st *Store) Get(key interface{}) interface{} {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.values[key]
+}
+
+// Delete value from the session.
+func (st *Store) Delete(key interface{}) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	delete(st.values, key)
+	return nil
+}
+
+// Flush clear all values of the session.
+func (st *Store) Flush() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.values = make(map[interface{}]interface{})
+	return nil
+}
+
+// Keys returns the keys of all values in the session
+func (st *Store) Keys() []interface{} {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	keys := make([]interface{}, 0, len(st.values))
+	for k := range st.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ID returns the session id.
+func (st *Store) ID() string {
+	return st.sid
+}
+
+// Release records the save of the session values to the provider.
+func (st *Store) Release(ctx *macross.Context) error {
+	st.p.record("Release", st.sid)
+	st.lock.RLock()
+	values := make(map[interface{}]interface{}, len(st.values))
+	for k, v := range st.values {
+		values[k] = v
+	}
+	st.lock.RUnlock()
+	st.p.lock.Lock()
+	st.p.sessions[st.sid] = values
+	st.p.lock.Unlock()
+	return nil
+}
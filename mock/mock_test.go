@@ -0,0 +1,138 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+	"github.com/valyala/fasthttp"
+)
+
+const cookieName = "MacrossSessionId"
+
+var mockpder, primarypder = New(), New()
+
+func init() {
+	session.Register("mock", mockpder)
+	session.Register("mock-primary", primarypder)
+}
+
+func doRequest(m *macross.Macross, cookie string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	if cookie != "" {
+		ctx.Request.Header.SetCookie(cookieName, cookie)
+	}
+	m.ServeHTTP(ctx)
+	return ctx
+}
+
+func TestSessionerProviderCalls(t *testing.T) {
+	session.GlobalManager = nil
+	m := macross.New()
+	m.Use(session.Sessioner(session.Options{Provider: "mock", Config: `{"cookieName":"` + cookieName + `","gcLifetime":3600}`}))
+	var sid string
+	m.Get("/", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+
+	mockpder.Reset()
+	ctx := doRequest(m, "")
+	if n := len(mockpder.CallsTo("Read")); n != 1 {
+		t.Fatalf("Start read the provider %d times, want 1: %v", n, mockpder.Calls())
+	}
+	if calls := mockpder.CallsTo("Release"); !reflect.DeepEqual(calls, []Call{{"Release", []string{sid}}}) {
+		t.Fatalf("Release saved %v, want one save of %s", calls, sid)
+	}
+
+	cookie := new(fasthttp.Cookie)
+	cookie.SetKey(cookieName)
+	if !ctx.Response.Header.Cookie(cookie) {
+		t.Fatal("session cookie not written")
+	}
+	mockpder.Reset()
+	doRequest(m, string(cookie.Value()))
+	want := []Call{{"Exist", []string{sid}}, {"Read", []string{sid}}, {"Release", []string{sid}}}
+	var got []Call
+	for _, call := range mockpder.Calls() {
+		if call.Method != "GC" {
+			got = append(got, call)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("existing session calls %v, want %v", got, want)
+	}
+}
+
+func TestProviderStore(t *testing.T) {
+	p := New()
+	store, _ := p.Read("aaaa")
+	store.Set("user", "insionng")
+	if p.Exist("aaaa") {
+		t.Fatal("session exists before Release")
+	}
+	store.Release(nil)
+	store, _ = p.Regenerate("aaaa", "bbbb")
+	if store.Get("user") != "insionng" || p.Exist("aaaa") {
+		t.Fatal("session not moved by Regenerate")
+	}
+	p.Destory("bbbb")
+	if p.Count() != 0 {
+		t.Fatal("destroyed session counted")
+	}
+	if calls := p.CallsTo("Regenerate"); len(calls) != 1 || !reflect.DeepEqual(calls[0].Args, []string{"aaaa", "bbbb"}) {
+		t.Fatalf("Regenerate recorded as %v", calls)
+	}
+}
+
+func TestReadProvider(t *testing.T) {
+	primary, replica := primarypder, New()
+	primary.Reset()
+	manager, err := session.NewManager("mock-primary", `{"cookieName":"`+cookieName+`","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.SetReadProvider(replica)
+
+	// the write of a new session goes to the primary.
+	store, _ := manager.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	if len(replica.CallsTo("Read")) != 0 || len(replica.CallsTo("Release")) != 0 {
+		t.Fatalf("new session used the replica: %v", replica.Calls())
+	}
+	if len(primary.CallsTo("Release")) != 1 {
+		t.Fatal("new session not written to the primary")
+	}
+
+	// replicated, the session is read from the replica and written to the primary.
+	replicated, _ := replica.Read("aaaa")
+	replicated.Set("user", "insionng")
+	replicated.Release(nil)
+	primary.Reset()
+	replica.Reset()
+	store, _ = manager.Read("aaaa")
+	if store.Get("user") != "insionng" || len(replica.CallsTo("Read")) != 1 {
+		t.Fatal("session not read from the replica")
+	}
+	store.Set("cart", "apple")
+	store.Release(nil)
+	if len(replica.CallsTo("Release")) != 0 {
+		t.Fatal("session written to the replica")
+	}
+	if values, _ := primary.Read("aaaa"); values.Get("cart") != "apple" || values.Get("user") != "insionng" {
+		t.Fatal("write of the replica session not sent to the primary")
+	}
+
+	// a session destroyed on the primary isn't read back from the replica.
+	primary.Destory("aaaa")
+	if len(replica.CallsTo("Destory")) != 0 {
+		t.Fatal("session destroyed on the replica")
+	}
+	replica.Reset()
+	if store, _ = manager.Read("aaaa"); store.Get("user") != nil || len(replica.CallsTo("Read")) != 0 {
+		t.Fatal("destroyed session read from the replica")
+	}
+}
@@ -0,0 +1,364 @@
+// Package mysql provides a session provider storing the sessions in a mysql
+// (or mariadb) table, through database/sql and github.com/go-sql-driver/mysql.
+//
+// Each session is a row keyed by its sid, holding the encoded values and the
+// unix time it expires at. The values are binary, gob by default, so they are
+// bound as bytes to a blob column, which stores them unchanged whatever the
+// character set of the table:
+//
+//	CREATE TABLE `session` (
+//		`session_key` VARCHAR(128) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+//		`session_data` MEDIUMBLOB,
+//		`session_expiry` BIGINT NOT NULL,
+//		PRIMARY KEY (`session_key`),
+//		KEY (`session_expiry`)
+//	) ENGINE=InnoDB;
+//
+// The sids are case sensitive, so the key column has a binary collation.
+// Tables of other frameworks keeping the values in a TEXT column can be
+// reused with the "base64" or "hex" encoding, see session.TextCodec.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+)
+
+var mysqlpder = &Provider{}
+
+// tablePattern is the format of the table names, which are quoted as is.
+var tablePattern = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+
+// SessionStore mysql session store
+type SessionStore struct {
+	p           *Provider
+	sid         string
+	lock        sync.RWMutex
+	values      map[interface{}]interface{}
+	maxLifetime int64  // already spread by the expiry jitter
+	lazy        bool   // skip the write of unchanged sessions
+	stored      []byte // encoded values as read, compared by lazy releases
+}
+
+// Set value in mysql session
+func (ms *SessionStore) Set(key, value interface{}) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.values[key] = value
+	return nil
+}
+
+// Get value in mysql session
+func (ms *SessionStore) Get(key interface{}) interface{} {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if v, ok := ms.values[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// Delete value in mysql session
+func (ms *SessionStore) Delete(key interface{}) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.values, key)
+	return nil
+}
+
+// Flush clear all values in mysql session
+func (ms *SessionStore) Flush() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.values = make(map[interface{}]interface{})
+	return nil
+}
+
+// SetAll replaces all values of mysql session
+func (ms *SessionStore) SetAll(values map[interface{}]interface{}) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.values = values
+	return nil
+}
+
+// Keys returns the keys of all values in the session
+func (ms *SessionStore) Keys() []interface{} {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	keys := make([]interface{}, 0, len(ms.values))
+	for k := range ms.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ID get mysql session id
+func (ms *SessionStore) ID() string {
+	return ms.sid
+}
+
+// Release save session values to its row
+func (ms *SessionStore) Release(ctx *macross.Context) error {
+	return ms.ReleaseContext(context.Background(), ctx)
+}
+
+// ReleaseContext saves the session values to its row, the query is
+// cancelled once ctx is done.
+func (ms *SessionStore) ReleaseContext(ctx context.Context, c *macross.Context) error {
+	ms.lock.RLock()
+	if ms.lazy && session.Unchanged(ms.p.codec, ms.stored, ms.values) {
+		ms.lock.RUnlock()
+		return nil
+	}
+	b, err := ms.p.codec.Encode(ms.values)
+	ms.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if ms.lazy {
+		ms.lock.Lock()
+		ms.stored = b
+		ms.lock.Unlock()
+	}
+	return ms.p.put(ctx, ms.sid, b, ms.maxLifetime)
+}
+
+// Config mysql session provider config
+type Config struct {
+	// DSN is the data source name of github.com/go-sql-driver/mysql,
+	// e.g. "user:password@tcp(127.0.0.1:3306)/app".
+	DSN string `json:"dsn"`
+	// Table holds the sessions, "session" by default, see the package doc.
+	Table string `json:"table"`
+	// Codec encodes the session values, session.GobCodec by default.
+	Codec session.Codec `json:"-"`
+	// Encoding stores the encoded values as "base64" or "hex" text, see session.TextCodec.
+	Encoding string `json:"encoding"`
+	// DB is used instead of opening DSN, e.g. to share the pool of the app.
+	DB *sql.DB `json:"-"`
+}
+
+// Provider mysql session provider
+type Provider struct {
+	maxLifetime int64
+	config      Config
+	jitter      int   // expiry jitter percentage
+	skew        int64 // tolerated clock skew in seconds
+	lazy        bool  // skip the write of unchanged sessions
+	codec       session.Codec
+	db          *sql.DB
+	now         func() time.Time
+}
+
+// Init init mysql session with a json Config, e.g.
+// {"dsn":"user:password@tcp(127.0.0.1:3306)/app","table":"session"}
+func (mp *Provider) Init(maxLifetime int64, config string) error {
+	var cf Config
+	if err := json.Unmarshal([]byte(config), &cf); err != nil {
+		return fmt.Errorf("session: mysql config: %v", err)
+	}
+	return mp.InitWithConfig(maxLifetime, cf)
+}
+
+// InitWithConfig init mysql session with a Config.
+func (mp *Provider) InitWithConfig(maxLifetime int64, cfg interface{}) error {
+	var cf Config
+	switch v := cfg.(type) {
+	case Config:
+		cf = v
+	case *Config:
+		cf = *v
+	default:
+		return fmt.Errorf("session: mysql provider does not support config %T", cfg)
+	}
+	if cf.DSN == "" && cf.DB == nil {
+		return errors.New("session: mysql dsn is empty")
+	}
+	if cf.Table == "" {
+		cf.Table = "session"
+	}
+	if !tablePattern.MatchString(cf.Table) {
+		return fmt.Errorf("session: bad mysql table name %q", cf.Table)
+	}
+	codec := cf.Codec
+	if codec == nil {
+		codec = session.GobCodec{}
+	}
+	codec, err := session.NewTextCodec(codec, cf.Encoding)
+	if err != nil {
+		return err
+	}
+	db := cf.DB
+	if db == nil {
+		if db, err = sql.Open("mysql", cf.DSN); err != nil {
+			return fmt.Errorf("session: mysql: %v", err)
+		}
+	}
+	mp.maxLifetime = maxLifetime
+	mp.config = cf
+	mp.codec = codec
+	mp.db = db
+	mp.now = time.Now
+	return nil
+}
+
+// SetExpiryJitter spread the session expiries by ±percent% of the lifetime
+func (mp *Provider) SetExpiryJitter(percent int) {
+	mp.jitter = percent
+}
+
+// Retryable opts in to the retries of the manager for network errors.
+func (mp *Provider) Retryable(err error) bool {
+	return session.IsTransient(err)
+}
+
+// SetLazyRelease skips writing back the sessions left unchanged.
+func (mp *Provider) SetLazyRelease(lazy bool) {
+	mp.lazy = lazy
+}
+
+// SetClockSkew keeps sessions seconds longer, as their expiries are written
+// with the clocks of other servers.
+func (mp *Provider) SetClockSkew(seconds int64) {
+	mp.skew = seconds
+}
+
+// query returns q with the quoted table name in place of its %s.
+func (mp *Provider) query(q string) string {
+	return fmt.Sprintf(q, "`"+mp.config.Table+"`")
+}
+
+// deadline returns the expiry of the sessions expired now, the clock skew aside.
+func (mp *Provider) deadline() int64 {
+	return mp.now().Unix() - mp.skew
+}
+
+// get returns the encoded values of session sid, nil if it doesn't exist or expired.
+func (mp *Provider) get(sid string) ([]byte, error) {
+	var b []byte
+	err := mp.db.QueryRow(mp.query("SELECT session_data FROM %s WHERE session_key = ? AND session_expiry > ?"),
+		sid, mp.deadline()).Scan(&b)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case b == nil:
+		// a NULL or empty blob, still an existing session.
+		b = []byte{}
+	}
+	return b, nil
+}
+
+func (mp *Provider) put(ctx context.Context, sid string, b []byte, lifetime int64) error {
+	if b == nil {
+		b = []byte{}
+	}
+	_, err := mp.db.ExecContext(ctx, mp.query("INSERT INTO %s (session_key, session_data, session_expiry) VALUES (?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE session_data = VALUES(session_data), session_expiry = VALUES(session_expiry)"),
+		sid, b, mp.now().Unix()+lifetime)
+	return err
+}
+
+func (mp *Provider) newStore(sid string, b []byte) *SessionStore {
+	values := make(map[interface{}]interface{})
+	if len(b) > 0 {
+		kv, err := mp.codec.Decode(b)
+		if err != nil {
+			log.Printf("session: can't decode mysql session %s: %v", sid, err)
+		} else {
+			values = kv
+		}
+	}
+	return &SessionStore{p: mp, sid: sid, values: values, maxLifetime: session.Jitter(mp.maxLifetime, mp.jitter, sid), lazy: mp.lazy, stored: b}
+}
+
+// Read read mysql session by sid
+func (mp *Provider) Read(sid string) (macross.RawStore, error) {
+	b, err := mp.get(sid)
+	if err != nil {
+		return nil, err
+	}
+	return mp.newStore(sid, b), nil
+}
+
+// Exist check mysql session exist by sid
+func (mp *Provider) Exist(sid string) bool {
+	var n int
+	err := mp.db.QueryRow(mp.query("SELECT COUNT(*) FROM %s WHERE session_key = ? AND session_expiry > ?"),
+		sid, mp.deadline()).Scan(&n)
+	return err == nil && n > 0
+}
+
+// Regenerate moves the session row to the new sid in one statement,
+// a missing old session starts a fresh one.
+func (mp *Provider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	b, err := mp.get(oldsid)
+	if err != nil {
+		return nil, err
+	}
+	store := mp.newStore(sid, b)
+	if b == nil {
+		return store, nil
+	}
+	_, err = mp.db.Exec(mp.query("UPDATE %s SET session_key = ?, session_expiry = ? WHERE session_key = ?"),
+		sid, mp.now().Unix()+store.maxLifetime, oldsid)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Destory delete mysql session by id
+func (mp *Provider) Destory(sid string) error {
+	_, err := mp.db.Exec(mp.query("DELETE FROM %s WHERE session_key = ?"), sid)
+	return err
+}
+
+// GC deletes the expired session rows.
+func (mp *Provider) GC() {
+	if _, err := mp.Sweep(); err != nil {
+		log.Printf("session: mysql gc: %v", err)
+	}
+}
+
+// Sweep deletes the expired session rows and returns how many.
+func (mp *Provider) Sweep() (int, error) {
+	result, err := mp.db.Exec(mp.query("DELETE FROM %s WHERE session_expiry <= ?"), mp.deadline())
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// Count returns the number of unexpired sessions.
+func (mp *Provider) Count() int {
+	var n int
+	if err := mp.db.QueryRow(mp.query("SELECT COUNT(*) FROM %s WHERE session_expiry > ?"), mp.deadline()).Scan(&n); err != nil {
+		log.Printf("session: mysql count: %v", err)
+	}
+	return n
+}
+
+// DestroyAll delete all rows of the session table.
+func (mp *Provider) DestroyAll() error {
+	_, err := mp.db.Exec(mp.query("DELETE FROM %s"))
+	return err
+}
+
+func init() {
+	session.Register("mysql", mysqlpder)
+}
@@ -0,0 +1,279 @@
+package mysql
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is a database/sql driver answering the statements of the provider
+// from a map, it checks the session data is bound as bytes.
+type fakeDB struct {
+	lock sync.Mutex
+	rows map[string]fakeRow
+}
+
+type fakeRow struct {
+	data   []byte
+	expiry int64
+}
+
+var fake = &fakeDB{rows: map[string]fakeRow{}}
+
+func init() {
+	sql.Register("mysqltest", fake)
+}
+
+func (db *fakeDB) Open(name string) (driver.Conn, error) { return db, nil }
+func (db *fakeDB) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db, strings.Replace(query, "`session`", "t", 1)}, nil
+}
+func (db *fakeDB) Close() error              { return nil }
+func (db *fakeDB) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	var n int64
+	switch s.query {
+	case "INSERT INTO t (session_key, session_data, session_expiry) VALUES (?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE session_data = VALUES(session_data), session_expiry = VALUES(session_expiry)":
+		data, ok := args[1].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("session_data bound as %T", args[1])
+		}
+		db.rows[args[0].(string)] = fakeRow{append([]byte(nil), data...), args[2].(int64)}
+		n = 1
+	case "UPDATE t SET session_key = ?, session_expiry = ? WHERE session_key = ?":
+		if r, ok := db.rows[args[2].(string)]; ok {
+			delete(db.rows, args[2].(string))
+			r.expiry = args[1].(int64)
+			db.rows[args[0].(string)] = r
+			n = 1
+		}
+	case "DELETE FROM t WHERE session_key = ?":
+		if _, ok := db.rows[args[0].(string)]; ok {
+			delete(db.rows, args[0].(string))
+			n = 1
+		}
+	case "DELETE FROM t WHERE session_expiry <= ?":
+		for k, r := range db.rows {
+			if r.expiry <= args[0].(int64) {
+				delete(db.rows, k)
+				n++
+			}
+		}
+	case "DELETE FROM t":
+		n = int64(len(db.rows))
+		db.rows = map[string]fakeRow{}
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", s.query)
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	switch s.query {
+	case "SELECT session_data FROM t WHERE session_key = ? AND session_expiry > ?":
+		if r, ok := db.rows[args[0].(string)]; ok && r.expiry > args[1].(int64) {
+			return &fakeRows{[]driver.Value{r.data}}, nil
+		}
+		return &fakeRows{}, nil
+	case "SELECT COUNT(*) FROM t WHERE session_key = ? AND session_expiry > ?":
+		var n int64
+		if r, ok := db.rows[args[0].(string)]; ok && r.expiry > args[1].(int64) {
+			n = 1
+		}
+		return &fakeRows{[]driver.Value{n}}, nil
+	case "SELECT COUNT(*) FROM t WHERE session_expiry > ?":
+		var n int64
+		for _, r := range db.rows {
+			if r.expiry > args[0].(int64) {
+				n++
+			}
+		}
+		return &fakeRows{[]driver.Value{n}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+// fakeRows is a result of at most one row.
+type fakeRows struct {
+	row []driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"c"}
+}
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.row = nil
+	return nil
+}
+
+// newTestProvider returns a provider on the mysql of $MYSQL_TEST_DSN, in
+// which it creates the session table, or else on the fake driver.
+func newTestProvider(t *testing.T, maxLifetime int64) *Provider {
+	driverName, dsn := "mysqltest", "fake"
+	if env := os.Getenv("MYSQL_TEST_DSN"); env != "" {
+		driverName, dsn = "mysql", env
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	if driverName == "mysql" {
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS `session` (" +
+			"`session_key` VARCHAR(128) CHARACTER SET ascii COLLATE ascii_bin NOT NULL, " +
+			"`session_data` MEDIUMBLOB, `session_expiry` BIGINT NOT NULL, " +
+			"PRIMARY KEY (`session_key`), KEY (`session_expiry`))")
+		if err != nil {
+			t.Fatal("CREATE TABLE:", err)
+		}
+	}
+	mp := &Provider{}
+	if err = mp.InitWithConfig(maxLifetime, Config{DB: db}); err != nil {
+		t.Fatal("Init:", err)
+	}
+	mp.DestroyAll()
+	return mp
+}
+
+func TestReadWriteDestroy(t *testing.T) {
+	mp := newTestProvider(t, 3600)
+	defer mp.DestroyAll()
+
+	store, err := mp.Read("aaaa")
+	if err != nil {
+		t.Fatal("Read:", err)
+	}
+	if mp.Exist("aaaa") {
+		t.Fatal("session exists before Release")
+	}
+	store.Set("user", "insionng")
+	if err = store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	if !mp.Exist("aaaa") {
+		t.Fatal("released session doesn't exist")
+	}
+	store, _ = mp.Read("aaaa")
+	if store.Get("user") != "insionng" {
+		t.Fatal("value not read back")
+	}
+	if mp.Count() != 1 {
+		t.Fatalf("Count = %d, want 1", mp.Count())
+	}
+	if mp.Exist("AAAA") {
+		t.Fatal("sids compared case insensitively")
+	}
+
+	store, err = mp.Regenerate("aaaa", "bbbb")
+	if err != nil {
+		t.Fatal("Regenerate:", err)
+	}
+	if store.Get("user") != "insionng" || mp.Exist("aaaa") || !mp.Exist("bbbb") {
+		t.Fatal("session not moved to the regenerated sid")
+	}
+
+	if err = mp.Destory("bbbb"); err != nil {
+		t.Fatal("Destory:", err)
+	}
+	if mp.Exist("bbbb") {
+		t.Fatal("destroyed session exists")
+	}
+	if store, _ = mp.Read("bbbb"); store.Get("user") != nil {
+		t.Fatal("destroyed session read back")
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	mp := newTestProvider(t, 3600)
+	defer mp.DestroyAll()
+
+	raw := []byte("\x00\xff\xfe'\"\\")
+	store, _ := mp.Read("aaaa")
+	store.Set("raw", raw)
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	store, _ = mp.Read("aaaa")
+	if got, _ := store.Get("raw").([]byte); !bytes.Equal(got, raw) {
+		t.Fatalf("read back %q, want %q", got, raw)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	mp := newTestProvider(t, 60)
+	defer mp.DestroyAll()
+
+	store, _ := mp.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+
+	now := time.Now()
+	mp.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if mp.Exist("aaaa") {
+		t.Fatal("expired session exists")
+	}
+	if store, _ = mp.Read("aaaa"); store.Get("user") != nil {
+		t.Fatal("expired session read back")
+	}
+	if mp.Count() != 0 {
+		t.Fatalf("Count = %d, want 0", mp.Count())
+	}
+	if n, err := mp.Sweep(); n != 1 || err != nil {
+		t.Fatalf("Sweep = %d, %v, want 1", n, err)
+	}
+
+	mp.SetClockSkew(180)
+	store, _ = mp.Read("bbbb")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	mp.now = func() time.Time { return now.Add(4 * time.Minute) }
+	if !mp.Exist("bbbb") {
+		t.Fatal("session within the clock skew doesn't exist")
+	}
+}
+
+func TestInitConfig(t *testing.T) {
+	mp := &Provider{}
+	if err := mp.Init(3600, `{"dsn":"user:password@tcp(127.0.0.1:3306)/app"}`); err != nil {
+		t.Fatal(err)
+	}
+	if mp.config.Table != "session" {
+		t.Fatalf("default table %q", mp.config.Table)
+	}
+	if err := mp.Init(3600, `{"table":"session"}`); err == nil {
+		t.Fatal("config without a dsn accepted")
+	}
+	if err := mp.Init(3600, "{\"dsn\":\"app\",\"table\":\"session`; DROP TABLE users\"}"); err == nil {
+		t.Fatal("bad table name accepted")
+	}
+	if err := mp.Init(3600, `not json`); err == nil {
+		t.Fatal("bad json accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// ErrNotPending is returned by Promote for a session not marked pending.
+var ErrNotPending = errors.New("session: the session is not pending")
+
+// SetPending marks the session as pending for ttl, e.g. during a captcha or
+// an OAuth redirect before the user is known. A pending session not promoted
+// with Promote within ttl is replaced by a new session on its next request.
+func (s store) SetPending(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("session: invalid pending ttl %v", ttl)
+	}
+	meta := getMeta(s.RawStore)
+	meta.PendingUntil = time.Now().Add(ttl)
+	return setMeta(s.RawStore, meta)
+}
+
+// IsPending reports whether the session is pending, see SetPending.
+func (s store) IsPending() bool {
+	return !getMeta(s.RawStore).PendingUntil.IsZero()
+}
+
+// Promote turns a pending session into a full session, e.g. once the user
+// logged in: its values are moved to a new session id and cookie, the pending
+// mark is cleared and the session gets the full lifetime from this request.
+// If the session can't be moved it stays pending under its old id.
+func (s *store) Promote(ctx *macross.Context) error {
+	meta := getMeta(s.RawStore)
+	if meta.PendingUntil.IsZero() {
+		return ErrNotPending
+	}
+	sid, err := s.Manager.sessionID()
+	if err != nil {
+		return err
+	}
+	raw, err := s.Manager.regenerate(ctx, s.ID(), sid)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		return fmt.Errorf("session: provider %T can't regenerate sessions", s.Manager.provider)
+	}
+	s.RawStore = raw
+	meta.PendingUntil = time.Time{}
+	meta.LastAccessed = time.Now()
+	return setMeta(raw, meta)
+}
+
+// expirePending destroys session s if it's pending past its ttl and returns
+// a new session in its place.
+func (manager *Manager) expirePending(ctx *macross.Context, s macross.RawStore) (macross.RawStore, error) {
+	if !pendingExpired(getMeta(s)) {
+		return s, nil
+	}
+	return manager.replace(ctx, s)
+}
+
+// pendingExpired reports whether the session of meta is pending past its ttl.
+func pendingExpired(meta Meta) bool {
+	return !meta.PendingUntil.IsZero() && !time.Now().Before(meta.PendingUntil)
+}
@@ -0,0 +1,67 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+func TestPendingPromote(t *testing.T) {
+	m := newTestApp(t, Options{})
+	ttl := 20 * time.Millisecond
+	var sid string
+	m.Get("/start", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		c.Session.Set("state", "oauth")
+		return c.Session.(Store).SetPending(ttl)
+	})
+	var gotSID string
+	var state interface{}
+	var pending bool
+	m.Get("/get", func(c *macross.Context) error {
+		gotSID, state = c.Session.ID(), c.Session.Get("state")
+		pending = c.Session.(Store).IsPending()
+		return nil
+	})
+	var promoteErr error
+	m.Get("/promote", func(c *macross.Context) error {
+		promoteErr = c.Session.(Store).Promote(c)
+		gotSID = c.Session.ID()
+		return nil
+	})
+
+	// a pending session not promoted within its ttl expires.
+	cookies := sessionCookies(t, doRequest(m, "/start", nil))
+	if doRequest(m, "/get", cookies); gotSID != sid || !pending || state != "oauth" {
+		t.Fatalf("pending session %s read as %s %v %v", sid, gotSID, pending, state)
+	}
+	time.Sleep(2 * ttl)
+	doRequest(m, "/get", cookies)
+	if gotSID == sid || state != nil || pending || GlobalManager.provider.Exist(sid) {
+		t.Fatalf("pending session %s not expired", sid)
+	}
+
+	// a promoted session moves to a new sid and outlives the ttl.
+	cookies = sessionCookies(t, doRequest(m, "/start", nil))
+	ctx := doRequest(m, "/promote", cookies)
+	if promoteErr != nil {
+		t.Fatal(promoteErr)
+	}
+	if gotSID == sid || GlobalManager.provider.Exist(sid) {
+		t.Fatalf("promoted session kept its sid %s", sid)
+	}
+	promoted := gotSID
+	cookies = sessionCookies(t, ctx)
+	time.Sleep(2 * ttl)
+	doRequest(m, "/get", cookies)
+	if gotSID != promoted || pending || state != "oauth" {
+		t.Fatalf("promoted session %s read as %s %v %v", promoted, gotSID, pending, state)
+	}
+
+	// only a pending session is promoted.
+	doRequest(m, "/promote", cookies)
+	if promoteErr != ErrNotPending {
+		t.Fatalf("Promote of a full session: %v", promoteErr)
+	}
+}
@@ -0,0 +1,20 @@
+// Package protobuf provides a session Codec storing proto.Message values in
+// the protobuf wire format, for providers storing bytes (file, redis).
+//
+//	session.Options{
+//		Provider:       "redis",
+//		Config:         `{"cookieName":"MacrossSessionId","gcLifetime":3600}`,
+//		ProviderConfig: redis.Config{Addr: "127.0.0.1:6379", Codec: protobuf.Codec{}},
+//	}
+//
+// Messages must be registered with proto.RegisterType, which generated code does.
+//
+// The package is optional and needs github.com/golang/protobuf, which isn't
+// vendored: get it and build with the protobuf tag, e.g.
+//
+//	go get github.com/golang/protobuf/proto
+//	go build -tags protobuf
+//
+// Without the tag the package is empty, so the rest of the module builds
+// without the dependency.
+package protobuf
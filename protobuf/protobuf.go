@@ -0,0 +1,93 @@
+//go:build protobuf
+// +build protobuf
+
+package protobuf
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/macross-contrib/session"
+)
+
+// Message is a proto.Message value as stored by Codec.
+type Message struct {
+	Name string // proto.MessageName of the value
+	Data []byte // protobuf wire format
+}
+
+func init() {
+	gob.Register(Message{})
+}
+
+// Codec encodes proto.Message values with protobuf,
+// the other values are left to Fallback.
+type Codec struct {
+	// Fallback encodes the values, session.GobCodec when nil.
+	Fallback session.Codec
+}
+
+func (c Codec) fallback() session.Codec {
+	if c.Fallback == nil {
+		return session.GobCodec{}
+	}
+	return c.Fallback
+}
+
+// Encode encodes values, proto messages in the protobuf wire format.
+func (c Codec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	wrapped := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		if pb, ok := v.(proto.Message); ok {
+			name := proto.MessageName(pb)
+			if name == "" {
+				return nil, fmt.Errorf("session: proto message %T is not registered", v)
+			}
+			data, err := proto.Marshal(pb)
+			if err != nil {
+				return nil, err
+			}
+			v = Message{Name: name, Data: data}
+		}
+		wrapped[k] = v
+	}
+	return c.fallback().Encode(wrapped)
+}
+
+// Decode decodes data encoded by Encode.
+// messages which fail to decode are dropped and logged, like session.DecodeGob does.
+func (c Codec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	values, err := c.fallback().Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range values {
+		m, ok := v.(Message)
+		if !ok {
+			continue
+		}
+		pb, err := unmarshal(m)
+		if err != nil {
+			log.Printf("session: drop key %v, can't decode its value: %v", k, err)
+			delete(values, k)
+			continue
+		}
+		values[k] = pb
+	}
+	return values, nil
+}
+
+func unmarshal(m Message) (proto.Message, error) {
+	t := proto.MessageType(m.Name)
+	if t == nil {
+		return nil, fmt.Errorf("unknown proto message %s", m.Name)
+	}
+	pb, ok := reflect.New(t.Elem()).Interface().(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a proto message", m.Name)
+	}
+	return pb, proto.Unmarshal(m.Data, pb)
+}
@@ -0,0 +1,66 @@
+//go:build protobuf
+// +build protobuf
+
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/macross-contrib/session/internal/redistest"
+	"github.com/macross-contrib/session/redis"
+)
+
+// Point is a hand written proto3 message.
+type Point struct {
+	X int32 `protobuf:"varint,1,opt,name=x,proto3" json:"x,omitempty"`
+	Y int32 `protobuf:"varint,2,opt,name=y,proto3" json:"y,omitempty"`
+}
+
+func (m *Point) Reset()         { *m = Point{} }
+func (m *Point) String() string { return proto.CompactTextString(m) }
+func (*Point) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*Point)(nil), "sessiontest.Point")
+}
+
+func TestRedisRoundTrip(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &redis.Provider{}
+	if err := rp.InitWithConfig(3600, redis.Config{Addr: fr.Addr(), Codec: Codec{}}); err != nil {
+		t.Fatal("InitWithConfig:", err)
+	}
+	store, _ := rp.Read("abcdef")
+	store.Set("point", &Point{X: 1, Y: 2})
+	store.Set("name", "insionng")
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+
+	store, _ = rp.Read("abcdef")
+	point, ok := store.Get("point").(*Point)
+	if !ok || point.X != 1 || point.Y != 2 {
+		t.Fatalf("proto message not round-tripped, got %#v", store.Get("point"))
+	}
+	if store.Get("name") != "insionng" {
+		t.Fatal("fallback value not round-tripped")
+	}
+}
+
+func TestEncodeWrapsMessages(t *testing.T) {
+	data, err := Codec{}.Encode(map[interface{}]interface{}{"point": &Point{X: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// decoding with the fallback alone shows how the message was stored.
+	values, err := Codec{}.fallback().Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := values["point"].(Message); !ok || m.Name != "sessiontest.Point" {
+		t.Fatalf("message not stored in wire format, got %#v", values["point"])
+	}
+}
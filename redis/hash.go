@@ -0,0 +1,229 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/macross-contrib/session"
+)
+
+// hashMarker is the field marking a session hash, so an empty session
+// exists as it does when stored as a single value.
+const hashMarker = "\x00"
+
+// fieldName returns the hash field of the session value key, the key itself
+// for the string keys. The field only addresses the value, the key is
+// encoded with it.
+func fieldName(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%T:%v", key, key)
+}
+
+// encodeField encodes the value of key alone, as stored in its hash field.
+func (rs *SessionStore) encodeField(key, value interface{}) ([]byte, error) {
+	return rs.codec.Encode(map[interface{}]interface{}{key: value})
+}
+
+// decodeFields decodes the stored hash fields, dropping those which don't
+// decode.
+func (rs *SessionStore) decodeFields() map[interface{}]interface{} {
+	values := make(map[interface{}]interface{}, len(rs.fields))
+	for name, field := range rs.fields {
+		if name == hashMarker {
+			continue
+		}
+		kv, err := rs.codec.Decode([]byte(field))
+		if err != nil {
+			log.Printf("session: can't decode field %q of redis session %s: %v", name, rs.sid, err)
+			continue
+		}
+		for k, v := range kv {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// touch records key as set or deleted, to be written by the next release of
+// a hash session. The caller must hold the lock.
+func (rs *SessionStore) touch(key interface{}) {
+	if !rs.hash {
+		return
+	}
+	if rs.touched == nil {
+		rs.touched = make(map[interface{}]bool)
+	}
+	rs.touched[key] = true
+}
+
+// releaseFields writes the fields of the values set or deleted since the last
+// write, all of them once the values were replaced or on the first write.
+func (rs *SessionStore) releaseFields(ctx context.Context) error {
+	key := rs.prefix + rs.sid
+	rs.lock.Lock()
+	if rs.values == nil {
+		rs.lock.Unlock()
+		if rs.lazy {
+			return nil
+		}
+		// never accessed, refresh the ttl.
+		return run(ctx, rs.p, func(conn redis.Conn) error {
+			conn.Send("EXPIRE", key, rs.maxLifetime)
+			_, err := conn.Do("EXPIRE", key+versionSuffix, rs.maxLifetime)
+			return err
+		})
+	}
+	// the keys touched meanwhile are written by the next release.
+	touched, replaced := rs.touched, rs.replaced
+	rs.touched, rs.replaced = nil, false
+	full := replaced || len(rs.fields) == 0
+	set := map[string]string{}
+	var del []string
+	if full {
+		set[hashMarker] = ""
+		for k, v := range rs.values {
+			b, err := rs.encodeField(k, v)
+			if err != nil {
+				rs.retouch(touched, replaced)
+				rs.lock.Unlock()
+				return err
+			}
+			set[fieldName(k)] = string(b)
+		}
+	} else {
+		for k := range touched {
+			name := fieldName(k)
+			stored, ok := rs.fields[name]
+			v, exists := rs.values[k]
+			if !exists {
+				if ok {
+					del = append(del, name)
+				}
+				continue
+			}
+			if ok && session.Unchanged(rs.codec, []byte(stored), map[interface{}]interface{}{k: v}) {
+				continue
+			}
+			b, err := rs.encodeField(k, v)
+			if err != nil {
+				rs.retouch(touched, replaced)
+				rs.lock.Unlock()
+				return err
+			}
+			set[name] = string(b)
+		}
+	}
+	written := len(set)
+	if full {
+		written-- // the marker
+	}
+	changed := replaced || written > 0 || len(del) > 0
+	rs.lock.Unlock()
+	if !changed && rs.lazy {
+		return nil
+	}
+
+	err := ctx.Err()
+	if err == nil {
+		err = run(ctx, rs.p, func(conn redis.Conn) error {
+			return rs.writeFields(conn, key, set, del, replaced, changed)
+		})
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if err != nil {
+		rs.retouch(touched, replaced)
+		return err
+	}
+	if full {
+		rs.fields = make(map[string]string, len(set))
+	}
+	for name, field := range set {
+		rs.fields[name] = field
+	}
+	for _, name := range del {
+		delete(rs.fields, name)
+	}
+	return nil
+}
+
+// retouch records again the touched keys of a release which failed, the
+// caller must hold the lock.
+func (rs *SessionStore) retouch(touched map[interface{}]bool, replaced bool) {
+	for k := range touched {
+		rs.touch(k)
+	}
+	rs.replaced = rs.replaced || replaced
+}
+
+// writeFields sets the fields set and deletes the fields del of the hash key
+// in one pipeline, after deleting the hash if its values were replaced.
+func (rs *SessionStore) writeFields(conn redis.Conn, key string, set map[string]string, del []string, replaced, changed bool) error {
+	if replaced {
+		conn.Send("DEL", key)
+	}
+	if len(set) > 0 {
+		args := []interface{}{key}
+		for name, field := range set {
+			args = append(args, name, field)
+		}
+		conn.Send("HSET", args...)
+	}
+	if len(del) > 0 {
+		args := []interface{}{key}
+		for _, name := range del {
+			args = append(args, name)
+		}
+		conn.Send("HDEL", args...)
+	}
+	conn.Send("EXPIRE", key, rs.maxLifetime)
+	if changed {
+		// INCR counts the writes of concurrent requests atomically.
+		conn.Send("INCR", key+versionSuffix)
+	}
+	conn.Send("EXPIRE", key+versionSuffix, rs.maxLifetime)
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	if changed {
+		version, err := redis.Uint64(replies[len(replies)-2], nil)
+		if err != nil {
+			return err
+		}
+		rs.lock.Lock()
+		rs.version = version
+		rs.lock.Unlock()
+	}
+	return nil
+}
+
+// getFields reads the hash fields of session sid and their version, a
+// missing session starts empty, a failed read fails.
+func (rp *Provider) getFields(c redis.Conn, sid string) (*SessionStore, error) {
+	c.Send("HGETALL", rp.prefix+sid)
+	c.Send("GET", rp.prefix+sid+versionSuffix)
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	fields, err := redis.StringMap(c.Receive())
+	if err != nil {
+		return nil, err
+	}
+	version, err := redis.Uint64(c.Receive())
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	store := rp.newStore(sid, "", version)
+	store.hash, store.fields = true, fields
+	return store, nil
+}
@@ -1,9 +1,15 @@
 package redis
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/insionng/macross"
@@ -19,22 +25,63 @@ var MaxPoolSize = 100
 type SessionStore struct {
 	p           *redis.Pool
 	sid         string
+	prefix      string
 	lock        sync.RWMutex
 	values      map[interface{}]interface{}
-	maxLifetime int64
+	raw         []byte // encoded values, decoded on first use
+	once        sync.Once
+	codec       session.Codec
+	maxLifetime int64                // already spread by the expiry jitter
+	lazy        bool                 // skip the write of unchanged sessions
+	stored      []byte               // encoded values as stored, to tell the changed releases
+	version     uint64               // writes that changed the values, as of the last read or write
+	hash        bool                 // values stored as hash fields, see Config.Hash
+	fields      map[string]string    // encoded hash fields as stored, by field name
+	touched     map[interface{}]bool // keys set or deleted since the last write
+	replaced    bool                 // all values replaced since the last write
+	decodeErr   error                // why the stored values can't be decoded, they're then not written over
+}
+
+// versionSuffix ends the key of the version counter of a session, stored next
+// to its values with the same ttl.
+const versionSuffix = ":version"
+
+// load decodes the stored values on first access,
+// so requests that never touch the session skip the decode cost.
+func (rs *SessionStore) load() {
+	rs.once.Do(func() {
+		rs.lock.Lock()
+		defer rs.lock.Unlock()
+		rs.values = make(map[interface{}]interface{})
+		if rs.hash {
+			rs.values = rs.decodeFields()
+		} else if len(rs.raw) > 0 {
+			kv, err := rs.codec.Decode(rs.raw)
+			if err != nil {
+				rs.decodeErr = err
+			} else {
+				rs.values = kv
+			}
+		}
+		rs.stored = rs.raw
+		rs.raw = nil
+	})
 }
 
 // Set value in redis session
 func (rs *SessionStore) Set(key, value interface{}) error {
+	rs.load()
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 	rs.values[key] = value
+	rs.touch(key)
 
 	return nil
 }
 
 // Get value in redis session
 func (rs *SessionStore) Get(key interface{}) interface{} {
+	rs.load()
 	rs.lock.RLock()
 	defer rs.lock.RUnlock()
 	if v, ok := rs.values[key]; ok {
@@ -45,37 +92,253 @@ func (rs *SessionStore) Get(key interface{}) interface{} {
 
 // Delete value in redis session
 func (rs *SessionStore) Delete(key interface{}) error {
+	rs.load()
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 	delete(rs.values, key)
+	rs.touch(key)
 	return nil
 }
 
 // Flush clear all values in redis session
 func (rs *SessionStore) Flush() error {
+	rs.load()
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 	rs.values = make(map[interface{}]interface{})
+	rs.replaced = true
+	return nil
+}
+
+// SetAll replaces all values of redis session
+func (rs *SessionStore) SetAll(values map[interface{}]interface{}) error {
+	rs.load()
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.values = values
+	rs.replaced = true
 	return nil
 }
 
+// GetOrSet returns the value of key, or sets it to the value of factory,
+// called under the session lock, and returns it.
+func (rs *SessionStore) GetOrSet(key interface{}, factory func() (interface{}, error)) (interface{}, error) {
+	rs.load()
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if v, ok := rs.values[key]; ok {
+		return v, nil
+	}
+	value, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	rs.values[key] = value
+	rs.touch(key)
+	return value, nil
+}
+
+// Take returns the value of key and deletes it, under the session lock.
+func (rs *SessionStore) Take(key interface{}) interface{} {
+	rs.load()
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	v := rs.values[key]
+	delete(rs.values, key)
+	rs.touch(key)
+	return v
+}
+
+// Keys returns the keys of all values in the session
+func (rs *SessionStore) Keys() []interface{} {
+	rs.load()
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	keys := make([]interface{}, 0, len(rs.values))
+	for k := range rs.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Version returns how many writes changed the values of the session.
+func (rs *SessionStore) Version() uint64 {
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	return rs.version
+}
+
 // SessionID get redis session id
 func (rs *SessionStore) ID() string {
 	return rs.sid
 }
 
 // SessionRelease save session values to redis
-func (rs *SessionStore) Release(ctx *macross.Context) (err error) {
+func (rs *SessionStore) Release(ctx *macross.Context) error {
+	return rs.ReleaseContext(context.Background(), ctx)
+}
+
+// ReleaseContext saves the session values to redis, giving up once ctx is
+// done rather than waiting on a slow server, the write may still complete.
+func (rs *SessionStore) ReleaseContext(ctx context.Context, c *macross.Context) (err error) {
+	if rs.hash {
+		return rs.releaseFields(ctx)
+	}
 	var b []byte
-	b, err = session.EncodeGob(rs.values)
+	changed := false
+	rs.lock.RLock()
+	switch {
+	case rs.decodeErr != nil:
+		rs.lock.RUnlock()
+		return rs.decodeErr
+	case rs.values == nil && rs.lazy:
+		// never accessed, so unchanged.
+		rs.lock.RUnlock()
+		return nil
+	case rs.values == nil:
+		// never accessed, write back the stored bytes to refresh the ttl.
+		b = rs.raw
+	case session.Unchanged(rs.codec, rs.stored, rs.values):
+		if rs.lazy {
+			rs.lock.RUnlock()
+			return nil
+		}
+		b = rs.stored
+	default:
+		b, err = rs.codec.Encode(rs.values)
+		changed = !session.UnchangedValues(rs.codec, rs.stored, rs.values)
+	}
+	rs.lock.RUnlock()
 	if err != nil {
 		return
 	}
-	c := rs.p.Get()
-	defer c.Close()
+	rs.lock.Lock()
+	rs.stored = b
+	rs.lock.Unlock()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	write := func(conn redis.Conn) error {
+		key := rs.prefix + rs.sid
+		// INCR counts the writes of concurrent requests atomically.
+		conn.Send("SETEX", key, rs.maxLifetime, string(b))
+		if changed {
+			conn.Send("INCR", key+versionSuffix)
+		}
+		conn.Send("EXPIRE", key+versionSuffix, rs.maxLifetime)
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+		if changed {
+			version, err := redis.Uint64(conn.Receive())
+			if err != nil {
+				return err
+			}
+			rs.lock.Lock()
+			rs.version = version
+			rs.lock.Unlock()
+		}
+		_, err := conn.Receive()
+		return err
+	}
+	return run(ctx, rs.p, write)
+}
 
-	c.Do("SETEX", rs.sid, rs.maxLifetime, string(b))
-	return
+// run runs write on a connection of p which is closed once ctx is done, so a
+// write stuck on a slow server returns ctx.Err() at once and its connection
+// leaves the pool rather than being held.
+func run(ctx context.Context, p *redis.Pool, write func(conn redis.Conn) error) error {
+	conn := p.Get()
+	defer conn.Close()
+	if ctx.Done() != nil {
+		if unbind, err := conn.Do(abortCommand, ctx); err == nil {
+			defer unbind.(func())()
+		}
+	}
+	if err := write(conn); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// abortCommand binds a context to a connection of the pool, see
+// abortableConn, it never reaches redis.
+const abortCommand = "\x00abort"
+
+var errAborted = errors.New("redis: connection closed with the context of its write")
+
+// abortableConn is a connection dialed by the provider, closed once the
+// context bound to it with abortCommand is done. The pool hides the
+// connections it returns, so the context is bound through Do.
+type abortableConn struct {
+	redis.Conn
+	netConn net.Conn
+	aborted int32
+}
+
+// dial connects to addr, see abortableConn.
+func dial(addr string) (redis.Conn, error) {
+	netConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &abortableConn{Conn: redis.NewConn(netConn, 0, 0), netConn: netConn}, nil
+}
+
+// Do binds the context of abortCommand until the returned func is called,
+// other commands are sent to redis.
+func (ac *abortableConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command != abortCommand {
+		return ac.Conn.Do(command, args...)
+	}
+	ctx := args[0].(context.Context)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&ac.aborted, 1)
+			ac.netConn.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}, nil
+}
+
+// Err reports an aborted connection broken, so the pool drops it.
+func (ac *abortableConn) Err() error {
+	if atomic.LoadInt32(&ac.aborted) == 1 {
+		return errAborted
+	}
+	return ac.Conn.Err()
+}
+
+// Config redis session provider config
+// New fields are appended, use keyed literals.
+type Config struct {
+	Addr     string `json:"addr"`
+	PoolSize int    `json:"poolSize"`
+	Password string `json:"password"`
+	DBNum    int    `json:"dbNum"`
+	Prefix   string `json:"prefix"`
+	// Codec encodes the session values, session.GobCodec by default.
+	Codec session.Codec `json:"-"`
+	// Encoding stores the encoded values as "base64" or "hex" text, see session.TextCodec.
+	Encoding string `json:"encoding"`
+	// Hash stores each session value in a field of a redis hash, encoded
+	// alone, so a release only writes the values set or deleted by its
+	// request, e.g. for large sessions changing a key per request. A value
+	// changed in place, e.g. a map, must be Set again to be written.
+	Hash bool `json:"hash"`
 }
 
 // Provider redis session provider
@@ -85,43 +348,82 @@ type Provider struct {
 	poolsize    int
 	password    string
 	dbNum       int
+	prefix      string
+	jitter      int  // expiry jitter percentage
+	lazy        bool // skip the write of unchanged sessions
+	lazyDecode  bool // decode the values on first access
+	hash        bool // values stored as hash fields
+	codec       session.Codec
 	poollist    *redis.Pool
+	regenLock   sync.Mutex // serializes Regenerate
 }
 
-// Init init redis session
-// savepath like redis server addr,pool size,password,dbnum
-// e.g. 127.0.0.1:6379,100,astaxie,0
-func (rp *Provider) Init(maxLifetime int64, savePath string) error {
-	rp.maxLifetime = maxLifetime
+// parseConfig parses savepath like redis server addr,pool size,password,dbnum,key prefix
+func parseConfig(savePath string) Config {
+	var cf Config
 	configs := strings.Split(savePath, ",")
 	if len(configs) > 0 {
-		rp.savePath = configs[0]
+		cf.Addr = configs[0]
 	}
 	if len(configs) > 1 {
-		poolsize, err := strconv.Atoi(configs[1])
-		if err != nil || poolsize <= 0 {
-			rp.poolsize = MaxPoolSize
-		} else {
-			rp.poolsize = poolsize
-		}
-	} else {
-		rp.poolsize = MaxPoolSize
+		cf.PoolSize, _ = strconv.Atoi(configs[1])
 	}
 	if len(configs) > 2 {
-		rp.password = configs[2]
+		cf.Password = configs[2]
 	}
 	if len(configs) > 3 {
-		dbnum, err := strconv.Atoi(configs[3])
-		if err != nil || dbnum < 0 {
-			rp.dbNum = 0
-		} else {
-			rp.dbNum = dbnum
-		}
+		cf.DBNum, _ = strconv.Atoi(configs[3])
+	}
+	if len(configs) > 4 {
+		cf.Prefix = configs[4]
+	}
+	return cf
+}
+
+// Init init redis session
+// savepath like redis server addr,pool size,password,dbnum,key prefix
+// e.g. 127.0.0.1:6379,100,astaxie,0,session:
+func (rp *Provider) Init(maxLifetime int64, savePath string) error {
+	return rp.InitWithConfig(maxLifetime, parseConfig(savePath))
+}
+
+// InitWithConfig init redis session with a Config.
+func (rp *Provider) InitWithConfig(maxLifetime int64, cfg interface{}) error {
+	var cf Config
+	switch v := cfg.(type) {
+	case Config:
+		cf = v
+	case *Config:
+		cf = *v
+	default:
+		return fmt.Errorf("session: redis provider does not support config %T", cfg)
+	}
+	rp.maxLifetime = maxLifetime
+	rp.savePath = cf.Addr
+	if cf.PoolSize <= 0 {
+		rp.poolsize = MaxPoolSize
 	} else {
+		rp.poolsize = cf.PoolSize
+	}
+	rp.password = cf.Password
+	if cf.DBNum < 0 {
 		rp.dbNum = 0
+	} else {
+		rp.dbNum = cf.DBNum
+	}
+	rp.prefix = cf.Prefix
+	rp.hash = cf.Hash
+	rp.codec = cf.Codec
+	if rp.codec == nil {
+		rp.codec = session.GobCodec{}
 	}
+	codec, err := session.NewTextCodec(rp.codec, cf.Encoding)
+	if err != nil {
+		return err
+	}
+	rp.codec = codec
 	rp.poollist = redis.NewPool(func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", rp.savePath)
+		c, err := dial(rp.savePath)
 		if err != nil {
 			return nil, err
 		}
@@ -142,24 +444,83 @@ func (rp *Provider) Init(maxLifetime int64, savePath string) error {
 	return rp.poollist.Get().Err()
 }
 
-// Read read redis session by sid
-func (rp *Provider) Read(sid string) (macross.RawStore, error) {
+// SetExpiryJitter spread the session expiries by ±percent% of the lifetime
+func (rp *Provider) SetExpiryJitter(percent int) {
+	rp.jitter = percent
+}
+
+// Retryable opts in to the retries of the manager for network errors.
+func (rp *Provider) Retryable(err error) bool {
+	return session.IsTransient(err)
+}
+
+// SetExpiry makes session sid expire d from now, its values and version alike.
+func (rp *Provider) SetExpiry(sid string, d time.Duration) error {
 	c := rp.poollist.Get()
 	defer c.Close()
 
-	kvs, err := redis.String(c.Do("GET", sid))
-	var kv map[interface{}]interface{}
-	if len(kvs) == 0 {
-		kv = make(map[interface{}]interface{})
-	} else {
-		kv, err = session.DecodeGob([]byte(kvs))
-		if err != nil {
-			return nil, err
+	seconds := int64(d / time.Second)
+	c.Send("EXPIRE", rp.prefix+sid, seconds)
+	c.Send("EXPIRE", rp.prefix+sid+versionSuffix, seconds)
+	_, err := c.Do("")
+	return err
+}
+
+// SetLazyRelease skips writing back the sessions left unchanged.
+func (rp *Provider) SetLazyRelease(lazy bool) {
+	rp.lazy = lazy
+}
+
+// SetLazyDecode decodes the values of the sessions on their first access.
+func (rp *Provider) SetLazyDecode(lazy bool) {
+	rp.lazyDecode = lazy
+}
+
+// newStore returns the session sid of the stored values kvs.
+func (rp *Provider) newStore(sid, kvs string, version uint64) *SessionStore {
+	return &SessionStore{p: rp.poollist, sid: sid, prefix: rp.prefix, raw: []byte(kvs), version: version, maxLifetime: rp.lifetime(sid), codec: rp.codec, lazy: rp.lazy}
+}
+
+// get reads the stored values of session sid and their version. A missing
+// session starts empty, a failed read fails rather than start it empty, as
+// its release would then overwrite the stored values.
+func (rp *Provider) get(c redis.Conn, sid string) (*SessionStore, error) {
+	if rp.hash {
+		return rp.getFields(c, sid)
+	}
+	var kvs string
+	var version uint64
+	reply, err := redis.Values(c.Do("MGET", rp.prefix+sid, rp.prefix+sid+versionSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = redis.Scan(reply, &kvs, &version); err != nil {
+		return nil, err
+	}
+	store := rp.newStore(sid, kvs, version)
+	if !rp.lazyDecode {
+		if store.load(); store.decodeErr != nil {
+			return nil, store.decodeErr
 		}
 	}
+	return store, nil
+}
 
-	rs := &SessionStore{p: rp.poollist, sid: sid, values: kv, maxLifetime: rp.maxLifetime}
-	return rs, nil
+// lifetime returns the ttl of session sid
+func (rp *Provider) lifetime(sid string) int64 {
+	return session.Jitter(rp.maxLifetime, rp.jitter, sid)
+}
+
+// Read read redis session by sid
+func (rp *Provider) Read(sid string) (macross.RawStore, error) {
+	c := rp.poollist.Get()
+	defer c.Close()
+
+	store, err := rp.get(c, sid)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
 }
 
 // Exist check redis session exist by sid
@@ -167,40 +528,56 @@ func (rp *Provider) Exist(sid string) bool {
 	c := rp.poollist.Get()
 	defer c.Close()
 
-	if existed, err := redis.Int(c.Do("EXISTS", sid)); err != nil || existed == 0 {
+	if existed, err := redis.Int(c.Do("EXISTS", rp.prefix+sid)); err != nil || existed == 0 {
 		return false
 	}
 	return true
 }
 
-// Regenerate generate new sid for redis session
+// Regenerate generate new sid for redis session.
+// The key is moved with a single RENAME, so the values are never copied nor
+// dropped half way. If oldsid is gone, expired or regenerated by a concurrent
+// request, a fresh session is started under sid instead.
 func (rp *Provider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	rp.regenLock.Lock()
+	defer rp.regenLock.Unlock()
 	c := rp.poollist.Get()
 	defer c.Close()
 
-	if existed, _ := redis.Int(c.Do("EXISTS", oldsid)); existed == 0 {
-		// oldsid doesn't exists, set the new sid directly
-		// ignore error here, since if it return error
-		// the existed value will be 0
-		c.Do("SET", sid, "", "EX", rp.maxLifetime)
-	} else {
-		c.Do("RENAME", oldsid, sid)
-		c.Do("EXPIRE", sid, rp.maxLifetime)
-	}
-
-	kvs, err := redis.String(c.Do("GET", sid))
-	var kv map[interface{}]interface{}
-	if len(kvs) == 0 {
-		kv = make(map[interface{}]interface{})
-	} else {
-		kv, err = session.DecodeGob([]byte(kvs))
-		if err != nil {
+	_, err := c.Do("RENAME", rp.prefix+oldsid, rp.prefix+sid)
+	switch {
+	case err == nil:
+		c.Do("EXPIRE", rp.prefix+sid, rp.lifetime(sid))
+		// the version follows the values, it's missing until their first change.
+		if _, err = c.Do("RENAME", rp.prefix+oldsid+versionSuffix, rp.prefix+sid+versionSuffix); err == nil {
+			c.Do("EXPIRE", rp.prefix+sid+versionSuffix, rp.lifetime(sid))
+		}
+	case isNoSuchKey(err) && rp.hash:
+		// HSETNX keeps the values of sid if a concurrent Regenerate already moved them there.
+		if _, err = c.Do("HSETNX", rp.prefix+sid, hashMarker, ""); err != nil {
+			return nil, err
+		}
+		c.Do("EXPIRE", rp.prefix+sid, rp.lifetime(sid))
+	case isNoSuchKey(err):
+		// NX keeps the values of sid if a concurrent Regenerate already moved them there.
+		if _, err = c.Do("SET", rp.prefix+sid, "", "EX", rp.lifetime(sid), "NX"); err != nil {
 			return nil, err
 		}
+	default:
+		return nil, err
+	}
+
+	store, err := rp.get(c, sid)
+	if err != nil {
+		return nil, err
 	}
+	return store, nil
+}
 
-	rs := &SessionStore{p: rp.poollist, sid: sid, values: kv, maxLifetime: rp.maxLifetime}
-	return rs, nil
+// isNoSuchKey reports the error of RENAME on a missing key.
+func isNoSuchKey(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.Contains(string(e), "no such key")
 }
 
 // Destory delete redis session by id
@@ -208,10 +585,72 @@ func (rp *Provider) Destory(sid string) error {
 	c := rp.poollist.Get()
 	defer c.Close()
 
-	c.Do("DEL", sid)
+	c.Do("DEL", rp.prefix+sid, rp.prefix+sid+versionSuffix)
 	return nil
 }
 
+// DestroyAll delete all redis sessions under the key prefix.
+// it refuses to run without a prefix, since the db may hold other keys.
+func (rp *Provider) DestroyAll() error {
+	if rp.prefix == "" {
+		return errors.New("session: redis DestroyAll needs a key prefix")
+	}
+	c := rp.poollist.Get()
+	defer c.Close()
+
+	return rp.scan(c, func(keys []interface{}) error {
+		_, err := c.Do("DEL", keys...)
+		return err
+	})
+}
+
+// SIDs returns the ids of the sessions under the key prefix, of all the keys
+// of the db without a prefix.
+func (rp *Provider) SIDs() ([]string, error) {
+	c := rp.poollist.Get()
+	defer c.Close()
+
+	var sids []string
+	err := rp.scan(c, func(keys []interface{}) error {
+		for _, key := range keys {
+			k, err := redis.String(key, nil)
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(k, versionSuffix) {
+				continue
+			}
+			sids = append(sids, strings.TrimPrefix(k, rp.prefix))
+		}
+		return nil
+	})
+	return sids, err
+}
+
+// scan calls f with the keys under the key prefix, by batches.
+// A key may be passed twice, as SCAN returns the keys added meanwhile.
+func (rp *Provider) scan(c redis.Conn, f func(keys []interface{}) error) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(c.Do("SCAN", cursor, "MATCH", rp.prefix+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		var keys []interface{}
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = f(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
 // GC Impelment method, no used.
 func (rp *Provider) GC() {
 	return
@@ -0,0 +1,726 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+	"github.com/macross-contrib/session/internal/redistest"
+	"github.com/valyala/fasthttp"
+)
+
+func TestInitWithConfig(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	err := rp.InitWithConfig(3600, Config{Addr: fr.Addr(), PoolSize: 10, Password: "secret", DBNum: 2})
+	if err != nil {
+		t.Fatal("InitWithConfig:", err)
+	}
+	if rp.savePath != fr.Addr() || rp.poolsize != 10 || rp.password != "secret" || rp.dbNum != 2 {
+		t.Fatalf("config not applied: %+v", rp)
+	}
+
+	// the json/string config must configure the provider the same way.
+	rp2 := &Provider{}
+	if err = rp2.Init(3600, fr.Addr()+",10,secret,2"); err != nil {
+		t.Fatal("Init:", err)
+	}
+	if rp2.savePath != rp.savePath || rp2.poolsize != rp.poolsize || rp2.password != rp.password || rp2.dbNum != rp.dbNum {
+		t.Fatalf("Init and InitWithConfig disagree: %+v %+v", rp, rp2)
+	}
+
+	if err = rp.InitWithConfig(3600, "not a config"); err == nil {
+		t.Fatal("unsupported config type accepted")
+	}
+}
+
+func TestManagerWithRedisConfig(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	manager, err := session.NewManagerWithConfig("redis", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, &Config{Addr: fr.Addr()})
+	if err != nil {
+		t.Fatal("NewManagerWithConfig:", err)
+	}
+	store, err := manager.Read("abcdef")
+	if err != nil {
+		t.Fatal("Read:", err)
+	}
+	store.Set("key", "value")
+	if err = store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	store, err = manager.Read("abcdef")
+	if err != nil {
+		t.Fatal("Read:", err)
+	}
+	if store.Get("key") != "value" {
+		t.Fatal("value not persisted through the configured provider")
+	}
+}
+
+func TestDestroyAll(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.Init(3600, fr.Addr()+",10,,0,session:"); err != nil {
+		t.Fatal(err)
+	}
+	c := rp.poollist.Get()
+	c.Do("SET", "other", "keep")
+	c.Close()
+
+	for _, sid := range []string{"aaaa", "bbbb"} {
+		store, _ := rp.Read(sid)
+		store.Set("k", sid)
+		store.Release(nil)
+	}
+	if !rp.Exist("aaaa") {
+		t.Fatal("session not stored")
+	}
+	if err := rp.DestroyAll(); err != nil {
+		t.Fatal("DestroyAll:", err)
+	}
+	if rp.Exist("aaaa") || rp.Exist("bbbb") {
+		t.Fatal("session survived DestroyAll")
+	}
+	c = rp.poollist.Get()
+	defer c.Close()
+	if v, _ := redis.String(c.Do("GET", "other")); v != "keep" {
+		t.Fatal("DestroyAll deleted a key outside its prefix")
+	}
+
+	rp.prefix = ""
+	if err := rp.DestroyAll(); err == nil {
+		t.Fatal("DestroyAll without a prefix must be refused")
+	}
+}
+
+func TestSIDs(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.Init(3600, fr.Addr()+",10,,0,session:"); err != nil {
+		t.Fatal(err)
+	}
+	c := rp.poollist.Get()
+	c.Do("SET", "other", "keep")
+	c.Close()
+	for _, sid := range []string{"aaaa", "bbbb"} {
+		store, _ := rp.Read(sid)
+		store.Set("k", sid)
+		store.Release(nil)
+	}
+	sids, err := rp.SIDs()
+	if err != nil {
+		t.Fatal("SIDs:", err)
+	}
+	sort.Strings(sids)
+	if len(sids) != 2 || sids[0] != "aaaa" || sids[1] != "bbbb" {
+		t.Fatalf("SIDs = %v, want the sessions under the prefix", sids)
+	}
+}
+
+func TestLazyDecode(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.Init(3600, fr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	rp.SetLazyDecode(true)
+	store, _ := rp.Read("abcdef")
+	store.Set("key", "value")
+	store.Release(nil)
+
+	store, _ = rp.Read("abcdef")
+	if store.(*SessionStore).values != nil {
+		t.Fatal("session decoded before first access")
+	}
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	store, _ = rp.Read("abcdef")
+	if store.Get("key") != "value" {
+		t.Fatal("untouched session lost its values on release")
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.Init(3600, fr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	c := rp.poollist.Get()
+	c.Do("SET", "abcdef", "not a session")
+	c.Close()
+	if _, err := rp.Read("abcdef"); err == nil {
+		t.Fatal("session which can't be decoded read")
+	}
+
+	// decoded lazily, the release fails rather than overwrite it.
+	rp.SetLazyDecode(true)
+	store, err := rp.Read("abcdef")
+	if err != nil {
+		t.Fatal("lazy Read:", err)
+	}
+	store.Set("user", "insionng")
+	if err = store.Release(nil); err == nil {
+		t.Fatal("session which can't be decoded released")
+	}
+	c = rp.poollist.Get()
+	defer c.Close()
+	if v, _ := redis.String(c.Do("GET", "abcdef")); v != "not a session" {
+		t.Fatalf("session which can't be decoded overwritten with %q", v)
+	}
+}
+
+func TestReadError(t *testing.T) {
+	rp := &Provider{}
+	if err := rp.Init(3600, "127.0.0.1:1"); err == nil {
+		t.Fatal("Init of an unreachable server succeeded")
+	}
+	// an empty session would overwrite the stored one on release.
+	if store, err := rp.Read("abcdef"); err == nil || store != nil {
+		t.Fatalf("Read of an unreachable server returned %v, %v", store, err)
+	}
+	if _, err := rp.Read("abcdef"); !rp.Retryable(err) {
+		t.Fatalf("read error %v not retryable", err)
+	}
+}
+
+func TestConcurrentRegenerate(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.Init(3600, fr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	for _, newsids := range [][2]string{{"bbbb", "cccc"}, {"dddd", "dddd"}} {
+		store, _ := rp.Read("aaaa")
+		store.Set("user", "insionng")
+		store.Release(nil)
+
+		var wg sync.WaitGroup
+		stores := make([]macross.RawStore, 2)
+		for i, sid := range newsids {
+			wg.Add(1)
+			go func(i int, sid string) {
+				defer wg.Done()
+				var err error
+				if stores[i], err = rp.Regenerate("aaaa", sid); err != nil {
+					t.Error("Regenerate:", err)
+				}
+			}(i, sid)
+		}
+		wg.Wait()
+
+		if rp.Exist("aaaa") {
+			t.Fatal("old sid survived Regenerate")
+		}
+		found := 0
+		for _, sid := range newsids {
+			store, _ := rp.Read(sid)
+			switch store.Get("user") {
+			case "insionng":
+				found++
+			case nil:
+			default:
+				t.Fatalf("session %s corrupted", sid)
+			}
+		}
+		if newsids[0] == newsids[1] {
+			found /= 2
+		}
+		if found != 1 {
+			t.Fatalf("regenerating to %v: data found in %d sessions, want 1", newsids, found)
+		}
+		for _, sid := range newsids {
+			rp.Destory(sid)
+		}
+	}
+}
+
+func TestRegenerateMissingSession(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.Init(3600, fr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	store, err := rp.Regenerate("gone", "bbbb")
+	if err != nil {
+		t.Fatal("Regenerate of a missing session:", err)
+	}
+	if len(store.(*SessionStore).Keys()) != 0 || !rp.Exist("bbbb") {
+		t.Fatal("fresh session not created")
+	}
+}
+
+func TestReleaseContextCancelled(t *testing.T) {
+	// a server accepting connections and never answering.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	pool := redis.NewPool(func() (redis.Conn, error) {
+		return dial(ln.Addr().String())
+	}, 1)
+	defer pool.Close()
+	store := &SessionStore{p: pool, sid: "aaaa", values: map[interface{}]interface{}{"user": "insionng"}, codec: session.GobCodec{}, maxLifetime: 3600}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = store.ReleaseContext(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("ReleaseContext on a stuck server returned %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("ReleaseContext returned after %v", d)
+	}
+	// the aborted write doesn't keep its connection.
+	if n := pool.ActiveCount(); n != 0 {
+		t.Fatalf("%d connections held after the aborted write", n)
+	}
+
+	fr := redistest.Start(t)
+	defer fr.Close()
+	rp := &Provider{}
+	if err = rp.InitWithConfig(3600, Config{Addr: fr.Addr()}); err != nil {
+		t.Fatal("InitWithConfig:", err)
+	}
+	raw, _ := rp.Read("bbbb")
+	raw.Set("user", "insionng")
+	cancel()
+	if err = raw.(*SessionStore).ReleaseContext(ctx, nil); err == nil {
+		t.Fatal("ReleaseContext of a cancelled context succeeded")
+	}
+	if fr.Calls("SETEX") != 0 {
+		t.Fatal("session of a cancelled context written")
+	}
+}
+
+func TestLazyRelease(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.Init(3600, fr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	rp.SetLazyRelease(true)
+	store, _ := rp.Read("abcdef")
+	store.Set("roles", []string{"admin"})
+	store.Release(nil)
+	if fr.Calls("SETEX") != 1 {
+		t.Fatal("changed session not written")
+	}
+
+	// untouched, or set back to the same values.
+	store, _ = rp.Read("abcdef")
+	store.Release(nil)
+	store, _ = rp.Read("abcdef")
+	store.Set("roles", []string{"admin"})
+	store.Set("page", 2)
+	store.Delete("page")
+	store.Release(nil)
+	if n := fr.Calls("SETEX"); n != 1 {
+		t.Fatalf("unchanged session written %d times", n-1)
+	}
+
+	store.Set("roles", []string{"admin", "editor"})
+	store.Release(nil)
+	store.Release(nil)
+	if n := fr.Calls("SETEX"); n != 2 {
+		t.Fatalf("changed session written %d times, want once", n-1)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.Init(3600, fr.Addr()+",10,,0,session:"); err != nil {
+		t.Fatal(err)
+	}
+	version := func(store macross.RawStore) uint64 {
+		return store.(*SessionStore).Version()
+	}
+	store, _ := rp.Read("aaaa")
+	if v := version(store); v != 0 {
+		t.Fatalf("new session at version %d", v)
+	}
+	store.Set("n", 1)
+	store.Release(nil)
+	if v := version(store); v != 1 {
+		t.Fatalf("version %d after a write, want 1", v)
+	}
+
+	// reads and unchanged releases keep the version.
+	store, _ = rp.Read("aaaa")
+	store.Release(nil)
+	store, _ = rp.Read("aaaa")
+	store.Set("n", 1)
+	store.Release(nil)
+	if v := version(store); v != 1 {
+		t.Fatalf("version %d after reads, want 1", v)
+	}
+
+	// concurrent writes are both counted.
+	first, _ := rp.Read("aaaa")
+	second, _ := rp.Read("aaaa")
+	first.Set("n", 2)
+	second.Set("n", 3)
+	first.Release(nil)
+	second.Release(nil)
+	if v := version(second); v != 3 {
+		t.Fatalf("version %d after concurrent writes, want 3", v)
+	}
+
+	store, _ = rp.Regenerate("aaaa", "bbbb")
+	if v := version(store); v != 3 {
+		t.Fatalf("regenerated session at version %d, want 3", v)
+	}
+	if sids, _ := rp.SIDs(); len(sids) != 1 || sids[0] != "bbbb" {
+		t.Fatalf("SIDs = %v, want the session without its version key", sids)
+	}
+	rp.Destory("bbbb")
+	if store, _ = rp.Read("bbbb"); version(store) != 0 {
+		t.Fatal("version of a destroyed session kept")
+	}
+}
+
+// decodeCounter is a GobCodec counting its decodes.
+type decodeCounter struct {
+	session.GobCodec
+	decodes int
+}
+
+func (dc *decodeCounter) Decode(data []byte) (map[interface{}]interface{}, error) {
+	dc.decodes++
+	return dc.GobCodec.Decode(data)
+}
+
+func TestExistDoesntRead(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	codec := &decodeCounter{}
+	rp := &Provider{}
+	if err := rp.InitWithConfig(3600, Config{Addr: fr.Addr(), Codec: codec}); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := rp.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+
+	gets := fr.Calls("GET") + fr.Calls("MGET")
+	if !rp.Exist("aaaa") || rp.Exist("bbbb") {
+		t.Fatal("Exist doesn't tell the released session")
+	}
+	if fr.Calls("GET")+fr.Calls("MGET") != gets || fr.Calls("EXISTS") != 2 {
+		t.Fatal("Exist read the session values rather than EXISTS")
+	}
+	if codec.decodes != 0 {
+		t.Fatalf("Exist decoded the session %d times", codec.decodes)
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.InitWithConfig(3600, Config{Addr: fr.Addr(), Prefix: "session:", Codec: session.JSONCodec{}}); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := rp.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Set("roles", []string{"admin"})
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+
+	c := rp.poollist.Get()
+	value, err := redis.Bytes(c.Do("GET", "session:aaaa"))
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(value, &fields); err != nil {
+		t.Fatalf("stored value %s is not JSON: %v", value, err)
+	}
+	if len(fields) != 2 || fields["user"] != "insionng" || !reflect.DeepEqual(fields["roles"], []interface{}{"admin"}) {
+		t.Fatalf("stored fields = %v", fields)
+	}
+
+	// a field written by another service.
+	c = rp.poollist.Get()
+	c.Do("SET", "session:aaaa", `{"user":"node","visits":3}`)
+	c.Close()
+	store, _ = rp.Read("aaaa")
+	if store.Get("user") != "node" || store.Get("visits") != 3.0 {
+		t.Fatalf("foreign fields read as %v, %v", store.Get("user"), store.Get("visits"))
+	}
+}
+
+func TestSubdomainSessions(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	config := `{"cookieName":"MacrossSessionId","gcLifetime":3600,"domain":"example.com","sameSite":"lax"}`
+	// newApp starts the app of a server of the subdomains, each with its own
+	// manager sharing the redis db.
+	newApp := func() *macross.Macross {
+		session.GlobalManager = nil
+		m := macross.New()
+		m.Use(session.Sessioner(session.Options{Provider: "redis", Config: config, ProviderConfig: Config{Addr: fr.Addr(), Prefix: "session:"}}))
+		return m
+	}
+	defer func() { session.GlobalManager = nil }()
+	request := func(m *macross.Macross, host, path string, cookie *fasthttp.Cookie) *fasthttp.RequestCtx {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI(path)
+		ctx.Request.Header.SetHost(host)
+		if cookie != nil {
+			ctx.Request.Header.SetCookie(string(cookie.Key()), string(cookie.Value()))
+		}
+		m.ServeHTTP(ctx)
+		return ctx
+	}
+	responseCookie := func(ctx *fasthttp.RequestCtx) *fasthttp.Cookie {
+		cookie := new(fasthttp.Cookie)
+		cookie.SetKey("MacrossSessionId")
+		if !ctx.Response.Header.Cookie(cookie) {
+			t.Fatal("session cookie not written")
+		}
+		return cookie
+	}
+
+	appServer := newApp()
+	appServer.Get("/login", func(c *macross.Context) error {
+		return c.Session.Set("user", "insionng")
+	})
+	cookie := responseCookie(request(appServer, "app.example.com", "/login", nil))
+	if string(cookie.Domain()) != "example.com" || cookie.SameSite() != fasthttp.CookieSameSiteLaxMode {
+		t.Fatalf("session cookie of domain %q and SameSite %v", cookie.Domain(), cookie.SameSite())
+	}
+
+	apiServer := newApp()
+	var user interface{}
+	apiServer.Get("/me", func(c *macross.Context) error {
+		user = c.Session.Get("user")
+		return nil
+	})
+	apiServer.Get("/logout", func(c *macross.Context) error {
+		return session.GlobalManager.Destory(c)
+	})
+	request(apiServer, "api.example.com", "/me", cookie)
+	if user != "insionng" {
+		t.Fatalf("login of app.example.com not seen on api.example.com, user %v", user)
+	}
+
+	// the logout deletes the cookie of the parent domain.
+	expired := responseCookie(request(apiServer, "api.example.com", "/logout", cookie))
+	if string(expired.Domain()) != "example.com" || expired.Expire().After(time.Now()) {
+		t.Fatalf("logout cookie of domain %q expiring %v", expired.Domain(), expired.Expire())
+	}
+}
+
+func TestHashDelta(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	rp := &Provider{}
+	if err := rp.InitWithConfig(3600, Config{Addr: fr.Addr(), Prefix: "session:", Hash: true}); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := rp.Read("aaaa")
+	for i := 0; i < 50; i++ {
+		store.Set("key"+strconv.Itoa(i), i)
+	}
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	if !rp.Exist("aaaa") {
+		t.Fatal("hash session doesn't exist")
+	}
+
+	// changing one key writes its field alone.
+	store, _ = rp.Read("aaaa")
+	store.Set("key7", 700)
+	hsets := fr.Calls("HSET")
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	if fr.Calls("HSET") != hsets+1 || len(fr.LastArgs("HSET")) != 3 || fr.LastArgs("HSET")[1] != "key7" {
+		t.Fatalf("HSET %v, want the field of key7 alone", fr.LastArgs("HSET"))
+	}
+
+	// deleting a key removes its field.
+	store, _ = rp.Read("aaaa")
+	store.Delete("key3")
+	store.Set(42, "int key")
+	store.Release(nil)
+	if args := fr.LastArgs("HDEL"); !reflect.DeepEqual(args, []string{"session:aaaa", "key3"}) {
+		t.Fatalf("HDEL %v, want the field of key3", args)
+	}
+
+	store, _ = rp.Read("aaaa")
+	if store.Get("key7") != 700 || store.Get("key3") != nil || store.Get("key8") != 8 || store.Get(42) != "int key" {
+		t.Fatalf("read back key7 %v, key3 %v, key8 %v, 42 %v", store.Get("key7"), store.Get("key3"), store.Get("key8"), store.Get(42))
+	}
+	if v := store.(*SessionStore).Version(); v != 3 {
+		t.Fatalf("version %d after 3 writes", v)
+	}
+
+	// an unchanged release writes no field.
+	hsets = fr.Calls("HSET")
+	store.Set("key8", 8)
+	store.Release(nil)
+	if fr.Calls("HSET") != hsets {
+		t.Fatal("unchanged value written")
+	}
+
+	// a flushed session is replaced as a whole.
+	store, _ = rp.Read("aaaa")
+	store.Flush()
+	store.Set("only", true)
+	store.Release(nil)
+	store, _ = rp.Regenerate("aaaa", "bbbb")
+	if keys := store.(*SessionStore).Keys(); len(keys) != 1 || store.Get("only") != true {
+		t.Fatalf("flushed and regenerated session holds %v", keys)
+	}
+}
+
+func TestExtendLifetime(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	session.GlobalManager = nil
+	defer func() { session.GlobalManager = nil }()
+	m := macross.New()
+	m.Use(session.Sessioner(session.Options{Provider: "redis", Config: `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, ProviderConfig: Config{Addr: fr.Addr()}}))
+	var sid string
+	m.Get("/upload", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		c.Session.Set("upload", "started")
+		return c.Session.(session.Store).ExtendLifetime(3 * time.Hour)
+	})
+	m.Get("/progress", func(c *macross.Context) error {
+		return c.Session.Set("upload", "halfway")
+	})
+	request := func(path, cookie string) *fasthttp.RequestCtx {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI(path)
+		if cookie != "" {
+			ctx.Request.Header.SetCookie("MacrossSessionId", cookie)
+		}
+		m.ServeHTTP(ctx)
+		return ctx
+	}
+	conn, err := redis.Dial("tcp", fr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ttl := func() int {
+		n, _ := redis.Int(conn.Do("TTL", sid))
+		return n
+	}
+
+	request("/upload", "")
+	if n := ttl(); n < 3*3600-60 {
+		t.Fatalf("ttl %d after ExtendLifetime, want 3h", n)
+	}
+	// a later release keeps the extension rather than the max lifetime.
+	request("/progress", sid)
+	if n := ttl(); n < 3*3600-60 {
+		t.Fatalf("ttl %d after a release, want 3h", n)
+	}
+}
+
+// money has no exported fields, so gob can't encode it.
+type money struct{ cents int64 }
+
+func init() {
+	session.RegisterConverter(money{}, session.Converter{
+		ToStore: func(v interface{}) (interface{}, error) {
+			return strconv.FormatInt(v.(money).cents, 10), nil
+		},
+		FromStore: func(stored interface{}) (interface{}, error) {
+			cents, err := strconv.ParseInt(stored.(string), 10, 64)
+			return money{cents}, err
+		},
+	})
+}
+
+func TestConverter(t *testing.T) {
+	fr := redistest.Start(t)
+	defer fr.Close()
+
+	session.GlobalManager = nil
+	defer func() { session.GlobalManager = nil }()
+	m := macross.New()
+	m.Use(session.Sessioner(session.Options{Provider: "redis", Config: `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, ProviderConfig: Config{Addr: fr.Addr()}}))
+	var sid string
+	var setErr error
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		setErr = c.Session.Set("balance", money{1234})
+		return nil
+	})
+	var balance interface{}
+	m.Get("/get", func(c *macross.Context) error {
+		balance = c.Session.Get("balance")
+		return nil
+	})
+	request := func(path, cookie string) {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI(path)
+		if cookie != "" {
+			ctx.Request.Header.SetCookie("MacrossSessionId", cookie)
+		}
+		m.ServeHTTP(ctx)
+	}
+
+	request("/set", "")
+	if setErr != nil {
+		t.Fatal("Set of a converted value:", setErr)
+	}
+	request("/get", sid)
+	if balance != (money{1234}) {
+		t.Fatalf("converted value read back as %#v", balance)
+	}
+}
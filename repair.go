@@ -0,0 +1,140 @@
+package session
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/gob"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// maxRepairCookie is the size of the largest repair cookie written, browsers
+// drop cookies over 4KB.
+const maxRepairCookie = 4000
+
+// repairState is the copy of a session kept in the repair cookie.
+type repairState struct {
+	SID       string
+	CreatedAt time.Time
+	Accessed  time.Time
+	Values    []repairValue
+}
+
+// repairValue is a session value of the repair cookie, kept in the order of
+// RepairKeys so an unchanged session encodes to the same cookie.
+type repairValue struct {
+	Key   string
+	Value interface{}
+}
+
+// encodeRepair returns the signed repair cookie value of state.
+func (manager *Manager) encodeRepair(state repairState) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	for _, v := range state.Values {
+		gob.Register(v.Value)
+	}
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		return "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(buf.Bytes())
+	return value + "." + signValue(manager.config.RepairSecret, value), nil
+}
+
+// readRepair returns the state of the repair cookie of the request, if it's
+// signed, copies session sid and that session could still be alive.
+func (manager *Manager) readRepair(ctx *macross.Context, sid string) (repairState, bool) {
+	var state repairState
+	value, err := macrossCookieCodec{}.Read(ctx, manager.config.RepairCookie)
+	if err != nil || value == "" {
+		return state, false
+	}
+	i := strings.LastIndex(value, ".")
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(signValue(manager.config.RepairSecret, value[:i]))) {
+		log.Printf("session: repair cookie with an invalid signature")
+		return state, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return state, false
+	}
+	if err = gob.NewDecoder(bytes.NewReader(b)).Decode(&state); err != nil {
+		log.Printf("session: can't decode the repair cookie: %v", err)
+		return state, false
+	}
+	if state.SID != sid {
+		return state, false
+	}
+	// a session past its lifetime or expired for idleness stays expired.
+	idle := time.Since(state.Accessed)
+	lifetime := Jitter(manager.config.MaxLifetime, manager.config.ExpiryJitter, sid)
+	if idle > time.Duration(lifetime)*time.Second {
+		return state, false
+	}
+	if timeout := manager.config.IdleTimeout; timeout > 0 && idle > time.Duration(timeout)*time.Second {
+		return state, false
+	}
+	return state, true
+}
+
+// repair rebuilds session sid the provider lost from the repair cookie of the
+// request, and reports whether it did.
+func (manager *Manager) repair(ctx *macross.Context, sid string) (macross.RawStore, bool) {
+	if manager.config.RepairCookie == "" || sid == "" {
+		return nil, false
+	}
+	state, ok := manager.readRepair(ctx, sid)
+	if !ok {
+		return nil, false
+	}
+	session, err := manager.read(RequestContext(ctx), sid)
+	if err != nil {
+		return nil, false
+	}
+	for _, v := range state.Values {
+		session.Set(v.Key, v.Value)
+	}
+	meta := getMeta(session)
+	meta.CreatedAt, meta.LastAccessed = state.CreatedAt, state.Accessed
+	setMeta(session, meta)
+	log.Printf("session: repaired session %s from its repair cookie", sid)
+	return session, true
+}
+
+// writeRepair writes the repair cookie copying the RepairKeys values of
+// session s, unless the request already sent it.
+func (manager *Manager) writeRepair(ctx *macross.Context, s macross.RawStore) {
+	if manager.config.RepairCookie == "" {
+		return
+	}
+	meta := getMeta(s)
+	state := repairState{
+		SID:       s.ID(),
+		CreatedAt: meta.CreatedAt,
+		Accessed:  meta.LastAccessed,
+	}
+	for _, key := range manager.config.RepairKeys {
+		if v := s.Get(key); v != nil {
+			state.Values = append(state.Values, repairValue{Key: key, Value: v})
+		}
+	}
+	value, err := manager.encodeRepair(state)
+	if err != nil {
+		log.Printf("session: can't encode the repair cookie of %s: %v", s.ID(), err)
+		return
+	}
+	if len(value) > maxRepairCookie {
+		log.Printf("session: repair cookie of %s is %d bytes, not written", s.ID(), len(value))
+		return
+	}
+	if sent, _ := (macrossCookieCodec{}).Read(ctx, manager.config.RepairCookie); sent == value {
+		return
+	}
+	cookie := manager.sidCookie(ctx, s.ID())
+	cookie.SetName(manager.config.RepairCookie)
+	cookie.SetValue(value)
+	setCookie(ctx, cookie)
+}
@@ -0,0 +1,117 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+func TestRepairCookie(t *testing.T) {
+	const repairCookie = "MacrossSessionRepair"
+	m := newTestApp(t, Options{
+		Provider: "memory",
+		Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,` +
+			`"repairCookie":"` + repairCookie + `","repairSecret":"Macrossrepairsecret","repairKeys":["cart"]}`,
+	})
+	var sid string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		c.Session.Set("cart", map[string]int{"apple": 2})
+		c.Session.Set("draft", "not repaired")
+		return c.Session.(Store).SetUserID("insionng")
+	})
+	var cart, draft interface{}
+	var gotSID, userID string
+	m.Get("/get", func(c *macross.Context) error {
+		gotSID, cart, draft = c.Session.ID(), c.Session.Get("cart"), c.Session.Get("draft")
+		userID = c.Session.(Store).UserID()
+		return nil
+	})
+	m.Get("/logout", func(c *macross.Context) error {
+		return GlobalManager.Destory(c)
+	})
+
+	ctx := doRequest(m, "/set", nil)
+	cookies := sessionCookies(t, ctx)
+	repair := responseCookie(ctx, repairCookie)
+	if repair == nil {
+		t.Fatal("repair cookie not written")
+	}
+	cookies[repairCookie] = string(repair.Value())
+
+	// an unchanged session doesn't write its repair cookie again.
+	if ctx = doRequest(m, "/get", cookies); responseCookie(ctx, repairCookie) != nil {
+		t.Fatal("repair cookie of an unchanged session written again")
+	}
+
+	// the provider lost the session, e.g. evicted.
+	GlobalManager.provider.Destory(sid)
+	ctx = doRequest(m, "/get", cookies)
+	if gotSID != sid || !GlobalManager.provider.Exist(sid) {
+		t.Fatalf("session %s not repaired, got %s", sid, gotSID)
+	}
+	if got, _ := cart.(map[string]int); got["apple"] != 2 {
+		t.Fatalf("cart repaired as %v", cart)
+	}
+	if draft != nil || userID != "" {
+		t.Fatalf("values not in repairKeys repaired: %v %q", draft, userID)
+	}
+	if responseCookie(ctx, testCookieName) != nil {
+		t.Fatal("repaired session got a new session cookie")
+	}
+
+	// a tampered cookie, or one of another session, starts a new session.
+	GlobalManager.provider.Destory(sid)
+	tampered := []byte(cookies[repairCookie])
+	tampered[0] ^= 1
+	for _, c := range []map[string]string{
+		{testCookieName: sid, repairCookie: string(tampered)},
+		{testCookieName: "aaaaaaaaaaaaaaaa", repairCookie: cookies[repairCookie]},
+	} {
+		doRequest(m, "/get", c)
+		if cart != nil || gotSID == sid {
+			t.Fatalf("session repaired from cookies %v", c)
+		}
+	}
+
+	// logging out deletes the repair cookie.
+	doRequest(m, "/get", cookies)
+	ctx = doRequest(m, "/logout", cookies)
+	if c := responseCookie(ctx, repairCookie); c == nil || len(c.Value()) != 0 {
+		t.Fatal("repair cookie not deleted on logout")
+	}
+
+	if _, err := NewManager("memory", `{"cookieName":"`+testCookieName+`","gcLifetime":3600,"repairCookie":"`+repairCookie+`"}`); err == nil {
+		t.Fatal("repairCookie without a repairSecret accepted")
+	}
+}
+
+func TestRepairExpiredSession(t *testing.T) {
+	const repairCookie = "MacrossSessionRepair"
+	m := newTestApp(t, Options{
+		Provider: "memory",
+		Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"maxLifetime":60,` +
+			`"repairCookie":"` + repairCookie + `","repairSecret":"Macrossrepairsecret","repairKeys":["cart"]}`,
+	})
+	var gotSID string
+	m.Get("/get", func(c *macross.Context) error {
+		gotSID = c.Session.ID()
+		return nil
+	})
+
+	// idle past maxLifetime, though within gcLifetime.
+	sid := strings.Repeat("a", 32)
+	for _, idle := range []time.Duration{30 * time.Second, 2 * time.Minute} {
+		value, err := GlobalManager.encodeRepair(repairState{SID: sid, CreatedAt: time.Now().Add(-idle), Accessed: time.Now().Add(-idle)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		GlobalManager.provider.Destory(sid)
+		doRequest(m, "/get", map[string]string{testCookieName: sid, repairCookie: value})
+		if repaired := gotSID == sid; repaired != (idle < time.Minute) {
+			t.Fatalf("session idle for %v repaired: %v", idle, repaired)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package session
+
+import (
+	"context"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// RetryableProvider is implemented by providers opting in to the retries of
+// the manager, see retryAttempts. Retryable tells the transient errors worth
+// retrying, e.g. timeouts, the others fail at once.
+type RetryableProvider interface {
+	Retryable(err error) bool
+}
+
+// IsTransient reports the network errors worth retrying: timeouts and
+// connections refused, reset or closed by the server.
+func IsTransient(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	switch e := err.(type) {
+	case *net.OpError:
+		return true
+	case net.Error:
+		return e.Timeout()
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// retryable reports whether p is a RetryableProvider retrying err. The
+// wrapping providers forward Retryable to the providers they wrap.
+func retryable(p Provider, err error) bool {
+	rp, ok := p.(RetryableProvider)
+	return ok && rp.Retryable(err)
+}
+
+// retry runs op, again on the transient errors of a RetryableProvider up to
+// retryAttempts times in all. The waits double from retryBackoff and are
+// jittered, so the clients of a failing server don't retry all at once.
+func (manager *Manager) retry(ctx context.Context, op func() error) error {
+	backoff := time.Duration(manager.config.RetryBackoff) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= manager.config.RetryAttempts || !retryable(manager.provider, err) {
+			return err
+		}
+		// wait between half and all of the backoff.
+		timer := time.NewTimer(backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)+1)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// read reads session sid from the provider, retried.
+func (manager *Manager) read(ctx context.Context, sid string) (s macross.RawStore, err error) {
+	err = manager.retry(ctx, func() error {
+		s, err = manager.provider.Read(sid)
+		return err
+	})
+	return s, err
+}
+
+// destroy destroys session sid in the provider, retried.
+func (manager *Manager) destroy(ctx context.Context, sid string) error {
+	err := manager.retry(ctx, func() error {
+		return manager.provider.Destory(sid)
+	})
+	if err == nil {
+		atomic.AddUint64(&manager.destroyed, 1)
+	}
+	return err
+}
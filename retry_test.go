@@ -0,0 +1,177 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+var errReset = errors.New("flaky: connection reset by peer")
+
+// flakyProvider fails the next calls of a method as set in failures.
+type flakyProvider struct {
+	Provider
+	lock     sync.Mutex
+	failures map[string]error // method -> error of its next calls
+	left     map[string]int   // method -> failures left
+	calls    map[string]int
+}
+
+func newFlakyProvider(p Provider) *flakyProvider {
+	return &flakyProvider{Provider: p, failures: map[string]error{}, left: map[string]int{}, calls: map[string]int{}}
+}
+
+// failNext fails the next n calls of method with err.
+func (fp *flakyProvider) failNext(method string, n int, err error) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fp.failures[method], fp.left[method] = err, n
+}
+
+func (fp *flakyProvider) call(method string) error {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fp.calls[method]++
+	if fp.left[method] == 0 {
+		return nil
+	}
+	fp.left[method]--
+	return fp.failures[method]
+}
+
+func (fp *flakyProvider) Read(sid string) (macross.RawStore, error) {
+	if err := fp.call("Read"); err != nil {
+		return nil, err
+	}
+	raw, err := fp.Provider.Read(sid)
+	return &flakyStore{raw, fp}, err
+}
+
+func (fp *flakyProvider) Destory(sid string) error {
+	if err := fp.call("Destory"); err != nil {
+		return err
+	}
+	return fp.Provider.Destory(sid)
+}
+
+func (fp *flakyProvider) Retryable(err error) bool {
+	return err == errReset
+}
+
+type flakyStore struct {
+	macross.RawStore
+	p *flakyProvider
+}
+
+func (fs *flakyStore) Release(ctx *macross.Context) error {
+	if err := fs.p.call("Release"); err != nil {
+		return err
+	}
+	return fs.RawStore.Release(ctx)
+}
+
+func TestRetry(t *testing.T) {
+	var fp *flakyProvider
+	m := newWrappedTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"retryAttempts":3,"retryBackoff":1}`},
+		func(p Provider) Provider {
+			fp = newFlakyProvider(p)
+			return fp
+		})
+	m.Get("/", func(c *macross.Context) error {
+		return c.Session.Set("user", "insionng")
+	})
+
+	// a new session whose read and release fail once.
+	fp.failNext("Read", 1, errReset)
+	fp.failNext("Release", 1, errReset)
+	ctx := doRequest(m, "/", nil)
+	if ctx.Response.StatusCode() != 200 || fp.calls["Read"] != 2 || fp.calls["Release"] != 2 {
+		t.Fatalf("status %d after %d reads and %d releases, want the failures retried",
+			ctx.Response.StatusCode(), fp.calls["Read"], fp.calls["Release"])
+	}
+	sid := string(responseCookie(ctx, testCookieName).Value())
+	if raw, err := GlobalManager.Read(sid); err != nil || raw.Get("user") != "insionng" {
+		t.Fatal("session not released by the retry")
+	}
+
+	fp.failNext("Destory", 2, errReset)
+	if err := GlobalManager.destroy(context.Background(), sid); err != nil || fp.calls["Destory"] != 3 {
+		t.Fatalf("destroy: %v after %d calls", err, fp.calls["Destory"])
+	}
+
+	// attempts run out, and other errors fail at once.
+	fp.failNext("Read", 3, errReset)
+	if _, err := GlobalManager.Read(sid); err != errReset {
+		t.Fatalf("read after 3 failures: %v", err)
+	}
+	fatal := errors.New("flaky: access denied")
+	fp.failNext("Read", 1, fatal)
+	reads := fp.calls["Read"]
+	if _, err := GlobalManager.Read(sid); err != fatal || fp.calls["Read"] != reads+1 {
+		t.Fatalf("non retryable error retried: %v", err)
+	}
+}
+
+func TestReleaseError(t *testing.T) {
+	var fp *flakyProvider
+	m := newWrappedTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`},
+		func(p Provider) Provider {
+			fp = newFlakyProvider(p)
+			return fp
+		})
+	m.Get("/", func(c *macross.Context) error {
+		return c.Session.Set("user", "insionng")
+	})
+
+	fp.failNext("Release", 1, errors.New("flaky: disk full"))
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	ctx := doRequest(m, "/", nil)
+	log.SetOutput(os.Stderr)
+	if ctx.Response.StatusCode() == 200 {
+		t.Fatal("failed release not returned by the middleware")
+	}
+	if !strings.Contains(buf.String(), "flaky: disk full") {
+		t.Fatalf("failed release not logged: %q", buf.String())
+	}
+}
+
+func TestRetryWrappedProvider(t *testing.T) {
+	fp := newFlakyProvider(mempder)
+	for _, p := range []Provider{
+		NewCacheProvider(fp, 10, time.Minute),
+		NewCoalescingProvider(fp, time.Minute),
+		NewMigratingProvider(fp, mempder, time.Now().Add(time.Minute)),
+		NewMirrorProvider(fp, mempder),
+		NewReplicaProvider(fp, mempder),
+	} {
+		manager, err := NewManager("memory", `{"cookieName":"`+testCookieName+`","gcLifetime":3600,"retryAttempts":3,"retryBackoff":1}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.provider = p
+		fp.failNext("Destory", 2, errReset)
+		if err = manager.destroy(context.Background(), "0123456789abcdef"); err != nil {
+			t.Fatalf("%T: transient error of the wrapped provider not retried: %v", p, err)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	_, err := net.Dial("tcp", "127.0.0.1:1")
+	if !IsTransient(err) {
+		t.Fatalf("refused connection not transient: %v", err)
+	}
+	if IsTransient(errors.New("access denied")) || IsTransient(nil) {
+		t.Fatal("plain error transient")
+	}
+}
@@ -0,0 +1,477 @@
+// Package s3 provides a session provider storing the sessions in S3
+// compatible object storage (aws s3, minio, ceph...), for archival or
+// long-lived sessions read now and then.
+//
+// Each session is an object keyed by prefix+sid, its expiry carried in the
+// x-amz-meta-expires object metadata. Expired sessions are never served and
+// are deleted by the gc sweep, a bucket lifecycle rule expiring the prefix
+// after the session lifetime does the same without listing the bucket.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insionng/macross"
+	"github.com/macross-contrib/session"
+)
+
+var s3pder = &Provider{}
+
+const expiresHeader = "X-Amz-Meta-Expires"
+
+// SessionStore s3 session store
+type SessionStore struct {
+	p           *Provider
+	sid         string
+	lock        sync.RWMutex
+	values      map[interface{}]interface{}
+	maxLifetime int64  // already spread by the expiry jitter
+	lazy        bool   // skip the write of unchanged sessions
+	stored      []byte // encoded values as read, compared by lazy releases
+}
+
+// Set value in s3 session
+func (ss *SessionStore) Set(key, value interface{}) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.values[key] = value
+	return nil
+}
+
+// Get value in s3 session
+func (ss *SessionStore) Get(key interface{}) interface{} {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	if v, ok := ss.values[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// Delete value in s3 session
+func (ss *SessionStore) Delete(key interface{}) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	delete(ss.values, key)
+	return nil
+}
+
+// Flush clear all values in s3 session
+func (ss *SessionStore) Flush() error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.values = make(map[interface{}]interface{})
+	return nil
+}
+
+// SetAll replaces all values of s3 session
+func (ss *SessionStore) SetAll(values map[interface{}]interface{}) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.values = values
+	return nil
+}
+
+// Keys returns the keys of all values in the session
+func (ss *SessionStore) Keys() []interface{} {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	keys := make([]interface{}, 0, len(ss.values))
+	for k := range ss.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ID get s3 session id
+func (ss *SessionStore) ID() string {
+	return ss.sid
+}
+
+// Release save session values to its object
+func (ss *SessionStore) Release(ctx *macross.Context) error {
+	return ss.ReleaseContext(context.Background(), ctx)
+}
+
+// ReleaseContext saves the session values to its object, the request is
+// cancelled once ctx is done.
+func (ss *SessionStore) ReleaseContext(ctx context.Context, c *macross.Context) error {
+	ss.lock.RLock()
+	if ss.lazy && session.Unchanged(ss.p.codec, ss.stored, ss.values) {
+		ss.lock.RUnlock()
+		return nil
+	}
+	b, err := ss.p.codec.Encode(ss.values)
+	ss.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if ss.lazy {
+		ss.lock.Lock()
+		ss.stored = b
+		ss.lock.Unlock()
+	}
+	return ss.p.put(ctx, ss.sid, b, ss.maxLifetime)
+}
+
+// Config s3 session provider config
+type Config struct {
+	// Endpoint is the url of the storage, https://s3.<region>.amazonaws.com by default,
+	// e.g. http://127.0.0.1:9000 for a local minio. Buckets are addressed path style.
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	// Prefix is prepended to the sids to make the object keys, e.g. "sessions/".
+	Prefix string `json:"prefix"`
+	// Codec encodes the session values, session.GobCodec by default.
+	Codec session.Codec `json:"-"`
+	// Encoding stores the encoded values as "base64" or "hex" text, see session.TextCodec.
+	Encoding string `json:"encoding"`
+	// Client sends the requests, http.DefaultClient by default.
+	Client *http.Client `json:"-"`
+}
+
+// Provider s3 session provider
+type Provider struct {
+	maxLifetime int64
+	config      Config
+	jitter      int   // expiry jitter percentage
+	skew        int64 // tolerated clock skew in seconds
+	lazy        bool  // skip the write of unchanged sessions
+	codec       session.Codec
+	client      *http.Client
+	now         func() time.Time
+}
+
+// Init init s3 session with a json Config, e.g.
+// {"endpoint":"http://127.0.0.1:9000","region":"us-east-1","bucket":"sessions","accessKey":"...","secretKey":"..."}
+func (sp *Provider) Init(maxLifetime int64, config string) error {
+	var cf Config
+	if err := json.Unmarshal([]byte(config), &cf); err != nil {
+		return fmt.Errorf("session: s3 config: %v", err)
+	}
+	return sp.InitWithConfig(maxLifetime, cf)
+}
+
+// InitWithConfig init s3 session with a Config.
+func (sp *Provider) InitWithConfig(maxLifetime int64, cfg interface{}) error {
+	var cf Config
+	switch v := cfg.(type) {
+	case Config:
+		cf = v
+	case *Config:
+		cf = *v
+	default:
+		return fmt.Errorf("session: s3 provider does not support config %T", cfg)
+	}
+	if cf.Bucket == "" {
+		return errors.New("session: s3 bucket is empty")
+	}
+	if cf.Region == "" {
+		cf.Region = "us-east-1"
+	}
+	if cf.Endpoint == "" {
+		cf.Endpoint = "https://s3." + cf.Region + ".amazonaws.com"
+	}
+	cf.Endpoint = strings.TrimSuffix(cf.Endpoint, "/")
+	codec := cf.Codec
+	if codec == nil {
+		codec = session.GobCodec{}
+	}
+	codec, err := session.NewTextCodec(codec, cf.Encoding)
+	if err != nil {
+		return err
+	}
+	sp.maxLifetime = maxLifetime
+	sp.config = cf
+	sp.codec = codec
+	sp.client = cf.Client
+	if sp.client == nil {
+		sp.client = http.DefaultClient
+	}
+	sp.now = time.Now
+	return nil
+}
+
+// SetExpiryJitter spread the session expiries by ±percent% of the lifetime
+func (sp *Provider) SetExpiryJitter(percent int) {
+	sp.jitter = percent
+}
+
+// Retryable opts in to the retries of the manager for network errors.
+func (sp *Provider) Retryable(err error) bool {
+	return session.IsTransient(err)
+}
+
+// SetLazyRelease skips writing back the sessions left unchanged.
+func (sp *Provider) SetLazyRelease(lazy bool) {
+	sp.lazy = lazy
+}
+
+// SetClockSkew keeps sessions seconds longer, as the expiries are written
+// with the clock of the servers and the modification times with the storage one.
+func (sp *Provider) SetClockSkew(seconds int64) {
+	sp.skew = seconds
+}
+
+// do sends a signed request on the object key, or on the bucket when key is empty.
+func (sp *Provider) do(method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	return sp.doContext(context.Background(), method, key, query, body, header)
+}
+
+// doContext is do with the request cancelled once ctx is done.
+func (sp *Provider) doContext(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(sp.config.Endpoint + "/" + sp.config.Bucket + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if sp.config.AccessKey != "" {
+		payloadHash := emptyPayloadSHA
+		if len(body) > 0 {
+			payloadHash = sha256Hex(body)
+		}
+		sign(req, sp.config.AccessKey, sp.config.SecretKey, sp.config.Region, payloadHash, sp.now())
+	}
+	return sp.client.Do(req)
+}
+
+func statusError(method, key string, resp *http.Response) error {
+	return fmt.Errorf("session: s3 %s %q: %s", method, key, resp.Status)
+}
+
+// expired reports an object past the expiry of its metadata,
+// written with the clock of another server maybe, and the clock skew.
+func (sp *Provider) expired(header http.Header) bool {
+	expires, err := strconv.ParseInt(header.Get(expiresHeader), 10, 64)
+	return err == nil && sp.now().Unix() >= expires+sp.skew
+}
+
+// get returns the content of the session object, nil if it doesn't exist or expired.
+func (sp *Provider) get(sid string) ([]byte, error) {
+	key := sp.config.Prefix + sid
+	resp, err := sp.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode/100 != 2:
+		return nil, statusError("GET", key, resp)
+	case sp.expired(resp.Header):
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if b == nil {
+		b = []byte{}
+	}
+	return b, err
+}
+
+func (sp *Provider) put(ctx context.Context, sid string, b []byte, lifetime int64) error {
+	key := sp.config.Prefix + sid
+	header := http.Header{}
+	header.Set(expiresHeader, strconv.FormatInt(sp.now().Unix()+lifetime, 10))
+	resp, err := sp.doContext(ctx, "PUT", key, nil, b, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return statusError("PUT", key, resp)
+	}
+	return nil
+}
+
+func (sp *Provider) delete(key string) error {
+	resp, err := sp.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return statusError("DELETE", key, resp)
+	}
+	return nil
+}
+
+func (sp *Provider) newStore(sid string, b []byte) *SessionStore {
+	values := make(map[interface{}]interface{})
+	if len(b) > 0 {
+		kv, err := sp.codec.Decode(b)
+		if err != nil {
+			log.Printf("session: can't decode s3 session %s: %v", sid, err)
+		} else {
+			values = kv
+		}
+	}
+	return &SessionStore{p: sp, sid: sid, values: values, maxLifetime: session.Jitter(sp.maxLifetime, sp.jitter, sid), lazy: sp.lazy, stored: b}
+}
+
+// Read read s3 session by sid
+func (sp *Provider) Read(sid string) (macross.RawStore, error) {
+	b, err := sp.get(sid)
+	if err != nil {
+		return nil, err
+	}
+	return sp.newStore(sid, b), nil
+}
+
+// Exist check s3 session exist by sid
+func (sp *Provider) Exist(sid string) bool {
+	key := sp.config.Prefix + sid
+	resp, err := sp.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode/100 == 2 && !sp.expired(resp.Header)
+}
+
+// Regenerate copies the session object to the new sid and deletes the old one,
+// a missing old session starts a fresh one.
+func (sp *Provider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	b, err := sp.get(oldsid)
+	if err != nil {
+		return nil, err
+	}
+	store := sp.newStore(sid, b)
+	if b == nil {
+		return store, nil
+	}
+	if err = sp.put(context.Background(), sid, b, store.maxLifetime); err != nil {
+		return nil, err
+	}
+	if err = sp.delete(sp.config.Prefix + oldsid); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Destory delete s3 session by id
+func (sp *Provider) Destory(sid string) error {
+	return sp.delete(sp.config.Prefix + sid)
+}
+
+// listResult is the response of ListObjectsV2.
+type listResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+	}
+}
+
+// walk calls f with the key and last modification of each session object.
+func (sp *Provider) walk(f func(key string, modified time.Time) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {sp.config.Prefix}}
+	for {
+		resp, err := sp.do("GET", "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result listResult
+		if resp.StatusCode/100 != 2 {
+			err = statusError("GET", "", resp)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			if err = f(object.Key, object.LastModified); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// expiredSince reports an object unmodified for longer than the session lifetime,
+// the listing doesn't carry the metadata so the expiry jitter isn't applied.
+func (sp *Provider) expiredSince(modified time.Time) bool {
+	return modified.Unix()+sp.maxLifetime+sp.skew < sp.now().Unix()
+}
+
+// GC deletes the expired session objects.
+func (sp *Provider) GC() {
+	if _, err := sp.Sweep(); err != nil {
+		log.Printf("session: s3 gc: %v", err)
+	}
+}
+
+// Sweep deletes the expired session objects and returns how many.
+func (sp *Provider) Sweep() (removed int, err error) {
+	err = sp.walk(func(key string, modified time.Time) error {
+		if !sp.expiredSince(modified) {
+			return nil
+		}
+		if err := sp.delete(key); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// Count returns the number of unexpired sessions, listing the whole prefix.
+func (sp *Provider) Count() int {
+	n := 0
+	err := sp.walk(func(key string, modified time.Time) error {
+		if !sp.expiredSince(modified) {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("session: s3 count: %v", err)
+	}
+	return n
+}
+
+// DestroyAll delete all session objects under the key prefix.
+// it refuses to run without a prefix, since the bucket may hold other objects.
+func (sp *Provider) DestroyAll() error {
+	if sp.config.Prefix == "" {
+		return errors.New("session: s3 DestroyAll needs a key prefix")
+	}
+	return sp.walk(func(key string, modified time.Time) error {
+		return sp.delete(key)
+	})
+}
+
+func init() {
+	session.Register("s3", s3pder)
+}
@@ -0,0 +1,269 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// asyncQueueSize is how many session writes wait for the workers of an
+// AsyncProvider, releases write at once while the queue is full.
+const asyncQueueSize = 1024
+
+// asyncWrite is the write of a session queued by AsyncProvider.
+type asyncWrite struct {
+	lock   sync.Mutex       // held while writing
+	store  macross.RawStore // of the last release
+	dirty  bool             // store released since the last write
+	queued bool             // sid in the queue
+}
+
+// AsyncProvider writes the sessions in background workers: Release queues the
+// write and returns at once, trading the writes lost on a crash for latency.
+// Until it's written a session is read from memory, so the next request sees
+// its values, and the writes of a session keep their order.
+// The writes are released without a request, so the providers writing cookies
+// (cookie, jwt) can't be wrapped.
+type AsyncProvider struct {
+	Provider
+	lock     sync.Mutex
+	inflight map[string]*asyncWrite
+	queue    chan string
+}
+
+// NewAsyncProvider wraps p, writing the released sessions in workers goroutines.
+func NewAsyncProvider(p Provider, workers int) *AsyncProvider {
+	ap := &AsyncProvider{
+		Provider: p,
+		inflight: make(map[string]*asyncWrite),
+		queue:    make(chan string, asyncQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for sid := range ap.queue {
+				if err := ap.write(sid); err != nil {
+					log.Printf("session: async write of a session: %v", err)
+				}
+			}
+		}()
+	}
+	return ap
+}
+
+// asyncStore queues its Release to the AsyncProvider.
+type asyncStore struct {
+	wrappedStore
+	ap  *AsyncProvider
+	sid string
+}
+
+// Release queues the write of the session.
+func (as *asyncStore) Release(c *macross.Context) error {
+	return as.ap.enqueue(as.sid, as.RawStore)
+}
+
+// ReleaseContext queues the write of the session, it's never aborted.
+func (as *asyncStore) ReleaseContext(ctx context.Context, c *macross.Context) error {
+	return as.Release(c)
+}
+
+// enqueue records store as the values of session sid to write, and queues
+// the write unless it's already queued.
+func (ap *AsyncProvider) enqueue(sid string, store macross.RawStore) error {
+	ap.lock.Lock()
+	w, ok := ap.inflight[sid]
+	if !ok {
+		w = &asyncWrite{}
+		ap.inflight[sid] = w
+	}
+	// the last release wins, as when every release is written.
+	w.store, w.dirty = store, true
+	if w.queued {
+		ap.lock.Unlock()
+		return nil
+	}
+	w.queued = true
+	ap.lock.Unlock()
+	select {
+	case ap.queue <- sid:
+		return nil
+	default:
+		// the workers are behind, write in the request.
+		return ap.write(sid)
+	}
+}
+
+// write writes the session sid if it was released since its last write.
+func (ap *AsyncProvider) write(sid string) error {
+	ap.lock.Lock()
+	w, ok := ap.inflight[sid]
+	if !ok {
+		ap.lock.Unlock()
+		return nil
+	}
+	w.queued = false
+	ap.lock.Unlock()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ap.lock.Lock()
+	store, dirty := w.store, w.dirty
+	w.dirty = false
+	ap.lock.Unlock()
+	var err error
+	if dirty {
+		err = store.Release(nil)
+	}
+	ap.lock.Lock()
+	if !w.dirty && ap.inflight[sid] == w {
+		delete(ap.inflight, sid)
+	}
+	ap.lock.Unlock()
+	return err
+}
+
+// drop forgets the write of sid, once a write in progress is done.
+func (ap *AsyncProvider) drop(sid string) {
+	ap.lock.Lock()
+	w, ok := ap.inflight[sid]
+	if ok {
+		// a worker holding w mustn't write it.
+		w.dirty = false
+		delete(ap.inflight, sid)
+	}
+	ap.lock.Unlock()
+	if ok {
+		w.lock.Lock()
+		w.lock.Unlock()
+	}
+}
+
+// FlushWrites writes the queued writes now.
+func (ap *AsyncProvider) FlushWrites() error {
+	ap.lock.Lock()
+	sids := make([]string, 0, len(ap.inflight))
+	for sid := range ap.inflight {
+		sids = append(sids, sid)
+	}
+	ap.lock.Unlock()
+	var first error
+	for _, sid := range sids {
+		if err := ap.write(sid); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Read returns the store of a session not written yet, or reads it from the
+// backend.
+func (ap *AsyncProvider) Read(sid string) (macross.RawStore, error) {
+	ap.lock.Lock()
+	w, ok := ap.inflight[sid]
+	ap.lock.Unlock()
+	if ok {
+		return &asyncStore{wrappedStore: wrappedStore{w.store}, ap: ap, sid: sid}, nil
+	}
+	store, err := ap.Provider.Read(sid)
+	if err != nil {
+		return nil, err
+	}
+	return &asyncStore{wrappedStore: wrappedStore{store}, ap: ap, sid: sid}, nil
+}
+
+// Exist reports a session not written yet without asking the backend.
+func (ap *AsyncProvider) Exist(sid string) bool {
+	ap.lock.Lock()
+	_, ok := ap.inflight[sid]
+	ap.lock.Unlock()
+	return ok || ap.Provider.Exist(sid)
+}
+
+// Regenerate writes oldsid first, so the backend moves its latest values to sid.
+func (ap *AsyncProvider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	if err := ap.write(oldsid); err != nil {
+		return nil, err
+	}
+	ap.drop(oldsid)
+	ap.drop(sid)
+	store, err := ap.Provider.Regenerate(oldsid, sid)
+	if err != nil {
+		return nil, err
+	}
+	return &asyncStore{wrappedStore: wrappedStore{store}, ap: ap, sid: sid}, nil
+}
+
+// Destory cancels the queued write of the session and destroys it in the backend.
+func (ap *AsyncProvider) Destory(sid string) error {
+	ap.drop(sid)
+	return ap.Provider.Destory(sid)
+}
+
+// DestroyAll cancels the queued writes and deletes all sessions of the backend.
+func (ap *AsyncProvider) DestroyAll() error {
+	p, ok := ap.Provider.(DestroyAllProvider)
+	if !ok {
+		return fmt.Errorf("session: provider %T does not support DestroyAll", ap.Provider)
+	}
+	ap.lock.Lock()
+	sids := make([]string, 0, len(ap.inflight))
+	for sid := range ap.inflight {
+		sids = append(sids, sid)
+	}
+	ap.lock.Unlock()
+	for _, sid := range sids {
+		ap.drop(sid)
+	}
+	return p.DestroyAll()
+}
+
+// SetExpiry writes the queued write of the session, which would refresh its
+// Retryable forwards to the wrapped provider.
+func (ap *AsyncProvider) Retryable(err error) bool {
+	return retryable(ap.Provider, err)
+}
+
+// lifetime, and extends its lifetime in the backend.
+func (ap *AsyncProvider) SetExpiry(sid string, d time.Duration) error {
+	if err := ap.write(sid); err != nil {
+		return err
+	}
+	return setExpiry(ap.Provider, sid, d)
+}
+
+// SIDs returns the sessions of the backend and those not written yet.
+func (ap *AsyncProvider) SIDs() ([]string, error) {
+	sids, err := listSIDs(ap.Provider)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool, len(sids))
+	for _, sid := range sids {
+		listed[sid] = true
+	}
+	ap.lock.Lock()
+	defer ap.lock.Unlock()
+	for sid := range ap.inflight {
+		if !listed[sid] {
+			sids = append(sids, sid)
+		}
+	}
+	return sids, nil
+}
+
+// GC runs the backend gc.
+func (ap *AsyncProvider) GC() {
+	if _, err := ap.Sweep(); err != nil {
+		log.Printf("session: gc: %v", err)
+	}
+}
+
+// Sweep returns how many sessions the backend gc removed, counted if the
+// backend is a SweepProvider.
+func (ap *AsyncProvider) Sweep() (int, error) {
+	return sweep(ap.Provider)
+}
@@ -0,0 +1,131 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newAsyncFileProvider(t *testing.T, workers int) (*AsyncProvider, *writeCounter, func()) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = filepder.Init(3600, dir); err != nil {
+		t.Fatal(err)
+	}
+	backend := &writeCounter{Provider: filepder, gate: make(chan struct{})}
+	return NewAsyncProvider(backend, workers), backend, func() { os.RemoveAll(dir) }
+}
+
+func TestAsyncProviderReadBeforeWrite(t *testing.T) {
+	ap, backend, cleanup := newAsyncFileProvider(t, 2)
+	defer cleanup()
+
+	store, _ := ap.Read("aaaa")
+	store.Set("user", "insionng")
+	released := make(chan error)
+	go func() { released <- store.Release(nil) }()
+	select {
+	case err := <-released:
+		if err != nil {
+			t.Fatal("Release:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Release waited for the write")
+	}
+
+	// the write waits for the gate, the session is read from memory meanwhile.
+	if !ap.Exist("aaaa") {
+		t.Fatal("session being written doesn't exist")
+	}
+	store, _ = ap.Read("aaaa")
+	if store.Get("user") != "insionng" {
+		t.Fatal("value not read back before its write")
+	}
+	store.Set("user", "ng")
+	store.Release(nil)
+
+	close(backend.gate)
+	if err := ap.FlushWrites(); err != nil {
+		t.Fatal("FlushWrites:", err)
+	}
+	if fresh, _ := filepder.Read("aaaa"); fresh.Get("user") != "ng" {
+		t.Fatalf("backend holds %v, want the last release", fresh.Get("user"))
+	}
+	if n := atomic.LoadInt32(&backend.writes); n < 1 || n > 2 {
+		t.Fatalf("%d writes of 2 releases", n)
+	}
+}
+
+// listedWriteCounter is a writeCounter listing the sessions of its provider.
+type listedWriteCounter struct {
+	*writeCounter
+}
+
+func (lw listedWriteCounter) SIDs() ([]string, error) {
+	return listSIDs(lw.Provider)
+}
+
+func TestAsyncProviderSIDs(t *testing.T) {
+	_, backend, cleanup := newAsyncFileProvider(t, 1)
+	defer cleanup()
+	ap := NewAsyncProvider(listedWriteCounter{backend}, 1)
+
+	stored, _ := filepder.Read("aaaa")
+	stored.Set("user", "insionng")
+	stored.Release(nil)
+	// the writes wait for the gate.
+	for _, sid := range []string{"aaaa", "bbbb"} {
+		store, _ := ap.Read(sid)
+		store.Set("user", "ng")
+		store.Release(nil)
+	}
+	sids, err := ap.SIDs()
+	if err != nil {
+		t.Fatal("SIDs:", err)
+	}
+	sort.Strings(sids)
+	if !reflect.DeepEqual(sids, []string{"aaaa", "bbbb"}) {
+		t.Fatalf("SIDs = %v, want each session once", sids)
+	}
+	close(backend.gate)
+	if err = ap.FlushWrites(); err != nil {
+		t.Fatal("FlushWrites:", err)
+	}
+}
+
+func TestAsyncProviderEventualWrite(t *testing.T) {
+	ap, backend, cleanup := newAsyncFileProvider(t, 4)
+	defer cleanup()
+	close(backend.gate)
+
+	sids := []string{"aaaa", "bbbb", "cccc"}
+	for _, sid := range sids {
+		store, _ := ap.Read(sid)
+		store.Set("user", sid)
+		store.Release(nil)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&backend.writes) < int32(len(sids)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for _, sid := range sids {
+		if fresh, _ := filepder.Read(sid); fresh.Get("user") != sid {
+			t.Fatalf("session %s not written by the workers", sid)
+		}
+	}
+
+	// a destroyed session isn't written again.
+	store, _ := ap.Read("aaaa")
+	store.Release(nil)
+	ap.Destory("aaaa")
+	ap.FlushWrites()
+	if filepder.Exist("aaaa") {
+		t.Fatal("queued write of a destroyed session written")
+	}
+}
@@ -0,0 +1,265 @@
+package session
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// cacheEntry is a session kept by CacheProvider: its values, copied for each
+// request, and the backend store they're written through.
+type cacheEntry struct {
+	sid     string
+	lock    sync.Mutex                  // serializes the writes through store
+	store   macross.RawStore            // backend store of the session
+	values  map[interface{}]interface{} // as of the last read or write
+	expires time.Time
+}
+
+// cachedStore is the copy of a cached session served to one request, so
+// concurrent requests don't share their changes before they're written.
+type cachedStore struct {
+	wrappedStore
+	cp    *CacheProvider
+	entry *cacheEntry
+}
+
+// Release writes the values of the request through the backend store.
+func (cs *cachedStore) Release(c *macross.Context) error {
+	return cs.ReleaseContext(context.Background(), c)
+}
+
+// ReleaseContext is Release aborted once ctx is done, see ContextReleaser.
+func (cs *cachedStore) ReleaseContext(ctx context.Context, c *macross.Context) error {
+	values := make(map[interface{}]interface{})
+	for _, key := range cs.Keys() {
+		values[key] = deepCopy(cs.Get(key))
+	}
+	entry := cs.entry
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+	err := setAll(entry.store, values)
+	if err == nil {
+		err = ReleaseContext(ctx, c, entry.store)
+	}
+	if err != nil {
+		// the backend store may be half written, read it again.
+		cs.cp.invalidate(entry.sid)
+		return err
+	}
+	entry.values = values
+	return nil
+}
+
+// Version returns how many writes changed the values of the backend store.
+func (cs *cachedStore) Version() uint64 {
+	cs.entry.lock.Lock()
+	defer cs.entry.lock.Unlock()
+	if v, ok := cs.entry.store.(versioner); ok {
+		return v.Version()
+	}
+	return 0
+}
+
+// CacheProvider is a read-through LRU cache in front of a slow provider (file, sql...),
+// hot sessions are served from memory without a backend read.
+// Each request gets a copy of the cached values, written through to the backend
+// on Release, and Destory/Regenerate invalidate them. Other processes sharing the backend may see a session up to
+// the cache ttl late, keep the ttl short when several instances serve the same users.
+type CacheProvider struct {
+	Provider
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	list    *list.List // most recently used in front
+	entries map[string]*list.Element
+}
+
+// NewCacheProvider wraps p with a cache of at most size sessions,
+// each kept for ttl after it was read from p.
+func NewCacheProvider(p Provider, size int, ttl time.Duration) *CacheProvider {
+	return &CacheProvider{
+		Provider: p,
+		size:     size,
+		ttl:      ttl,
+		list:     list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the cache entry of sid, nil if it isn't cached or expired.
+func (cp *CacheProvider) get(sid string) *cacheEntry {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	element, ok := cp.entries[sid]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cp.remove(element)
+		return nil
+	}
+	cp.list.MoveToFront(element)
+	return entry
+}
+
+// copy returns a store of its own holding the values of entry, for one request.
+func (cp *CacheProvider) copy(entry *cacheEntry) macross.RawStore {
+	entry.lock.Lock()
+	values := make(map[interface{}]interface{}, len(entry.values))
+	for key, value := range entry.values {
+		values[key] = deepCopy(value)
+	}
+	entry.lock.Unlock()
+	mem := &MemSessionStore{sid: entry.sid, timeAccessed: time.Now(), value: values}
+	return &cachedStore{wrappedStore: wrappedStore{mem}, cp: cp, entry: entry}
+}
+
+// put caches store, read from the backend, and returns the copy of it for
+// the request. A store not listing its keys isn't cached.
+func (cp *CacheProvider) put(sid string, store macross.RawStore) macross.RawStore {
+	k, ok := store.(keyer)
+	if !ok {
+		return store
+	}
+	values := make(map[interface{}]interface{})
+	for _, key := range k.Keys() {
+		values[key] = deepCopy(store.Get(key))
+	}
+	entry := &cacheEntry{sid: sid, store: store, values: values, expires: time.Now().Add(cp.ttl)}
+	cp.insert(entry)
+	return cp.copy(entry)
+}
+
+// insert caches entry, evicting the least recently used entries over size.
+func (cp *CacheProvider) insert(entry *cacheEntry) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	sid := entry.sid
+	if element, ok := cp.entries[sid]; ok {
+		element.Value = entry
+		cp.list.MoveToFront(element)
+		return
+	}
+	cp.entries[sid] = cp.list.PushFront(entry)
+	for cp.list.Len() > cp.size {
+		cp.remove(cp.list.Back())
+	}
+}
+
+func (cp *CacheProvider) invalidate(sids ...string) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for _, sid := range sids {
+		if element, ok := cp.entries[sid]; ok {
+			cp.remove(element)
+		}
+	}
+}
+
+// remove drops element, the caller must hold the lock.
+func (cp *CacheProvider) remove(element *list.Element) {
+	cp.list.Remove(element)
+	delete(cp.entries, element.Value.(*cacheEntry).sid)
+}
+
+// Read returns the cached store of sid, or reads it from the backend.
+func (cp *CacheProvider) Read(sid string) (macross.RawStore, error) {
+	if entry := cp.get(sid); entry != nil {
+		return cp.copy(entry), nil
+	}
+	store, err := cp.Provider.Read(sid)
+	if err != nil {
+		return nil, err
+	}
+	return cp.put(sid, store), nil
+}
+
+// Exist reports a cached session without asking the backend.
+func (cp *CacheProvider) Exist(sid string) bool {
+	if cp.get(sid) != nil {
+		return true
+	}
+	return cp.Provider.Exist(sid)
+}
+
+// Regenerate drops both sids from the cache and caches the regenerated store.
+func (cp *CacheProvider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	cp.invalidate(oldsid, sid)
+	store, err := cp.Provider.Regenerate(oldsid, sid)
+	if err != nil {
+		return nil, err
+	}
+	return cp.put(sid, store), nil
+}
+
+// Destory drops the session from the cache and the backend.
+func (cp *CacheProvider) Destory(sid string) error {
+	cp.invalidate(sid)
+	return cp.Provider.Destory(sid)
+}
+
+// DestroyAll clears the cache and deletes all sessions of the backend.
+func (cp *CacheProvider) DestroyAll() error {
+	p, ok := cp.Provider.(DestroyAllProvider)
+	if !ok {
+		return fmt.Errorf("session: provider %T does not support DestroyAll", cp.Provider)
+	}
+	cp.lock.Lock()
+	cp.list.Init()
+	cp.entries = make(map[string]*list.Element)
+	cp.lock.Unlock()
+	return p.DestroyAll()
+}
+
+// FlushWrites writes the deferred writes of the backend, if it defers any.
+func (cp *CacheProvider) FlushWrites() error {
+	if wf, ok := cp.Provider.(WriteFlusher); ok {
+		return wf.FlushWrites()
+	}
+	return nil
+}
+
+// Retryable forwards to the cached provider.
+func (cp *CacheProvider) Retryable(err error) bool {
+	return retryable(cp.Provider, err)
+}
+
+// SetExpiry extends the lifetime of the session in the backend.
+func (cp *CacheProvider) SetExpiry(sid string, d time.Duration) error {
+	return setExpiry(cp.Provider, sid, d)
+}
+
+// SIDs returns the sessions of the backend.
+func (cp *CacheProvider) SIDs() ([]string, error) {
+	return listSIDs(cp.Provider)
+}
+
+// GC drops the expired cache entries and runs the backend gc.
+func (cp *CacheProvider) GC() {
+	if _, err := cp.Sweep(); err != nil {
+		log.Printf("session: gc: %v", err)
+	}
+}
+
+// Sweep drops the expired cache entries and returns how many sessions the
+// backend gc removed, counted if the backend is a SweepProvider.
+func (cp *CacheProvider) Sweep() (removed int, err error) {
+	cp.lock.Lock()
+	now := time.Now()
+	for element := cp.list.Back(); element != nil; {
+		prev := element.Prev()
+		if now.After(element.Value.(*cacheEntry).expires) {
+			cp.remove(element)
+		}
+		element = prev
+	}
+	cp.lock.Unlock()
+	return sweep(cp.Provider)
+}
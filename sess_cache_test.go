@@ -0,0 +1,152 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// countingBackend counts the reads reaching the wrapped provider.
+type countingBackend struct {
+	Provider
+	reads int
+}
+
+func (cb *countingBackend) Read(sid string) (macross.RawStore, error) {
+	cb.reads++
+	return cb.Provider.Read(sid)
+}
+
+func newCachedFileProvider(t *testing.T, size int, ttl time.Duration) (*CacheProvider, *countingBackend, func()) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = filepder.Init(3600, dir); err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingBackend{Provider: filepder}
+	return NewCacheProvider(backend, size, ttl), backend, func() { os.RemoveAll(dir) }
+}
+
+func TestCacheProviderServesHotSessions(t *testing.T) {
+	cp, backend, cleanup := newCachedFileProvider(t, 2, time.Minute)
+	defer cleanup()
+
+	store, _ := cp.Read("aaaa")
+	store.Set("user", "insionng")
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	store, _ = cp.Read("aaaa")
+	if backend.reads != 1 {
+		t.Fatalf("cached session read %d times from the backend", backend.reads)
+	}
+	if store.Get("user") != "insionng" {
+		t.Fatal("cached session lost its value")
+	}
+	if !cp.Exist("aaaa") {
+		t.Fatal("cached session doesn't exist")
+	}
+
+	// the write went through to the backend.
+	fresh, _ := filepder.Read("aaaa")
+	if fresh.Get("user") != "insionng" {
+		t.Fatal("Release didn't write through to the backend")
+	}
+
+	// the least recently used session is evicted.
+	cp.Read("bbbb")
+	cp.Read("cccc")
+	cp.Read("aaaa")
+	if backend.reads != 4 {
+		t.Fatalf("evicted session not read from the backend, %d reads", backend.reads)
+	}
+}
+
+func TestCacheProviderInvalidation(t *testing.T) {
+	cp, backend, cleanup := newCachedFileProvider(t, 10, time.Minute)
+	defer cleanup()
+
+	store, _ := cp.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+
+	if err := cp.Destory("aaaa"); err != nil {
+		t.Fatal("Destory:", err)
+	}
+	store, _ = cp.Read("aaaa")
+	if backend.reads != 2 || store.Get("user") != nil {
+		t.Fatal("destroyed session still served from the cache")
+	}
+
+	store.Set("user", "insionng")
+	store.Release(nil)
+	if _, err := cp.Regenerate("aaaa", "bbbb"); err != nil {
+		t.Fatal("Regenerate:", err)
+	}
+	reads := backend.reads
+	if store, _ = cp.Read("bbbb"); store.Get("user") != "insionng" || backend.reads != reads {
+		t.Fatal("regenerated session not cached")
+	}
+	if store, _ = cp.Read("aaaa"); backend.reads != reads+1 || store.Get("user") != nil {
+		t.Fatal("old sid still served from the cache after Regenerate")
+	}
+}
+
+func TestCacheProviderTTL(t *testing.T) {
+	cp, backend, cleanup := newCachedFileProvider(t, 10, time.Millisecond)
+	defer cleanup()
+
+	cp.Read("aaaa")
+	time.Sleep(5 * time.Millisecond)
+	cp.Read("aaaa")
+	if backend.reads != 2 {
+		t.Fatal("expired cache entry served")
+	}
+}
+
+func TestManagerCacheConfig(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"cacheSize":100,"cacheTTL":30}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, ok := manager.provider.(*CacheProvider)
+	if !ok || cp.size != 100 || cp.ttl != 30*time.Second {
+		t.Fatalf("cache not configured: %#v", manager.provider)
+	}
+
+	if _, err = NewManager("cookie", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"cacheSize":100,"validateSID":true,`+
+		`"providerConfig":"{\"cookieName\":\"MacrossSessionId\",\"securityKey\":\"Macrosscookiehashkey\"}"}`); err == nil {
+		t.Fatal("cacheSize accepted for the cookie provider")
+	}
+}
+
+func TestCacheProviderCopiesPerRequest(t *testing.T) {
+	cp, _, cleanup := newCachedFileProvider(t, 10, time.Minute)
+	defer cleanup()
+
+	store, _ := cp.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+
+	// two concurrent requests of the same session.
+	a, _ := cp.Read("aaaa")
+	b, _ := cp.Read("aaaa")
+	a.Set("user", "ng")
+	if b.Get("user") != "insionng" {
+		t.Fatal("change of a request seen by another before its release")
+	}
+	if err := a.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+	if store, _ = cp.Read("aaaa"); store.Get("user") != "ng" {
+		t.Fatal("released change not cached")
+	}
+	if fresh, _ := filepder.Read("aaaa"); fresh.Get("user") != "ng" {
+		t.Fatal("released change not written through")
+	}
+}
@@ -0,0 +1,259 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// coalescedEntry is a session store written by CoalescingProvider.
+type coalescedEntry struct {
+	store   macross.RawStore // of the last release
+	written time.Time        // last write to the backend
+	pending *time.Timer      // deferred write, nil if none
+}
+
+// CoalescingProvider writes a session to the backend at most once per window:
+// a session released again within window of its last write is written at the
+// end of the window, with the values of its last Release. Until then the
+// session is read from memory, so the requests in between see its latest
+// values. It cuts the writes of sessions updated by rapid requests, e.g.
+// polling dashboards. Writes pending when the process exits are lost, call
+// Manager.FlushWrites on shutdown. Other processes sharing the backend see
+// the session up to window late.
+// The deferred writes are released without a request, so the providers
+// writing cookies (cookie, jwt) can't be wrapped.
+type CoalescingProvider struct {
+	Provider
+	window  time.Duration
+	lock    sync.Mutex
+	entries map[string]*coalescedEntry
+}
+
+// NewCoalescingProvider wraps p, writing each session at most once per window.
+func NewCoalescingProvider(p Provider, window time.Duration) *CoalescingProvider {
+	return &CoalescingProvider{
+		Provider: p,
+		window:   window,
+		entries:  make(map[string]*coalescedEntry),
+	}
+}
+
+// coalescedStore defers the Release of its store to the CoalescingProvider.
+type coalescedStore struct {
+	wrappedStore
+	cp  *CoalescingProvider
+	sid string
+}
+
+// Release writes the session to the backend, or once the window since its
+// last write is over.
+func (cs *coalescedStore) Release(c *macross.Context) error {
+	return cs.ReleaseContext(context.Background(), c)
+}
+
+// ReleaseContext is Release aborted once ctx is done, see ContextReleaser.
+func (cs *coalescedStore) ReleaseContext(ctx context.Context, c *macross.Context) error {
+	if !cs.cp.deferWrite(cs.sid, cs.RawStore) {
+		return nil
+	}
+	return ReleaseContext(ctx, c, cs.RawStore)
+}
+
+// deferWrite records the release of store as the latest values of session
+// sid, and reports whether it must be written now. Otherwise it's written at
+// the end of the window since the last write.
+func (cp *CoalescingProvider) deferWrite(sid string, store macross.RawStore) (now bool) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	entry, ok := cp.entries[sid]
+	if !ok {
+		entry = &coalescedEntry{}
+		cp.entries[sid] = entry
+	}
+	// the last release wins, as when every release is written.
+	entry.store = store
+	if entry.pending != nil {
+		return false
+	}
+	if wait := entry.written.Add(cp.window).Sub(time.Now()); wait > 0 {
+		entry.pending = time.AfterFunc(wait, func() {
+			if err := cp.flush(sid); err != nil {
+				log.Printf("session: coalesced write of a session: %v", err)
+			}
+		})
+		return false
+	}
+	entry.written = time.Now()
+	return true
+}
+
+// flush writes the pending write of sid.
+func (cp *CoalescingProvider) flush(sid string) error {
+	cp.lock.Lock()
+	entry, ok := cp.entries[sid]
+	if !ok || entry.pending == nil {
+		cp.lock.Unlock()
+		return nil
+	}
+	entry.pending.Stop()
+	entry.pending = nil
+	entry.written = time.Now()
+	store := entry.store
+	cp.lock.Unlock()
+	return store.Release(nil)
+}
+
+// FlushWrites writes the pending writes now.
+func (cp *CoalescingProvider) FlushWrites() error {
+	cp.lock.Lock()
+	var sids []string
+	for sid, entry := range cp.entries {
+		if entry.pending != nil {
+			sids = append(sids, sid)
+		}
+	}
+	cp.lock.Unlock()
+	var first error
+	for _, sid := range sids {
+		if err := cp.flush(sid); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// drop forgets sids, their pending writes are cancelled.
+func (cp *CoalescingProvider) drop(sids ...string) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for _, sid := range sids {
+		if entry, ok := cp.entries[sid]; ok {
+			if entry.pending != nil {
+				entry.pending.Stop()
+			}
+			delete(cp.entries, sid)
+		}
+	}
+}
+
+// Read returns the store of a session written within the window, or reads it
+// from the backend.
+func (cp *CoalescingProvider) Read(sid string) (macross.RawStore, error) {
+	cp.lock.Lock()
+	entry, ok := cp.entries[sid]
+	if ok && (entry.pending != nil || time.Since(entry.written) < cp.window) {
+		cp.lock.Unlock()
+		return &coalescedStore{wrappedStore: wrappedStore{entry.store}, cp: cp, sid: sid}, nil
+	}
+	cp.lock.Unlock()
+	store, err := cp.Provider.Read(sid)
+	if err != nil {
+		return nil, err
+	}
+	return &coalescedStore{wrappedStore: wrappedStore{store}, cp: cp, sid: sid}, nil
+}
+
+// Exist reports a session with a pending write without asking the backend.
+func (cp *CoalescingProvider) Exist(sid string) bool {
+	cp.lock.Lock()
+	entry, ok := cp.entries[sid]
+	pending := ok && entry.pending != nil
+	cp.lock.Unlock()
+	return pending || cp.Provider.Exist(sid)
+}
+
+// Regenerate writes the pending write of oldsid, so the backend moves the
+// latest values to sid.
+func (cp *CoalescingProvider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	if err := cp.flush(oldsid); err != nil {
+		return nil, err
+	}
+	cp.drop(oldsid, sid)
+	store, err := cp.Provider.Regenerate(oldsid, sid)
+	if err != nil {
+		return nil, err
+	}
+	return &coalescedStore{wrappedStore: wrappedStore{store}, cp: cp, sid: sid}, nil
+}
+
+// Destory cancels the pending write of the session and destroys it in the backend.
+func (cp *CoalescingProvider) Destory(sid string) error {
+	cp.drop(sid)
+	return cp.Provider.Destory(sid)
+}
+
+// DestroyAll cancels the pending writes and deletes all sessions of the backend.
+func (cp *CoalescingProvider) DestroyAll() error {
+	p, ok := cp.Provider.(DestroyAllProvider)
+	if !ok {
+		return fmt.Errorf("session: provider %T does not support DestroyAll", cp.Provider)
+	}
+	cp.lock.Lock()
+	for _, entry := range cp.entries {
+		if entry.pending != nil {
+			entry.pending.Stop()
+		}
+	}
+	cp.entries = make(map[string]*coalescedEntry)
+	cp.lock.Unlock()
+	return p.DestroyAll()
+}
+
+// SetExpiry writes the pending write of the session, which would refresh its
+// Retryable forwards to the wrapped provider.
+func (cp *CoalescingProvider) Retryable(err error) bool {
+	return retryable(cp.Provider, err)
+}
+
+// lifetime, and extends its lifetime in the backend.
+func (cp *CoalescingProvider) SetExpiry(sid string, d time.Duration) error {
+	if err := cp.flush(sid); err != nil {
+		return err
+	}
+	return setExpiry(cp.Provider, sid, d)
+}
+
+// SIDs returns the sessions of the backend and those of pending writes.
+func (cp *CoalescingProvider) SIDs() ([]string, error) {
+	sids, err := listSIDs(cp.Provider)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool, len(sids))
+	for _, sid := range sids {
+		listed[sid] = true
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for sid, entry := range cp.entries {
+		if entry.pending != nil && !listed[sid] {
+			sids = append(sids, sid)
+		}
+	}
+	return sids, nil
+}
+
+// GC forgets the sessions written before the window and runs the backend gc.
+func (cp *CoalescingProvider) GC() {
+	if _, err := cp.Sweep(); err != nil {
+		log.Printf("session: gc: %v", err)
+	}
+}
+
+// Sweep forgets the sessions written before the window and returns how many
+// sessions the backend gc removed, counted if the backend is a SweepProvider.
+func (cp *CoalescingProvider) Sweep() (removed int, err error) {
+	cp.lock.Lock()
+	for sid, entry := range cp.entries {
+		if entry.pending == nil && time.Since(entry.written) >= cp.window {
+			delete(cp.entries, sid)
+		}
+	}
+	cp.lock.Unlock()
+	return sweep(cp.Provider)
+}
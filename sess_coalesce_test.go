@@ -0,0 +1,154 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// writeCounter counts the releases of the stores of the wrapped provider,
+// which wait for gate if it's set.
+type writeCounter struct {
+	Provider
+	writes int32
+	gate   chan struct{}
+}
+
+type countedStore struct {
+	macross.RawStore
+	wc *writeCounter
+}
+
+func (cs *countedStore) Release(ctx *macross.Context) error {
+	if cs.wc.gate != nil {
+		<-cs.wc.gate
+	}
+	// counted once written, so the tests waiting for the count read it back.
+	defer atomic.AddInt32(&cs.wc.writes, 1)
+	return cs.RawStore.Release(ctx)
+}
+
+func (wc *writeCounter) Read(sid string) (macross.RawStore, error) {
+	store, err := wc.Provider.Read(sid)
+	if err != nil {
+		return nil, err
+	}
+	return &countedStore{RawStore: store, wc: wc}, nil
+}
+
+func newCoalescedFileProvider(t *testing.T, window time.Duration) (*CoalescingProvider, *writeCounter, func()) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = filepder.Init(3600, dir); err != nil {
+		t.Fatal(err)
+	}
+	backend := &writeCounter{Provider: filepder}
+	return NewCoalescingProvider(backend, window), backend, func() { os.RemoveAll(dir) }
+}
+
+func TestCoalescingProviderWrites(t *testing.T) {
+	cp, backend, cleanup := newCoalescedFileProvider(t, time.Minute)
+	defer cleanup()
+
+	for i := 0; i < 10; i++ {
+		store, _ := cp.Read("aaaa")
+		if i > 0 && store.Get("n") != i-1 {
+			t.Fatalf("release %d not read back: %v", i-1, store.Get("n"))
+		}
+		store.Set("n", i)
+		if err := store.Release(nil); err != nil {
+			t.Fatal("Release:", err)
+		}
+	}
+	if backend.writes != 1 {
+		t.Fatalf("%d writes within the window, want 1", backend.writes)
+	}
+	if !cp.Exist("aaaa") {
+		t.Fatal("session of a pending write doesn't exist")
+	}
+
+	if err := cp.FlushWrites(); err != nil {
+		t.Fatal("FlushWrites:", err)
+	}
+	if backend.writes != 2 {
+		t.Fatalf("%d writes after FlushWrites, want 2", backend.writes)
+	}
+	if store, _ := filepder.Read("aaaa"); store.Get("n") != 9 {
+		t.Fatalf("backend holds %v, want the last release", store.Get("n"))
+	}
+
+	// a destroyed session isn't written again.
+	store, _ := cp.Read("aaaa")
+	store.Set("n", 10)
+	store.Release(nil)
+	cp.Destory("aaaa")
+	cp.FlushWrites()
+	if backend.writes != 2 || filepder.Exist("aaaa") {
+		t.Fatal("pending write of a destroyed session written")
+	}
+}
+
+func TestCoalescingProviderWindowEnd(t *testing.T) {
+	cp, backend, cleanup := newCoalescedFileProvider(t, 20*time.Millisecond)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		store, _ := cp.Read("aaaa")
+		store.Set("n", i)
+		store.Release(nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&backend.writes); n != 2 {
+		t.Fatalf("%d writes, want the first and one at the window end", n)
+	}
+	if store, _ := filepder.Read("aaaa"); store.Get("n") != 2 {
+		t.Fatalf("backend holds %v after the window, want the last release", store.Get("n"))
+	}
+}
+
+func TestCoalescingProviderSIDs(t *testing.T) {
+	_, _, cleanup := newCoalescedFileProvider(t, time.Minute)
+	defer cleanup()
+	cp := NewCoalescingProvider(filepder, time.Minute)
+
+	// the first write reaches the backend, the next ones are pending.
+	for _, sid := range []string{"aaaa", "aaaa", "bbbb"} {
+		store, _ := cp.Read(sid)
+		store.Set("user", "insionng")
+		store.Release(nil)
+	}
+	sids, err := cp.SIDs()
+	if err != nil {
+		t.Fatal("SIDs:", err)
+	}
+	sort.Strings(sids)
+	if !reflect.DeepEqual(sids, []string{"aaaa", "bbbb"}) {
+		t.Fatalf("SIDs = %v, want each session once", sids)
+	}
+	if err = cp.FlushWrites(); err != nil {
+		t.Fatal("FlushWrites:", err)
+	}
+}
+
+func TestManagerCoalesceConfig(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"coalesceWindow":500}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, ok := manager.provider.(*CoalescingProvider)
+	if !ok || cp.window != 500*time.Millisecond {
+		t.Fatalf("coalescing not configured: %#v", manager.provider)
+	}
+	if _, err = NewManager("cookie", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"coalesceWindow":500,`+
+		`"providerConfig":"{\"cookieName\":\"MacrossSessionId\",\"securityKey\":\"Macrosscookiehashkey\"}"}`); err == nil {
+		t.Fatal("coalesceWindow accepted for the cookie provider")
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/json"
-	"net/url"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/insionng/macross"
@@ -18,14 +24,21 @@ type CookieSessionStore struct {
 	sid    string
 	values map[interface{}]interface{} // session data
 	lock   sync.RWMutex
+	dirty  bool  // values changed since Read
+	issued int64 // unix time the read cookie was written at, 0 for a new session
 }
 
 // Set value to cookie session.
 // the value are encoded as gob with hash block string.
+// setting a value equal to the current one doesn't change the session.
 func (st *CookieSessionStore) Set(key, value interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
+	if old, ok := st.values[key]; ok && reflect.DeepEqual(old, value) {
+		return nil
+	}
 	st.values[key] = value
+	st.dirty = true
 	return nil
 }
 
@@ -43,7 +56,10 @@ func (st *CookieSessionStore) Get(key interface{}) interface{} {
 func (st *CookieSessionStore) Delete(key interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	delete(st.values, key)
+	if _, ok := st.values[key]; ok {
+		delete(st.values, key)
+		st.dirty = true
+	}
 	return nil
 }
 
@@ -51,51 +67,260 @@ func (st *CookieSessionStore) Delete(key interface{}) error {
 func (st *CookieSessionStore) Flush() error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	st.values = make(map[interface{}]interface{})
+	if len(st.values) > 0 {
+		st.values = make(map[interface{}]interface{})
+		st.dirty = true
+	}
+	return nil
+}
+
+// SetAll replaces all values of cookie session
+func (st *CookieSessionStore) SetAll(values map[interface{}]interface{}) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if reflect.DeepEqual(st.values, values) {
+		return nil
+	}
+	st.values = values
+	st.dirty = true
 	return nil
 }
 
+// GetOrSet returns the value of key, or sets it to the value of factory,
+// called under the session lock, and returns it.
+func (st *CookieSessionStore) GetOrSet(key interface{}, factory func() (interface{}, error)) (interface{}, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if v, ok := st.values[key]; ok {
+		return v, nil
+	}
+	value, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	st.values[key] = value
+	st.dirty = true
+	return value, nil
+}
+
+// Take returns the value of key and deletes it, under the session lock.
+func (st *CookieSessionStore) Take(key interface{}) interface{} {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	v, ok := st.values[key]
+	if ok {
+		delete(st.values, key)
+		st.dirty = true
+	}
+	return v
+}
+
+// Keys returns the keys of all values in the session
+func (st *CookieSessionStore) Keys() []interface{} {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	keys := make([]interface{}, 0, len(st.values))
+	for k := range st.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 // SessionID Return id of this cookie session
 func (st *CookieSessionStore) ID() string {
 	return st.sid
 }
 
-// SessionRelease Write cookie session to http response cookie
+// SessionRelease Write cookie session to http response cookie.
+// an unchanged session is written again only once its cookie is refreshAfter
+// seconds old, to slide its expiry, read-only requests set no cookie.
 func (st *CookieSessionStore) Release(ctx *macross.Context) error {
-	str, err := encodeCookie(cookiepder.block,
-		cookiepder.config.SecurityKey,
+	st.lock.RLock()
+	dirty, issued := st.dirty, st.issued
+	st.lock.RUnlock()
+	if !dirty && (issued == 0 || time.Now().Unix()-issued < cookiepder.refreshAfter()) {
+		return nil
+	}
+	securityKey, block := cookiepder.keys()
+	st.lock.RLock()
+	str, err := encodeCookieThreshold(block,
+		securityKey,
 		cookiepder.config.SecurityName,
-		st.values)
+		st.values,
+		cookiepder.config.Threshold)
+	st.lock.RUnlock()
 	if err != nil {
 		return err
 	}
 
+	value := encodeCookieValue(str, cookiepder.encoding)
+	name := cookiepder.config.CookieName
+	chunks := splitCookieValue(value, cookiepder.config.ChunkSize)
+	if len(chunks) > cookiepder.config.MaxChunks {
+		atomic.AddUint64(&cookiepder.stats.oversized, 1)
+		return fmt.Errorf("session: cookie session needs %d chunks, more than maxChunks %d", len(chunks), cookiepder.config.MaxChunks)
+	}
+
+	if len(chunks) == 1 {
+		st.writeCookie(ctx, name, value, false)
+		// drop the chunks of a session which shrunk.
+		st.expireChunks(ctx, name, 0)
+		return nil
+	}
+	for i, chunk := range chunks {
+		st.writeCookie(ctx, chunkName(name, i), chunk, false)
+	}
+	st.expireChunks(ctx, name, len(chunks))
+	if _, err := ctx.Cookie(name); err == nil {
+		st.writeCookie(ctx, name, "", true)
+	}
+	return nil
+}
+
+// writeCookie writes one cookie of the cookie session, or expires it.
+func (st *CookieSessionStore) writeCookie(ctx *macross.Context, name, value string, expire bool) {
 	cookie := &macross.Cookie{}
-	cookie.SetName(cookiepder.config.CookieName)
-	cookie.SetValue(url.QueryEscape(str))
+	cookie.SetName(name)
+	cookie.SetValue(value)
 	cookie.SetPath("/")
 	cookie.SetHTTPOnly(true)
 	cookie.SetSecure(cookiepder.config.Secure)
-	cookie.SetExpire(time.Now().Add(time.Duration(cookiepder.config.MaxAge) * time.Second))
+	if expire {
+		cookie.SetExpire(time.Now())
+	} else {
+		cookie.SetExpire(time.Now().Add(time.Duration(cookiepder.config.MaxAge) * time.Second))
+	}
 
-	ctx.SetCookie(cookie)
-	return nil
+	setCookie(ctx, cookie)
 }
 
-type cookieConfig struct {
+// expireChunks expires the request's chunks of name from index from on.
+func (st *CookieSessionStore) expireChunks(ctx *macross.Context, name string, from int) {
+	for i := from; ; i++ {
+		if _, err := ctx.Cookie(chunkName(name, i)); err != nil {
+			return
+		}
+		st.writeCookie(ctx, chunkName(name, i), "", true)
+	}
+}
+
+// chunkName returns the name of the i-th chunk cookie of name.
+func chunkName(name string, i int) string {
+	return name + "." + strconv.Itoa(i)
+}
+
+// splitCookieValue splits value into chunks of at most size bytes.
+func splitCookieValue(value string, size int) []string {
+	if size <= 0 || len(value) <= size {
+		return []string{value}
+	}
+	var chunks []string
+	for len(value) > size {
+		chunks = append(chunks, value[:size])
+		value = value[size:]
+	}
+	return append(chunks, value)
+}
+
+// readCookieChunks reassembles the value of a cookie split into
+// name.0, name.1, ... by the cookie provider, each chunk read through codec,
+// or returns "".
+func readCookieChunks(ctx *macross.Context, name string, codec CookieCodec) (string, error) {
+	var value string
+	for i := 0; ; i++ {
+		if _, err := ctx.Cookie(chunkName(name, i)); err != nil {
+			return value, nil
+		}
+		chunk, err := codec.Read(ctx, chunkName(name, i))
+		if err != nil {
+			return "", err
+		}
+		value += chunk
+	}
+}
+
+// CookieConfig Cookie session provider config
+// New fields are appended, use keyed literals.
+type CookieConfig struct {
 	SecurityKey  string `json:"securityKey"`
 	BlockKey     string `json:"blockKey"`
 	SecurityName string `json:"securityName"`
 	CookieName   string `json:"cookieName"`
 	Secure       bool   `json:"secure"`
 	MaxAge       int    `json:"maxAge"`
+	Threshold    int    `json:"threshold"`
+	ChunkSize    int    `json:"chunkSize"`
+	MaxChunks    int    `json:"maxChunks"`
+	RefreshAfter int    `json:"refreshAfter"`
+	// BeegoCompat is deprecated, the cookies of the beego cookie provider
+	// have the legacy layout, always read.
+	BeegoCompat bool `json:"beegoCompat"`
+	// KeyProvider supplies SecurityKey and BlockKey at Init instead of the config.
+	KeyProvider KeyProvider `json:"-"`
+	// KeyRefresh fetches the keys from KeyProvider again at this interval, 0 never does.
+	KeyRefresh time.Duration `json:"-"`
+	// KeyGrace is how long the cookies of the previous keys are still read
+	// after the keys changed, the max lifetime by default. They are written
+	// again with the new keys.
+	KeyGrace time.Duration `json:"-"`
+}
+
+// KeyProvider supplies the cookie provider keys from e.g. Vault, a KMS or the
+// environment, so they needn't be written in config files.
+type KeyProvider interface {
+	// Keys returns the hmac key (securityKey) and the aes key (blockKey).
+	Keys() (securityKey, blockKey string, err error)
+}
+
+// EnvKeyProvider reads the cookie provider keys from environment variables.
+type EnvKeyProvider struct {
+	SecurityKeyVar string
+	BlockKeyVar    string
+}
+
+// Keys returns the keys in the environment, both must be set.
+func (ep EnvKeyProvider) Keys() (string, string, error) {
+	for _, name := range []string{ep.SecurityKeyVar, ep.BlockKeyVar} {
+		if os.Getenv(name) == "" {
+			return "", "", fmt.Errorf("session: environment variable %s is empty", name)
+		}
+	}
+	return os.Getenv(ep.SecurityKeyVar), os.Getenv(ep.BlockKeyVar), nil
+}
+
+// cookieKeys are the hmac key and the aes block of cookie sessions.
+type cookieKeys struct {
+	securityKey string
+	block       cipher.Block
 }
 
 // CookieProvider Cookie session provider
 type CookieProvider struct {
 	maxLifetime int64
-	config      *cookieConfig
+	config      *CookieConfig
 	block       cipher.Block
+	encoding    string       // cookie value encoding, set by the manager
+	keyLock     sync.RWMutex // guards block, config.SecurityKey and prev on key refresh
+	// prev are the keys replaced by the last refresh, read until prevUntil.
+	prev        *cookieKeys
+	prevUntil   time.Time
+	stopRefresh chan struct{} // stops the key refresh of the previous Init
+	stats       struct {
+		decodeFailures, signatureMismatches, oversized uint64
+	}
+}
+
+// Stats returns the cookie failure counters, cookies merely expired aren't counted.
+func (pder *CookieProvider) Stats() Stats {
+	return Stats{
+		CookieDecodeFailures:      atomic.LoadUint64(&pder.stats.decodeFailures),
+		CookieSignatureMismatches: atomic.LoadUint64(&pder.stats.signatureMismatches),
+		CookiesOversized:          atomic.LoadUint64(&pder.stats.oversized),
+	}
+}
+
+func (pder *CookieProvider) setCookieEncoding(encoding string) {
+	pder.encoding = encoding
 }
 
 // Init Init cookie session provider with max lifetime and config json.
@@ -106,37 +331,190 @@ type CookieProvider struct {
 // 	securityName - recognized name in encoded cookie string
 // 	cookieName - cookie name
 // 	maxAge - cookie max life time.
+// 	threshold - encoded values from this size on are compressed, 0 never
+// 	compresses. Values are always encrypted.
+// 	chunkSize - values longer than this are split into cookieName.0, cookieName.1, ...
+// 	default 4000.
+// 	maxChunks - max number of chunk cookies, default 4.
+// 	refreshAfter - seconds after which the cookie of an unchanged session is
+// 	written again to slide its expiry, default half the max lifetime.
+// 	beegoCompat - deprecated, the cookies of the beego cookie provider signed
+// 	and encrypted with the same keys and securityName are always read and
+// 	written in this package's format by the next response.
 func (pder *CookieProvider) Init(maxLifetime int64, config string) error {
-	pder.config = &cookieConfig{}
-	err := json.Unmarshal([]byte(config), pder.config)
+	cf := &CookieConfig{}
+	err := json.Unmarshal([]byte(config), cf)
 	if err != nil {
 		return err
 	}
-	if pder.config.BlockKey == "" {
-		pder.config.BlockKey = string(generateRandomKey(16))
+	return pder.InitWithConfig(maxLifetime, cf)
+}
+
+// InitWithConfig Init cookie session provider with max lifetime and a CookieConfig.
+func (pder *CookieProvider) InitWithConfig(maxLifetime int64, cfg interface{}) error {
+	switch v := cfg.(type) {
+	case CookieConfig:
+		pder.config = &v
+	case *CookieConfig:
+		cf := *v
+		pder.config = &cf
+	default:
+		return fmt.Errorf("session: cookie provider does not support config %T", cfg)
 	}
 	if pder.config.SecurityName == "" {
 		pder.config.SecurityName = string(generateRandomKey(20))
 	}
-	pder.block, err = aes.NewCipher([]byte(pder.config.BlockKey))
+	if pder.config.ChunkSize <= 0 {
+		pder.config.ChunkSize = 4000
+	}
+	if pder.config.MaxChunks <= 0 {
+		pder.config.MaxChunks = 4
+	}
+	if pder.stopRefresh != nil {
+		close(pder.stopRefresh)
+		pder.stopRefresh = nil
+	}
+	pder.maxLifetime = maxLifetime
+	pder.keyLock.Lock()
+	pder.block, pder.prev = nil, nil
+	pder.keyLock.Unlock()
+	kp := pder.config.KeyProvider
+	if kp == nil {
+		// a config without a block key keeps the generated one for the process.
+		if pder.config.BlockKey == "" {
+			pder.config.BlockKey = string(generateRandomKey(16))
+		}
+		return pder.setKeys(pder.config.SecurityKey, pder.config.BlockKey)
+	}
+	if err := pder.fetchKeys(kp); err != nil {
+		return err
+	}
+	if pder.config.KeyRefresh > 0 {
+		pder.stopRefresh = make(chan struct{})
+		go pder.refreshKeys(kp, pder.config.KeyRefresh, pder.stopRefresh)
+	}
+	return nil
+}
+
+// setKeys switches to the given keys, the replaced ones are still read for
+// the key grace window. The block key must be set, a generated one would
+// differ between instances and refreshes.
+func (pder *CookieProvider) setKeys(securityKey, blockKey string) error {
+	if blockKey == "" {
+		return errors.New("session: cookie provider block key is empty")
+	}
+	block, err := aes.NewCipher([]byte(blockKey))
 	if err != nil {
 		return err
 	}
-	pder.maxLifetime = maxLifetime
+	pder.keyLock.Lock()
+	defer pder.keyLock.Unlock()
+	if pder.block != nil && securityKey == pder.config.SecurityKey && blockKey == pder.config.BlockKey {
+		return nil
+	}
+	if pder.block != nil {
+		pder.prev = &cookieKeys{securityKey: pder.config.SecurityKey, block: pder.block}
+		pder.prevUntil = time.Now().Add(pder.keyGrace())
+	}
+	pder.config.SecurityKey = securityKey
+	pder.config.BlockKey = blockKey
+	pder.block = block
 	return nil
 }
 
+// keyGrace returns how long the replaced keys are still read.
+func (pder *CookieProvider) keyGrace() time.Duration {
+	if pder.config.KeyGrace > 0 {
+		return pder.config.KeyGrace
+	}
+	return time.Duration(pder.maxLifetime) * time.Second
+}
+
+func (pder *CookieProvider) fetchKeys(kp KeyProvider) error {
+	securityKey, blockKey, err := kp.Keys()
+	if err != nil {
+		return err
+	}
+	return pder.setKeys(securityKey, blockKey)
+}
+
+// refreshKeys fetches the keys every interval until stop is closed,
+// on failure the current keys are kept.
+func (pder *CookieProvider) refreshKeys(kp KeyProvider, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := pder.fetchKeys(kp); err != nil {
+				log.Println("session: cookie key refresh failed:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refreshAfter returns the age in seconds from which unchanged sessions are written again.
+func (pder *CookieProvider) refreshAfter() int64 {
+	if pder.config.RefreshAfter > 0 {
+		return int64(pder.config.RefreshAfter)
+	}
+	return pder.maxLifetime / 2
+}
+
+// keys returns the current hmac key and aes block, which sign and encrypt.
+func (pder *CookieProvider) keys() (string, cipher.Block) {
+	pder.keyLock.RLock()
+	defer pder.keyLock.RUnlock()
+	return pder.config.SecurityKey, pder.block
+}
+
+// readKeys returns the keys cookies are read with: the current ones, then
+// the previous ones within their grace window.
+func (pder *CookieProvider) readKeys() []cookieKeys {
+	pder.keyLock.RLock()
+	defer pder.keyLock.RUnlock()
+	keys := []cookieKeys{{securityKey: pder.config.SecurityKey, block: pder.block}}
+	if pder.prev != nil && time.Now().Before(pder.prevUntil) {
+		keys = append(keys, *pder.prev)
+	}
+	return keys
+}
+
 // Read Get SessionStore in cooke.
 // decode cooke string to map and put into SessionStore with sid.
 func (pder *CookieProvider) Read(sid string) (macross.RawStore, error) {
-	maps, _ := decodeCookie(pder.block,
-		pder.config.SecurityKey,
-		pder.config.SecurityName,
-		sid, pder.maxLifetime)
+	keys := pder.readKeys()
+	var (
+		maps    map[interface{}]interface{}
+		issued  int64
+		err     error
+		rewrite bool // written again with the current keys and format
+	)
+	for i, k := range keys {
+		var legacy bool
+		maps, issued, legacy, err = decodeCookieIssued(k.block,
+			k.securityKey,
+			pder.config.SecurityName,
+			sid, pder.maxLifetime)
+		if err == nil || err == errCookieExpired {
+			rewrite = (i > 0 || legacy) && err == nil
+			break
+		}
+	}
+	if err != nil && sid != "" && err != errCookieExpired {
+		atomic.AddUint64(&pder.stats.decodeFailures, 1)
+		if err == errCookieSignature {
+			atomic.AddUint64(&pder.stats.signatureMismatches, 1)
+		}
+	}
 	if maps == nil {
 		maps = make(map[interface{}]interface{})
 	}
-	rs := &CookieSessionStore{sid: sid, values: maps}
+	// a cookie of the legacy layout, e.g. of beego, or of the previous keys is
+	// dirty, to be written again in the current format with the current keys.
+	rs := &CookieSessionStore{sid: sid, values: maps, issued: issued, dirty: rewrite}
 	return rs, nil
 }
 
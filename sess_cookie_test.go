@@ -0,0 +1,439 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+	"github.com/valyala/fasthttp"
+)
+
+// newCookieTestApp returns an app using the cookie provider with extra provider config,
+// the session is released after each request.
+func newCookieTestApp(t *testing.T, providerConfig string) *macross.Macross {
+	manager, err := NewManager("cookie", `{"cookieName":"`+testCookieName+`","enableSetCookie":false,"gcLifetime":3600,"providerConfig":"{\"cookieName\":\"`+
+		testCookieName+`\",\"securityKey\":\"Macrosscookiehashkey\",\"maxAge\":3600`+providerConfig+`}"}`)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	m := macross.New()
+	m.Use(func(c *macross.Context) error {
+		sess, err := manager.Start(c)
+		if err != nil {
+			return err
+		}
+		c.Session = sess
+		defer sess.Release(c)
+		return c.Next()
+	})
+	return m
+}
+
+// liveCookies returns the unexpired response cookies by name.
+func liveCookies(ctx *fasthttp.RequestCtx) map[string]string {
+	cookies := map[string]string{}
+	ctx.Response.Header.VisitAllCookie(func(key, value []byte) {
+		cookie := new(fasthttp.Cookie)
+		cookie.SetKey(string(key))
+		ctx.Response.Header.Cookie(cookie)
+		if cookie.Expire().IsZero() || cookie.Expire().After(time.Now()) {
+			cookies[string(key)] = string(cookie.Value())
+		}
+	})
+	return cookies
+}
+
+func TestCookieChunking(t *testing.T) {
+	m := newCookieTestApp(t, `,\"chunkSize\":600,\"maxChunks\":4`)
+	var got string
+	m.Get("/big", func(c *macross.Context) error {
+		return c.Session.Set("data", strings.Repeat("x", 800))
+	})
+	m.Get("/small", func(c *macross.Context) error {
+		return c.Session.Set("data", "x")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, _ = c.Session.Get("data").(string)
+		return nil
+	})
+
+	ctx := doRequest(m, "/big", nil)
+	cookies := liveCookies(ctx)
+	for i := 0; i < 3; i++ {
+		if _, ok := cookies[chunkName(testCookieName, i)]; !ok {
+			t.Fatalf("chunk %d missing, got %v", i, cookies)
+		}
+	}
+	if _, ok := cookies[chunkName(testCookieName, 3)]; ok {
+		t.Fatal("more chunks than needed")
+	}
+	if _, ok := cookies[testCookieName]; ok {
+		t.Fatal("unchunked cookie written along with chunks")
+	}
+
+	doRequest(m, "/get", cookies)
+	if got != strings.Repeat("x", 800) {
+		t.Fatalf("chunked session not reassembled, got %d bytes", len(got))
+	}
+
+	// shrinking back to one cookie expires the stale chunks.
+	ctx = doRequest(m, "/small", cookies)
+	cookies = liveCookies(ctx)
+	if _, ok := cookies[testCookieName]; !ok {
+		t.Fatal("single cookie not written")
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := cookies[chunkName(testCookieName, i)]; ok {
+			t.Fatalf("stale chunk %d not expired", i)
+		}
+		if responseCookie(ctx, chunkName(testCookieName, i)) == nil {
+			t.Fatalf("stale chunk %d not deleted", i)
+		}
+	}
+	doRequest(m, "/get", cookies)
+	if got != "x" {
+		t.Fatalf("shrunk session not read back, got %q", got)
+	}
+}
+
+func TestChunkCookiesOnlyForCookieProvider(t *testing.T) {
+	m := newTestApp(t, Options{})
+	var sid, got string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, _ = c.Session.Get("user").(string)
+		return nil
+	})
+	doRequest(m, "/set", nil)
+
+	// the sid of a server side session isn't read from chunk cookies.
+	doRequest(m, "/get", map[string]string{chunkName(testCookieName, 0): sid})
+	if got != "" {
+		t.Fatal("sid read from a chunk cookie")
+	}
+}
+
+func TestCookieChunkingCap(t *testing.T) {
+	m := newCookieTestApp(t, `,\"chunkSize\":100,\"maxChunks\":2`)
+	var err error
+	m.Get("/big", func(c *macross.Context) error {
+		c.Session.Set("data", strings.Repeat("x", 800))
+		err = c.Session.Release(c)
+		return nil
+	})
+	doRequest(m, "/big", nil)
+	if err == nil {
+		t.Fatal("session exceeding maxChunks accepted")
+	}
+}
+
+func TestCookieBase64Encoding(t *testing.T) {
+	manager, err := NewManager("cookie", `{"cookieName":"`+testCookieName+`","gcLifetime":3600,"cookieEncoding":"base64","providerConfig":"{\"cookieName\":\"`+
+		testCookieName+`\",\"securityKey\":\"Macrosscookiehashkey\",\"maxAge\":3600}"}`)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	defer cookiepder.setCookieEncoding("")
+	var got string
+	m := macross.New()
+	m.Use(func(c *macross.Context) error {
+		sess, err := manager.Start(c)
+		if err != nil {
+			return err
+		}
+		c.Session = sess
+		defer sess.Release(c)
+		return c.Next()
+	})
+	m.Get("/set", func(c *macross.Context) error {
+		return c.Session.Set("name", "€uro ünïcödé")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, _ = c.Session.Get("name").(string)
+		return nil
+	})
+
+	cookies := liveCookies(doRequest(m, "/set", nil))
+	if strings.Contains(cookies[testCookieName], "%") {
+		t.Fatal("cookie value percent-encoded")
+	}
+	doRequest(m, "/get", cookies)
+	if got != "€uro ünïcödé" {
+		t.Fatalf("base64 cookie session not read back, got %q", got)
+	}
+}
+
+// mockKeyProvider hands out the keys of its current generation.
+type mockKeyProvider struct {
+	lock sync.Mutex
+	gen  int
+}
+
+func (mk *mockKeyProvider) Keys() (string, string, error) {
+	mk.lock.Lock()
+	defer mk.lock.Unlock()
+	return fmt.Sprintf("hashkey-%d", mk.gen), fmt.Sprintf("blockkey-%07d", mk.gen), nil
+}
+
+func (mk *mockKeyProvider) rotate() {
+	mk.lock.Lock()
+	mk.gen++
+	mk.lock.Unlock()
+}
+
+func TestCookieKeyProvider(t *testing.T) {
+	kp := &mockKeyProvider{}
+	pder := &CookieProvider{}
+	err := pder.InitWithConfig(3600, CookieConfig{CookieName: testCookieName, SecurityName: "name", KeyProvider: kp, KeyRefresh: 5 * time.Millisecond, KeyGrace: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal("InitWithConfig:", err)
+	}
+	defer close(pder.stopRefresh)
+
+	securityKey, block := pder.keys()
+	if securityKey != "hashkey-0" {
+		t.Fatalf("security key not taken from the KeyProvider, got %q", securityKey)
+	}
+	mockBlock, _ := aes.NewCipher([]byte("blockkey-0000000"))
+	str, err := encodeCookie(mockBlock, "hashkey-0", "name", map[interface{}]interface{}{"user": "insionng"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ := pder.Read(str)
+	if store.Get("user") != "insionng" {
+		t.Fatal("cookie encoded with the provided keys not decoded")
+	}
+	if _, err = decodeCookie(block, "hashkey-0", "name", str, 3600); err != nil {
+		t.Fatal("provider block differs from the provided block key:", err)
+	}
+
+	// a refresh picks up new keys.
+	kp.rotate()
+	for i := 0; i < 100; i++ {
+		if securityKey, _ = pder.keys(); securityKey == "hashkey-1" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if securityKey != "hashkey-1" {
+		t.Fatal("keys not refreshed")
+	}
+	// the cookies of the old keys are read during the grace window, and
+	// written again with the new ones.
+	if store, _ = pder.Read(str); store.Get("user") != "insionng" {
+		t.Fatal("cookie of the old keys rejected right after the refresh")
+	}
+	if !store.(*CookieSessionStore).dirty {
+		t.Fatal("cookie of the old keys not written again with the new ones")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if store, _ = pder.Read(str); store.Get("user") != nil {
+		t.Fatal("cookie of the old keys still accepted after the grace window")
+	}
+}
+
+func TestEnvKeyProvider(t *testing.T) {
+	os.Setenv("TEST_SESSION_HASH_KEY", "envhash")
+	os.Setenv("TEST_SESSION_BLOCK_KEY", "0123456789abcdef")
+	defer os.Unsetenv("TEST_SESSION_HASH_KEY")
+	defer os.Unsetenv("TEST_SESSION_BLOCK_KEY")
+
+	pder := &CookieProvider{}
+	err := pder.InitWithConfig(3600, CookieConfig{CookieName: testCookieName, KeyProvider: EnvKeyProvider{"TEST_SESSION_HASH_KEY", "TEST_SESSION_BLOCK_KEY"}})
+	if err != nil {
+		t.Fatal("InitWithConfig:", err)
+	}
+	if pder.config.SecurityKey != "envhash" || pder.config.BlockKey != "0123456789abcdef" {
+		t.Fatalf("keys not read from the environment: %+v", pder.config)
+	}
+	err = pder.InitWithConfig(3600, CookieConfig{CookieName: testCookieName, KeyProvider: EnvKeyProvider{"TEST_SESSION_UNSET", ""}})
+	if err == nil {
+		t.Fatal("missing security key accepted")
+	}
+	// a generated block key would differ between instances and refreshes.
+	err = pder.InitWithConfig(3600, CookieConfig{CookieName: testCookieName, KeyProvider: EnvKeyProvider{"TEST_SESSION_HASH_KEY", "TEST_SESSION_UNSET"}})
+	if err == nil {
+		t.Fatal("missing block key accepted")
+	}
+}
+
+func TestCookieReadOnlyRequest(t *testing.T) {
+	m := newCookieTestApp(t, "")
+	m.Get("/set", func(c *macross.Context) error {
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		c.Session.Get("user")
+		return nil
+	})
+	m.Get("/old", func(c *macross.Context) error {
+		// as if the cookie was written an hour ago.
+		c.Session.(*CookieSessionStore).issued -= 3600
+		return nil
+	})
+
+	cookies := liveCookies(doRequest(m, "/set", nil))
+	if _, ok := cookies[testCookieName]; !ok {
+		t.Fatal("changed session not written")
+	}
+	for _, path := range []string{"/get", "/set"} {
+		if ctx := doRequest(m, path, cookies); responseCookie(ctx, testCookieName) != nil {
+			t.Fatalf("%s: unchanged session written again", path)
+		}
+	}
+	if ctx := doRequest(m, "/old", cookies); responseCookie(ctx, testCookieName) == nil {
+		t.Fatal("old cookie of an unchanged session not refreshed")
+	}
+	if ctx := doRequest(m, "/get", nil); responseCookie(ctx, testCookieName) != nil {
+		t.Fatal("empty new session written")
+	}
+
+	// nor through the Sessioner, which keeps its meta in the session.
+	m = newTestApp(t, Options{Provider: "cookie", Config: `{"cookieName":"` + testCookieName + `","enableSetCookie":false,"gcLifetime":3600,"providerConfig":"{\"cookieName\":\"` +
+		testCookieName + `\",\"securityKey\":\"Macrosscookiehashkey\",\"maxAge\":3600}"}`})
+	m.Get("/set", func(c *macross.Context) error {
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		c.Session.Get("user")
+		return nil
+	})
+	cookies = liveCookies(doRequest(m, "/set", nil))
+	if ctx := doRequest(m, "/get", cookies); responseCookie(ctx, testCookieName) != nil {
+		t.Fatal("read-only request through the Sessioner set the cookie")
+	}
+}
+
+func TestCookieFailureStats(t *testing.T) {
+	manager, err := NewManager("cookie", `{"cookieName":"`+testCookieName+`","enableSetCookie":false,"gcLifetime":3600,"providerConfig":"{\"cookieName\":\"`+
+		testCookieName+`\",\"securityKey\":\"Macrosscookiehashkey\",\"maxAge\":3600,\"chunkSize\":100,\"maxChunks\":1}"}`)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	before := manager.Stats()
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		manager.Read(fmt.Sprintf("corrupt%d", i))
+	}
+	// a valid cookie of another key.
+	block, _ := aes.NewCipher([]byte("0123456789abcdef"))
+	forged, _ := encodeCookie(block, "otherkey", cookiepder.config.SecurityName, map[interface{}]interface{}{"user": "insionng"})
+	manager.Read(forged)
+	// a new session has no cookie to decode.
+	manager.Read("")
+
+	store, _ := manager.Read("")
+	store.Set("data", strings.Repeat("x", 800))
+	m := macross.New()
+	m.Get("/", func(c *macross.Context) error {
+		store.Release(c)
+		return nil
+	})
+	doRequest(m, "/", nil)
+
+	stats := manager.Stats()
+	if got := stats.CookieDecodeFailures - before.CookieDecodeFailures; got != n+1 {
+		t.Fatalf("%d decode failures counted, want %d", got, n+1)
+	}
+	if got := stats.CookieSignatureMismatches - before.CookieSignatureMismatches; got != 1 {
+		t.Fatalf("%d signature mismatches counted, want 1", got)
+	}
+	if got := stats.CookiesOversized - before.CookiesOversized; got != 1 {
+		t.Fatalf("%d oversized cookies counted, want 1", got)
+	}
+}
+
+func TestCookieWrittenOnce(t *testing.T) {
+	// the manager writes the sid cookie of the new session, then the cookie
+	// provider its values under the same name.
+	manager, err := NewManager("cookie", `{"cookieName":"`+testCookieName+`","enableSetCookie":true,"gcLifetime":3600,"providerConfig":"{\"cookieName\":\"`+
+		testCookieName+`\",\"securityKey\":\"Macrosscookiehashkey\",\"maxAge\":3600}"}`)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	m := macross.New()
+	m.Get("/", func(c *macross.Context) error {
+		sess, err := manager.Start(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user", "insionng")
+		return sess.Release(c)
+	})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	ctx := doRequest(m, "/", nil)
+
+	var n int
+	ctx.Response.Header.VisitAllCookie(func(key, value []byte) {
+		if string(key) == testCookieName {
+			n++
+		}
+	})
+	if n != 1 {
+		t.Fatalf("%d Set-Cookie for %s, want 1", n, testCookieName)
+	}
+	value := liveCookies(ctx)[testCookieName]
+	if store, _ := manager.Read(value); store.Get("user") != "insionng" {
+		t.Fatal("the cookie isn't the session values of the last writer")
+	}
+	if !strings.Contains(buf.String(), "cookie "+testCookieName+" set twice") {
+		t.Fatalf("conflicting cookie not logged: %q", buf.String())
+	}
+}
+
+// encodeBeegoCookie encodes values like the cookie provider of beego.
+func encodeBeegoCookie(block cipher.Block, hashKey, name string, values map[interface{}]interface{}) string {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(values)
+	b, _ := encrypt(block, buf.Bytes())
+	b = []byte(fmt.Sprintf("%s|%d|%s|", name, time.Now().UTC().Unix(), encode(b)))
+	h := hmac.New(sha1.New, []byte(hashKey))
+	h.Write(b)
+	b = append(b, h.Sum(nil)...)[len(name)+1:]
+	return url.QueryEscape(string(encode(b)))
+}
+
+func TestCookieBeegoCompat(t *testing.T) {
+	block, _ := aes.NewCipher([]byte("0123456789abcdef"))
+	beego := encodeBeegoCookie(block, "Macrosscookiehashkey", "beegoSessionId", map[interface{}]interface{}{"user": "insionng"})
+	keys := `,\"securityName\":\"beegoSessionId\",\"blockKey\":\"0123456789abcdef\"`
+
+	var got interface{}
+	handler := func(c *macross.Context) error {
+		got = c.Session.Get("user")
+		return nil
+	}
+	m := newCookieTestApp(t, keys)
+	m.Get("/", handler)
+	ctx := doRequest(m, "/", map[string]string{testCookieName: beego})
+	if got != "insionng" {
+		t.Fatalf("beego cookie read as %v", got)
+	}
+	cookie := responseCookie(ctx, testCookieName)
+	if cookie == nil {
+		t.Fatal("beego cookie not written again")
+	}
+	value, _ := url.QueryUnescape(string(cookie.Value()))
+	if values, err := decodeCookie(block, "Macrosscookiehashkey", "beegoSessionId", value, 3600); err != nil || values["user"] != "insionng" {
+		t.Fatalf("beego cookie written again as %v, %v", values, err)
+	}
+}
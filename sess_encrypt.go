@@ -0,0 +1,171 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"github.com/insionng/macross"
+)
+
+// ErrInvalidCiphertext is returned by EncryptedCookieCodec for a session id
+// cookie it can't decrypt.
+var ErrInvalidCiphertext = errors.New("session: can't decrypt the session id")
+
+// EncryptedCookieCodec is a CookieCodec encrypting the session id with
+// AES-GCM, so clients only see ciphertext and can't learn or enumerate the
+// provider keys from captured cookies. The cookie name is authenticated too.
+type EncryptedCookieCodec struct {
+	aead cipher.AEAD
+	// Codec reads and writes the encrypted cookie, macross cookies by default.
+	Codec CookieCodec
+}
+
+// NewEncryptedCookieCodec returns an EncryptedCookieCodec using key,
+// 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+func NewEncryptedCookieCodec(key []byte) (*EncryptedCookieCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedCookieCodec{aead: aead}, nil
+}
+
+func (ec *EncryptedCookieCodec) codec() CookieCodec {
+	if ec.Codec == nil {
+		return macrossCookieCodec{}
+	}
+	return ec.Codec
+}
+
+// Read returns the decrypted session id of the cookie name.
+func (ec *EncryptedCookieCodec) Read(ctx *macross.Context, name string) (string, error) {
+	value, err := ec.codec().Read(ctx, name)
+	if err != nil || value == "" {
+		return value, err
+	}
+	return ec.decrypt(name, value)
+}
+
+// decrypt returns the value encrypted for the cookie name.
+func (ec *EncryptedCookieCodec) decrypt(name, value string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	size := ec.aead.NonceSize()
+	if err != nil || len(b) < size {
+		return "", ErrInvalidCiphertext
+	}
+	plain, err := ec.aead.Open(nil, b[:size], b[size:], []byte(name))
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	return string(plain), nil
+}
+
+// ErrUndecryptable is returned by EncryptedCodec for session data none of its
+// keys decrypts.
+var ErrUndecryptable = errors.New("session: can't decrypt the session values with any key")
+
+// EncryptedCodec encrypts the session values encoded by Codec with AES-GCM,
+// so the backend of the provider (redis, files, sql) only stores ciphertext.
+// Its keys are listed newest first: the values are encrypted with the first
+// key and decrypted with any of them, so keys rotate without downtime. Put the
+// new key first, a session read with an old key is encrypted with the new one
+// by its next write, and remove the old key once the sessions not written
+// since had time to expire.
+type EncryptedCodec struct {
+	aeads []cipher.AEAD
+	// Codec encodes the values before their encryption, GobCodec when nil.
+	Codec Codec
+}
+
+// NewEncryptedCodec returns an EncryptedCodec encrypting with the first of keys,
+// each 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+func NewEncryptedCodec(codec Codec, keys ...[]byte) (*EncryptedCodec, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("session: EncryptedCodec needs a key")
+	}
+	ec := &EncryptedCodec{Codec: codec}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ec.aeads = append(ec.aeads, aead)
+	}
+	return ec, nil
+}
+
+func (ec *EncryptedCodec) codec() Codec {
+	if ec.Codec == nil {
+		return GobCodec{}
+	}
+	return ec.Codec
+}
+
+// Encode encodes values with Codec and encrypts them with the newest key.
+func (ec *EncryptedCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	b, err := ec.codec().Encode(values)
+	if err != nil {
+		return nil, err
+	}
+	aead := ec.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, b, nil), nil
+}
+
+// Decode decrypts data with the first key that can, then decodes the values
+// with Codec.
+func (ec *EncryptedCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	for _, aead := range ec.aeads {
+		size := aead.NonceSize()
+		if len(data) < size {
+			continue
+		}
+		if b, err := aead.Open(nil, data[:size], data[size:], nil); err == nil {
+			return ec.codec().Decode(b)
+		}
+	}
+	return nil, ErrUndecryptable
+}
+
+// Write encrypts the cookie value with a random nonce.
+func (ec *EncryptedCookieCodec) Write(ctx *macross.Context, cookie *macross.Cookie) {
+	cookie.SetValue(ec.encrypt(cookie.Name(), cookie.Value()))
+	ec.codec().Write(ctx, cookie)
+}
+
+// encrypt returns value encrypted for the cookie name.
+func (ec *EncryptedCookieCodec) encrypt(name, value string) string {
+	nonce := make([]byte, ec.aead.NonceSize(), ec.aead.NonceSize()+len(value)+ec.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic("session: can't read a random nonce: " + err.Error())
+	}
+	b := ec.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (ec *EncryptedCookieCodec) encodeValue(name, value string) (string, error) {
+	return encodeValue(ec.codec(), name, ec.encrypt(name, value))
+}
+
+func (ec *EncryptedCookieCodec) decodeValue(name, value string) (string, error) {
+	value, err := decodeValue(ec.codec(), name, value)
+	if err != nil {
+		return "", err
+	}
+	return ec.decrypt(name, value)
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insionng/macross"
+)
+
+func TestEncryptedCookieCodec(t *testing.T) {
+	codec, err := NewEncryptedCookieCodec([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestApp(t, Options{
+		Provider:    "memory",
+		Config:      `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+		CookieCodec: codec,
+	})
+	var sid, got string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, _ = c.Session.Get("user").(string)
+		return nil
+	})
+
+	cookies := sessionCookies(t, doRequest(m, "/set", nil))
+	value := cookies[testCookieName]
+	if strings.Contains(value, sid) {
+		t.Fatal("sid readable in the cookie")
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(value); err != nil || len(b) <= len(sid) {
+		t.Fatalf("cookie value %q isn't ciphertext", value)
+	}
+
+	doRequest(m, "/get", cookies)
+	if got != "insionng" {
+		t.Fatal("cookie not decrypted to the sid")
+	}
+
+	// the plain sid, a tampered ciphertext or another key start a new session.
+	other, _ := NewEncryptedCookieCodec([]byte("fedcba9876543210"))
+	tampered := []byte(value)
+	tampered[len(tampered)-1] ^= 1
+	for _, c := range []struct {
+		codec *EncryptedCookieCodec
+		value string
+	}{
+		{codec, sid},
+		{codec, string(tampered)},
+		{other, value},
+	} {
+		m = newTestApp(t, Options{
+			Provider:    "memory",
+			Config:      `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+			CookieCodec: c.codec,
+		})
+		m.Get("/get", func(c *macross.Context) error {
+			got, _ = c.Session.Get("user").(string)
+			return nil
+		})
+		got = ""
+		doRequest(m, "/get", map[string]string{testCookieName: c.value})
+		if got != "" {
+			t.Fatalf("cookie %q accepted", c.value)
+		}
+	}
+
+	if _, err = NewEncryptedCookieCodec([]byte("short")); err == nil {
+		t.Fatal("bad key size accepted")
+	}
+}
+
+func TestEncryptedCookieCodecSidSources(t *testing.T) {
+	codec, err := NewEncryptedCookieCodec([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSidSources(t, codec)
+}
+
+func TestEncryptedCodecRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldKey, newKey := []byte("0123456789abcdef"), []byte("fedcba9876543210")
+	newManager := func(keys ...[]byte) *Manager {
+		codec, err := NewEncryptedCodec(nil, keys...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager, err := NewManagerWithConfig("file", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, FileConfig{SavePath: dir, Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manager
+	}
+
+	manager := newManager(oldKey)
+	store, _ := manager.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "a", "a", "aaaa")); bytes.Contains(b, []byte("insionng")) {
+		t.Fatal("value stored in clear")
+	}
+
+	// the old key still decrypts the session once the new key is first.
+	manager = newManager(newKey, oldKey)
+	store, _ = manager.Read("aaaa")
+	if store.Get("user") != "insionng" {
+		t.Fatalf("value of the old key read as %v", store.Get("user"))
+	}
+	store.Set("cart", 2)
+	store.Release(nil)
+
+	// the write encrypted the session with the new key alone.
+	manager = newManager(newKey)
+	if store, _ = manager.Read("aaaa"); store.Get("user") != "insionng" || store.Get("cart") != 2 {
+		t.Fatalf("session not re-encrypted with the new key: %v %v", store.Get("user"), store.Get("cart"))
+	}
+	manager = newManager(oldKey)
+	if _, err = manager.Read("aaaa"); err == nil {
+		t.Fatal("session still encrypted with the old key")
+	}
+
+	if _, err = NewEncryptedCodec(nil); err == nil {
+		t.Fatal("codec without keys accepted")
+	}
+	if _, err = (&EncryptedCodec{aeads: nil}).Decode([]byte("garbage")); err != ErrUndecryptable {
+		t.Fatalf("Decode of garbage: %v", err)
+	}
+}
@@ -1,33 +1,58 @@
 package session
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/insionng/macross"
 )
 
-var (
-	filepder      = &FileProvider{}
-	gcMaxLifetime int64
-)
+var filepder = &FileProvider{}
 
 // FileSessionStore File session store
 type FileSessionStore struct {
-	sid    string
-	lock   sync.RWMutex
-	values map[interface{}]interface{}
+	sid     string
+	lock    sync.RWMutex
+	values  map[interface{}]interface{}
+	raw     []byte // encoded values, decoded on first use
+	stamp   int64  // access time stored in the file, 0 for files of older versions
+	version uint64 // releases that changed the values, stored in the file
+	once    sync.Once
+	codec   Codec
+	lazy    bool   // skip the write of unchanged sessions
+	stored  []byte // encoded values as stored, to tell the changed releases
+	// decodeErr is why the stored values couldn't be decoded, the session
+	// then isn't written over.
+	decodeErr error
+}
+
+// load decodes the stored values on first access,
+// so requests that never touch the session skip the decode cost.
+func (fs *FileSessionStore) load() {
+	fs.once.Do(func() {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		fs.values, fs.decodeErr = decodeRaw(fs.codec, fs.raw)
+		fs.stored = fs.raw
+		fs.raw = nil
+	})
 }
 
 // Set value to file session
 func (fs *FileSessionStore) Set(key, value interface{}) error {
+	fs.load()
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 	fs.values[key] = value
@@ -36,6 +61,7 @@ func (fs *FileSessionStore) Set(key, value interface{}) error {
 
 // Get value from file session
 func (fs *FileSessionStore) Get(key interface{}) interface{} {
+	fs.load()
 	fs.lock.RLock()
 	defer fs.lock.RUnlock()
 	if v, ok := fs.values[key]; ok {
@@ -46,6 +72,7 @@ func (fs *FileSessionStore) Get(key interface{}) interface{} {
 
 // Delete value in file session by given key
 func (fs *FileSessionStore) Delete(key interface{}) error {
+	fs.load()
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 	delete(fs.values, key)
@@ -54,12 +81,68 @@ func (fs *FileSessionStore) Delete(key interface{}) error {
 
 // Flush Clean all values in file session
 func (fs *FileSessionStore) Flush() error {
+	fs.load()
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 	fs.values = make(map[interface{}]interface{})
 	return nil
 }
 
+// SetAll replaces all values of file session
+func (fs *FileSessionStore) SetAll(values map[interface{}]interface{}) error {
+	fs.load()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.values = values
+	return nil
+}
+
+// GetOrSet returns the value of key, or sets it to the value of factory,
+// called under the session lock, and returns it.
+func (fs *FileSessionStore) GetOrSet(key interface{}, factory func() (interface{}, error)) (interface{}, error) {
+	fs.load()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if v, ok := fs.values[key]; ok {
+		return v, nil
+	}
+	value, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	fs.values[key] = value
+	return value, nil
+}
+
+// Take returns the value of key and deletes it, under the session lock.
+func (fs *FileSessionStore) Take(key interface{}) interface{} {
+	fs.load()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	v := fs.values[key]
+	delete(fs.values, key)
+	return v
+}
+
+// Keys returns the keys of all values in the session
+func (fs *FileSessionStore) Keys() []interface{} {
+	fs.load()
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	keys := make([]interface{}, 0, len(fs.values))
+	for k := range fs.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Version returns how many releases changed the values of the session.
+func (fs *FileSessionStore) Version() uint64 {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.version
+}
+
 // ID Get file session store id
 func (fs *FileSessionStore) ID() string {
 	return fs.sid
@@ -67,11 +150,57 @@ func (fs *FileSessionStore) ID() string {
 
 // SessionRelease Write file session to local file with Gob string
 func (fs *FileSessionStore) Release(ctx *macross.Context) (err error) {
+	return fs.ReleaseContext(context.Background(), ctx)
+}
+
+// ReleaseContext writes the session file unless ctx is done first.
+func (fs *FileSessionStore) ReleaseContext(ctx context.Context, c *macross.Context) (err error) {
 	var b []byte
-	b, err = EncodeGob(fs.values)
+	changed := false
+	fs.lock.RLock()
+	switch {
+	case fs.decodeErr != nil:
+		fs.lock.RUnlock()
+		return fs.decodeErr
+	case fs.values == nil && fs.lazy:
+		// never accessed, so unchanged.
+		fs.lock.RUnlock()
+		return nil
+	case fs.values == nil:
+		// never accessed, write back the stored bytes as they are.
+		b = fs.raw
+	case Unchanged(fs.codec, fs.stored, fs.values):
+		if fs.lazy {
+			fs.lock.RUnlock()
+			return nil
+		}
+		b = fs.stored
+	default:
+		b, err = fs.codec.Encode(fs.values)
+		changed = !UnchangedValues(fs.codec, fs.stored, fs.values)
+	}
+	fs.lock.RUnlock()
 	if err != nil {
 		return
 	}
+	fs.lock.Lock()
+	fs.stored = b
+	if changed {
+		fs.version++
+	}
+	version := fs.version
+	fs.lock.Unlock()
+	b = joinVersion(version, b)
+	// the stored access time never goes back, so a server with a late clock
+	// doesn't shorten the session.
+	stamp := filepder.clock().Unix()
+	if fs.stamp > stamp {
+		stamp = fs.stamp
+	}
+	b = joinStamp(stamp, b)
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	_, err = os.Stat(path.Join(filepder.savePath, string(fs.sid[0]), string(fs.sid[1]), fs.sid))
 	var f *os.File
 	if err == nil {
@@ -88,18 +217,168 @@ func (fs *FileSessionStore) Release(ctx *macross.Context) (err error) {
 	return
 }
 
+// FileConfig File session provider config
+type FileConfig struct {
+	SavePath string `json:"savePath"`
+	// Codec encodes the session values, GobCodec by default.
+	Codec Codec `json:"-"`
+	// Encoding stores the encoded values as "base64" or "hex" text, see TextCodec.
+	Encoding string `json:"encoding"`
+}
+
 // FileProvider File session provider
+// Sessions expire from the access time stored in their file rather than the
+// file modification time, which the servers sharing the save path (e.g. over
+// nfs) set with their own clocks. The gc tolerates the clockSkew of the manager.
 type FileProvider struct {
 	lock        sync.RWMutex
 	maxLifetime int64
 	savePath    string
+	jitter      int   // expiry jitter percentage
+	skew        int64 // tolerated clock skew in seconds
+	lazy        bool  // skip the write of unchanged sessions
+	lazyDecode  bool  // decode the values on first access
+	codec       Codec
+	now         func() time.Time
+}
+
+// stampPrefix starts the access time line of session files.
+const stampPrefix = "session-stamp:"
+
+// joinStamp prepends the access time line to the encoded values.
+func joinStamp(stamp int64, raw []byte) []byte {
+	head := stampPrefix + strconv.FormatInt(stamp, 10) + "\n"
+	return append([]byte(head), raw...)
+}
+
+// splitStamp returns the access time and the encoded values of a session file,
+// ok is false for the files of older versions, only holding the values.
+func splitStamp(b []byte) (stamp int64, raw []byte, ok bool) {
+	if !bytes.HasPrefix(b, []byte(stampPrefix)) {
+		return 0, b, false
+	}
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		return 0, b, false
+	}
+	stamp, err := strconv.ParseInt(string(b[len(stampPrefix):end]), 10, 64)
+	if err != nil {
+		return 0, b, false
+	}
+	return stamp, b[end+1:], true
+}
+
+// versionPrefix starts the version line of session files, following the
+// access time line. It's left out until the first change of the values.
+const versionPrefix = "session-version:"
+
+// joinVersion prepends the version line to the encoded values.
+func joinVersion(version uint64, raw []byte) []byte {
+	if version == 0 {
+		return raw
+	}
+	head := versionPrefix + strconv.FormatUint(version, 10) + "\n"
+	return append([]byte(head), raw...)
+}
+
+// splitVersion returns the version and the encoded values following it,
+// 0 and raw if raw has no version line.
+func splitVersion(raw []byte) (uint64, []byte) {
+	if !bytes.HasPrefix(raw, []byte(versionPrefix)) {
+		return 0, raw
+	}
+	end := bytes.IndexByte(raw, '\n')
+	if end < 0 {
+		return 0, raw
+	}
+	version, err := strconv.ParseUint(string(raw[len(versionPrefix):end]), 10, 64)
+	if err != nil {
+		return 0, raw
+	}
+	return version, raw[end+1:]
+}
+
+// readStamp returns the access time stored in the session file at path.
+func readStamp(path string) (int64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	b := make([]byte, len(stampPrefix)+21)
+	n, _ := io.ReadFull(f, b)
+	stamp, _, ok := splitStamp(b[:n])
+	return stamp, ok
+}
+
+func (fp *FileProvider) clock() time.Time {
+	if fp.now == nil {
+		return time.Now()
+	}
+	return fp.now()
+}
+
+// newStore returns the session sid of the file content b.
+func (fp *FileProvider) newStore(sid string, b []byte) *FileSessionStore {
+	stamp, raw, _ := splitStamp(b)
+	version, raw := splitVersion(raw)
+	if ahead := stamp - fp.clock().Unix(); ahead > fp.skew {
+		log.Printf("session: file session %s was written %ds ahead of this server clock, more than clockSkew", sid, ahead)
+	}
+	return &FileSessionStore{sid: sid, raw: raw, stamp: stamp, version: version, codec: fp.codec, lazy: fp.lazy}
+}
+
+// decoded returns fs, its values decoded at once unless they're decoded
+// lazily, see SetLazyDecode.
+func (fp *FileProvider) decoded(fs *FileSessionStore) (macross.RawStore, error) {
+	if !fp.lazyDecode {
+		if fs.load(); fs.decodeErr != nil {
+			return nil, fs.decodeErr
+		}
+	}
+	return fs, nil
 }
 
 // Init Init file session provider.
 // savePath sets the session files path.
 func (fp *FileProvider) Init(maxLifetime int64, savePath string) error {
+	fp.configure(maxLifetime, savePath, GobCodec{})
+	return nil
+}
+
+// configure sets the settings of Init under the lock, the gc of an earlier
+// manager may still sweep the provider.
+func (fp *FileProvider) configure(maxLifetime int64, savePath string, codec Codec) {
+	filepder.lock.Lock()
+	defer filepder.lock.Unlock()
 	fp.maxLifetime = maxLifetime
 	fp.savePath = savePath
+	fp.codec = codec
+}
+
+// InitWithConfig Init file session provider with a FileConfig
+// or the save path string.
+func (fp *FileProvider) InitWithConfig(maxLifetime int64, cfg interface{}) error {
+	var cf FileConfig
+	switch v := cfg.(type) {
+	case FileConfig:
+		cf = v
+	case *FileConfig:
+		cf = *v
+	case string:
+		cf.SavePath = v
+	default:
+		return fmt.Errorf("session: file provider does not support config %T", cfg)
+	}
+	codec := cf.Codec
+	if codec == nil {
+		codec = GobCodec{}
+	}
+	codec, err := NewTextCodec(codec, cf.Encoding)
+	if err != nil {
+		return err
+	}
+	fp.configure(maxLifetime, cf.SavePath, codec)
 	return nil
 }
 
@@ -124,29 +403,19 @@ func (fp *FileProvider) Read(sid string) (macross.RawStore, error) {
 		return nil, err
 	}
 	os.Chtimes(path.Join(fp.savePath, string(sid[0]), string(sid[1]), sid), time.Now(), time.Now())
-	var kv map[interface{}]interface{}
 	b, err := ioutil.ReadAll(f)
 	if err != nil {
 		return nil, err
 	}
-	if len(b) == 0 {
-		kv = make(map[interface{}]interface{})
-	} else {
-		kv, err = DecodeGob(b)
-		if err != nil {
-			return nil, err
-		}
-	}
 	f.Close()
-	ss := &FileSessionStore{sid: sid, values: kv}
-	return ss, nil
+	return fp.decoded(fp.newStore(sid, b))
 }
 
 // Exist Check file session exist.
 // it checkes the file named from sid exist or not.
 func (fp *FileProvider) Exist(sid string) bool {
-	filepder.lock.Lock()
-	defer filepder.lock.Unlock()
+	filepder.lock.RLock()
+	defer filepder.lock.RUnlock()
 
 	_, err := os.Stat(path.Join(fp.savePath, string(sid[0]), string(sid[1]), sid))
 	if err == nil {
@@ -163,13 +432,153 @@ func (fp *FileProvider) Destory(sid string) error {
 	return nil
 }
 
+// DestroyAll Remove all session files in save path, the other files there
+// are left alone. The lock is held by each removal only, not the whole walk.
+func (fp *FileProvider) DestroyAll() error {
+	if _, err := os.Stat(fp.savePath); os.IsNotExist(err) {
+		return nil
+	}
+	var paths []string
+	err := filepath.Walk(fp.savePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && fp.isSessionFile(path) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		filepder.lock.Lock()
+		err = os.Remove(path)
+		filepder.lock.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSessionFile reports whether the file at path is laid out as the file of
+// a session, savePath/sid[0]/sid[1]/sid.
+func (fp *FileProvider) isSessionFile(path string) bool {
+	rel, err := filepath.Rel(fp.savePath, path)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	return len(parts) == 3 && len(parts[2]) >= 2 &&
+		parts[0] == parts[2][:1] && parts[1] == parts[2][1:2]
+}
+
 // GC Recycle files in save path
 func (fp *FileProvider) GC() {
+	fp.Sweep()
+}
+
+// Sweep removes the expired session files and returns how many.
+func (fp *FileProvider) Sweep() (removed int, err error) {
+	return fp.sweep(0)
+}
+
+// reconcileGrace is how long after their last modification files are left
+// alone by Reconcile, as they may still be being written.
+const reconcileGrace = time.Minute
+
+// Reconcile removes the session files which expired while no gc ran, e.g.
+// during a downtime, logs and returns how many. It's run at startup by the
+// reconcileOnStart config, files modified within reconcileGrace are kept.
+func (fp *FileProvider) Reconcile() (removed int, err error) {
+	if _, err = os.Stat(fp.savePath); os.IsNotExist(err) {
+		// no session written yet.
+		return 0, nil
+	}
+	removed, err = fp.sweep(reconcileGrace)
+	log.Printf("session: reconciled file sessions in %s, removed %d expired", fp.savePath, removed)
+	return removed, err
+}
+
+// sweep removes the expired session files not modified within grace.
+func (fp *FileProvider) sweep(grace time.Duration) (removed int, err error) {
 	filepder.lock.Lock()
 	defer filepder.lock.Unlock()
 
-	gcMaxLifetime = fp.maxLifetime
-	filepath.Walk(fp.savePath, gcpath)
+	err = filepath.Walk(fp.savePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || time.Since(info.ModTime()) < grace {
+			return nil
+		}
+		if fp.expired(path, info) && os.Remove(path) == nil {
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// SIDs returns the ids of the unexpired session files.
+func (fp *FileProvider) SIDs() (sids []string, err error) {
+	filepder.lock.RLock()
+	defer filepder.lock.RUnlock()
+
+	if _, err = os.Stat(fp.savePath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	err = filepath.Walk(fp.savePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !fp.expired(path, info) {
+			sids = append(sids, info.Name())
+		}
+		return nil
+	})
+	return sids, err
+}
+
+// expired reports whether the session file at path is past its lifetime and
+// the clock skew, from its stored access time, or its modification time for
+// files of older versions.
+func (fp *FileProvider) expired(path string, info os.FileInfo) bool {
+	stamp, ok := readStamp(path)
+	if !ok {
+		stamp = info.ModTime().Unix()
+	}
+	return stamp+Jitter(fp.maxLifetime, fp.jitter, info.Name())+fp.skew < fp.clock().Unix()
+}
+
+// SetClockSkew keeps sessions seconds longer, as the servers sharing the
+// save path may have clocks off by that much.
+func (fp *FileProvider) SetClockSkew(seconds int64) {
+	filepder.lock.Lock()
+	defer filepder.lock.Unlock()
+	fp.skew = seconds
+}
+
+// SetLazyRelease skips writing back the sessions left unchanged.
+func (fp *FileProvider) SetLazyRelease(lazy bool) {
+	filepder.lock.Lock()
+	defer filepder.lock.Unlock()
+	fp.lazy = lazy
+}
+
+// SetLazyDecode decodes the values of the sessions on their first access.
+func (fp *FileProvider) SetLazyDecode(lazy bool) {
+	filepder.lock.Lock()
+	defer filepder.lock.Unlock()
+	fp.lazyDecode = lazy
+}
+
+// SetExpiryJitter spread the session expiries by ±percent% of the lifetime
+func (fp *FileProvider) SetExpiryJitter(percent int) {
+	filepder.lock.Lock()
+	defer filepder.lock.Unlock()
+	fp.jitter = percent
 }
 
 // SessionCount Get active file session number.
@@ -219,37 +628,16 @@ func (fp *FileProvider) Regenerate(oldsid, sid string) (macross.RawStore, error)
 		return nil, err
 	}
 	f.Close()
-	os.Remove(path.Join(fp.savePath, string(oldsid[0]), string(oldsid[1])))
+	os.Remove(path.Join(fp.savePath, string(oldsid[0]), string(oldsid[1]), oldsid))
 	os.Chtimes(path.Join(fp.savePath, string(sid[0]), string(sid[1]), sid), time.Now(), time.Now())
-	var kv map[interface{}]interface{}
+	// read the copied values back from the start of the new file.
+	newf.Seek(0, 0)
 	b, err := ioutil.ReadAll(newf)
+	newf.Close()
 	if err != nil {
 		return nil, err
 	}
-	if len(b) == 0 {
-		kv = make(map[interface{}]interface{})
-	} else {
-		kv, err = DecodeGob(b)
-		if err != nil {
-			return nil, err
-		}
-	}
-	ss := &FileSessionStore{sid: sid, values: kv}
-	return ss, nil
-}
-
-// remove file in save path if expired
-func gcpath(path string, info os.FileInfo, err error) error {
-	if err != nil {
-		return err
-	}
-	if info.IsDir() {
-		return nil
-	}
-	if (info.ModTime().Unix() + gcMaxLifetime) < time.Now().Unix() {
-		os.Remove(path)
-	}
-	return nil
+	return fp.decoded(fp.newStore(sid, b))
 }
 
 type activeSession struct {
@@ -2,6 +2,8 @@ package session
 
 import (
 	"container/list"
+	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
@@ -17,12 +19,22 @@ type MemSessionStore struct {
 	timeAccessed time.Time                   //last access time
 	value        map[interface{}]interface{} //session store
 	lock         sync.RWMutex
+	dirty        bool      // values changed since the last release
+	version      uint64    // releases that changed the values
+	keepUntil    time.Time // kept past its lifetime until then, see SetExpiry
 }
 
-// Set value to memory session
+// Set value to memory session.
+// the value is stored as a deep copy, not encoded, so later changes
+// by the caller don't show up in the session.
 func (st *MemSessionStore) Set(key, value interface{}) error {
+	value = deepCopy(value)
 	st.lock.Lock()
 	defer st.lock.Unlock()
+	// the metadata isn't counted in the version.
+	if old, ok := st.value[key]; key != metaKey && (!ok || !reflect.DeepEqual(old, value)) {
+		st.dirty = true
+	}
 	st.value[key] = value
 	return nil
 }
@@ -41,6 +53,9 @@ func (st *MemSessionStore) Get(key interface{}) interface{} {
 func (st *MemSessionStore) Delete(key interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
+	if _, ok := st.value[key]; ok && key != metaKey {
+		st.dirty = true
+	}
 	delete(st.value, key)
 	return nil
 }
@@ -49,20 +64,93 @@ func (st *MemSessionStore) Delete(key interface{}) error {
 func (st *MemSessionStore) Flush() error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
+	if len(st.value) > 0 {
+		st.dirty = true
+	}
 	st.value = make(map[interface{}]interface{})
 	return nil
 }
 
+// SetAll replaces all values of memory session by deep copies of values
+func (st *MemSessionStore) SetAll(values map[interface{}]interface{}) error {
+	copied := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		copied[k] = deepCopy(v)
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if !sameValues(st.value, copied) {
+		st.dirty = true
+	}
+	st.value = copied
+	return nil
+}
+
+// GetOrSet returns the value of key, or sets it to a deep copy of the value of
+// factory, called under the session lock, and returns it.
+func (st *MemSessionStore) GetOrSet(key interface{}, factory func() (interface{}, error)) (interface{}, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if v, ok := st.value[key]; ok {
+		return v, nil
+	}
+	value, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	value = deepCopy(value)
+	st.value[key] = value
+	st.dirty = true
+	return value, nil
+}
+
+// Take returns the value of key and deletes it, under the session lock.
+func (st *MemSessionStore) Take(key interface{}) interface{} {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	v, ok := st.value[key]
+	if ok {
+		delete(st.value, key)
+		st.dirty = true
+	}
+	return v
+}
+
+// Keys returns the keys of all values in the session
+func (st *MemSessionStore) Keys() []interface{} {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	keys := make([]interface{}, 0, len(st.value))
+	for k := range st.value {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 // SessionID get this id of memory session store
 func (st *MemSessionStore) ID() string {
 	return st.sid
 }
 
-// SessionRelease Implement method, no used.
+// SessionRelease counts a write if the values changed since the last release,
+// they're already in memory.
 func (st *MemSessionStore) Release(ctx *macross.Context) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.dirty {
+		st.version++
+		st.dirty = false
+	}
 	return nil
 }
 
+// Version returns how many releases changed the values of the session.
+func (st *MemSessionStore) Version() uint64 {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.version
+}
+
 // MemProvider Implement the provider interface
 type MemProvider struct {
 	lock        sync.RWMutex             // locker
@@ -70,15 +158,39 @@ type MemProvider struct {
 	list        *list.List               // for gc
 	maxLifetime int64
 	savePath    string
+	jitter      int              // expiry jitter percentage
+	now         func() time.Time // time.Now if nil, replaced by the tests
+}
+
+func (pder *MemProvider) clock() time.Time {
+	if pder.now == nil {
+		return time.Now()
+	}
+	return pder.now()
 }
 
 // Init init memory session
 func (pder *MemProvider) Init(maxLifetime int64, savePath string) error {
+	// the gc of an earlier manager may still sweep the provider.
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
 	pder.maxLifetime = maxLifetime
 	pder.savePath = savePath
 	return nil
 }
 
+// InitWithConfig init memory session, memory sessions have no options
+// besides the lifetime, so cfg must be nil or the save path string.
+func (pder *MemProvider) InitWithConfig(maxLifetime int64, cfg interface{}) error {
+	switch v := cfg.(type) {
+	case nil:
+		return pder.Init(maxLifetime, "")
+	case string:
+		return pder.Init(maxLifetime, v)
+	}
+	return fmt.Errorf("session: memory provider does not support config %T", cfg)
+}
+
 // Read get memory session store by sid
 func (pder *MemProvider) Read(sid string) (macross.RawStore, error) {
 	pder.lock.RLock()
@@ -89,7 +201,7 @@ func (pder *MemProvider) Read(sid string) (macross.RawStore, error) {
 	}
 	pder.lock.RUnlock()
 	pder.lock.Lock()
-	newsess := &MemSessionStore{sid: sid, timeAccessed: time.Now(), value: make(map[interface{}]interface{})}
+	newsess := &MemSessionStore{sid: sid, timeAccessed: pder.clock(), value: make(map[interface{}]interface{})}
 	element := pder.list.PushFront(newsess)
 	pder.sessions[sid] = element
 
@@ -122,7 +234,7 @@ func (pder *MemProvider) Regenerate(oldsid, sid string) (macross.RawStore, error
 	}
 	pder.lock.RUnlock()
 	pder.lock.Lock()
-	newsess := &MemSessionStore{sid: sid, timeAccessed: time.Now(), value: make(map[interface{}]interface{})}
+	newsess := &MemSessionStore{sid: sid, timeAccessed: pder.clock(), value: make(map[interface{}]interface{})}
 	element := pder.list.PushFront(newsess)
 	pder.sessions[sid] = element
 	pder.lock.Unlock()
@@ -141,30 +253,81 @@ func (pder *MemProvider) Destory(sid string) error {
 	return nil
 }
 
+// DestroyAll delete all session stores in memory session
+func (pder *MemProvider) DestroyAll() error {
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+	pder.sessions = make(map[string]*list.Element)
+	pder.list.Init()
+	return nil
+}
+
 // GC clean expired session stores in memory session
 func (pder *MemProvider) GC() {
-	pder.lock.RLock()
-	for {
-		element := pder.list.Back()
-		if element == nil {
+	pder.Sweep()
+}
+
+// Sweep removes the expired session stores and returns how many.
+func (pder *MemProvider) Sweep() (removed int, err error) {
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+	now := pder.clock().Unix()
+	for element := pder.list.Back(); element != nil; {
+		prev := element.Prev()
+		st := element.Value.(*MemSessionStore)
+		kept := st.keepUntil.Unix() >= now
+		if st.timeAccessed.Unix()+Jitter(pder.maxLifetime, pder.jitter, st.sid) < now {
+			if !kept {
+				pder.list.Remove(element)
+				delete(pder.sessions, st.sid)
+				removed++
+			}
+		} else if pder.jitter == 0 {
+			// the list is ordered by access time, the rest is younger.
 			break
 		}
-		if (element.Value.(*MemSessionStore).timeAccessed.Unix() + pder.maxLifetime) < time.Now().Unix() {
-			pder.lock.RUnlock()
-			pder.lock.Lock()
-			pder.list.Remove(element)
-			delete(pder.sessions, element.Value.(*MemSessionStore).sid)
-			pder.lock.Unlock()
-			pder.lock.RLock()
-		} else {
-			break
+		element = prev
+	}
+	return removed, nil
+}
+
+// SIDs returns the ids of the unexpired session stores.
+func (pder *MemProvider) SIDs() ([]string, error) {
+	pder.lock.RLock()
+	defer pder.lock.RUnlock()
+	now := pder.clock().Unix()
+	sids := make([]string, 0, len(pder.sessions))
+	for sid, element := range pder.sessions {
+		st := element.Value.(*MemSessionStore)
+		if st.timeAccessed.Unix()+Jitter(pder.maxLifetime, pder.jitter, sid) >= now || st.keepUntil.Unix() >= now {
+			sids = append(sids, sid)
 		}
 	}
-	pder.lock.RUnlock()
+	return sids, nil
+}
+
+// SetExpiryJitter spread the session expiries by ±percent% of the lifetime
+func (pder *MemProvider) SetExpiryJitter(percent int) {
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+	pder.jitter = percent
+}
+
+// SetExpiry keeps session sid until d from now, even if it's idle longer
+// than the max lifetime.
+func (pder *MemProvider) SetExpiry(sid string, d time.Duration) error {
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+	if element, ok := pder.sessions[sid]; ok {
+		element.Value.(*MemSessionStore).keepUntil = pder.clock().Add(d)
+	}
+	return nil
 }
 
 // Count get count number of memory session
 func (pder *MemProvider) Count() int {
+	pder.lock.RLock()
+	defer pder.lock.RUnlock()
 	return pder.list.Len()
 }
 
@@ -173,7 +336,7 @@ func (pder *MemProvider) SessionUpdate(sid string) error {
 	pder.lock.Lock()
 	defer pder.lock.Unlock()
 	if element, ok := pder.sessions[sid]; ok {
-		element.Value.(*MemSessionStore).timeAccessed = time.Now()
+		element.Value.(*MemSessionStore).timeAccessed = pder.clock()
 		pder.list.MoveToFront(element)
 		return nil
 	}
@@ -0,0 +1,261 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+var mirrorpder = &MirrorProvider{}
+
+// mirrorConfig is the providerConfig of the mirror provider, naming two
+// registered providers and their own providerConfig.
+type mirrorConfig struct {
+	Primary         string `json:"primary"`
+	PrimaryConfig   string `json:"primaryConfig"`
+	Secondary       string `json:"secondary"`
+	SecondaryConfig string `json:"secondaryConfig"`
+}
+
+// MirrorProvider keeps every session in two providers for high availability,
+// e.g. two redis servers. Sessions are read from the primary, from the
+// secondary when the primary fails or lost them, and each release writes
+// both. A write failing on one side is logged, and that side isn't read for
+// the session until a release writes it again, so both sides are eventually
+// consistent.
+// Values are copied between the sides with the keys of their stores, so both
+// providers must list their keys.
+type MirrorProvider struct {
+	Provider
+	secondary Provider
+	lock      sync.Mutex
+	stale     map[string]Provider // sid -> side which missed its last write
+}
+
+// NewMirrorProvider returns a provider mirroring the sessions of primary to
+// secondary, both initialized.
+func NewMirrorProvider(primary, secondary Provider) *MirrorProvider {
+	return &MirrorProvider{Provider: primary, secondary: secondary, stale: make(map[string]Provider)}
+}
+
+// Init initializes the providers named by the json config, e.g.
+// {"primary":"redis","primaryConfig":"10.0.0.1:6379","secondary":"redis-b","secondaryConfig":"10.0.0.2:6379"}.
+// Register a second instance of a provider under another name to mirror two
+// servers of the same kind.
+func (mp *MirrorProvider) Init(maxLifetime int64, config string) error {
+	var cf mirrorConfig
+	if err := json.Unmarshal([]byte(config), &cf); err != nil {
+		return fmt.Errorf("session: mirror provider config: %v", err)
+	}
+	if cf.Primary == cf.Secondary {
+		return fmt.Errorf("session: mirror provider needs two providers, got %q twice", cf.Primary)
+	}
+	names := []string{cf.Primary, cf.Secondary}
+	configs := []string{cf.PrimaryConfig, cf.SecondaryConfig}
+	providers := make([]Provider, 2)
+	for i, name := range names {
+		p, ok := provides[name]
+		if !ok || p == mirrorpder {
+			return fmt.Errorf("session: mirror provider can't mirror provide %q", name)
+		}
+		if err := p.Init(maxLifetime, configs[i]); err != nil {
+			return err
+		}
+		providers[i] = p
+	}
+	mp.Provider, mp.secondary = providers[0], providers[1]
+	mp.stale = make(map[string]Provider)
+	return nil
+}
+
+// other returns the side of the mirror other than p.
+func (mp *MirrorProvider) other(p Provider) Provider {
+	if p == mp.Provider {
+		return mp.secondary
+	}
+	return mp.Provider
+}
+
+// isStale reports whether p missed the last write of session sid.
+func (mp *MirrorProvider) isStale(sid string, p Provider) bool {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	return mp.stale[sid] == p
+}
+
+// setStale records the side p which missed the last write of session sid,
+// nil once both sides were written.
+func (mp *MirrorProvider) setStale(sid string, p Provider) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	if p == nil {
+		delete(mp.stale, sid)
+		return
+	}
+	mp.stale[sid] = p
+}
+
+// Read returns session sid of the primary, or of the secondary if the primary
+// fails, doesn't have it or missed its last write.
+func (mp *MirrorProvider) Read(sid string) (macross.RawStore, error) {
+	if !mp.isStale(sid, mp.Provider) {
+		store, err := mp.Provider.Read(sid)
+		if err == nil && (mp.isStale(sid, mp.secondary) || mp.Provider.Exist(sid) || !mp.secondary.Exist(sid)) {
+			return &mirrorStore{wrappedStore: wrappedStore{store}, mp: mp, from: mp.Provider}, nil
+		}
+		if err != nil {
+			log.Printf("session: mirror primary read of %s: %v", sid, err)
+		}
+	}
+	store, err := mp.secondary.Read(sid)
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorStore{wrappedStore: wrappedStore{store}, mp: mp, from: mp.secondary}, nil
+}
+
+// Exist checks both providers.
+func (mp *MirrorProvider) Exist(sid string) bool {
+	return mp.Provider.Exist(sid) || mp.secondary.Exist(sid)
+}
+
+// Regenerate regenerates the session in both providers, and returns the
+// store of the primary unless only the secondary had oldsid.
+func (mp *MirrorProvider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	inPrimary := mp.Provider.Exist(oldsid) && !mp.isStale(oldsid, mp.Provider)
+	mp.setStale(oldsid, nil)
+	store, err := mp.Provider.Regenerate(oldsid, sid)
+	secondary, serr := mp.secondary.Regenerate(oldsid, sid)
+	if err == nil && (inPrimary || serr != nil) {
+		if serr != nil {
+			log.Printf("session: mirror secondary regenerate of %s: %v", oldsid, serr)
+		}
+		return &mirrorStore{wrappedStore: wrappedStore{store}, mp: mp, from: mp.Provider}, nil
+	}
+	if err != nil {
+		log.Printf("session: mirror primary regenerate of %s: %v", oldsid, err)
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return &mirrorStore{wrappedStore: wrappedStore{secondary}, mp: mp, from: mp.secondary}, nil
+}
+
+// Destory deletes the session from both providers, failing if either fails
+// so a logged out session can't come back from the other.
+func (mp *MirrorProvider) Destory(sid string) error {
+	mp.setStale(sid, nil)
+	err := mp.Provider.Destory(sid)
+	if serr := mp.secondary.Destory(sid); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// DestroyAll deletes all sessions of both providers.
+func (mp *MirrorProvider) DestroyAll() error {
+	for _, p := range []Provider{mp.Provider, mp.secondary} {
+		dp, ok := p.(DestroyAllProvider)
+		if !ok {
+			return fmt.Errorf("session: provider %T does not support DestroyAll", p)
+		}
+		if err := dp.DestroyAll(); err != nil {
+			return err
+		}
+	}
+	mp.lock.Lock()
+	mp.stale = make(map[string]Provider)
+	mp.lock.Unlock()
+	return nil
+}
+
+// Retryable retries the errors either side retries.
+func (mp *MirrorProvider) Retryable(err error) bool {
+	return retryable(mp.Provider, err) || retryable(mp.secondary, err)
+}
+
+// SetExpiry extends the lifetime of the session in both providers.
+func (mp *MirrorProvider) SetExpiry(sid string, d time.Duration) error {
+	err := setExpiry(mp.Provider, sid, d)
+	if serr := setExpiry(mp.secondary, sid, d); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// SIDs returns the sessions of the primary.
+func (mp *MirrorProvider) SIDs() ([]string, error) {
+	return listSIDs(mp.Provider)
+}
+
+// GC runs the gc of both providers.
+func (mp *MirrorProvider) GC() {
+	if _, err := mp.Sweep(); err != nil {
+		log.Printf("session: gc: %v", err)
+	}
+}
+
+// Sweep runs the gc of both providers and returns how many sessions the
+// primary removed, counted if it's a SweepProvider.
+func (mp *MirrorProvider) Sweep() (int, error) {
+	if _, err := sweep(mp.secondary); err != nil {
+		log.Printf("session: mirror secondary gc: %v", err)
+	}
+	return sweep(mp.Provider)
+}
+
+// mirrorStore is a session store read from the side from of a MirrorProvider,
+// copied to the other side on release.
+type mirrorStore struct {
+	wrappedStore
+	mp   *MirrorProvider
+	from Provider
+}
+
+// Release writes the session to both providers, and fails only if both
+// writes fail.
+func (ms *mirrorStore) Release(ctx *macross.Context) error {
+	err := ms.RawStore.Release(ctx)
+	oerr := copyStore(ctx, ms.RawStore, ms.mp.other(ms.from))
+	switch {
+	case err != nil && oerr != nil:
+		return err
+	case err != nil:
+		log.Printf("session: mirror release of %s: %v", ms.ID(), err)
+		ms.mp.setStale(ms.ID(), ms.from)
+	case oerr != nil:
+		log.Printf("session: mirror copy of %s: %v", ms.ID(), oerr)
+		ms.mp.setStale(ms.ID(), ms.mp.other(ms.from))
+	default:
+		ms.mp.setStale(ms.ID(), nil)
+	}
+	return nil
+}
+
+// copyStore writes the values of from to its session in the provider to.
+func copyStore(ctx *macross.Context, from macross.RawStore, to Provider) error {
+	k, ok := from.(keyer)
+	if !ok {
+		return fmt.Errorf("session: can't copy from %T, it doesn't list its keys", from)
+	}
+	values := make(map[interface{}]interface{})
+	for _, key := range k.Keys() {
+		values[key] = from.Get(key)
+	}
+	store, err := to.Read(from.ID())
+	if err != nil {
+		return err
+	}
+	if err = setAll(store, values); err != nil {
+		return err
+	}
+	return store.Release(ctx)
+}
+
+func init() {
+	Register("mirror", mirrorpder)
+}
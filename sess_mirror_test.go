@@ -0,0 +1,145 @@
+package session
+
+import (
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/insionng/macross"
+)
+
+var errDown = errors.New("provider down")
+
+// downProvider is a memory provider which can be killed.
+type downProvider struct {
+	*MemProvider
+	down bool
+}
+
+func (dp *downProvider) Read(sid string) (macross.RawStore, error) {
+	if dp.down {
+		return nil, errDown
+	}
+	return dp.MemProvider.Read(sid)
+}
+
+func (dp *downProvider) Exist(sid string) bool {
+	return !dp.down && dp.MemProvider.Exist(sid)
+}
+
+func (dp *downProvider) Regenerate(oldsid, sid string) (macross.RawStore, error) {
+	if dp.down {
+		return nil, errDown
+	}
+	return dp.MemProvider.Regenerate(oldsid, sid)
+}
+
+func TestMirrorProvider(t *testing.T) {
+	primary := &downProvider{MemProvider: &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}}
+	secondary := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}
+	primary.Init(3600, "")
+	secondary.Init(3600, "")
+	mp := NewMirrorProvider(primary, secondary)
+
+	// writes reach both providers.
+	store, _ := mp.Read("aaaa")
+	store.Set("user", "insionng")
+	if err := store.Release(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []Provider{primary.MemProvider, secondary} {
+		if s, _ := p.Read("aaaa"); s.Get("user") != "insionng" {
+			t.Fatalf("session not written to %T", p)
+		}
+	}
+
+	// killing the primary serves the session from the secondary.
+	primary.down = true
+	store, err := mp.Read("aaaa")
+	if err != nil || store.Get("user") != "insionng" {
+		t.Fatalf("session not served by the secondary: %v", err)
+	}
+	store.Set("cart", "apple")
+	if err = store.Release(nil); err != nil {
+		t.Fatal("release failed with the secondary up:", err)
+	}
+	if store, err = mp.Regenerate("aaaa", "bbbb"); err != nil || store.Get("cart") != "apple" {
+		t.Fatalf("session not regenerated by the secondary: %v", err)
+	}
+	store.Release(nil)
+
+	// back up, the primary which missed the writes isn't read until written.
+	primary.down = false
+	primary.MemProvider.Regenerate("aaaa", "bbbb")
+	if store, _ = mp.Read("bbbb"); store.Get("cart") != "apple" {
+		t.Fatal("stale primary read")
+	}
+	store.Release(nil)
+	if s, _ := primary.MemProvider.Read("bbbb"); s.Get("cart") != "apple" {
+		t.Fatal("primary not written again")
+	}
+
+	if err = mp.Destory("bbbb"); err != nil || mp.Exist("bbbb") {
+		t.Fatalf("session not destroyed from both: %v", err)
+	}
+}
+
+func TestMirrorProviderConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager, err := NewManager("mirror", `{"cookieName":"`+testCookieName+`","gcLifetime":3600,`+
+		`"providerConfig":"{\"primary\":\"memory\",\"secondary\":\"file\",\"secondaryConfig\":\"`+dir+`\"}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ := manager.provider.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	if s, _ := filepder.Read("aaaa"); s.Get("user") != "insionng" {
+		t.Fatal("session not mirrored to the file provider")
+	}
+	if _, err = NewManager("mirror", `{"cookieName":"`+testCookieName+`","gcLifetime":3600,`+
+		`"providerConfig":"{\"primary\":\"memory\",\"secondary\":\"memory\"}"}`); err == nil {
+		t.Fatal("mirror of a provider with itself accepted")
+	}
+}
+
+func TestWrappedStoresForward(t *testing.T) {
+	newMem := func() *MemProvider {
+		p := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}
+		p.Init(3600, "")
+		return p
+	}
+	for _, p := range []Provider{
+		NewMirrorProvider(newMem(), newMem()),
+		NewReplicaProvider(newMem(), newMem()),
+		NewAsyncProvider(newMem(), 1),
+		NewCoalescingProvider(newMem(), 0),
+	} {
+		store, err := p.Read("aaaa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := store.(setAller); !ok {
+			t.Fatalf("%T: SetAll not forwarded", store)
+		}
+		if _, ok := store.(versioner); !ok {
+			t.Fatalf("%T: Version not forwarded", store)
+		}
+		gs, ok := store.(getOrSetter)
+		if !ok {
+			t.Fatalf("%T: GetOrSet not forwarded", store)
+		}
+		v, err := gs.GetOrSet("user", func() (interface{}, error) {
+			return "insionng", nil
+		})
+		if err != nil || v != "insionng" {
+			t.Fatalf("%T: GetOrSet = %v, %v", store, v, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/insionng/macross"
+)
+
+// ReplicaProvider reads the sessions from a read replica, e.g. of a
+// replicated database, and writes them to the primary: the releases,
+// Regenerate, Destory and the gc all go to the primary.
+// A session is read from the primary until the replica has it, and only while
+// the primary still has it, so a new session isn't lost nor a destroyed one
+// brought back by the replication lag. Values changed within the lag aren't
+// caught though: a request may read values older than the last write, and
+// its release writes them back over the newer ones. Keep sessions which must
+// be read after their writes, e.g. those changed by every request, on the
+// primary alone.
+type ReplicaProvider struct {
+	Provider
+	replica Provider
+}
+
+// NewReplicaProvider returns a provider reading the sessions of primary from
+// replica, both initialized. The stores of replica must list their keys.
+func NewReplicaProvider(primary, replica Provider) *ReplicaProvider {
+	return &ReplicaProvider{Provider: primary, replica: replica}
+}
+
+// Read returns session sid of the replica, written to the primary on release.
+func (rp *ReplicaProvider) Read(sid string) (macross.RawStore, error) {
+	if !rp.Provider.Exist(sid) || !rp.replica.Exist(sid) {
+		return rp.Provider.Read(sid)
+	}
+	store, err := rp.replica.Read(sid)
+	if err != nil {
+		return nil, err
+	}
+	return &replicaStore{wrappedStore: wrappedStore{store}, primary: rp.Provider}, nil
+}
+
+// DestroyAll deletes all sessions of the primary.
+func (rp *ReplicaProvider) DestroyAll() error {
+	p, ok := rp.Provider.(DestroyAllProvider)
+	if !ok {
+		return fmt.Errorf("session: provider %T does not support DestroyAll", rp.Provider)
+	}
+	return p.DestroyAll()
+}
+
+// Retryable retries the errors the primary or the replica retries.
+func (rp *ReplicaProvider) Retryable(err error) bool {
+	return retryable(rp.Provider, err) || retryable(rp.replica, err)
+}
+
+// SetExpiry extends the lifetime of the session in the primary.
+func (rp *ReplicaProvider) SetExpiry(sid string, d time.Duration) error {
+	return setExpiry(rp.Provider, sid, d)
+}
+
+// SIDs returns the sessions of the primary.
+func (rp *ReplicaProvider) SIDs() ([]string, error) {
+	return listSIDs(rp.Provider)
+}
+
+// Sweep runs the gc of the primary.
+func (rp *ReplicaProvider) Sweep() (int, error) {
+	return sweep(rp.Provider)
+}
+
+// replicaStore is a session store read from a replica, written to the primary.
+type replicaStore struct {
+	wrappedStore
+	primary Provider
+}
+
+// Release writes the session to the primary, never to the replica.
+func (rs *replicaStore) Release(ctx *macross.Context) error {
+	return copyStore(ctx, rs.RawStore, rs.primary)
+}
+
+// SetReadProvider makes the manager read the sessions from p, an initialized
+// read replica of its provider, which keeps the writes. See ReplicaProvider
+// for the consistency caveats. Call it at startup, before serving requests.
+func (manager *Manager) SetReadProvider(p Provider) {
+	manager.provider = NewReplicaProvider(manager.provider, p)
+}
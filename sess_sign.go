@@ -0,0 +1,102 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/insionng/macross"
+)
+
+// ErrInvalidSignature is returned by SignedCookieCodec for a session id cookie
+// not signed by any of its secrets.
+var ErrInvalidSignature = errors.New("session: invalid session id signature")
+
+// SignedCookieCodec is a CookieCodec signing the session id with HMAC-SHA256.
+// Secrets are ordered newest first: new cookies are signed with Secrets[0]
+// and cookies signed with any of them are accepted, so a secret can be rolled
+// by prepending the new one and dropping the old one once its cookies expired.
+type SignedCookieCodec struct {
+	Secrets []string
+	// Codec reads and writes the signed cookie, macross cookies by default.
+	Codec CookieCodec
+}
+
+// NewSignedCookieCodec returns a SignedCookieCodec using secrets, newest first.
+// It fails without secrets or with an empty one.
+func NewSignedCookieCodec(secrets ...string) (*SignedCookieCodec, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("session: signed cookie codec has no secrets")
+	}
+	for i, secret := range secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("session: signed cookie codec secret %d is empty", i)
+		}
+	}
+	return &SignedCookieCodec{Secrets: secrets}, nil
+}
+
+func (sc *SignedCookieCodec) codec() CookieCodec {
+	if sc.Codec == nil {
+		return macrossCookieCodec{}
+	}
+	return sc.Codec
+}
+
+func signValue(secret, value string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Read returns the session id of the cookie name once its signature verified.
+func (sc *SignedCookieCodec) Read(ctx *macross.Context, name string) (string, error) {
+	value, err := sc.codec().Read(ctx, name)
+	if err != nil || value == "" {
+		return value, err
+	}
+	return sc.verify(value)
+}
+
+// verify returns the value signed by one of the secrets.
+func (sc *SignedCookieCodec) verify(value string) (string, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", ErrInvalidSignature
+	}
+	value, sig := value[:i], value[i+1:]
+	for _, secret := range sc.Secrets {
+		if hmac.Equal([]byte(sig), []byte(signValue(secret, value))) {
+			return value, nil
+		}
+	}
+	return "", ErrInvalidSignature
+}
+
+// Write signs the cookie value with the newest secret.
+func (sc *SignedCookieCodec) Write(ctx *macross.Context, cookie *macross.Cookie) {
+	cookie.SetValue(sc.sign(string(cookie.Value())))
+	sc.codec().Write(ctx, cookie)
+}
+
+func (sc *SignedCookieCodec) sign(value string) string {
+	if len(sc.Secrets) == 0 {
+		return value
+	}
+	return value + "." + signValue(sc.Secrets[0], value)
+}
+
+func (sc *SignedCookieCodec) encodeValue(name, value string) (string, error) {
+	return encodeValue(sc.codec(), name, sc.sign(value))
+}
+
+func (sc *SignedCookieCodec) decodeValue(name, value string) (string, error) {
+	value, err := decodeValue(sc.codec(), name, value)
+	if err != nil {
+		return "", err
+	}
+	return sc.verify(value)
+}
@@ -0,0 +1,130 @@
+package session
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/insionng/macross"
+	"github.com/valyala/fasthttp"
+)
+
+func TestSignedCookieCodecRotation(t *testing.T) {
+	for _, secrets := range [][]string{nil, {"new", ""}} {
+		if _, err := NewSignedCookieCodec(secrets...); err == nil {
+			t.Fatalf("secrets %q accepted", secrets)
+		}
+	}
+	codec, err := NewSignedCookieCodec("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestApp(t, Options{
+		Provider:    "memory",
+		Config:      `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+		CookieCodec: codec,
+	})
+	defer GlobalManager.DestroyAll()
+	var sid, got string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, _ = c.Session.Get("user").(string)
+		return nil
+	})
+
+	oldCookies := sessionCookies(t, doRequest(m, "/set", nil))
+	if oldCookies[testCookieName] != sid+"."+signValue("old", sid) {
+		t.Fatalf("sid not signed, got %q", oldCookies[testCookieName])
+	}
+
+	// rolled: a sid signed with the older secret still validates.
+	codec.Secrets = []string{"new", "old"}
+	doRequest(m, "/get", oldCookies)
+	if got != "insionng" {
+		t.Fatal("sid signed with an older secret rejected")
+	}
+	cookies := sessionCookies(t, doRequest(m, "/set", nil))
+	if !strings.HasSuffix(cookies[testCookieName], "."+signValue("new", sid)) {
+		t.Fatal("new sid not signed with the newest secret")
+	}
+
+	// a secret dropped from the list invalidates its cookies.
+	codec.Secrets = []string{"new"}
+	got = ""
+	doRequest(m, "/get", oldCookies)
+	if got != "" {
+		t.Fatal("sid signed with a dropped secret accepted")
+	}
+	for _, value := range []string{sid, sid + ".forged", "other." + signValue("new", sid)} {
+		doRequest(m, "/get", map[string]string{testCookieName: value})
+		if got != "" {
+			t.Fatalf("unsigned or forged sid %q accepted", value)
+		}
+	}
+	doRequest(m, "/get", cookies)
+	if got != "insionng" {
+		t.Fatal("sid signed with the newest secret rejected")
+	}
+}
+
+// testSidSources checks the sids sent in the header, the query and chunk
+// cookies go through codec like the cookie: the value exposed in the header
+// is accepted, the raw sid isn't.
+func testSidSources(t *testing.T, codec CookieCodec) {
+	m := newTestApp(t, Options{
+		Provider:    "memory",
+		Config:      `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"exposeSIDHeader":true}`,
+		CookieCodec: codec,
+	})
+	defer GlobalManager.DestroyAll()
+	var sid, got string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, _ = c.Session.Get("user").(string)
+		return nil
+	})
+	value := string(doRequest(m, "/set", nil).Response.Header.Peek("X-Session-Id"))
+	if value == "" || value == sid {
+		t.Fatalf("sid header %q not encoded by the codec", value)
+	}
+
+	for _, v := range []string{value, sid} {
+		for source, send := range map[string]func(ctx *fasthttp.RequestCtx){
+			"header": func(ctx *fasthttp.RequestCtx) {
+				ctx.Request.SetRequestURI("/get")
+				ctx.Request.Header.Set("X-Session-Id", v)
+			},
+			"query": func(ctx *fasthttp.RequestCtx) {
+				ctx.Request.SetRequestURI("/get?" + testCookieName + "=" + url.QueryEscape(v))
+			},
+			"chunk cookie": func(ctx *fasthttp.RequestCtx) {
+				ctx.Request.SetRequestURI("/get")
+				ctx.Request.Header.SetCookie(chunkName(testCookieName, 0), v)
+			},
+		} {
+			got = ""
+			ctx := new(fasthttp.RequestCtx)
+			send(ctx)
+			m.ServeHTTP(ctx)
+			// chunk cookies are only read for the cookie provider.
+			want := v == value && source != "chunk cookie"
+			if (got == "insionng") != want {
+				t.Fatalf("sid %q in the %s: session loaded %v, want %v", v, source, got == "insionng", want)
+			}
+		}
+	}
+}
+
+func TestSignedCookieCodecSidSources(t *testing.T) {
+	codec, err := NewSignedCookieCodec("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSidSources(t, codec)
+}
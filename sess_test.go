@@ -1,9 +1,27 @@
 package session
 
 import (
+	"bytes"
+	"container/list"
 	"crypto/aes"
+	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/insionng/macross"
 )
 
 func Test_gob(t *testing.T) {
@@ -104,7 +122,7 @@ func TestParseConfig(t *testing.T) {
 	if cf2.EnableSetCookie != false {
 		t.Fatal("parseconfig get enableSetCookie error")
 	}
-	cconfig := new(cookieConfig)
+	cconfig := new(CookieConfig)
 	err = json.Unmarshal([]byte(cf2.ProviderConfig), cconfig)
 	if err != nil {
 		t.Fatal("parse providerConfig err,", err)
@@ -116,3 +134,1152 @@ func TestParseConfig(t *testing.T) {
 		t.Fatal("providerConfig get securityKey error")
 	}
 }
+
+func TestNewManagerWithConfig(t *testing.T) {
+	config := `{"cookieName":"MacrossSessionId","gcLifetime":3600}`
+	manager, err := NewManagerWithConfig("memory", config, nil)
+	if err != nil {
+		t.Fatal("memory NewManagerWithConfig:", err)
+	}
+	if manager.config.CookieName != "MacrossSessionId" {
+		t.Fatal("manager config not parsed")
+	}
+	if _, err = NewManagerWithConfig("memory", config, FileConfig{}); err == nil {
+		t.Fatal("memory provider accepted an unsupported config")
+	}
+
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = NewManagerWithConfig("file", config, FileConfig{SavePath: dir}); err != nil {
+		t.Fatal("file NewManagerWithConfig:", err)
+	}
+
+	cf := &CookieConfig{CookieName: "MacrossSessionId", SecurityKey: "Macrosscookiehashkey"}
+	if _, err = NewManagerWithConfig("cookie", config, cf); err != nil {
+		t.Fatal("cookie NewManagerWithConfig:", err)
+	}
+	if cookiepder.config.SecurityKey != "Macrosscookiehashkey" || cookiepder.config.BlockKey == "" {
+		t.Fatal("cookie config not applied")
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]string{"sid-a1": "42", "sid-b": "7", "sid-a2": "42", "sid-anon": ""}
+	for sid, userID := range users {
+		s, err := manager.Read(sid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userID != "" {
+			s.Set("user_id", userID)
+		}
+	}
+	defer manager.DestroyAll()
+
+	deleted, err := manager.DeleteWhere(func(sid string, s macross.RawStore) bool {
+		return s.Get("user_id") == "42"
+	})
+	if err != nil || deleted != 2 {
+		t.Fatalf("DeleteWhere deleted %d sessions, err %v, want 2", deleted, err)
+	}
+	for sid, userID := range users {
+		if exist := manager.provider.Exist(sid); exist != (userID != "42") {
+			t.Fatalf("session %s of user %q exists: %v", sid, userID, exist)
+		}
+	}
+}
+
+func TestSessionIDLengthMinimum(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.config.SessionIDLength < minSessionIDLength {
+		t.Fatalf("default sessionIDLength %d below the minimum %d", manager.config.SessionIDLength, minSessionIDLength)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	if manager, err = NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"sessionIDLength":2}`); err != nil {
+		t.Fatal("short sessionIDLength rejected instead of clamped:", err)
+	}
+	if manager.config.SessionIDLength != minSessionIDLength {
+		t.Fatalf("sessionIDLength 2 not clamped, got %d", manager.config.SessionIDLength)
+	}
+	if !strings.Contains(logged.String(), "sessionIDLength 2 is too short") {
+		t.Fatalf("clamping not logged: %q", logged.String())
+	}
+	sid, err := manager.sessionID()
+	if err != nil || len(sid) != 2*minSessionIDLength {
+		t.Fatal("sid not of the clamped length", sid, err)
+	}
+}
+
+func TestDeterministicSessionID(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.SetRandReader(bytes.NewReader(bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 4)))
+	sid, err := manager.sessionID()
+	if err != nil {
+		t.Fatal("sessionID:", err)
+	}
+	if sid != strings.Repeat("deadbeef", 4) {
+		t.Fatalf("sid not generated from the given reader, got %q", sid)
+	}
+	// an exhausted reader must fail instead of returning a short sid.
+	if _, err = manager.sessionID(); err == nil {
+		t.Fatal("short read accepted")
+	}
+
+	manager.SetRandReader(nil)
+	if sid, err = manager.sessionID(); err != nil || len(sid) != 32 {
+		t.Fatal("crypto/rand not restored", sid, err)
+	}
+}
+
+func TestDeterministicRandomKey(t *testing.T) {
+	defer func(r io.Reader) { randReader = r }(randReader)
+	randReader = bytes.NewReader([]byte("0123456789abcdef"))
+	if key := generateRandomKey(16); string(key) != "0123456789abcdef" {
+		t.Fatalf("key not generated from the given reader, got %q", key)
+	}
+}
+
+// cookieFlag returns the transform flag of an encoded cookie value.
+func cookieFlag(t *testing.T, str string) byte {
+	b, err := decode([]byte(str))
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+	parts := bytes.SplitN(b, []byte("|"), 3)
+	v, err := decode(parts[1])
+	if err != nil {
+		t.Fatal("decode value:", err)
+	}
+	if version := v[0] >> cookieVersionBits; version != cookieVersion {
+		t.Fatalf("cookie version = %d, want %d", version, cookieVersion)
+	}
+	return v[0] & (1<<cookieVersionBits - 1)
+}
+
+func TestCookieEncodeThreshold(t *testing.T) {
+	block, err := aes.NewCipher(generateRandomKey(16))
+	if err != nil {
+		t.Fatal("NewCipher:", err)
+	}
+	small := map[interface{}]interface{}{"name": "insionng"}
+	large := map[interface{}]interface{}{"name": strings.Repeat("insionng", 100)}
+
+	for _, c := range []struct {
+		value map[interface{}]interface{}
+		flag  byte
+	}{
+		{small, cookieEncrypted},
+		{large, cookieEncrypted | cookieCompressed},
+	} {
+		str, err := encodeCookieThreshold(block, "hashKey", "name", c.value, 256)
+		if err != nil {
+			t.Fatal("encodeCookieThreshold:", err)
+		}
+		if flag := cookieFlag(t, str); flag != c.flag {
+			t.Fatalf("flag = %d, want %d", flag, c.flag)
+		}
+		dst, err := decodeCookie(block, "hashKey", "name", str, 3600)
+		if err != nil {
+			t.Fatal("decodeCookie:", err)
+		}
+		if dst["name"] != c.value["name"] {
+			t.Fatal("value not round-tripped")
+		}
+	}
+
+	// without a threshold the value is never compressed.
+	str, err := encodeCookie(block, "hashKey", "name", large)
+	if err != nil {
+		t.Fatal("encodeCookie:", err)
+	}
+	if flag := cookieFlag(t, str); flag != cookieEncrypted {
+		t.Fatalf("flag = %d, want %d", flag, cookieEncrypted)
+	}
+}
+
+func TestCookieLegacyLayout(t *testing.T) {
+	block, err := aes.NewCipher(generateRandomKey(16))
+	if err != nil {
+		t.Fatal("NewCipher:", err)
+	}
+	// the layout of the cookies written before the flag byte: the gob of the
+	// values map, encrypted as a whole.
+	for i := 0; i < 50; i++ {
+		b, err := EncodeGob(map[interface{}]interface{}{"name": "insionng", "n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err = encrypt(block, b); err != nil {
+			t.Fatal(err)
+		}
+		dst, err := decodeCookie(block, "hashKey", "name", signCookie("hashKey", "name", b), 3600)
+		if err != nil || dst["name"] != "insionng" || dst["n"] != i {
+			t.Fatalf("cookie of the legacy layout read as %v, %v", dst, err)
+		}
+	}
+}
+
+func TestCookieVersion(t *testing.T) {
+	block, err := aes.NewCipher(generateRandomKey(16))
+	if err != nil {
+		t.Fatal("NewCipher:", err)
+	}
+	value := map[interface{}]interface{}{"name": "insionng"}
+	b, err := EncodeGob(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name    string
+		version byte
+		valid   bool
+	}{
+		{"v1", cookieVersion, true},
+		{"unversioned", 0, true},
+		{"unknown", cookieVersion + 1, false},
+	} {
+		str := signCookie("hashKey", "name", append([]byte{c.version << cookieVersionBits}, b...))
+		dst, err := decodeCookie(block, "hashKey", "name", str, 3600)
+		if !c.valid {
+			if err != errCookieVersion {
+				t.Fatalf("%s cookie decoded, err %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil || dst["name"] != "insionng" {
+			t.Fatalf("%s cookie not decoded: %v", c.name, err)
+		}
+	}
+}
+
+type ageV1 struct{ Age string }
+
+type ageV2 struct{ Age int }
+
+func init() {
+	// registered names differ in one byte, so an encoded ageV1 can be relabeled as ageV2.
+	gob.Register(ageV1{})
+	gob.Register(ageV2{})
+}
+
+func TestDecodeGobDropsUndecodableKeys(t *testing.T) {
+	b, err := EncodeGob(map[interface{}]interface{}{
+		"username": "insionng",
+		"age":      ageV1{"eighteen"},
+	})
+	if err != nil {
+		t.Fatal("EncodeGob:", err)
+	}
+	// simulate the app changing the registered type of "age" to an incompatible one.
+	b = bytes.Replace(b, []byte("session.ageV1"), []byte("session.ageV2"), -1)
+
+	dst, err := DecodeGob(b)
+	if err != nil {
+		t.Fatal("DecodeGob:", err)
+	}
+	if dst["username"] != "insionng" {
+		t.Fatal("decodable key lost")
+	}
+	if _, ok := dst["age"]; ok {
+		t.Fatal("undecodable key kept")
+	}
+}
+
+func TestDecodeGobLegacyFormat(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(map[interface{}]interface{}{"username": "insionng"}); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := DecodeGob(buf.Bytes())
+	if err != nil {
+		t.Fatal("DecodeGob:", err)
+	}
+	if dst["username"] != "insionng" {
+		t.Fatal("legacy encoded session not decoded")
+	}
+}
+
+func TestParseConfigAliases(t *testing.T) {
+	camel := `{"cookieName":"MacrossSessionId","enableSetCookie":false,"gcLifetime":3600,"maxLifetime":7200,"cookieLifetime":60,"providerConfig":"./data/session","sessionIDLength":32}`
+	snake := `{"cookie_name":"MacrossSessionId","enable_set_cookie":false,"gclifetime":3600,"max_lifetime":7200,"cookie_lifetime":60,"provider_config":"./data/session","session_id_length":32}`
+	cf1 := &managerConfig{EnableSetCookie: true}
+	if err := json.Unmarshal([]byte(camel), cf1); err != nil {
+		t.Fatal("parse camelCase config:", err)
+	}
+	cf2 := &managerConfig{EnableSetCookie: true}
+	if err := json.Unmarshal([]byte(snake), cf2); err != nil {
+		t.Fatal("parse snake_case config:", err)
+	}
+	if !reflect.DeepEqual(cf1, cf2) {
+		t.Fatalf("configs differ:\n%+v\n%+v", cf1, cf2)
+	}
+	if cf2.CookieName != "MacrossSessionId" || cf2.EnableSetCookie || cf2.GcLifetime != 3600 || cf2.SessionIDLength != 32 {
+		t.Fatalf("snake_case config not applied: %+v", cf2)
+	}
+
+	m1, err := NewManager("memory", camel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := NewManager("memory", snake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m1.config, m2.config) {
+		t.Fatal("managers differ")
+	}
+
+	// both spellings of a setting are ambiguous.
+	err = json.Unmarshal([]byte(`{"cookieName":"a","cookie_name":"b","gcLifetime":3600}`), &managerConfig{})
+	if err == nil || !strings.Contains(err.Error(), `config keys "cookieName" and "cookie_name" name the same setting`) {
+		t.Fatalf("conflicting keys: %v", err)
+	}
+	if _, err = NewManager("memory", `{"cookieName":"a","gcLifetime":3600,"gclifetime":60}`); err == nil {
+		t.Fatal("conflicting keys accepted by NewManager")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, c := range []struct {
+		config string
+		err    string
+	}{
+		{`{"gcLifetime":3600}`, "cookieName is empty"},
+		{`{"cookieName":"sid","gcLifetime":-1}`, "gcLifetime -1 is negative"},
+		{`{"cookieName":"sid","gcLifetime":3600,"maxLifetime":-1}`, "maxLifetime -1 is negative"},
+		{`{"cookieName":"sid","gcLifetime":3600,"cookieLifetime":-1}`, "cookieLifetime -1 is negative"},
+		{`{"cookieName":"sid","gcLifetime":3600,"sessionIDLength":-1}`, "sessionIDLength -1 is negative"},
+		{`{"cookieName":"sid","gcLifetime":3600,"clockSkew":-1}`, "clockSkew -1 is negative"},
+		{`{"cookieName":"sid","gcLifetime":3600,"maxValueBytes":-1}`, "maxValueBytes -1 is negative"},
+		{`{"cookieName":"sid","gcLifetime":3600,"idleTimeout":-1}`, "idleTimeout -1 is negative"},
+		{`{"cookieName":"sid","gcLifetime":3600,"sameSite":"None"}`, "sameSite none requires secure"},
+		{`{"cookieName":"sid","gcLifetime":3600,"sameSite":"loose"}`, `unknown sameSite "loose"`},
+	} {
+		_, err := NewManager("memory", c.config)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, want %q", c.config, err, c.err)
+		}
+	}
+
+	if _, err := NewManager("memory", `{"cookieName":"sid","gcLifetime":3600,"secure":true,"sameSite":"None"}`); err != nil {
+		t.Fatal("valid config rejected:", err)
+	}
+}
+
+func TestDestroyAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct{ provider, config string }{
+		{"memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`},
+		{"file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"` + dir + `"}`},
+	} {
+		manager, err := NewManager(c.provider, c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sids []string
+		for i := 0; i < 3; i++ {
+			sid, _ := manager.sessionID()
+			store, err := manager.Read(sid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Set("n", i)
+			store.Release(nil)
+			sids = append(sids, sid)
+		}
+		if manager.Count() != 3 {
+			t.Fatalf("%s: Count = %d, want 3", c.provider, manager.Count())
+		}
+		if err = manager.DestroyAll(); err != nil {
+			t.Fatalf("%s: DestroyAll: %v", c.provider, err)
+		}
+		if manager.Count() != 0 {
+			t.Fatalf("%s: Count = %d after DestroyAll", c.provider, manager.Count())
+		}
+		for _, sid := range sids {
+			if manager.provider.Exist(sid) {
+				t.Fatalf("%s: session %s survived DestroyAll", c.provider, sid)
+			}
+		}
+	}
+
+	manager, err := NewManager("cookie", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"{\"cookieName\":\"MacrossSessionId\"}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = manager.DestroyAll(); err == nil {
+		t.Fatal("cookie provider can't destroy client side sessions")
+	}
+}
+
+func TestStoreVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct{ provider, config string }{
+		{"memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`},
+		{"file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"` + dir + `"}`},
+	} {
+		manager, err := NewManager(c.provider, c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid, _ := manager.sessionID()
+		read := func() store {
+			raw, _ := manager.Read(sid)
+			return store{RawStore: raw, Manager: manager}
+		}
+		s := read()
+		if v := s.Version(); v != 0 {
+			t.Fatalf("%s: new session at version %d", c.provider, v)
+		}
+		for i := 1; i <= 2; i++ {
+			s = read()
+			s.Set("n", i)
+			s.Release(nil)
+			if v := read().Version(); v != uint64(i) {
+				t.Fatalf("%s: version %d after %d writes", c.provider, v, i)
+			}
+		}
+
+		// reads and releases of the same values keep the version.
+		s = read()
+		s.Get("n")
+		s.Release(nil)
+		s = read()
+		s.Set("n", 2)
+		s.Release(nil)
+		if v := read().Version(); v != 2 {
+			t.Fatalf("%s: version %d after reads, want 2", c.provider, v)
+		}
+
+		// the metadata is written but isn't counted.
+		s = read()
+		setMeta(s.RawStore, Meta{LastAccessed: time.Unix(1, 0)})
+		s.Release(nil)
+		if s = read(); s.Version() != 2 || !s.Meta().LastAccessed.Equal(time.Unix(1, 0)) {
+			t.Fatalf("%s: version %d, meta %v after a metadata update", c.provider, s.Version(), s.Meta())
+		}
+		manager.provider.Destory(sid)
+	}
+}
+
+func TestActiveSIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct{ provider, config string }{
+		{"memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`},
+		{"file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"` + dir + `"}`},
+	} {
+		manager, err := NewManager(c.provider, c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the providers are shared with the other tests, start empty.
+		manager.DestroyAll()
+		var sids []string
+		for i := 0; i < 3; i++ {
+			sid, _ := manager.sessionID()
+			store, _ := manager.Read(sid)
+			store.Set("n", i)
+			store.Release(nil)
+			sids = append(sids, sid)
+		}
+		sort.Strings(sids)
+		got, err := manager.ActiveSIDs()
+		if err != nil {
+			t.Fatalf("%s: ActiveSIDs: %v", c.provider, err)
+		}
+		if !reflect.DeepEqual(got, sids) {
+			t.Fatalf("%s: ActiveSIDs = %v, want %v", c.provider, got, sids)
+		}
+		manager.DestroyAll()
+	}
+
+	manager, err := NewManager("cookie", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"{\"cookieName\":\"MacrossSessionId\"}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.ActiveSIDs(); err != ErrSIDsUnsupported {
+		t.Fatalf("cookie provider listed its sessions: %v", err)
+	}
+}
+
+// newFileManager returns a file backed manager saving under a temp dir,
+// the returned func removes it.
+func newFileManager(tb testing.TB) (*Manager, func()) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	manager, err := NewManagerWithConfig("file", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, FileConfig{SavePath: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+	return manager, func() { os.RemoveAll(dir) }
+}
+
+func TestFileLazyDecode(t *testing.T) {
+	manager, cleanup := newFileManager(t)
+	defer cleanup()
+	filepder.SetLazyDecode(true)
+	defer filepder.SetLazyDecode(false)
+
+	sid, _ := manager.sessionID()
+	store, _ := manager.Read(sid)
+	store.Set("user", User{"insion", "ng"})
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+
+	// a store released without being touched keeps its values.
+	store, _ = manager.Read(sid)
+	if fs := store.(*FileSessionStore); fs.values != nil {
+		t.Fatal("session decoded before first access")
+	}
+	if err := store.Release(nil); err != nil {
+		t.Fatal("Release:", err)
+	}
+
+	store, _ = manager.Read(sid)
+	if u, ok := store.Get("user").(User); !ok || u.Username != "insion" {
+		t.Fatalf("lazily decoded value lost, got %v", store.Get("user"))
+	}
+	store.Delete("user")
+	store.Set("n", 1)
+	store.Release(nil)
+
+	store, _ = manager.Read(sid)
+	if store.Get("user") != nil || store.Get("n") != 1 {
+		t.Fatal("changes after lazy decode not persisted")
+	}
+}
+
+func TestFileDecodeError(t *testing.T) {
+	manager, cleanup := newFileManager(t)
+	defer cleanup()
+
+	sid, _ := manager.sessionID()
+	name := filepath.Join(filepder.savePath, sid[0:1], sid[1:2], sid)
+	os.MkdirAll(filepath.Dir(name), 0777)
+	if err := ioutil.WriteFile(name, []byte("not a session"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Read(sid); err == nil {
+		t.Fatal("session which can't be decoded read")
+	}
+
+	// decoded lazily, the release fails rather than overwrite it.
+	filepder.SetLazyDecode(true)
+	defer filepder.SetLazyDecode(false)
+	store, err := manager.Read(sid)
+	if err != nil {
+		t.Fatal("lazy Read:", err)
+	}
+	store.Set("user", "insionng")
+	if err = store.Release(nil); err == nil {
+		t.Fatal("session which can't be decoded released")
+	}
+	if b, _ := ioutil.ReadFile(name); string(b) != "not a session" {
+		t.Fatalf("session which can't be decoded overwritten with %q", b)
+	}
+}
+
+func benchmarkFileRead(b *testing.B, access bool) {
+	manager, cleanup := newFileManager(b)
+	defer cleanup()
+	filepder.SetLazyDecode(true)
+	defer filepder.SetLazyDecode(false)
+
+	sid, _ := manager.sessionID()
+	store, _ := manager.Read(sid)
+	for i := 0; i < 20; i++ {
+		store.Set(i, User{"insion", "ng"})
+	}
+	store.Release(nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store, _ = manager.Read(sid)
+		if access {
+			store.Get(0)
+		}
+		store.Release(nil)
+	}
+}
+
+func BenchmarkFileReadUnused(b *testing.B)   { benchmarkFileRead(b, false) }
+func BenchmarkFileReadAccessed(b *testing.B) { benchmarkFileRead(b, true) }
+
+// decodeCounter is a GobCodec counting its decodes.
+type decodeCounter struct {
+	GobCodec
+	decodes int32
+}
+
+func (dc *decodeCounter) Decode(data []byte) (map[interface{}]interface{}, error) {
+	atomic.AddInt32(&dc.decodes, 1)
+	return dc.GobCodec.Decode(data)
+}
+
+func TestExistDoesntDecode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	codec := &decodeCounter{}
+	for _, c := range []struct {
+		provider string
+		config   interface{}
+	}{
+		{"memory", nil},
+		{"file", FileConfig{SavePath: dir, Codec: codec}},
+	} {
+		manager, err := NewManagerWithConfig(c.provider, `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid, _ := manager.sessionID()
+		store, _ := manager.Read(sid)
+		store.Set("user", User{"insion", "ng"})
+		store.Release(nil)
+
+		before := atomic.LoadInt32(&codec.decodes)
+		if !manager.provider.Exist(sid) {
+			t.Fatalf("%s: released session doesn't exist", c.provider)
+		}
+		if other, _ := manager.sessionID(); manager.provider.Exist(other) {
+			t.Fatalf("%s: unknown session exists", c.provider)
+		}
+		if n := atomic.LoadInt32(&codec.decodes) - before; n != 0 {
+			t.Fatalf("%s: Exist decoded the session %d times", c.provider, n)
+		}
+	}
+}
+
+// benchmarkFileLarge benchmarks op on a file session of 1000 values.
+func benchmarkFileLarge(b *testing.B, op func(manager *Manager, sid string)) {
+	manager, cleanup := newFileManager(b)
+	defer cleanup()
+
+	sid, _ := manager.sessionID()
+	store, _ := manager.Read(sid)
+	for i := 0; i < 1000; i++ {
+		store.Set(i, User{"insion", "ng"})
+	}
+	store.Release(nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		op(manager, sid)
+	}
+}
+
+func BenchmarkFileExistLarge(b *testing.B) {
+	benchmarkFileLarge(b, func(manager *Manager, sid string) {
+		manager.provider.Exist(sid)
+	})
+}
+
+func BenchmarkFileReadLarge(b *testing.B) {
+	benchmarkFileLarge(b, func(manager *Manager, sid string) {
+		store, _ := manager.Read(sid)
+		store.Get(0)
+	})
+}
+
+type profile struct {
+	Name  string
+	Tags  []string
+	Attrs map[string]interface{}
+	Next  *profile
+}
+
+func TestMemStoreDeepCopy(t *testing.T) {
+	pder := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}
+	store, _ := pder.Read("abcdef")
+
+	p := &profile{Name: "insion", Tags: []string{"a"}, Attrs: map[string]interface{}{"age": 1, "langs": []string{"go"}}}
+	p.Next = p
+	store.Set("profile", p)
+	store.Set("tags", p.Tags)
+
+	p.Name = "changed"
+	p.Tags[0] = "changed"
+	p.Attrs["age"] = 2
+	p.Attrs["langs"].([]string)[0] = "changed"
+
+	got := store.Get("profile").(*profile)
+	if got == p || got.Name != "insion" || got.Tags[0] != "a" || got.Attrs["age"] != 1 || got.Attrs["langs"].([]string)[0] != "go" {
+		t.Fatalf("stored value changed with the caller's value: %+v", got)
+	}
+	if got.Next != got {
+		t.Fatal("cyclic pointer not preserved in the copy")
+	}
+	if store.Get("tags").([]string)[0] != "a" {
+		t.Fatal("stored slice shares its array with the caller")
+	}
+}
+
+func BenchmarkMemStoreSetGet(b *testing.B) {
+	pder := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}
+	store, _ := pder.Read("abcdef")
+	u := User{"insion", "ng"}
+	for i := 0; i < b.N; i++ {
+		store.Set("user", u)
+		_ = store.Get("user").(User)
+	}
+}
+
+// BenchmarkGobSetGet is what a gob round-trip of the same value costs.
+func BenchmarkGobSetGet(b *testing.B) {
+	values := map[interface{}]interface{}{}
+	for i := 0; i < b.N; i++ {
+		values["user"] = User{"insion", "ng"}
+		buf, err := EncodeGob(values)
+		if err != nil {
+			b.Fatal(err)
+		}
+		kv, _ := DecodeGob(buf)
+		_ = kv["user"].(User)
+	}
+}
+
+func TestCookieValueEncoding(t *testing.T) {
+	value := "€uro ünïcödé & spaces/+="
+	for _, encoding := range []string{"", "url", "base64"} {
+		encoded := encodeCookieValue(value, encoding)
+		decoded, err := decodeCookieValue(encoded, encoding)
+		if err != nil || decoded != value {
+			t.Fatalf("%q: round trip gave %q, %v", encoding, decoded, err)
+		}
+	}
+	if b64, esc := encodeCookieValue(value, "base64"), encodeCookieValue(value, "url"); len(b64) >= len(esc) {
+		t.Fatalf("base64 (%d bytes) not smaller than percent-encoding (%d bytes)", len(b64), len(esc))
+	}
+	if _, err := NewManager("memory", `{"cookieName":"sid","gcLifetime":3600,"cookieEncoding":"hex"}`); err == nil {
+		t.Fatal("unknown cookieEncoding accepted")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if Jitter(3600, 0, "aaaa") != 3600 {
+		t.Fatal("jitter applied while off")
+	}
+	seen := map[int64]bool{}
+	for i := 0; i < 100; i++ {
+		sid := fmt.Sprintf("%032x", i)
+		lifetime := Jitter(3600, 10, sid)
+		if lifetime < 3240 || lifetime > 3960 {
+			t.Fatalf("lifetime %d out of the ±10%% band", lifetime)
+		}
+		if Jitter(3600, 10, sid) != lifetime {
+			t.Fatal("jitter of a session changes between calls")
+		}
+		seen[lifetime] = true
+	}
+	if len(seen) < 50 {
+		t.Fatalf("lifetimes not spread, only %d distinct values", len(seen))
+	}
+}
+
+func TestMemGCWithJitter(t *testing.T) {
+	pder := &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}
+	pder.Init(100, "")
+	pder.SetExpiryJitter(50)
+	accessed := time.Now().Add(-100 * time.Second)
+	var expired, alive int
+	for i := 0; i < 20; i++ {
+		sid := fmt.Sprintf("%032x", i)
+		store, _ := pder.Read(sid)
+		store.(*MemSessionStore).timeAccessed = accessed
+		if Jitter(100, 50, sid) < 100 {
+			expired++
+		} else {
+			alive++
+		}
+	}
+	time.Sleep(10 * time.Millisecond) // let the async SessionUpdate of Read settle
+	pder.GC()
+	if pder.Count() != alive || expired == 0 {
+		t.Fatalf("GC kept %d sessions, want %d (%d expired)", pder.Count(), alive, expired)
+	}
+}
+
+// textStore simulates a text column, rejecting NUL bytes and invalid utf-8.
+type textStore map[string]string
+
+func (ts textStore) put(key string, b []byte) error {
+	if !utf8.Valid(b) || bytes.IndexByte(b, 0) >= 0 {
+		return fmt.Errorf("binary data in a text column")
+	}
+	ts[key] = string(b)
+	return nil
+}
+
+func TestTextCodec(t *testing.T) {
+	blob := []byte{0, 0xff, 0x80, 'a', 0}
+	values := map[interface{}]interface{}{"blob": blob}
+	ts := textStore{}
+	if b, _ := (GobCodec{}).Encode(values); ts.put("gob", b) == nil {
+		t.Fatal("the gob blob is text safe, the test proves nothing")
+	}
+	for _, encoding := range []string{"base64", "hex"} {
+		codec, err := NewTextCodec(GobCodec{}, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := codec.Encode(values)
+		if err != nil {
+			t.Fatal(encoding, "Encode:", err)
+		}
+		if err = ts.put(encoding, b); err != nil {
+			t.Fatal(encoding, err)
+		}
+		decoded, err := codec.Decode([]byte(ts[encoding]))
+		if err != nil {
+			t.Fatal(encoding, "Decode:", err)
+		}
+		if got, _ := decoded["blob"].([]byte); !bytes.Equal(got, blob) {
+			t.Fatalf("%s: blob read back as %v", encoding, decoded["blob"])
+		}
+	}
+	if _, err := NewTextCodec(GobCodec{}, "base32"); err == nil {
+		t.Fatal("unknown encoding accepted")
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	values := map[interface{}]interface{}{
+		"user":  "insionng",
+		"cart":  []int{1, 2},
+		metaKey: Meta{CreatedAt: created, UserID: "42"},
+	}
+	b, err := JSONCodec{}.Encode(values)
+	if err != nil {
+		t.Fatal("Encode:", err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("%s is not a JSON object: %v", b, err)
+	}
+	if fields["user"] != "insionng" || fields["_session_meta"] == nil {
+		t.Fatalf("fields = %v", fields)
+	}
+
+	decoded, err := JSONCodec{}.Decode(b)
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if decoded["user"] != "insionng" || !reflect.DeepEqual(decoded["cart"], []interface{}{1.0, 2.0}) {
+		t.Fatalf("values read back as %v", decoded)
+	}
+	if meta, ok := decoded[metaKey].(Meta); !ok || !meta.CreatedAt.Equal(created) || meta.UserID != "42" {
+		t.Fatalf("meta read back as %#v", decoded[metaKey])
+	}
+
+	for _, bad := range []map[interface{}]interface{}{
+		{1: "int key"},
+		{"_session_meta": "reserved"},
+	} {
+		if _, err = (JSONCodec{}).Encode(bad); err == nil {
+			t.Fatalf("%v encoded", bad)
+		}
+	}
+}
+
+func TestFileTextEncoding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager, err := NewManagerWithConfig("file", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, FileConfig{SavePath: dir, Encoding: "base64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, _ := manager.Read("aaaa")
+	store.Set("blob", []byte{0, 0xff})
+	store.Release(nil)
+
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "a", "a", "aaaa"))
+	if err = (textStore{}).put("aaaa", b); err != nil {
+		t.Fatalf("session file %q: %v", b, err)
+	}
+	store, _ = manager.Read("aaaa")
+	if got, _ := store.Get("blob").([]byte); !bytes.Equal(got, []byte{0, 0xff}) {
+		t.Fatalf("blob read back as %v", store.Get("blob"))
+	}
+}
+
+type cart struct {
+	Items map[string]int
+	Total float64
+}
+
+func TestRegisterType(t *testing.T) {
+	RegisterType(cart{})
+	// a value in an interface only encodes once its type is registered.
+	var v interface{} = cart{}
+	if err := gob.NewEncoder(ioutil.Discard).Encode(&v); err != nil {
+		t.Fatal("type not registered:", err)
+	}
+
+	want := cart{Items: map[string]int{"apple": 2}, Total: 3.5}
+	b, err := EncodeGob(map[interface{}]interface{}{"cart": want})
+	if err != nil {
+		t.Fatal("EncodeGob:", err)
+	}
+	values, err := DecodeGob(b)
+	if err != nil {
+		t.Fatal("DecodeGob:", err)
+	}
+	if got, ok := values["cart"].(cart); !ok || !reflect.DeepEqual(got, want) {
+		t.Fatalf("cart read back as %#v", values["cart"])
+	}
+}
+
+func TestFileClockSkew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager, err := NewManagerWithConfig("file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"clockSkew":120}`, FileConfig{SavePath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { filepder.now = nil }()
+	now := time.Now()
+	// clock sets the clock of the server, off by skew.
+	clock := func(skew time.Duration) {
+		filepder.now = func() time.Time { return now.Add(skew) }
+	}
+
+	store, _ := manager.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	file := filepath.Join(dir, "a", "a", "aaaa")
+	// a server with a late clock touched the file.
+	os.Chtimes(file, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+
+	// a server 100s late rewrites the session, its stored access time is kept.
+	clock(-100 * time.Second)
+	store, _ = manager.Read("aaaa")
+	store.Release(nil)
+	if stamp, _ := readStamp(file); stamp != now.Unix() {
+		t.Fatalf("stored access time moved back to %d", stamp)
+	}
+
+	// close to the end of the lifetime, a gc 100s ahead keeps the session.
+	now = now.Add(3590 * time.Second)
+	clock(100 * time.Second)
+	manager.GC()
+	if !manager.provider.Exist("aaaa") {
+		t.Fatal("session expired early by a gc with a clock ahead")
+	}
+
+	// past the lifetime and the skew the session expires.
+	clock(200 * time.Second)
+	manager.GC()
+	if manager.provider.Exist("aaaa") {
+		t.Fatal("expired session kept")
+	}
+}
+
+func TestBase64URLSessionID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, provider := range []string{"memory", "file"} {
+		config := `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"sessionIDEncoding":"base64url","providerConfig":"` + dir + `"}`
+		m := newTestApp(t, Options{Provider: provider, Config: config})
+		var sid string
+		var user interface{}
+		m.Get("/set", func(c *macross.Context) error {
+			sid = c.Session.ID()
+			return c.Session.Set("user", "insionng")
+		})
+		m.Get("/get", func(c *macross.Context) error {
+			user = c.Session.Get("user")
+			return nil
+		})
+
+		cookies := sessionCookies(t, doRequest(m, "/set", nil))
+		if b, err := base64.RawURLEncoding.DecodeString(sid); err != nil || len(b) != 16 || len(sid) != 22 {
+			t.Fatalf("%s: sid %q isn't 16 base64url encoded bytes", provider, sid)
+		}
+		if cookies[testCookieName] != sid {
+			t.Fatalf("%s: cookie %q, want the sid %q", provider, cookies[testCookieName], sid)
+		}
+		doRequest(m, "/get", cookies)
+		if user != "insionng" {
+			t.Fatalf("%s: session of the base64url sid not read", provider)
+		}
+		if raw, _ := GlobalManager.Read(sid); raw.Get("user") != "insionng" {
+			t.Fatalf("%s: provider Read of the base64url sid lost the session", provider)
+		}
+	}
+	if _, err := NewManager("memory", `{"cookieName":"sid","gcLifetime":3600,"sessionIDEncoding":"base32"}`); err == nil {
+		t.Fatal("unknown sessionIDEncoding accepted")
+	}
+}
+
+func TestFileLazyRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager, err := NewManager("file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"lazyRelease":true,"providerConfig":"`+dir+`"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filepder.SetLazyRelease(false)
+	store, _ := manager.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+
+	// written reports whether the session file was written since its stamp was backdated.
+	file := filepath.Join(dir, "a", "a", "aaaa")
+	b, _ := ioutil.ReadFile(file)
+	stamp, raw, _ := splitStamp(b)
+	backdated := joinStamp(stamp-60, raw)
+	ioutil.WriteFile(file, backdated, 0777)
+	written := func() bool {
+		b, _ := ioutil.ReadFile(file)
+		return !bytes.Equal(b, backdated)
+	}
+
+	store, _ = manager.Read("aaaa")
+	store.Set("user", "insionng")
+	store.Release(nil)
+	if written() {
+		t.Fatal("session set to its existing value written")
+	}
+
+	store.Set("user", "ng")
+	store.Release(nil)
+	if !written() {
+		t.Fatal("changed session not written")
+	}
+	if store, _ = manager.Read("aaaa"); store.Get("user") != "ng" {
+		t.Fatal("changed value not read back")
+	}
+}
+
+// reconcilepder is a file provider of its own, so the gc of the managers of
+// other tests sweeping the shared one can't remove the files being written.
+var reconcilepder = &FileProvider{}
+
+func init() {
+	Register("reconcile", reconcilepder)
+}
+
+func TestFileReconcileOnStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	// seed writes the session file sid last accessed at stamp and modified at mtime.
+	seed := func(sid string, stamp, mtime time.Time) string {
+		file := filepath.Join(dir, sid[:1], sid[1:2], sid)
+		os.MkdirAll(filepath.Dir(file), 0777)
+		ioutil.WriteFile(file, joinStamp(stamp.Unix(), nil), 0777)
+		os.Chtimes(file, mtime, mtime)
+		return file
+	}
+	expired := seed("aaaa", now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	valid := seed("bbbb", now.Add(-time.Minute), now.Add(-2*time.Hour))
+	// expired by its stamp, but being written.
+	writing := seed("cccc", now.Add(-2*time.Hour), now)
+
+	if _, err = NewManager("reconcile", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"reconcileOnStart":true,"providerConfig":"`+dir+`"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(expired); !os.IsNotExist(err) {
+		t.Fatal("expired session file not removed")
+	}
+	for _, file := range []string{valid, writing} {
+		if _, err = os.Stat(file); err != nil {
+			t.Fatalf("session file %s removed", file)
+		}
+	}
+
+	if _, err = NewManager("reconcile", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"reconcileOnStart":true,"providerConfig":"`+dir+`/missing"}`); err != nil {
+		t.Fatal("reconcile of a missing save path:", err)
+	}
+}
+
+func TestFileDestroyAllKeepsOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager, err := NewManager("file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"`+dir+`"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, _ := manager.sessionID()
+	store, err := manager.Read(sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Release(nil)
+	// files sharing the save path, outside of the session layout.
+	var others []string
+	for _, name := range []string{"README", filepath.Join(sid[:1], "notes"), filepath.Join("x", "y", "zz")} {
+		file := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(file), 0777)
+		ioutil.WriteFile(file, []byte("keep"), 0777)
+		others = append(others, file)
+	}
+
+	if err = manager.DestroyAll(); err != nil {
+		t.Fatal("DestroyAll:", err)
+	}
+	if manager.provider.Exist(sid) {
+		t.Fatal("session file survived DestroyAll")
+	}
+	for _, file := range others {
+		if _, err = os.Stat(file); err != nil {
+			t.Fatalf("file %s removed by DestroyAll", file)
+		}
+	}
+}
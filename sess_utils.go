@@ -2,6 +2,7 @@ package session
 
 import (
 	"bytes"
+	"compress/flate"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
@@ -9,14 +10,23 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	r "math/rand"
+	"net/url"
+	"reflect"
 	"strconv"
 	"time"
 )
 
+// randReader is the random source of generated keys, tests may replace it.
+var randReader io.Reader = rand.Reader
+
 func init() {
 	gob.Register([]interface{}{})
 	gob.Register(map[int]interface{}{})
@@ -28,22 +38,276 @@ func init() {
 	gob.Register(map[int]int64{})
 }
 
-// EncodeGob encode the obj to gob
+// RegisterType registers the concrete type of v with gob for all providers,
+// e.g. RegisterType(Cart{}) or RegisterType(map[string]int{}). Types are
+// registered when a session holding them is written, but a process reading
+// sessions written by another one must register them first, at init.
+func RegisterType(v interface{}) {
+	gob.Register(v)
+}
+
+// Codec encodes the session values of providers storing bytes,
+// e.g. the file and redis providers.
+type Codec interface {
+	Encode(values map[interface{}]interface{}) ([]byte, error)
+	Decode(data []byte) (map[interface{}]interface{}, error)
+}
+
+// GobCodec is the default Codec, it uses EncodeGob and DecodeGob.
+type GobCodec struct{}
+
+// Encode encodes values with EncodeGob.
+func (GobCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	return EncodeGob(values)
+}
+
+// Decode decodes data with DecodeGob.
+func (GobCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	return DecodeGob(data)
+}
+
+// TextCodec stores the values encoded by Codec as base64 or hex text,
+// for backends which aren't binary safe, e.g. some sql text columns.
+type TextCodec struct {
+	// Codec encodes the session values, GobCodec when nil.
+	Codec Codec
+	// Encoding is "base64" or "hex".
+	Encoding string
+}
+
+// NewTextCodec returns codec storing text of encoding, codec itself when encoding is empty.
+// providers use it for their encoding option.
+func NewTextCodec(codec Codec, encoding string) (Codec, error) {
+	switch encoding {
+	case "":
+		return codec, nil
+	case "base64", "hex":
+		return TextCodec{Codec: codec, Encoding: encoding}, nil
+	}
+	return nil, fmt.Errorf("session: unknown encoding %q", encoding)
+}
+
+func (tc TextCodec) codec() Codec {
+	if tc.Codec == nil {
+		return GobCodec{}
+	}
+	return tc.Codec
+}
+
+// Encode encodes values with Codec then as text.
+func (tc TextCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	b, err := tc.codec().Encode(values)
+	if err != nil {
+		return nil, err
+	}
+	if tc.Encoding == "hex" {
+		return []byte(hex.EncodeToString(b)), nil
+	}
+	return []byte(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+// Decode decodes the text then the values with Codec.
+func (tc TextCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	var b []byte
+	var err error
+	if tc.Encoding == "hex" {
+		b, err = hex.DecodeString(string(data))
+	} else {
+		b, err = base64.StdEncoding.DecodeString(string(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tc.codec().Decode(b)
+}
+
+// JSONCodec stores the session values as a JSON object, each key a field,
+// so services in other languages can read and write them, e.g. in redis.
+// The keys must be strings, and the values encodable by encoding/json. The
+// values decode as the generic JSON types (string, float64, bool, nil,
+// []interface{} and map[string]interface{}), not the types they were set
+// with. The session metadata is kept in the "_session_meta" field.
+type JSONCodec struct{}
+
+// jsonMetaField is the field of the session metadata in JSONCodec documents.
+const jsonMetaField = "_session_meta"
+
+// Encode encodes values as a JSON object.
+func (JSONCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	fields := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		switch key := k.(type) {
+		case internalKey:
+			if key != metaKey {
+				return nil, fmt.Errorf("session: JSONCodec can't encode key %q", key)
+			}
+			fields[jsonMetaField] = v
+		case string:
+			if key == jsonMetaField {
+				return nil, fmt.Errorf("session: key %q is reserved by JSONCodec", key)
+			}
+			fields[key] = v
+		default:
+			return nil, fmt.Errorf("session: JSONCodec needs string keys, got %T", k)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// Decode decodes a JSON object encoded by Encode, or written by another service.
+func (JSONCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, len(fields))
+	for name, raw := range fields {
+		if name == jsonMetaField {
+			var meta Meta
+			if err := json.Unmarshal(raw, &meta); err != nil {
+				log.Printf("session: drop the session metadata, can't decode it: %v", err)
+				continue
+			}
+			values[metaKey] = meta
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		values[name] = v
+	}
+	return values, nil
+}
+
+// EncodeGob encode the obj to gob.
+// each value is encoded on its own, so a value which can't be decoded
+// any more (e.g. its type changed) doesn't spoil the others.
 func EncodeGob(obj map[interface{}]interface{}) ([]byte, error) {
-	for _, v := range obj {
+	values := make(map[interface{}][]byte, len(obj))
+	for k, v := range obj {
 		gob.Register(v)
+		b, err := encodeGobValue(v)
+		if err != nil {
+			return []byte(""), err
+		}
+		values[k] = b
 	}
 	buf := bytes.NewBuffer(nil)
 	enc := gob.NewEncoder(buf)
-	err := enc.Encode(obj)
+	err := enc.Encode(values)
 	if err != nil {
 		return []byte(""), err
 	}
 	return buf.Bytes(), nil
 }
 
-// DecodeGob decode data to map
+// DecodeGob decode data to map.
+// values which fail to decode are dropped and logged, the other keys are kept.
 func DecodeGob(encoded []byte) (map[interface{}]interface{}, error) {
+	buf := bytes.NewBuffer(encoded)
+	dec := gob.NewDecoder(buf)
+	var values map[interface{}][]byte
+	err := dec.Decode(&values)
+	if err != nil {
+		// data encoded before values were encoded one by one.
+		return decodeGobMap(encoded)
+	}
+	out := make(map[interface{}]interface{}, len(values))
+	for k, b := range values {
+		v, err := decodeGobValue(b)
+		if err != nil {
+			log.Printf("session: drop key %v, can't decode its value: %v", k, err)
+			continue
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// decodeRaw decodes the encoded values of session sid,
+// an empty or corrupt session reads as an empty one.
+func decodeRaw(codec Codec, raw []byte) (map[interface{}]interface{}, error) {
+	if len(raw) == 0 {
+		return make(map[interface{}]interface{}), nil
+	}
+	kv, err := codec.Decode(raw)
+	if err != nil {
+		return make(map[interface{}]interface{}), err
+	}
+	return kv, nil
+}
+
+// Unchanged reports whether values deeply equal the values encoded in original,
+// so stores can skip writing back a session a request left as it was, even
+// when a value was set back to what it was.
+func Unchanged(codec Codec, original []byte, values map[interface{}]interface{}) bool {
+	before := map[interface{}]interface{}{}
+	if len(original) > 0 {
+		var err error
+		if before, err = codec.Decode(original); err != nil {
+			return false
+		}
+	}
+	if len(before) == 0 && len(values) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(before, values)
+}
+
+// UnchangedValues reports whether values equal the decoded original apart from
+// the session metadata, updated by the middleware on reads, so a change of the
+// metadata alone is written but doesn't count in the version of the session.
+func UnchangedValues(codec Codec, original []byte, values map[interface{}]interface{}) bool {
+	before := map[interface{}]interface{}{}
+	if len(original) > 0 {
+		var err error
+		if before, err = codec.Decode(original); err != nil {
+			return false
+		}
+	}
+	return sameValues(before, values)
+}
+
+// sameValues reports whether a and b hold the same values, but the metadata.
+func sameValues(a, b map[interface{}]interface{}) bool {
+	count := func(m map[interface{}]interface{}) int {
+		if _, ok := m[metaKey]; ok {
+			return len(m) - 1
+		}
+		return len(m)
+	}
+	if count(a) != count(b) {
+		return false
+	}
+	for k, v := range a {
+		if k == metaKey {
+			continue
+		}
+		if w, ok := b[k]; !ok || !reflect.DeepEqual(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeGobValue(v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	// encode through a pointer to interface to keep the concrete type.
+	err := gob.NewEncoder(buf).Encode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeGobValue(b []byte) (interface{}, error) {
+	var v interface{}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+func decodeGobMap(encoded []byte) (map[interface{}]interface{}, error) {
 	buf := bytes.NewBuffer(encoded)
 	dec := gob.NewDecoder(buf)
 	var out map[interface{}]interface{}
@@ -57,7 +321,7 @@ func DecodeGob(encoded []byte) (map[interface{}]interface{}, error) {
 // generateRandomKey creates a random key with the given strength.
 func generateRandomKey(strength int) []byte {
 	k := make([]byte, strength)
-	if n, err := io.ReadFull(rand.Reader, k); n != strength || err != nil {
+	if n, err := io.ReadFull(randReader, k); n != strength || err != nil {
 		return RandomCreateBytes(strength)
 	}
 	return k
@@ -68,7 +332,7 @@ func RandomCreateBytes(n int, alphabets ...byte) []byte {
 	const alphanum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 	var bytes = make([]byte, n)
 	var randby bool
-	if num, err := rand.Read(bytes); num != n || err != nil {
+	if num, err := io.ReadFull(randReader, bytes); num != n || err != nil {
 		r.Seed(time.Now().UnixNano())
 		randby = true
 	}
@@ -127,41 +391,158 @@ func decrypt(block cipher.Block, value []byte) ([]byte, error) {
 	return nil, errors.New("decrypt: the value could not be decrypted")
 }
 
+// flags of the transforms applied to an encoded cookie value.
+const (
+	cookieEncrypted byte = 1 << iota
+	cookieCompressed
+)
+
+// cookieVersion is the format version of the encoded cookie values, kept in
+// the high bits of their flag byte. Values encoded before the versions read
+// as version 0, the same format. Bump it when the format changes, and have
+// decodeCookieIssued read the older versions still in browsers.
+const (
+	cookieVersion     byte = 1
+	cookieVersionBits      = 4
+)
+
+// errCookieVersion is returned decoding a cookie value of an unknown format
+// version, e.g. written by a newer release.
+var errCookieVersion = errors.New("Decode: unknown cookie version")
+
 func encodeCookie(block cipher.Block, hashKey, name string, value map[interface{}]interface{}) (string, error) {
+	return encodeCookieThreshold(block, hashKey, name, value, 0)
+}
+
+// encodeCookieThreshold encodes value like encodeCookie, values of threshold
+// bytes or more are compressed, smaller ones aren't worth it. threshold 0
+// never compresses. Values are always encrypted with block.
+func encodeCookieThreshold(block cipher.Block, hashKey, name string, value map[interface{}]interface{}, threshold int) (string, error) {
 	var err error
 	var b []byte
 	// 1. EncodeGob.
 	if b, err = EncodeGob(value); err != nil {
 		return "", err
 	}
-	// 2. Encrypt (optional).
-	if b, err = encrypt(block, b); err != nil {
-		return "", err
+	var flag byte
+	if block != nil {
+		flag = cookieEncrypted
 	}
-	b = encode(b)
-	// 3. Create MAC for "name|date|value". Extra pipe to be used later.
+	if threshold > 0 && len(b) >= threshold {
+		flag |= cookieCompressed
+	}
+	// 2. Compress (optional).
+	if flag&cookieCompressed != 0 {
+		if b, err = compress(b); err != nil {
+			return "", err
+		}
+	}
+	// 3. Encrypt (optional).
+	if flag&cookieEncrypted != 0 {
+		if b, err = encrypt(block, b); err != nil {
+			return "", err
+		}
+	}
+	return signCookie(hashKey, name, append([]byte{cookieVersion<<cookieVersionBits | flag}, b...)), nil
+}
+
+// signCookie returns the cookie value of payload, signed with its name and
+// the current time.
+func signCookie(hashKey, name string, payload []byte) string {
+	b := encode(payload)
+	// 4. Create MAC for "name|date|value". Extra pipe to be used later.
 	b = []byte(fmt.Sprintf("%s|%d|%s|", name, time.Now().UTC().Unix(), b))
 	h := hmac.New(sha1.New, []byte(hashKey))
 	h.Write(b)
 	sig := h.Sum(nil)
 	// Append mac, remove name.
 	b = append(b, sig...)[len(name)+1:]
-	// 4. Encode to base64.
+	// 5. Encode to base64.
 	b = encode(b)
 	// Done.
-	return string(b), nil
+	return string(b)
 }
 
+var (
+	errCookieSignature = errors.New("Decode: the value is not valid")
+	errCookieExpired   = errors.New("Decode: expired timestamp")
+)
+
 func decodeCookie(block cipher.Block, hashKey, name, value string, gcMaxLifetime int64) (map[interface{}]interface{}, error) {
+	dst, _, _, err := decodeCookieIssued(block, hashKey, name, value, gcMaxLifetime)
+	return dst, err
+}
+
+// decodeCookieIssued decodes value like decodeCookie and also returns the
+// unix time it was encoded at. The values encoded before the flag byte,
+// encrypted as a whole as by the beego cookie provider, are still read and
+// reported legacy, to be written again in the current format.
+func decodeCookieIssued(block cipher.Block, hashKey, name, value string, gcMaxLifetime int64) (dst map[interface{}]interface{}, issued int64, legacy bool, err error) {
+	payload, t1, err := verifyCookie(hashKey, name, value, gcMaxLifetime)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	b, err := decode(payload)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	// decrypt works in place, each layout decodes its own copy.
+	if dst, err = decodeFlagged(block, append([]byte(nil), b...)); err != nil {
+		if values, lerr := decodeLegacy(block, b); lerr == nil {
+			return values, t1, true, nil
+		}
+		return nil, 0, false, err
+	}
+	return dst, t1, false, nil
+}
+
+// decodeFlagged decrypts and decompresses b as told by its flag byte, and
+// decodes the values.
+func decodeFlagged(block cipher.Block, b []byte) (map[interface{}]interface{}, error) {
+	var err error
+	if len(b) == 0 {
+		return nil, errors.New("Decode: missing flag")
+	}
+	flag, b := b[0], b[1:]
+	switch flag >> cookieVersionBits {
+	case 0, cookieVersion:
+	default:
+		return nil, errCookieVersion
+	}
+	if flag&cookieEncrypted != 0 {
+		if b, err = decrypt(block, b); err != nil {
+			return nil, err
+		}
+	}
+	if flag&cookieCompressed != 0 {
+		if b, err = decompress(b); err != nil {
+			return nil, err
+		}
+	}
+	return DecodeGob(b)
+}
+
+// decodeLegacy decrypts and decodes b encoded before the flag byte.
+func decodeLegacy(block cipher.Block, b []byte) (map[interface{}]interface{}, error) {
+	b, err := decrypt(block, b)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeGob(b)
+}
+
+// verifyCookie checks the signature and the age of the encoded cookie value,
+// and returns its payload and the unix time it was encoded at.
+func verifyCookie(hashKey, name, value string, gcMaxLifetime int64) ([]byte, int64, error) {
 	// 1. Decode from base64.
 	b, err := decode([]byte(value))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	// 2. Verify MAC. Value is "date|value|mac".
 	parts := bytes.SplitN(b, []byte("|"), 3)
 	if len(parts) != 3 {
-		return nil, errors.New("Decode: invalid value %v")
+		return nil, 0, errors.New("Decode: invalid value %v")
 	}
 
 	b = append([]byte(name+"|"), b[:len(b)-len(parts[2])]...)
@@ -169,38 +550,74 @@ func decodeCookie(block cipher.Block, hashKey, name, value string, gcMaxLifetime
 	h.Write(b)
 	sig := h.Sum(nil)
 	if len(sig) != len(parts[2]) || subtle.ConstantTimeCompare(sig, parts[2]) != 1 {
-		return nil, errors.New("Decode: the value is not valid")
+		return nil, 0, errCookieSignature
 	}
 	// 3. Verify date ranges.
 	var t1 int64
 	if t1, err = strconv.ParseInt(string(parts[0]), 10, 64); err != nil {
-		return nil, errors.New("Decode: invalid timestamp")
+		return nil, 0, errors.New("Decode: invalid timestamp")
 	}
 	t2 := time.Now().UTC().Unix()
 	if t1 > t2 {
-		return nil, errors.New("Decode: timestamp is too new")
+		return nil, 0, errors.New("Decode: timestamp is too new")
 	}
 	if t1 < t2-gcMaxLifetime {
-		return nil, errors.New("Decode: expired timestamp")
+		return nil, 0, errCookieExpired
 	}
-	// 4. Decrypt (optional).
-	b, err = decode(parts[1])
+	return parts[1], t1, nil
+}
+
+// Compression ----------------------------------------------------------------
+
+// compress compresses a value using flate.
+func compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
 	if err != nil {
 		return nil, err
 	}
-	if b, err = decrypt(block, b); err != nil {
+	if _, err = w.Write(value); err != nil {
 		return nil, err
 	}
-	// 5. DecodeGob.
-	dst, err := DecodeGob(b)
-	if err != nil {
+	if err = w.Close(); err != nil {
 		return nil, err
 	}
-	return dst, nil
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses a value compressed by compress.
+func decompress(value []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(value))
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
 
 // Encoding -------------------------------------------------------------------
 
+// cookie value encodings, see the cookieEncoding config.
+const (
+	cookieEncodingURL    = "url"
+	cookieEncodingBase64 = "base64"
+)
+
+// encodeCookieValue escapes value for a cookie, percent-encoding it by default,
+// or as unpadded base64url which grows non ascii bytes far less.
+func encodeCookieValue(value, encoding string) string {
+	if encoding == cookieEncodingBase64 {
+		return base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return url.QueryEscape(value)
+}
+
+// decodeCookieValue reverses encodeCookieValue.
+func decodeCookieValue(value, encoding string) (string, error) {
+	if encoding == cookieEncodingBase64 {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		return string(b), err
+	}
+	return url.QueryUnescape(value)
+}
+
 // encode encodes a value using base64.
 func encode(value []byte) []byte {
 	encoded := make([]byte, base64.URLEncoding.EncodedLen(len(value)))
@@ -217,3 +634,72 @@ func decode(value []byte) ([]byte, error) {
 	}
 	return decoded[:b], nil
 }
+
+// deepCopy returns a copy of v sharing no maps, slices or pointers with it,
+// so later changes by the caller don't leak into a stored value.
+// Channels, funcs and unexported struct fields are copied shallowly.
+func deepCopy(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return copyValue(reflect.ValueOf(v), map[uintptr]reflect.Value{}).Interface()
+}
+
+// copyValue deep copies v, seen maps the pointers already copied to their copies
+// so shared and cyclic pointers stay so in the copy.
+func copyValue(v reflect.Value, seen map[uintptr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if c, ok := seen[v.Pointer()]; ok {
+			return c
+		}
+		c := reflect.New(v.Elem().Type())
+		seen[v.Pointer()] = c
+		c.Elem().Set(copyValue(v.Elem(), seen))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyValue(v.Elem(), seen))
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			c.SetMapIndex(k, copyValue(v.MapIndex(k), seen))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), seen))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), seen))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := c.Field(i); f.CanSet() {
+				f.Set(copyValue(v.Field(i), seen))
+			}
+		}
+		return c
+	}
+	return v
+}
@@ -1,15 +1,28 @@
 package session
 
 import (
+	"context"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/url"
+	"hash/fnv"
+	"io"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	//"log"
 
 	"github.com/insionng/macross"
+	"github.com/valyala/fasthttp"
 )
 
 // Provider contains global session methods and saved SessionStores.
@@ -17,13 +30,92 @@ import (
 type Provider interface {
 	Init(gcLifetime int64, config string) error
 	Read(sid string) (macross.RawStore, error)
-	Exist(sid string) bool
+	Exist(sid string) bool // presence only, never reading nor decoding the values
 	Regenerate(oldsid, sid string) (macross.RawStore, error)
 	Destory(sid string) error
 	Count() int //get all active session
 	GC()
 }
 
+// ConfigProvider is implemented by providers which can be initialized with
+// a Go value instead of a json config string.
+type ConfigProvider interface {
+	InitWithConfig(gcLifetime int64, cfg interface{}) error
+}
+
+// JitterProvider is implemented by providers which can spread the expiry
+// of their sessions by ±percent% of the lifetime, see Jitter.
+type JitterProvider interface {
+	SetExpiryJitter(percent int)
+}
+
+// ReconcileProvider is implemented by providers able to remove the sessions
+// expired while no gc ran, Reconcile returns how many it removed.
+type ReconcileProvider interface {
+	Reconcile() (int, error)
+}
+
+// SIDLister is implemented by providers able to list their sessions, SIDs
+// returns the ids of the unexpired ones.
+type SIDLister interface {
+	SIDs() ([]string, error)
+}
+
+// ErrSIDsUnsupported is returned by ActiveSIDs for providers unable to list
+// their sessions, e.g. the cookie provider which keeps none.
+var ErrSIDsUnsupported = errors.New("session: the provider can't list its sessions")
+
+// WriteFlusher is implemented by providers deferring writes, FlushWrites
+// writes the deferred ones at once.
+type WriteFlusher interface {
+	FlushWrites() error
+}
+
+// ContextReleaser is implemented by session stores whose Release can be
+// aborted, so the write of a cancelled request doesn't hold a backend
+// connection. ReleaseContext returns ctx.Err() once ctx is done, the write
+// may still complete in the background.
+type ContextReleaser interface {
+	ReleaseContext(ctx context.Context, c *macross.Context) error
+}
+
+// SkewProvider is implemented by providers comparing expiry times written
+// by other servers, which tolerate their clocks being off by seconds.
+type SkewProvider interface {
+	SetClockSkew(seconds int64)
+}
+
+// LazyReleaseProvider is implemented by providers whose stores can skip
+// writing back the sessions a request left unchanged, see Unchanged.
+type LazyReleaseProvider interface {
+	SetLazyRelease(lazy bool)
+}
+
+// LazyDecodeProvider is implemented by providers whose stores can decode the
+// values on their first access rather than in Read.
+type LazyDecodeProvider interface {
+	SetLazyDecode(lazy bool)
+}
+
+// SweepProvider is implemented by providers whose gc counts the expired
+// sessions it removes, see Manager.GCNow. Their GC runs Sweep.
+type SweepProvider interface {
+	Sweep() (removed int, err error)
+}
+
+// ExpiryProvider is implemented by providers able to keep a session past its
+// lifetime, see Store.ExtendLifetime. SetExpiry makes session sid expire d
+// from now, which may shorten its lifetime, so d must exceed it.
+type ExpiryProvider interface {
+	SetExpiry(sid string, d time.Duration) error
+}
+
+// DestroyAllProvider is implemented by providers which can delete
+// all of their sessions at once.
+type DestroyAllProvider interface {
+	DestroyAll() error
+}
+
 var provides = make(map[string]Provider)
 
 // Register makes a session provide available by the provided name.
@@ -48,13 +140,411 @@ type managerConfig struct {
 	CookieLifetime  int    `json:"cookieLifetime"`
 	ProviderConfig  string `json:"providerConfig"`
 	Domain          string `json:"domain"`
-	SessionIDLength int64  `json:"sessionIDLength"`
+	SameSite        string `json:"sameSite"`
+	// SessionIDLength is the number of random bytes of the sids, 16 by
+	// default and at least minSessionIDLength.
+	SessionIDLength int64 `json:"sessionIDLength"`
+	// SessionIDHeader is the request header the sid is read from when there's
+	// no cookie, only when set or with ExposeSIDHeader, X-Session-Id by default.
+	// Like the query, it carries the sid encoded as by the CookieCodec, e.g.
+	// signed, and is ignored with a codec from outside this package.
+	SessionIDHeader string `json:"sessionIDHeader"`
+	ExposeSIDHeader bool   `json:"exposeSIDHeader"`
+	CacheSize       int    `json:"cacheSize"`
+	CacheTTL        int64  `json:"cacheTTL"`
+	CookieEncoding  string `json:"cookieEncoding"`
+	ExpiryJitter    int    `json:"expiryJitter"`
+	// GcInterval runs the gc every gcInterval seconds, gcLifetime by default.
+	GcInterval int64 `json:"gcInterval"`
+	// GcCron runs the gc on a cron schedule instead, e.g. "30 3 * * *" off-peak.
+	GcCron string `json:"gcCron"`
+	// LegacyCookieNames are former cookie names still read when the request lacks
+	// the cookie name, the sid is then moved to the cookie name.
+	LegacyCookieNames []string `json:"legacyCookieNames"`
+	// MigrationWindow is how long RebindProvider keeps reading the previous
+	// provider, in seconds, maxLifetime by default.
+	MigrationWindow int64 `json:"migrationWindow"`
+	// CookiePersistent keeps the sid cookie for cookieLifetime seconds when true,
+	// when false it's a browser session cookie. Unset, cookieLifetime decides.
+	CookiePersistent *bool `json:"cookiePersistent"`
+	// CookieExpires writes the Expires attribute of persistent cookies
+	// besides Max-Age, both of the same lifetime, for old clients ignoring
+	// Max-Age. fasthttp writes only Max-Age. It applies to the default
+	// CookieCodec.
+	CookieExpires bool `json:"cookieExpires"`
+	// IdleTimeout destroys sessions idle for longer, in seconds, 0 never does.
+	IdleTimeout int64 `json:"idleTimeout"`
+	// IdleHeader is the response header telling the seconds left before the
+	// session expires from idleness, X-Session-Expires-In by default.
+	IdleHeader string `json:"idleHeader"`
+	// MaxValueBytes rejects the Set of values encoding to more bytes, 0 doesn't.
+	// It guards single values, unlike the session size limits of providers.
+	MaxValueBytes int `json:"maxValueBytes"`
+	// ClockSkew is how many seconds the clocks of the servers sharing the
+	// sessions may be off, providers comparing times written by another
+	// server (file, mysql, s3) keep sessions that long past their expiry.
+	ClockSkew int64 `json:"clockSkew"`
+	// SessionIDEncoding writes the random bytes of sids as "hex" (default) or
+	// "base64url", a third shorter. Providers take sids as they are, so the
+	// sids of either encoding stay valid when it changes.
+	SessionIDEncoding string `json:"sessionIDEncoding"`
+	// NearExpiryWindow is how many seconds before its expiry a session is
+	// passed to the OnNearExpiry hook by Start, 0 never does.
+	NearExpiryWindow int64 `json:"nearExpiryWindow"`
+	// LazyRelease skips the provider write of sessions left unchanged by a
+	// request, compared deeply with the values read. Their expiry then isn't
+	// pushed back, the middleware writes active sessions once a minute anyway.
+	LazyRelease bool `json:"lazyRelease"`
+	// LazyDecode decodes the values of a session on their first access
+	// rather than in Read, so requests which don't touch the session skip
+	// the decode. A session which can't be decoded then fails its release
+	// instead of its read, and isn't overwritten.
+	LazyDecode bool `json:"lazyDecode"`
+	// RetryAttempts is how many times the reads, releases and destroys of a
+	// RetryableProvider are tried on transient errors, 1 by default.
+	RetryAttempts int `json:"retryAttempts"`
+	// RetryBackoff is the wait before the first retry in milliseconds, 50 by
+	// default, doubled for each next one.
+	RetryBackoff int64 `json:"retryBackoff"`
+	// IgnoreMalformedCookie starts a new session for a sid cookie failing to
+	// decode, e.g. one of another app on the domain, instead of failing Start.
+	IgnoreMalformedCookie bool `json:"ignoreMalformedCookie"`
+	// CoalesceWindow writes a session at most once per window, in
+	// milliseconds, deferring the writes of rapid requests, see
+	// CoalescingProvider. 0 writes every release.
+	CoalesceWindow int64 `json:"coalesceWindow"`
+	// ReconcileOnStart removes the sessions of a ReconcileProvider (file)
+	// which expired while the app was down, before NewManager returns,
+	// rather than at the first gc.
+	ReconcileOnStart bool `json:"reconcileOnStart"`
+	// IPBindPrefix binds sessions to the network of the client which created
+	// them, the /ipBindPrefix of its IPv4 address, e.g. 24 tolerates a NAT or
+	// a pool of proxies, a request from outside gets a new session. It logs
+	// out roaming clients (mobile networks, VPNs), keep it to admin panels.
+	// 0 doesn't bind.
+	IPBindPrefix int `json:"ipBindPrefix"`
+	// IPv6BindPrefix is the network of the IPv6 clients bound by
+	// ipBindPrefix, 64 by default.
+	IPv6BindPrefix int `json:"ipv6BindPrefix"`
+	// AsyncWorkers writes the released sessions in that many background
+	// workers, see AsyncProvider, a crash loses the writes not done yet.
+	// 0 writes in Release.
+	AsyncWorkers int `json:"asyncWorkers"`
+	// ValidateSID starts a new session for a request sid (cookie, header or
+	// query) not of the format of the generated ones, sessionIDLength random
+	// bytes in sessionIDEncoding, before it reaches the provider. The sids of
+	// a former length or encoding are then dropped.
+	ValidateSID bool `json:"validateSID"`
+	// SIDPattern is the regexp the whole request sids must match instead,
+	// e.g. "[0-9a-f]{32}|[0-9a-f]{40}" while moving to longer sids.
+	SIDPattern string `json:"sidPattern"`
+	// OnEncodeError handles the values which can't be encoded, e.g. a func or
+	// a channel: "fail" (the default) returns an EncodeError from Set and
+	// fails the request of a session holding one on release, "drop" logs and
+	// deletes their keys instead.
+	OnEncodeError string `json:"onEncodeError"`
+	// RepairCookie names a cookie keeping a signed copy of the RepairKeys
+	// values of the session, "" disables it. A session its provider lost,
+	// e.g. evicted by redis, is rebuilt from the cookie by the next request,
+	// unless it expired meanwhile. Only the RepairKeys values are kept, the
+	// login state isn't, so a session logged out or revoked elsewhere comes
+	// back logged out.
+	RepairCookie string `json:"repairCookie"`
+	// RepairSecret signs the RepairCookie, required with it.
+	RepairSecret string `json:"repairSecret"`
+	// RepairKeys are the session values copied to the RepairCookie, e.g. the
+	// cart or the locale, which must fit in a cookie once encoded.
+	RepairKeys []string `json:"repairKeys"`
+}
+
+// persistentCookie reports whether the sid cookie outlives the browser session.
+func (cf *managerConfig) persistentCookie() bool {
+	if cf.CookiePersistent != nil {
+		return *cf.CookiePersistent
+	}
+	return cf.CookieLifetime > 0
+}
+
+// UnmarshalJSON decodes the config ignoring case and underscores in its keys,
+// so beego style configs ("cookie_name", "gclifetime") load as they are.
+// Two keys of the same setting, e.g. "cookieName" and "cookie_name", are an
+// error rather than one silently winning.
+func (cf *managerConfig) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	keys := make(map[string]string, len(raw))
+	for k := range raw {
+		key := normalizeConfigKey(k)
+		if other, ok := keys[key]; ok {
+			if other > k {
+				other, k = k, other
+			}
+			return fmt.Errorf("session: config keys %q and %q name the same setting", other, k)
+		}
+		keys[key] = k
+	}
+	type plain managerConfig
+	canonical := make(map[string]json.RawMessage, len(raw))
+	t := reflect.TypeOf(plain{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if k, ok := keys[normalizeConfigKey(name)]; ok {
+			canonical[name] = raw[k]
+		}
+	}
+	b, err := json.Marshal(canonical)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, (*plain)(cf))
+}
+
+// validate reports misconfigurations which would produce broken cookies or sessions.
+func (cf *managerConfig) validate() error {
+	if cf.CookieName == "" {
+		return errors.New("session: cookieName is empty")
+	}
+	if cf.GcLifetime < 0 {
+		return fmt.Errorf("session: gcLifetime %d is negative", cf.GcLifetime)
+	}
+	if cf.GcInterval < 0 {
+		return fmt.Errorf("session: gcInterval %d is negative", cf.GcInterval)
+	}
+	for _, name := range cf.LegacyCookieNames {
+		if name == "" || name == cf.CookieName {
+			return fmt.Errorf("session: bad legacy cookie name %q", name)
+		}
+	}
+	if cf.MigrationWindow < 0 {
+		return fmt.Errorf("session: migrationWindow %d is negative", cf.MigrationWindow)
+	}
+	if cf.GcInterval > 0 && cf.GcCron != "" {
+		return errors.New("session: gcInterval and gcCron are exclusive")
+	}
+	if cf.MaxLifetime < 0 {
+		return fmt.Errorf("session: maxLifetime %d is negative", cf.MaxLifetime)
+	}
+	if cf.CookieLifetime < 0 {
+		return fmt.Errorf("session: cookieLifetime %d is negative", cf.CookieLifetime)
+	}
+	if cf.SessionIDLength < 0 {
+		return fmt.Errorf("session: sessionIDLength %d is negative", cf.SessionIDLength)
+	}
+	if cf.RetryAttempts < 0 {
+		return fmt.Errorf("session: retryAttempts %d is negative", cf.RetryAttempts)
+	}
+	if cf.RetryBackoff < 0 {
+		return fmt.Errorf("session: retryBackoff %d is negative", cf.RetryBackoff)
+	}
+	if cf.IPBindPrefix < 0 || cf.IPBindPrefix > 32 {
+		return fmt.Errorf("session: ipBindPrefix %d is not an IPv4 prefix length", cf.IPBindPrefix)
+	}
+	if cf.IPv6BindPrefix < 0 || cf.IPv6BindPrefix > 128 {
+		return fmt.Errorf("session: ipv6BindPrefix %d is not an IPv6 prefix length", cf.IPv6BindPrefix)
+	}
+	if cf.AsyncWorkers < 0 {
+		return fmt.Errorf("session: asyncWorkers %d is negative", cf.AsyncWorkers)
+	}
+	if cf.CoalesceWindow < 0 {
+		return fmt.Errorf("session: coalesceWindow %d is negative", cf.CoalesceWindow)
+	}
+	if cf.NearExpiryWindow < 0 {
+		return fmt.Errorf("session: nearExpiryWindow %d is negative", cf.NearExpiryWindow)
+	}
+	switch cf.SessionIDEncoding {
+	case "", "hex", "base64url":
+	default:
+		return fmt.Errorf("session: unknown sessionIDEncoding %q", cf.SessionIDEncoding)
+	}
+	if cf.CacheSize < 0 {
+		return fmt.Errorf("session: cacheSize %d is negative", cf.CacheSize)
+	}
+	if cf.CacheTTL < 0 {
+		return fmt.Errorf("session: cacheTTL %d is negative", cf.CacheTTL)
+	}
+	if cf.CookiePersistent != nil && *cf.CookiePersistent && cf.CookieLifetime == 0 {
+		return errors.New("session: cookiePersistent requires a cookieLifetime")
+	}
+	if cf.ClockSkew < 0 {
+		return fmt.Errorf("session: clockSkew %d is negative", cf.ClockSkew)
+	}
+	if cf.MaxValueBytes < 0 {
+		return fmt.Errorf("session: maxValueBytes %d is negative", cf.MaxValueBytes)
+	}
+	if cf.IdleTimeout < 0 {
+		return fmt.Errorf("session: idleTimeout %d is negative", cf.IdleTimeout)
+	}
+	if cf.ExpiryJitter < 0 || cf.ExpiryJitter > 100 {
+		return fmt.Errorf("session: expiryJitter %d is not a percentage", cf.ExpiryJitter)
+	}
+	switch cf.CookieEncoding {
+	case "", cookieEncodingURL, cookieEncodingBase64:
+	default:
+		return fmt.Errorf("session: unknown cookieEncoding %q", cf.CookieEncoding)
+	}
+	if strings.ContainsAny(cf.Domain, ":/ ") {
+		return fmt.Errorf("session: domain %q is not a host name", cf.Domain)
+	}
+	switch strings.ToLower(cf.SameSite) {
+	case "", "lax", "strict":
+	case "none":
+		if !cf.Secure {
+			return errors.New("session: sameSite none requires secure")
+		}
+	default:
+		return fmt.Errorf("session: unknown sameSite %q", cf.SameSite)
+	}
+	if cf.RepairCookie != "" {
+		if cf.RepairSecret == "" {
+			return errors.New("session: repairCookie requires a repairSecret")
+		}
+		if cf.RepairCookie == cf.CookieName {
+			return fmt.Errorf("session: repairCookie %q is the session cookie", cf.RepairCookie)
+		}
+	}
+	switch cf.OnEncodeError {
+	case "", encodeErrorFail, encodeErrorDrop:
+	default:
+		return fmt.Errorf("session: unknown onEncodeError %q", cf.OnEncodeError)
+	}
+	return nil
+}
+
+func normalizeConfigKey(key string) string {
+	return strings.ToLower(strings.Replace(strings.Replace(key, "_", "", -1), "-", "", -1))
+}
+
+// CookieCodec reads and writes the session id cookie,
+// replace it to e.g. sign the value or keep cookies in a test jar.
+type CookieCodec interface {
+	// Read returns the value of the request cookie name.
+	Read(ctx *macross.Context, name string) (string, error)
+	// Write sets cookie on the response.
+	Write(ctx *macross.Context, cookie *macross.Cookie)
+}
+
+// valueCodec is implemented by the CookieCodecs of this package, which
+// encode the sid sent outside the cookie, in the session id header or the
+// query, as they encode the cookie value. The sids of other codecs are only
+// read from their cookie.
+type valueCodec interface {
+	encodeValue(name, value string) (string, error)
+	decodeValue(name, value string) (string, error)
+}
+
+// encodeValue encodes value as codec writes the cookie name.
+func encodeValue(codec CookieCodec, name, value string) (string, error) {
+	vc, ok := codec.(valueCodec)
+	if !ok {
+		return "", fmt.Errorf("session: cookie codec %T only writes cookies", codec)
+	}
+	return vc.encodeValue(name, value)
+}
+
+// decodeValue decodes value as codec reads the cookie name.
+func decodeValue(codec CookieCodec, name, value string) (string, error) {
+	vc, ok := codec.(valueCodec)
+	if !ok {
+		return "", fmt.Errorf("session: cookie codec %T only reads cookies", codec)
+	}
+	return vc.decodeValue(name, value)
+}
+
+// macrossCookieCodec is the default CookieCodec using macross cookies.
+type macrossCookieCodec struct {
+	expires bool // write Expires besides Max-Age, see cookieExpires
+}
+
+func (macrossCookieCodec) encodeValue(name, value string) (string, error) {
+	return value, nil
+}
+
+func (macrossCookieCodec) decodeValue(name, value string) (string, error) {
+	return value, nil
+}
+
+func (macrossCookieCodec) Read(ctx *macross.Context, name string) (string, error) {
+	cookie, err := ctx.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	return cookie.Value(), nil
+}
+
+func (cc macrossCookieCodec) Write(ctx *macross.Context, cookie *macross.Cookie) {
+	if cc.expires {
+		setCookieWithExpires(ctx, cookie)
+		return
+	}
+	setCookie(ctx, cookie)
+}
+
+// setCookie sets cookie on the response, replacing a cookie of the same name
+// set earlier in the response so browsers get one Set-Cookie per name.
+// The last writer wins, replacing another value is logged as it means two
+// writers disagree, e.g. the manager and the cookie provider sharing a name.
+func setCookie(ctx *macross.Context, cookie *macross.Cookie) {
+	prev := new(fasthttp.Cookie)
+	prev.SetKey(cookie.Name())
+	if ctx.Response.Header.Cookie(prev) && len(prev.Value()) > 0 && cookie.Value() != "" && string(prev.Value()) != cookie.Value() {
+		log.Printf("session: cookie %s set twice in the response, the last value is kept", cookie.Name())
+	}
+	ctx.Response.Header.DelCookie(cookie.Name())
+	ctx.SetCookie(cookie)
+}
+
+// SetCookie sets cookie on the response as the manager does, replacing a
+// cookie of the same name set earlier in the response, for the providers of
+// other packages writing their own cookies.
+func SetCookie(ctx *macross.Context, cookie *macross.Cookie) {
+	setCookie(ctx, cookie)
+}
+
+// setCookieWithExpires is setCookie writing both the Max-Age and the Expires
+// of a persistent cookie, which fasthttp can't as it drops Expires when
+// Max-Age is set.
+func setCookieWithExpires(ctx *macross.Context, cookie *macross.Cookie) {
+	setCookie(ctx, cookie)
+	expire := cookie.Cookie.Expire()
+	if cookie.Cookie.MaxAge() <= 0 || expire.Equal(fasthttp.CookieExpireUnlimited) {
+		return
+	}
+	header := string(cookie.Cookie.Cookie()) + "; expires=" + string(fasthttp.AppendHTTPDate(nil, expire))
+	ctx.Response.Header.DelCookie(cookie.Name())
+	ctx.Response.Header.Add("Set-Cookie", header)
+}
+
+// cookieEncoder is implemented by providers writing their own cookies.
+type cookieEncoder interface {
+	setCookieEncoding(encoding string)
 }
 
 // Manager contains Provider and its configuration.
 type Manager struct {
+	// activity counters, first for their 64-bit alignment on 32-bit platforms.
+	created   uint64
+	destroyed uint64
+	expired   uint64
+	lastGC    int64 // unix nanoseconds, 0 before the first gc
+
 	provider Provider
 	config   *managerConfig
+	rand     io.Reader      // random source of session ids
+	sidRE    *regexp.Regexp // format of the request sids, nil accepts any
+	codec    CookieCodec    // reads and writes the session id cookie
+	users    *userIndex     // sessions bound to users
+	types    sync.Map       // key -> reflect.Type expected for its values
+
+	nearExpiry func(sid string, remaining time.Duration) // OnNearExpiry hook
+
+	gcLock    sync.Mutex
+	schedule  Schedule
+	clock     Clock
+	gcTimer   Timer // pending gc run
+	gcGen     int   // bumped to cancel a pending gc run
+	gcRunning bool
 }
 
 // NewManager Create new Manager with provider name and json config string.
@@ -62,102 +552,381 @@ type Manager struct {
 // 1. cookie
 // 2. file
 // 3. memory
-// 4. redis
-// 5. mysql
+// 4. redis, mysql, s3, firestore and jwt, registered by importing their package
 // json config:
 // 1. is https  default false
 // 2. hashfunc  default sha1
 // 3. hashkey default beegosessionkey
 // 4. maxage default is none
+// A config of the form "@/path/to/config.json" is read from that file, e.g.
+// to keep the secrets of the config out of the code.
 func NewManager(provideName, config string) (*Manager, error) {
+	return newManager(provideName, config, func(provider Provider, cf *managerConfig) error {
+		return provider.Init(cf.MaxLifetime, cf.ProviderConfig)
+	})
+}
+
+// NewManagerWithConfig Create new Manager like NewManager, but the provider is
+// initialized from cfg, e.g. a provider config struct, instead of the json
+// providerConfig string. The provider must implement ConfigProvider.
+func NewManagerWithConfig(provideName, config string, cfg interface{}) (*Manager, error) {
+	return newManager(provideName, config, func(provider Provider, cf *managerConfig) error {
+		cp, ok := provider.(ConfigProvider)
+		if !ok {
+			return fmt.Errorf("session: provide %q does not support config %T", provideName, cfg)
+		}
+		return cp.InitWithConfig(cf.MaxLifetime, cfg)
+	})
+}
+
+func newManager(provideName, config string, initProvider func(Provider, *managerConfig) error) (*Manager, error) {
 	provider, ok := provides[provideName]
 	if !ok {
 		return nil, fmt.Errorf("session: unknown provide %q (forgotten import?)", provideName)
 	}
+	config, err := configFromFile(config)
+	if err != nil {
+		return nil, err
+	}
 	cf := new(managerConfig)
 	cf.EnableSetCookie = true
-	err := json.Unmarshal([]byte(config), cf)
+	err = json.Unmarshal([]byte(config), cf)
 	if err != nil {
 		return nil, err
 	}
 	if cf.MaxLifetime == 0 {
 		cf.MaxLifetime = cf.GcLifetime
 	}
-	err = provider.Init(cf.MaxLifetime, cf.ProviderConfig)
+	if err = cf.validate(); err != nil {
+		return nil, err
+	}
+	err = initProvider(provider, cf)
 	if err != nil {
 		return nil, err
 	}
+	if jp, ok := provider.(JitterProvider); ok {
+		jp.SetExpiryJitter(cf.ExpiryJitter)
+	}
+	if sp, ok := provider.(SkewProvider); ok {
+		sp.SetClockSkew(cf.ClockSkew)
+	}
+	if lp, ok := provider.(LazyReleaseProvider); ok {
+		lp.SetLazyRelease(cf.LazyRelease)
+	}
+	if lp, ok := provider.(LazyDecodeProvider); ok {
+		lp.SetLazyDecode(cf.LazyDecode)
+	}
+	if ce, ok := provider.(cookieEncoder); ok {
+		// providers writing cookies must encode them as the manager decodes them.
+		ce.setCookieEncoding(cf.CookieEncoding)
+	}
+
+	if rp, ok := provider.(ReconcileProvider); ok && cf.ReconcileOnStart {
+		// the gc removes whatever a failed pass left.
+		if _, err := rp.Reconcile(); err != nil {
+			log.Printf("session: reconcile: %v", err)
+		}
+	}
+
+	// checked on the provider itself, the wrappers below hide what it is.
+	if _, ok := provider.(cookieEncoder); ok {
+		if cf.CoalesceWindow > 0 || cf.AsyncWorkers > 0 || cf.CacheSize > 0 {
+			return nil, errors.New("session: coalesceWindow, asyncWorkers and cacheSize need a provider storing sessions server side")
+		}
+		if cf.ValidateSID || cf.SIDPattern != "" {
+			return nil, errors.New("session: validateSID and sidPattern need a provider storing sessions server side")
+		}
+	}
+	if cf.CoalesceWindow > 0 {
+		provider = NewCoalescingProvider(provider, time.Duration(cf.CoalesceWindow)*time.Millisecond)
+	}
+	if cf.AsyncWorkers > 0 {
+		provider = NewAsyncProvider(provider, cf.AsyncWorkers)
+	}
+	if cf.CacheSize > 0 {
+		// keep hot sessions in memory in front of the provider.
+		if cf.CacheTTL == 0 {
+			cf.CacheTTL = 60
+		}
+		provider = NewCacheProvider(provider, cf.CacheSize, time.Duration(cf.CacheTTL)*time.Second)
+	}
+
+	var schedule Schedule
+	if cf.GcCron != "" {
+		if schedule, err = ParseCron(cf.GcCron); err != nil {
+			return nil, err
+		}
+	} else if cf.GcInterval > 0 {
+		schedule = Every(time.Duration(cf.GcInterval) * time.Second)
+	} else {
+		schedule = Every(time.Duration(cf.GcLifetime) * time.Second)
+	}
 
 	if cf.SessionIDLength == 0 {
-		cf.SessionIDLength = 16
+		cf.SessionIDLength = minSessionIDLength
+	} else if cf.SessionIDLength < minSessionIDLength {
+		log.Printf("session: sessionIDLength %d is too short to keep sids unguessable, using %d", cf.SessionIDLength, minSessionIDLength)
+		cf.SessionIDLength = minSessionIDLength
+	}
+
+	// a sid from a header isn't accepted unless the header is enabled.
+	if cf.SessionIDHeader == "" && cf.ExposeSIDHeader {
+		cf.SessionIDHeader = "X-Session-Id"
+	}
+	if cf.IdleHeader == "" {
+		cf.IdleHeader = "X-Session-Expires-In"
+	}
+	if cf.RetryBackoff == 0 {
+		cf.RetryBackoff = 50
+	}
+	if cf.IPv6BindPrefix == 0 {
+		cf.IPv6BindPrefix = 64
+	}
+	var sidRE *regexp.Regexp
+	if cf.ValidateSID || cf.SIDPattern != "" {
+		if sidRE, err = compileSIDPattern(cf); err != nil {
+			return nil, err
+		}
 	}
 
 	return &Manager{
-		provider,
-		cf,
+		provider: provider,
+		config:   cf,
+		rand:     rand.Reader,
+		sidRE:    sidRE,
+		codec:    macrossCookieCodec{expires: cf.CookieExpires},
+		users:    newUserIndex(),
+		schedule: schedule,
+		clock:    realClock{},
 	}, nil
 }
 
 // getSid retrieves session identifier from HTTP Request.
 // First try to retrieve id by reading from cookie, session cookie name is configurable,
-// if not exist, then retrieve id from querying parameters.
+// then from the legacy cookie names, if not exist, then retrieve id from the
+// session id header, and then from querying parameters.
 //
 // error is not nil when there is anything wrong.
-// sid is empty when need to generate a new session id
-// otherwise return an valid session id.
-func (manager *Manager) getSid(ctx *macross.Context) (string, error) {
+// sid is empty when need to generate a new session id, e.g. when it doesn't
+// match validateSID or sidPattern, otherwise return an valid session id.
+// legacy is the legacy cookie name the sid was read from, if any.
+func (manager *Manager) getSid(ctx *macross.Context) (sid, legacy string, err error) {
+	sid, legacy, err = manager.readSid(ctx)
+	if err == nil && sid != "" && manager.sidRE != nil && !manager.sidRE.MatchString(sid) {
+		// malformed or forged, keep it away from the provider keys.
+		return "", "", nil
+	}
+	return
+}
+
+// compileSIDPattern returns the regexp of the sids accepted by validateSID
+// or sidPattern, anchored to match whole sids.
+func compileSIDPattern(cf *managerConfig) (*regexp.Regexp, error) {
+	pattern := cf.SIDPattern
+	if pattern == "" {
+		n := int(cf.SessionIDLength)
+		if cf.SessionIDEncoding == "base64url" {
+			pattern = fmt.Sprintf("[A-Za-z0-9_-]{%d}", base64.RawURLEncoding.EncodedLen(n))
+		} else {
+			pattern = fmt.Sprintf("[0-9a-f]{%d}", hex.EncodedLen(n))
+		}
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("session: sidPattern: %v", err)
+	}
+	return re, nil
+}
+
+// readSid reads the request sid for getSid.
+func (manager *Manager) readSid(ctx *macross.Context) (sid, legacy string, err error) {
 	//log.Println("get cookie name", manager.config.CookieName)
-	cookie, errs := ctx.Cookie(manager.config.CookieName)
+	value, errs := manager.codec.Read(ctx, manager.config.CookieName)
+	if errs == ErrInvalidSignature || errs == ErrInvalidCiphertext {
+		// forged, signed by a dropped secret or encrypted with another key,
+		// start a new session.
+		return "", "", nil
+	}
 
-	if errs != nil || cookie.Value() == "" {
+	if errs != nil || value == "" {
+		for _, name := range manager.config.LegacyCookieNames {
+			if value, err := manager.codec.Read(ctx, name); err == nil && value != "" {
+				sid, err = manager.decodeSid(value)
+				return sid, name, err
+			}
+		}
+		// the cookie provider splits large values into chunk cookies.
+		if _, ok := manager.provider.(cookieEncoder); ok {
+			value, err := readCookieChunks(ctx, manager.config.CookieName, manager.codec)
+			if err != nil {
+				// a chunk the codec rejects, start a new session.
+				return "", "", nil
+			}
+			if value != "" {
+				sid, err = manager.decodeSid(value)
+				return sid, "", err
+			}
+		}
+		if name := manager.config.SessionIDHeader; name != "" {
+			if value := ctx.Request.Header.Peek(name); len(value) > 0 {
+				return manager.valueSid(string(value)), "", nil
+			}
+		}
 		//log.Println("read from query")
-		sid := ctx.FormValue(manager.config.CookieName)
-		return sid, nil
+		return manager.valueSid(ctx.FormValue(manager.config.CookieName)), "", nil
 	}
 
 	// HTTP Request contains cookie for sessionid info.
-	return url.QueryUnescape(cookie.Value())
+	sid, err = manager.decodeSid(value)
+	return sid, "", err
+}
+
+// valueSid returns the sid of value sent in the session id header or the
+// query, decoded by the codec as the session cookie, or "" when the codec
+// rejects it, e.g. an unsigned sid with a SignedCookieCodec.
+func (manager *Manager) valueSid(value string) string {
+	if value == "" {
+		return ""
+	}
+	sid, err := decodeValue(manager.codec, manager.config.CookieName, value)
+	if err != nil {
+		return ""
+	}
+	return sid
+}
+
+// decodeSid decodes the sid of a cookie value, an empty sid when it's
+// malformed and ignoreMalformedCookie is set.
+func (manager *Manager) decodeSid(value string) (string, error) {
+	sid, err := decodeCookieValue(value, manager.config.CookieEncoding)
+	if err != nil && manager.config.IgnoreMalformedCookie {
+		return "", nil
+	}
+	return sid, err
+}
+
+// sidCookie returns the session id cookie of sid.
+func (manager *Manager) sidCookie(ctx *macross.Context, sid string) *macross.Cookie {
+	cookie := new(macross.Cookie)
+	cookie.SetName(manager.config.CookieName)
+	cookie.SetValue(encodeCookieValue(sid, manager.config.CookieEncoding))
+	cookie.SetPath("/")
+	cookie.SetHTTPOnly(true)
+	cookie.SetSecure(manager.isSecure(ctx))
+	cookie.SetDomain(manager.config.Domain)
+	manager.setSameSite(cookie)
+	manager.setLifetime(cookie, sid)
+	return cookie
+}
+
+// SetClientCookie writes value to the cookie name readable by javascript, not
+// HttpOnly, e.g. to mirror a csrf token for the client. The cookie shares the
+// path, domain, Secure and SameSite attributes and the lifetime of the
+// session cookie, which stays HttpOnly. An empty value deletes the cookie.
+// Only write values the scripts of the page may see.
+func (manager *Manager) SetClientCookie(ctx *macross.Context, name, value string) error {
+	if name == "" || name == manager.config.CookieName {
+		return fmt.Errorf("session: client cookie name %q is not allowed", name)
+	}
+	for _, legacy := range manager.config.LegacyCookieNames {
+		if name == legacy {
+			return fmt.Errorf("session: client cookie name %q is a legacy session cookie name", name)
+		}
+	}
+	cookie := new(macross.Cookie)
+	cookie.SetName(name)
+	cookie.SetValue(value)
+	cookie.SetPath("/")
+	cookie.SetHTTPOnly(false)
+	cookie.SetSecure(manager.isSecure(ctx))
+	cookie.SetDomain(manager.config.Domain)
+	manager.setSameSite(cookie)
+	if value == "" {
+		cookie.SetExpire(time.Now())
+	} else if ctx.Session != nil {
+		// expire along with the session cookie.
+		manager.setLifetime(cookie, ctx.Session.ID())
+	}
+	macrossCookieCodec{expires: manager.config.CookieExpires}.Write(ctx, cookie)
+	return nil
+}
+
+// migrateLegacyCookie moves the sid of the legacy cookie name to the cookie name.
+func (manager *Manager) migrateLegacyCookie(ctx *macross.Context, sid, legacy string) {
+	if !manager.config.EnableSetCookie {
+		return
+	}
+	manager.codec.Write(ctx, manager.sidCookie(ctx, sid))
+	setCookie(ctx, manager.expiredCookie(ctx, legacy))
+}
+
+// expiredCookie returns the cookie deleting the cookie name, with the path
+// and domain of the session cookie, so a cookie of the parent domain shared
+// by subdomains is deleted as well.
+func (manager *Manager) expiredCookie(ctx *macross.Context, name string) *macross.Cookie {
+	cookie := new(macross.Cookie)
+	cookie.SetName(name)
+	cookie.SetPath("/")
+	cookie.SetHTTPOnly(true)
+	cookie.SetSecure(manager.isSecure(ctx))
+	cookie.SetDomain(manager.config.Domain)
+	manager.setSameSite(cookie)
+	cookie.SetExpire(time.Now())
+	return cookie
 }
 
 // Start generate or read the session id from http request.
 // if session id exists, return SessionStore with this id.
 func (manager *Manager) Start(ctx *macross.Context) (session macross.RawStore, err error) {
-	sid, errs := manager.getSid(ctx)
+	session, _, err = manager.start(ctx)
+	return
+}
+
+// start is Start also reporting whether the session was created.
+func (manager *Manager) start(ctx *macross.Context) (session macross.RawStore, created bool, err error) {
+	sid, legacy, errs := manager.getSid(ctx)
 	if errs != nil {
-		return nil, errs
+		return nil, false, errs
 	}
 
 	//log.Println("start sid", sid)
 
 	if sid != "" && manager.provider.Exist(sid) {
 		//log.Println("sid exists")
-		return manager.provider.Read(sid)
+		if legacy != "" {
+			manager.migrateLegacyCookie(ctx, sid, legacy)
+		}
+		if session, err = manager.read(RequestContext(ctx), sid); err == nil {
+			manager.checkNearExpiry(sid, session)
+		}
+		return
 	}
 
 	//log.Println("sid not exists")
 
+	if session, ok := manager.repair(ctx, sid); ok {
+		return session, false, nil
+	}
+
 	// Generate a new session
 	sid, errs = manager.sessionID()
 	if errs != nil {
-		return nil, errs
+		return nil, false, errs
 	}
 
-	session, err = manager.provider.Read(sid)
-	cookie := new(macross.Cookie)
-	cookie.SetName(manager.config.CookieName)
-	cookie.SetValue(url.QueryEscape(sid))
-	cookie.SetPath("/")
-	cookie.SetHTTPOnly(true)
-	cookie.SetSecure(manager.isSecure(ctx))
-	cookie.SetDomain(manager.config.Domain)
-
-	if manager.config.CookieLifetime > 0 {
-		// cookie.MaxAge = manager.config.CookieLifetime
-		cookie.SetExpire(time.Now().Add(time.Duration(manager.config.CookieLifetime)))
-	}
+	session, err = manager.read(RequestContext(ctx), sid)
+	created = true
+	atomic.AddUint64(&manager.created, 1)
 	if manager.config.EnableSetCookie {
-		ctx.SetCookie(cookie)
-
+		manager.codec.Write(ctx, manager.sidCookie(ctx, sid))
+	}
+	if manager.config.ExposeSIDHeader {
+		// let js clients that can't read cookies echo the sid back in the header,
+		// encoded like the cookie.
+		if value, err := encodeValue(manager.codec, manager.config.CookieName, sid); err == nil {
+			ctx.Response.Header.Set(manager.config.SessionIDHeader, value)
+			ctx.Response.Header.Add("Access-Control-Expose-Headers", manager.config.SessionIDHeader)
+		}
 	}
 
 	// r.AddCookie(cookie)
@@ -165,9 +934,21 @@ func (manager *Manager) Start(ctx *macross.Context) (session macross.RawStore, e
 	return
 }
 
+// dropCreated destroys the session sid created by the request ctx, and
+// unsets the cookie and header naming it.
+func (manager *Manager) dropCreated(ctx *macross.Context, sid string) {
+	manager.provider.Destory(sid)
+	if manager.config.EnableSetCookie {
+		ctx.Response.Header.DelCookie(manager.config.CookieName)
+	}
+	if manager.config.ExposeSIDHeader {
+		ctx.Response.Header.Del(manager.config.SessionIDHeader)
+	}
+}
+
 // Read returns raw session store by session ID.
 func (manager *Manager) Read(sid string) (rawStore macross.RawStore, err error) {
-	rawStore, err = manager.provider.Read(sid)
+	rawStore, err = manager.read(context.Background(), sid)
 	return
 }
 
@@ -177,10 +958,101 @@ func (m *Manager) Count() int {
 }
 
 // GC Start session gc process.
-// it can do gc in times after gc lifetime.
+// it runs the provider gc now and then as scheduled by gcInterval or gcCron,
+// every gcLifetime seconds by default.
 func (manager *Manager) GC() {
+	manager.gcLock.Lock()
+	manager.gcRunning = true
+	manager.gcLock.Unlock()
+	manager.collect()
+}
+
+// collect runs the provider gc and schedules the next run unless the gc was
+// stopped meanwhile.
+func (manager *Manager) collect() {
+	removed, err := sweep(manager.provider)
+	if err != nil {
+		log.Printf("session: gc: %v", err)
+	}
+	manager.recordGC(removed)
+	manager.scheduleGC()
+}
+
+// recordGC records a gc run having removed sessions, see Activity.
+func (manager *Manager) recordGC(removed int) {
+	atomic.AddUint64(&manager.expired, uint64(removed))
+	atomic.StoreInt64(&manager.lastGC, manager.clock.Now().UnixNano())
+}
+
+// GCNow removes the expired sessions at once, e.g. for an admin endpoint, and
+// returns how many it removed. For providers which aren't a SweepProvider the
+// count is the drop of Count, sessions created meanwhile lower it.
+func (manager *Manager) GCNow() (removed int, err error) {
+	defer func() {
+		manager.recordGC(removed)
+	}()
+	if _, ok := manager.provider.(SweepProvider); ok {
+		return sweep(manager.provider)
+	}
+	before := manager.provider.Count()
 	manager.provider.GC()
-	time.AfterFunc(time.Duration(manager.config.GcLifetime)*time.Second, func() { manager.GC() })
+	if removed = before - manager.provider.Count(); removed < 0 {
+		removed = 0
+	}
+	return removed, nil
+}
+
+// FlushWrites writes the sessions whose writes the provider deferred, see
+// coalesceWindow, e.g. on shutdown.
+func (manager *Manager) FlushWrites() error {
+	if wf, ok := manager.provider.(WriteFlusher); ok {
+		return wf.FlushWrites()
+	}
+	return nil
+}
+
+// ActiveSIDs returns the sorted ids of the current sessions, e.g. for an
+// admin view of the active sessions, or ErrSIDsUnsupported if the provider
+// isn't a SIDLister.
+func (manager *Manager) ActiveSIDs() ([]string, error) {
+	sids, err := listSIDs(manager.provider)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(sids)
+	// drop the duplicates of listings done in several passes.
+	unique := sids[:0]
+	for i, sid := range sids {
+		if i == 0 || sid != sids[i-1] {
+			unique = append(unique, sid)
+		}
+	}
+	return unique, nil
+}
+
+// listSIDs returns the sessions of p, ErrSIDsUnsupported if it isn't a SIDLister.
+func listSIDs(p Provider) ([]string, error) {
+	if l, ok := p.(SIDLister); ok {
+		return l.SIDs()
+	}
+	return nil, ErrSIDsUnsupported
+}
+
+// setExpiry makes session sid of p expire d from now, if p is an ExpiryProvider.
+func setExpiry(p Provider, sid string, d time.Duration) error {
+	if ep, ok := p.(ExpiryProvider); ok {
+		return ep.SetExpiry(sid, d)
+	}
+	return fmt.Errorf("session: provider %T can't extend the lifetime of a session", p)
+}
+
+// sweep runs the gc of p, and counts the removed sessions of a SweepProvider.
+func sweep(p Provider) (int, error) {
+	if sp, ok := p.(SweepProvider); ok {
+		return sp.Sweep()
+	}
+	p.GC()
+	return 0, nil
 }
 
 // RegenerateId Regenerate a session id for this SessionStore who's id is saving in http request.
@@ -189,39 +1061,26 @@ func (manager *Manager) RegenerateId(ctx *macross.Context) (session macross.RawS
 	if err != nil {
 		return
 	}
-	var c *macross.Cookie
-	cookie, err := ctx.Cookie(manager.config.CookieName)
-	if err != nil || cookie.Value() == "" {
+	var oldsid string
+	if value, err := manager.codec.Read(ctx, manager.config.CookieName); err == nil && value != "" {
+		oldsid, _ = decodeCookieValue(value, manager.config.CookieEncoding)
+	}
+	return manager.regenerate(ctx, oldsid, sid)
+}
+
+// regenerate moves session oldsid to sid and sets its cookie,
+// without oldsid a new session is started.
+func (manager *Manager) regenerate(ctx *macross.Context, oldsid, sid string) (session macross.RawStore, err error) {
+	if oldsid == "" {
 		//delete old cookie
 		session, _ = manager.provider.Read(sid)
-		c = new(macross.Cookie)
-		c.SetName(manager.config.CookieName)
-		c.SetValue(url.QueryEscape(sid))
-		c.SetPath("/")
-		c.SetHTTPOnly(true)
-		c.SetSecure(manager.isSecure(ctx))
-		c.SetDomain(manager.config.Domain)
-
+		atomic.AddUint64(&manager.created, 1)
 	} else {
-		oldsid, _ := url.QueryUnescape(cookie.Value())
 		session, _ = manager.provider.Regenerate(oldsid, sid)
-
-		c = new(macross.Cookie)
-		c.SetName(cookie.Name())
-		c.SetValue(url.QueryEscape(sid))
-		c.SetPath("/")
-		c.SetHTTPOnly(true)
-		c.SetSecure(cookie.Secure())
-		c.SetDomain(cookie.Domain())
-	}
-	if manager.config.CookieLifetime > 0 {
-		// cookie.MaxAge = manager.config.CookieLifetime
-		c.SetExpire(time.Now().Add(time.Duration(manager.config.CookieLifetime)))
-
+		manager.users.rename(oldsid, sid)
 	}
 	if manager.config.EnableSetCookie {
-		ctx.SetCookie(c)
-
+		manager.codec.Write(ctx, manager.sidCookie(ctx, sid))
 	}
 	// r.AddCookie(c)
 	return
@@ -230,43 +1089,318 @@ func (manager *Manager) RegenerateId(ctx *macross.Context) (session macross.RawS
 // Destory deletes a session by given ID.
 func (m *Manager) Destory(self *macross.Context) error {
 
-	var sid string
-	c, e := self.Cookie(m.config.CookieName)
-	if !(e != nil) {
-		sid = c.Value()
-	}
+	value, _ := m.codec.Read(self, m.config.CookieName)
+	sid, _ := decodeCookieValue(value, m.config.CookieEncoding)
 
 	if len(sid) == 0 {
 		return nil
 	}
 
-	if err := m.provider.Destory(sid); err != nil {
+	if err := m.destroy(RequestContext(self), sid); err != nil {
 		return err
 	}
+	m.users.unbind(sid)
 
-	cookie := new(macross.Cookie)
-	cookie.SetName(m.config.CookieName)
-	cookie.SetPath("/")
-	cookie.SetHTTPOnly(true)
-	cookie.SetExpire(time.Now())
-	self.SetCookie(cookie)
+	m.codec.Write(self, m.expiredCookie(self, m.config.CookieName))
+	if m.config.RepairCookie != "" {
+		setCookie(self, m.expiredCookie(self, m.config.RepairCookie))
+	}
 	return nil
 }
 
+// Stats are the counters of a provider, to spot attacks or key rotation issues.
+type Stats struct {
+	// CookieDecodeFailures counts the cookies which didn't decode, signature mismatches included.
+	CookieDecodeFailures uint64
+	// CookieSignatureMismatches counts the cookies signed with another key or tampered with.
+	CookieSignatureMismatches uint64
+	// CookiesOversized counts the sessions too large to be written in maxChunks cookies.
+	CookiesOversized uint64
+}
+
+// StatsProvider is implemented by providers keeping Stats.
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// Stats returns the counters of the provider, zero if it keeps none.
+func (m *Manager) Stats() Stats {
+	if sp, ok := m.provider.(StatsProvider); ok {
+		return sp.Stats()
+	}
+	return Stats{}
+}
+
+// Activity counts the sessions of a Manager, e.g. to publish them with expvar.
+type Activity struct {
+	// Active is the Count of the provider.
+	Active int
+	// Created counts the sessions started by Start.
+	Created uint64
+	// Destroyed counts the sessions destroyed by the manager: logouts,
+	// rotations and idle or evicted sessions.
+	Destroyed uint64
+	// Expired counts the sessions removed by the gc, as told by SweepProvider
+	// providers or the drop of Count.
+	Expired uint64
+	// LastGC is when the gc last ran, zero before its first run.
+	LastGC time.Time
+}
+
+// Activity returns the session counters of m since it was created.
+func (m *Manager) Activity() Activity {
+	a := Activity{
+		Active:    m.provider.Count(),
+		Created:   atomic.LoadUint64(&m.created),
+		Destroyed: atomic.LoadUint64(&m.destroyed),
+		Expired:   atomic.LoadUint64(&m.expired),
+	}
+	if last := atomic.LoadInt64(&m.lastGC); last != 0 {
+		a.LastGC = time.Unix(0, last)
+	}
+	return a
+}
+
+// DestroyAll deletes every session of the provider, e.g. to invalidate
+// all sessions during an incident. It fails if the provider can't do it.
+func (m *Manager) DestroyAll() error {
+	p, ok := m.provider.(DestroyAllProvider)
+	if !ok {
+		return fmt.Errorf("session: provider %T does not support DestroyAll", m.provider)
+	}
+	return p.DestroyAll()
+}
+
+// DeleteWhere deletes the sessions for which fn returns true, e.g. all the
+// sessions of a user on a GDPR erasure request, and returns how many it
+// deleted. fn gets the store of each session listed by the provider, which
+// must be a SIDLister, else it returns ErrSIDsUnsupported. The deletions done
+// before an error are counted.
+func (manager *Manager) DeleteWhere(fn func(sid string, store macross.RawStore) bool) (int, error) {
+	sids, err := listSIDs(manager.provider)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	deleted := 0
+	for _, sid := range sids {
+		// expired since listed, don't let Read start it again.
+		if !manager.provider.Exist(sid) {
+			continue
+		}
+		raw, err := manager.read(ctx, sid)
+		if err != nil {
+			return deleted, err
+		}
+		if !fn(sid, &store{RawStore: raw, Manager: manager}) {
+			continue
+		}
+		if err = manager.destroy(ctx, sid); err != nil {
+			return deleted, err
+		}
+		manager.users.unbind(sid)
+		deleted++
+	}
+	return deleted, nil
+}
+
 // SetSecure Set cookie with https.
 func (manager *Manager) SetSecure(secure bool) {
 	manager.config.Secure = secure
 }
 
+// SetValueType makes Set of the session store (Store) reject values of key
+// which don't have the type of example, e.g. SetValueType("user_id", 0)
+// catches a string user id before a later Get(...).(int) panics.
+// The type of example is registered with RegisterType.
+// A nil example removes the expectation.
+func (manager *Manager) SetValueType(key, example interface{}) {
+	if example == nil {
+		manager.types.Delete(key)
+		return
+	}
+	RegisterType(example)
+	manager.types.Store(key, reflect.TypeOf(example))
+}
+
+// checkValueType reports whether value has the type registered for key.
+func (manager *Manager) checkValueType(key, value interface{}) error {
+	want, ok := manager.types.Load(key)
+	if !ok {
+		return nil
+	}
+	if got := reflect.TypeOf(value); got != want.(reflect.Type) {
+		return fmt.Errorf("session: value of %v must be a %v, not %T", key, want, value)
+	}
+	return nil
+}
+
+// checkValue reports whether value can be set to key: of the type registered
+// with SetValueType, encodable and fitting in maxValueBytes once converted by
+// the converter of its type. It returns the value to store.
+func (manager *Manager) checkValue(key, value interface{}) (interface{}, error) {
+	if err := manager.checkValueType(key, value); err != nil {
+		return nil, err
+	}
+	stored, err := toStored(value)
+	if err != nil {
+		return nil, fmt.Errorf("session: can't convert the value of %v: %v", key, err)
+	}
+	if err = manager.checkValueSize(key, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// checkValueSize reports whether value can be gob encoded, an EncodeError
+// otherwise, and fits in maxValueBytes once encoded. Strings, byte slices and
+// other basic values are measured as they are.
+func (manager *Manager) checkValueSize(key, value interface{}) error {
+	var size int
+	switch v := value.(type) {
+	case nil, bool, int, int64, uint64, float64:
+	case string:
+		size = len(v)
+	case []byte:
+		size = len(v)
+	default:
+		gob.Register(value)
+		b, err := encodeGobValue(value)
+		if err != nil {
+			return &EncodeError{Key: key, Err: err}
+		}
+		size = len(b)
+	}
+	if limit := manager.config.MaxValueBytes; limit > 0 && size > limit {
+		return fmt.Errorf("session: value of %v is %d bytes, more than maxValueBytes %d", key, size, limit)
+	}
+	return nil
+}
+
+// The handlings of the values which can't be encoded, see OnEncodeError.
+const (
+	encodeErrorFail = "fail"
+	encodeErrorDrop = "drop"
+)
+
+// EncodeError is the error of a session value which can't be encoded, e.g.
+// a func or a channel.
+type EncodeError struct {
+	Key interface{}
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("session: value of %v can't be encoded: %v", e.Key, e.Err)
+}
+
+// dropsUnencodable reports whether err is an EncodeError whose key is to be
+// dropped rather than failed, see OnEncodeError, and logs it then.
+func (manager *Manager) dropsUnencodable(err error) bool {
+	if _, ok := err.(*EncodeError); !ok || manager.config.OnEncodeError != encodeErrorDrop {
+		return false
+	}
+	log.Printf("%v, dropped", err)
+	return true
+}
+
+// unencodable returns the EncodeError of the first value of raw which can't
+// be encoded, e.g. to tell which key failed the release of raw, and nil if
+// raw can't list its keys.
+func (manager *Manager) unencodable(raw macross.RawStore) *EncodeError {
+	k, ok := raw.(keyer)
+	if !ok {
+		return nil
+	}
+	for _, key := range k.Keys() {
+		if err, ok := manager.checkValueSize(key, raw.Get(key)).(*EncodeError); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetRandReader Set the random source of session ids, crypto/rand by default.
+// It's meant for deterministic tests, nil restores crypto/rand.
+func (manager *Manager) SetRandReader(r io.Reader) {
+	if r == nil {
+		r = rand.Reader
+	}
+	manager.rand = r
+}
+
+// SetCookieCodec Set how the session id cookie is read and written,
+// nil restores the default macross cookies. The sids of codecs from outside
+// this package are only read from the cookie, not the header nor the query.
+func (manager *Manager) SetCookieCodec(codec CookieCodec) {
+	if codec == nil {
+		codec = macrossCookieCodec{expires: manager.config.CookieExpires}
+	}
+	manager.codec = codec
+}
+
+// OnNearExpiry sets the hook Start calls for a session expiring within
+// nearExpiryWindow seconds, e.g. to refresh an OAuth token or extend a lease.
+// It's called on every Start in the window, remaining is up to a minute short
+// without an idleTimeout since the last access is only kept to the minute.
+func (manager *Manager) OnNearExpiry(hook func(sid string, remaining time.Duration)) {
+	manager.nearExpiry = hook
+}
+
+// minSessionIDLength is the least number of random bytes of the sids. 128
+// bits keep them unguessable: an attacker trying millions of sids per second
+// against millions of live sessions still needs ages to hit one.
+const minSessionIDLength = 16
+
 func (manager *Manager) sessionID() (string, error) {
 	b := make([]byte, manager.config.SessionIDLength)
-	n, err := rand.Read(b)
+	n, err := io.ReadFull(manager.rand, b)
 	if n != len(b) || err != nil {
 		return "", fmt.Errorf("Could not successfully read from the system CSPRNG.")
 	}
+	if manager.config.SessionIDEncoding == "base64url" {
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	}
 	return hex.EncodeToString(b), nil
 }
 
+// setLifetime makes the sid cookie persistent for cookieLifetime seconds,
+// spread by the expiry jitter, or leaves it a browser session cookie
+// without Expires nor Max-Age.
+func (manager *Manager) setLifetime(cookie *macross.Cookie, sid string) {
+	if !manager.config.persistentCookie() {
+		return
+	}
+	lifetime := Jitter(int64(manager.config.CookieLifetime), manager.config.ExpiryJitter, sid)
+	cookie.SetExpire(time.Now().Add(time.Duration(lifetime) * time.Second))
+	cookie.SetMaxAge(int(lifetime))
+}
+
+// Jitter returns lifetime moved by up to ±percent% of it. The offset is derived
+// from sid, so a session keeps its expiry while sessions created in a burst
+// don't all expire at once.
+func Jitter(lifetime int64, percent int, sid string) int64 {
+	band := lifetime * int64(percent) / 100
+	if band <= 0 {
+		return lifetime
+	}
+	h := fnv.New64a()
+	h.Write([]byte(sid))
+	return lifetime - band + int64(h.Sum64()%uint64(2*band+1))
+}
+
+// setSameSite applies the configured SameSite mode to cookie.
+func (manager *Manager) setSameSite(cookie *macross.Cookie) {
+	switch strings.ToLower(manager.config.SameSite) {
+	case "lax":
+		cookie.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	case "strict":
+		cookie.SetSameSite(fasthttp.CookieSameSiteStrictMode)
+	case "none":
+		cookie.SetSameSite(fasthttp.CookieSameSiteNoneMode)
+	}
+}
+
 // Set cookie with https.
 func (manager *Manager) isSecure(ctx *macross.Context) bool {
 	if !manager.config.Secure {
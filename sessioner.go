@@ -1,29 +1,106 @@
 package session
 
 import (
+	"context"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"github.com/insionng/macross"
+	"hash/fnv"
 	"log"
+	"net"
 	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
 )
 
 var GlobalManager *Manager
 
-var defaultOtions = Options{"memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`}
+var defaultOtions = Options{Provider: "memory", Config: `{"cookieName":"MacrossSessionId","gcLifetime":3600}`}
 
-//var defaultOtions = Options{"file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"./data/session"}`}
+//var defaultOtions = Options{Provider: "file", Config: `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"./data/session"}`}
 
-//var defaultOtions = Options{"redis", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"127.0.0.1:6379"}`}
+//var defaultOtions = Options{Provider: "redis", Config: `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"127.0.0.1:6379"}`}
 
 const (
 	CONTEXT_SESSION_KEY = "_SESSION_STORE"
+	CONTEXT_REQUEST_KEY = "_SESSION_REQUEST_CONTEXT"
 	COOKIE_FLASH_KEY    = "_COOKIE_FLASH"
 	CONTEXT_FLASH_KEY   = "Flash"
-	SESSION_FLASH_KEY   = "_SESSION_FLASH"
-	SESSION_INPUT_KEY   = "_SESSION_INPUT"
+	// Deprecated: the flash is kept in the session Meta.
+	SESSION_FLASH_KEY = "_SESSION_FLASH"
+	// Deprecated: the saved input is kept in the session Meta.
+	SESSION_INPUT_KEY = "_SESSION_INPUT"
 )
 
+// Meta is the session metadata, kept apart from the user values
+// so internal state never shows up among the session keys.
+type Meta struct {
+	CreatedAt time.Time
+	// LastAccessed is the time of the last request, to the minute
+	// (to the second with an idleTimeout).
+	LastAccessed time.Time
+	ClientIP     string
+	UserAgent    string
+	// Device is the client parsed from UserAgent, see UserDevices.
+	Device Device
+	// Flash holds the flash messages for the next request.
+	Flash url.Values
+	// FlashNow is the FlashNow of the flash holding Flash.
+	FlashNow bool
+	// Input holds the form input saved by SaveInput.
+	Input url.Values
+	// Inputs holds the input of the named forms saved by SaveInput.
+	Inputs map[string]url.Values
+	// Authenticated marks a logged-in session, see RequireAuth.
+	Authenticated bool
+	// UserID is the user the session belongs to, see SetUserID.
+	UserID string
+	// BoundAt is when the session was bound to UserID.
+	BoundAt time.Time
+	// PendingUntil is when a pending session expires unless promoted,
+	// zero for a full session, see SetPending.
+	PendingUntil time.Time
+	// KeepUntil is when a session kept alive by ExtendLifetime expires again
+	// as usual.
+	KeepUntil time.Time
+}
+
+// internalKey is the type of the keys reserved by the package,
+// user keys can't collide with them.
+type internalKey string
+
+const metaKey internalKey = "meta"
+
+// keyer is implemented by raw stores able to list their keys.
+type keyer interface {
+	Keys() []interface{}
+}
+
+// setAller is implemented by raw stores replacing all their values at once.
+type setAller interface {
+	SetAll(values map[interface{}]interface{}) error
+}
+
+// getOrSetter is implemented by raw stores setting a missing value under
+// their lock.
+type getOrSetter interface {
+	GetOrSet(key interface{}, factory func() (interface{}, error)) (interface{}, error)
+}
+
+// taker is implemented by raw stores getting and deleting a value under
+// their lock.
+type taker interface {
+	Take(key interface{}) interface{}
+}
+
+// versioner is implemented by raw stores counting the writes of their values.
+type versioner interface {
+	Version() uint64
+}
+
 // Store is the interface that contains all data for one session process with specific ID.
 type Store interface {
 	macross.RawStore
@@ -37,22 +114,565 @@ type Store interface {
 	Count() int
 	// GC calls GC to clean expired sessions.
 	GC()
+	// Keys returns the keys of the user values.
+	Keys() []interface{}
+	// SetAll replaces all the user values by values.
+	SetAll(values map[interface{}]interface{}) error
+	// Version returns how many writes changed the session values.
+	Version() uint64
+	// GetOrSet returns the value of key, or sets it to the value of factory.
+	GetOrSet(key interface{}, factory func() interface{}) interface{}
+	// Meta returns the session metadata.
+	Meta() Meta
+	// CreatedAt returns when the session was created.
+	CreatedAt() (time.Time, error)
+	// LastAccessedAt returns when the session was last requested.
+	LastAccessedAt() (time.Time, error)
+	// SetAuthenticated marks the session as logged in or out.
+	SetAuthenticated(bool) error
+	// IsAuthenticated reports whether the session is logged in.
+	IsAuthenticated() bool
+	// SetUserID binds the session to a user, "" unbinds it.
+	SetUserID(string) error
+	// UserID returns the user the session is bound to.
+	UserID() string
+	// FlushAndRotate clears the session and moves it to a new session id,
+	// e.g. after a login or a password change.
+	FlushAndRotate(*macross.Context) error
+	// Discard skips saving the session at the end of the request.
+	Discard()
+	// SetPending marks the session as pending, expiring after a short ttl
+	// unless promoted.
+	SetPending(time.Duration) error
+	// IsPending reports whether the session is pending.
+	IsPending() bool
+	// Promote turns a pending session into a full session under a new id.
+	Promote(*macross.Context) error
+	// Fingerprint returns a hash of the user values, equal for equal values.
+	Fingerprint() string
+	// ExtendLifetime keeps the session alive for d, past its usual lifetime.
+	ExtendLifetime(d time.Duration) error
 }
 
 type store struct {
 	macross.RawStore
 	*Manager
+	noFlash   bool // Options.DisableFlash
+	noInput   bool // Options.DisableInput
+	maxInput  int  // Options.MaxInputSize
+	discarded bool // not released by the middleware, see Discard
+	saved     bool // input saved by SaveInput in this request
 }
 
 var _ Store = &store{}
 
+// Keys returns the keys of the user values, nil if the provider can't list them.
+func (s store) Keys() []interface{} {
+	k, ok := s.RawStore.(keyer)
+	if !ok {
+		return nil
+	}
+	var keys []interface{}
+	for _, key := range k.Keys() {
+		if _, internal := key.(internalKey); !internal {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Version returns how many writes changed the session values, as of its read
+// or its last release in this process. It's 0 for a new session, and for the
+// providers not counting the writes: cookie, jwt, s3 and firestore.
+func (s store) Version() uint64 {
+	if v, ok := s.RawStore.(versioner); ok {
+		return v.Version()
+	}
+	return 0
+}
+
+// Meta returns the session metadata.
+func (s store) Meta() Meta {
+	return getMeta(s.RawStore)
+}
+
+// CreatedAt returns when the session was created, recorded by the middleware
+// on its first request.
+func (s store) CreatedAt() (time.Time, error) {
+	meta := getMeta(s.RawStore)
+	if meta.CreatedAt.IsZero() {
+		return time.Time{}, ErrNoTimestamps
+	}
+	return meta.CreatedAt, nil
+}
+
+// LastAccessedAt returns when the session was last requested, to the minute
+// (to the second with an idleTimeout).
+func (s store) LastAccessedAt() (time.Time, error) {
+	meta := getMeta(s.RawStore)
+	if meta.LastAccessed.IsZero() {
+		return time.Time{}, ErrNoTimestamps
+	}
+	return meta.LastAccessed, nil
+}
+
+// Set sets value of key, rejecting values of a type other than the
+// one registered with Manager.SetValueType, larger than maxValueBytes or
+// which can't be encoded, see OnEncodeError. A value of a type with a
+// converter is stored converted, see RegisterConverter.
+func (s store) Set(key, value interface{}) error {
+	stored, err := s.Manager.checkValue(key, value)
+	if err != nil {
+		if s.Manager.dropsUnencodable(err) {
+			return s.RawStore.Delete(key)
+		}
+		return err
+	}
+	return s.RawStore.Set(key, stored)
+}
+
+// Get returns the value of key, converted back if it was stored converted.
+func (s store) Get(key interface{}) interface{} {
+	return fromStored(s.RawStore.Get(key))
+}
+
+// SetAll replaces all the user values by values, e.g. to restore a session,
+// keeping the session metadata. The values are checked before the session
+// changes, and stores supporting it swap them in one step, so the session is
+// never seen half replaced. Other stores are flushed and set key by key.
+func (s store) SetAll(values map[interface{}]interface{}) error {
+	all := make(map[interface{}]interface{}, len(values)+1)
+	for key, value := range values {
+		stored, err := s.Manager.checkValue(key, value)
+		if err != nil {
+			if s.Manager.dropsUnencodable(err) {
+				continue
+			}
+			return err
+		}
+		all[key] = stored
+	}
+	if meta := s.RawStore.Get(metaKey); meta != nil {
+		all[metaKey] = meta
+	}
+	return setAll(s.RawStore, all)
+}
+
+// GetOrSet returns the value of key, or sets it to the value of factory and
+// returns it, e.g. to create the shopping cart of a session on first use.
+// factory runs once even for concurrent calls, under the session lock, so it
+// mustn't use the session. A value rejected as by Set is returned but not
+// set, and logged.
+func (s store) GetOrSet(key interface{}, factory func() interface{}) interface{} {
+	var rejected interface{}
+	checked := func() (interface{}, error) {
+		value := factory()
+		stored, err := s.Manager.checkValue(key, value)
+		if err != nil {
+			rejected = value
+			return nil, err
+		}
+		return stored, nil
+	}
+	value, err := getOrSet(s.RawStore, key, checked)
+	if err != nil {
+		log.Printf("session: GetOrSet of %v: %v", key, err)
+		return rejected
+	}
+	return fromStored(value)
+}
+
+// storeLocks serialize the GetOrSet and take of the raw stores without a
+// lock of their own, e.g. those of the s3 and firestore providers. They're
+// striped by session id, so a slow factory only holds up the sessions
+// sharing its stripe.
+var storeLocks [256]sync.Mutex
+
+// storeLock returns the lock of the stripe of session sid.
+func storeLock(sid string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	return &storeLocks[h.Sum32()%uint32(len(storeLocks))]
+}
+
+// getOrSet returns the value of key in raw, or sets it to the value of
+// factory, under the lock of raw if it's a getOrSetter.
+func getOrSet(raw macross.RawStore, key interface{}, factory func() (interface{}, error)) (interface{}, error) {
+	if gs, ok := raw.(getOrSetter); ok {
+		return gs.GetOrSet(key, factory)
+	}
+	lock := storeLock(raw.ID())
+	lock.Lock()
+	defer lock.Unlock()
+	if v := raw.Get(key); v != nil {
+		return v, nil
+	}
+	value, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	if err = raw.Set(key, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// take returns the value of key in raw and deletes it, under the lock of raw
+// if it's a taker.
+func take(raw macross.RawStore, key interface{}) interface{} {
+	if t, ok := raw.(taker); ok {
+		return t.Take(key)
+	}
+	lock := storeLock(raw.ID())
+	lock.Lock()
+	defer lock.Unlock()
+	v := raw.Get(key)
+	if v != nil {
+		raw.Delete(key)
+	}
+	return v
+}
+
+// setAll replaces all values of raw, in one step if it's a setAller.
+func setAll(raw macross.RawStore, values map[interface{}]interface{}) error {
+	if sa, ok := raw.(setAller); ok {
+		return sa.SetAll(values)
+	}
+	if err := raw.Flush(); err != nil {
+		return err
+	}
+	for key, value := range values {
+		if err := raw.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrappedStore forwards the optional methods of the raw store it wraps to it,
+// see keyer, setAller, getOrSetter, taker and versioner. The stores of the
+// wrapping providers embed it and implement their own Release.
+type wrappedStore struct {
+	macross.RawStore
+}
+
+// SetAll replaces all values of the session, in one step if its store can.
+func (ws wrappedStore) SetAll(values map[interface{}]interface{}) error {
+	return setAll(ws.RawStore, values)
+}
+
+// Version returns how many writes changed the session values.
+func (ws wrappedStore) Version() uint64 {
+	if v, ok := ws.RawStore.(versioner); ok {
+		return v.Version()
+	}
+	return 0
+}
+
+// GetOrSet returns the value of key, or sets it to the value of factory.
+func (ws wrappedStore) GetOrSet(key interface{}, factory func() (interface{}, error)) (interface{}, error) {
+	return getOrSet(ws.RawStore, key, factory)
+}
+
+// Take returns the value of key and deletes it.
+func (ws wrappedStore) Take(key interface{}) interface{} {
+	return take(ws.RawStore, key)
+}
+
+// Keys returns the keys of the session values.
+func (ws wrappedStore) Keys() []interface{} {
+	if k, ok := ws.RawStore.(keyer); ok {
+		return k.Keys()
+	}
+	return nil
+}
+
+// SetAuthenticated marks the session as logged in or out.
+func (s store) SetAuthenticated(authenticated bool) error {
+	meta := getMeta(s.RawStore)
+	meta.Authenticated = authenticated
+	return setMeta(s.RawStore, meta)
+}
+
+// IsAuthenticated reports whether the session is logged in.
+func (s store) IsAuthenticated() bool {
+	return getMeta(s.RawStore).Authenticated
+}
+
+// SetUserID binds the session to a user, so Manager.UserSessions and
+// Manager.DestroyUserSessionsExcept find it. "" unbinds it.
+func (s store) SetUserID(userID string) error {
+	meta := getMeta(s.RawStore)
+	meta.UserID = userID
+	meta.BoundAt = time.Now()
+	if err := setMeta(s.RawStore, meta); err != nil {
+		return err
+	}
+	s.Manager.users.bind(userID, s.ID(), meta.BoundAt)
+	return nil
+}
+
+// UserID returns the user the session is bound to.
+func (s store) UserID() string {
+	return getMeta(s.RawStore).UserID
+}
+
+// Discard skips the release of the session by the middleware, so the changes
+// of the request aren't saved, e.g. when a form fails validation. A session
+// created by the request is destroyed and its cookie isn't set. Providers
+// saving each change at once (memory) keep the changes made before Discard.
+func (s *store) Discard() {
+	s.discarded = true
+}
+
+// FlushAndRotate clears the values of the session, its login and user included,
+// and regenerates its id and cookie, so the old sid can't be reused.
+// Only the creation and client metadata are kept.
+func (s *store) FlushAndRotate(ctx *macross.Context) error {
+	sid, err := s.Manager.sessionID()
+	if err != nil {
+		return err
+	}
+	meta := getMeta(s.RawStore)
+	raw, err := s.Manager.regenerate(ctx, s.ID(), sid)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		return fmt.Errorf("session: provider %T can't regenerate sessions", s.Manager.provider)
+	}
+	if err = raw.Flush(); err != nil {
+		return err
+	}
+	s.Manager.users.unbind(sid)
+	s.RawStore = raw
+	return setMeta(raw, Meta{
+		CreatedAt:    meta.CreatedAt,
+		LastAccessed: meta.LastAccessed,
+		ClientIP:     meta.ClientIP,
+		UserAgent:    meta.UserAgent,
+	})
+}
+
+func getMeta(s macross.RawStore) Meta {
+	if meta, ok := s.Get(metaKey).(Meta); ok {
+		return meta
+	}
+	return Meta{}
+}
+
+// setMeta stores meta in s unless it's unchanged, so a request which only
+// reads the session doesn't write it, e.g. the cookie of the cookie provider.
+func setMeta(s macross.RawStore, meta Meta) error {
+	if old, ok := s.Get(metaKey).(Meta); ok && reflect.DeepEqual(old, meta) {
+		return nil
+	}
+	return s.Set(metaKey, meta)
+}
+
+// lastAccessedPrecision is how often Meta.LastAccessed is updated, so
+// read-only requests don't change the session on every hit.
+const lastAccessedPrecision = time.Minute
+
+// accessPrecision returns how often Meta.LastAccessed is updated,
+// every second when it drives the idle timeout.
+func (manager *Manager) accessPrecision() time.Duration {
+	if manager.config.IdleTimeout > 0 {
+		return time.Second
+	}
+	return lastAccessedPrecision
+}
+
+// expireIdle destroys session s if it has been idle for longer than
+// idleTimeout and returns a new session in its place.
+func (manager *Manager) expireIdle(ctx *macross.Context, s macross.RawStore) (macross.RawStore, error) {
+	if !manager.idle(getMeta(s)) {
+		return s, nil
+	}
+	return manager.replace(ctx, s)
+}
+
+// idle reports whether the session of meta has been idle for longer than
+// idleTimeout, and isn't kept alive by ExtendLifetime.
+func (manager *Manager) idle(meta Meta) bool {
+	idle := time.Duration(manager.config.IdleTimeout) * time.Second
+	last := meta.LastAccessed
+	return idle > 0 && !last.IsZero() && time.Since(last) > idle && !time.Now().Before(meta.KeepUntil)
+}
+
+// bindIP destroys session s if the client of ctx is outside the network of
+// the client which created it, see ipBindPrefix, and returns a new session
+// in its place. A session without a client ip, e.g. started before the
+// binding was enabled, is bound to the client of ctx from now on.
+func (manager *Manager) bindIP(ctx *macross.Context, s macross.RawStore) (macross.RawStore, error) {
+	if manager.config.IPBindPrefix == 0 {
+		return s, nil
+	}
+	meta := getMeta(s)
+	created := net.ParseIP(meta.ClientIP)
+	if created == nil {
+		meta.ClientIP = ctx.RemoteIP().String()
+		return s, setMeta(s, meta)
+	}
+	if manager.sameNetwork(created, ctx.RemoteIP()) {
+		return s, nil
+	}
+	return manager.replace(ctx, s)
+}
+
+// valid reports whether session s passes the checks of the middleware for
+// the request ctx, without replacing nor binding it: not idle, not pending
+// past its ttl and used from the network of its client. See Peek.
+func (manager *Manager) valid(ctx *macross.Context, s macross.RawStore) bool {
+	meta := getMeta(s)
+	if manager.idle(meta) || pendingExpired(meta) {
+		return false
+	}
+	if manager.config.IPBindPrefix == 0 {
+		return true
+	}
+	// a session not bound yet is refused until the middleware binds it.
+	created := net.ParseIP(meta.ClientIP)
+	return created != nil && manager.sameNetwork(created, ctx.RemoteIP())
+}
+
+// sameNetwork reports whether a and b are in the same /ipBindPrefix network,
+// /ipv6BindPrefix for IPv6 addresses.
+func (manager *Manager) sameNetwork(a, b net.IP) bool {
+	bits, prefix := 32, manager.config.IPBindPrefix
+	if a.To4() == nil {
+		bits, prefix = 128, manager.config.IPv6BindPrefix
+	} else {
+		a = a.To4()
+		if b = b.To4(); b == nil {
+			return false
+		}
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return a.Mask(mask).Equal(b.Mask(mask))
+}
+
+// replace destroys session s and returns a new session in its place.
+func (manager *Manager) replace(ctx *macross.Context, s macross.RawStore) (macross.RawStore, error) {
+	if err := manager.destroy(RequestContext(ctx), s.ID()); err != nil {
+		return nil, err
+	}
+	manager.users.unbind(s.ID())
+	sid, err := manager.sessionID()
+	if err != nil {
+		return nil, err
+	}
+	return manager.regenerate(ctx, "", sid)
+}
+
+// checkNearExpiry calls the OnNearExpiry hook if session s expires within
+// nearExpiryWindow, from idleness or its max lifetime whichever comes first.
+func (manager *Manager) checkNearExpiry(sid string, s macross.RawStore) {
+	window := time.Duration(manager.config.NearExpiryWindow) * time.Second
+	last := getMeta(s).LastAccessed
+	if manager.nearExpiry == nil || window == 0 || last.IsZero() {
+		return
+	}
+	lifetime := manager.config.MaxLifetime
+	if idle := manager.config.IdleTimeout; idle > 0 && idle < lifetime {
+		lifetime = idle
+	}
+	remaining := last.Add(time.Duration(lifetime) * time.Second).Sub(time.Now())
+	if remaining > 0 && remaining <= window {
+		manager.nearExpiry(sid, remaining)
+	}
+}
+
+// setIdleHeader tells the client the seconds left before its session expires
+// from idleness, e.g. to show a countdown and a keepalive prompt.
+func (manager *Manager) setIdleHeader(ctx *macross.Context, meta Meta) {
+	if manager.config.IdleTimeout == 0 {
+		return
+	}
+	left := manager.config.IdleTimeout - int64(time.Since(meta.LastAccessed)/time.Second)
+	ctx.Response.Header.Set(manager.config.IdleHeader, strconv.FormatInt(left, 10))
+}
+
+// touchMeta records the access of c to the session, and its client on creation.
+// LastAccessed is updated once it's older than precision.
+func touchMeta(c *macross.Context, s macross.RawStore, precision time.Duration) Meta {
+	now := time.Now()
+	meta := getMeta(s)
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = now
+		meta.ClientIP = c.RemoteIP().String()
+		meta.UserAgent = string(c.UserAgent())
+		meta.Device = ParseUserAgent(meta.UserAgent)
+		// sessions of older versions keep flash and input under plain keys.
+		if input, ok := s.Get(SESSION_INPUT_KEY).(url.Values); ok && len(input) > 0 {
+			meta.Input = input
+		}
+		if flash := legacyFlash(s.Get(SESSION_FLASH_KEY)); flash != nil && hasFlashMessages(flash.Values) {
+			meta.Flash, meta.FlashNow = flash.Values, flash.FlashNow
+		}
+		s.Delete(SESSION_FLASH_KEY)
+		s.Delete(SESSION_INPUT_KEY)
+	}
+	if now.Sub(meta.LastAccessed) >= precision {
+		meta.LastAccessed = now
+	}
+	setMeta(s, meta)
+	return meta
+}
+
+// legacyFlash returns the flash stored under SESSION_FLASH_KEY by older
+// versions, nil if v isn't one.
+func legacyFlash(v interface{}) *macross.Flash {
+	switch flash := v.(type) {
+	case *macross.Flash:
+		return flash
+	case macross.Flash:
+		return &flash
+	}
+	return nil
+}
+
+// ErrNoTimestamps is returned by CreatedAt and LastAccessedAt for a session
+// never started by the middleware, e.g. one read with Manager.Read.
+var ErrNoTimestamps = errors.New("session: the session has no timestamps")
+
+var errNoManager = errors.New("session manager not found, use session middleware but not init ?")
+
+// Options configures the session middleware. New fields are appended, use
+// keyed literals, e.g. Options{Provider: "memory", Config: ...}.
 type Options struct {
 	Provider string
 	Config   string
+	// ProviderConfig configures the provider with a Go value (e.g. a provider
+	// config struct) instead of the json providerConfig field of Config.
+	ProviderConfig interface{}
+	// Skipper skips the session middleware when it returns true,
+	// e.g. for static assets and health checks.
+	Skipper func(*macross.Context) bool
+	// CookieCodec replaces how the session id cookie is read and written.
+	CookieCodec CookieCodec
+	// DisableFlash skips restoring and saving flash messages,
+	// c.Flash stays nil and GetFlash returns an empty flash.
+	DisableFlash bool
+	// DisableInput turns SaveInput into a no-op and GetInput returns no values.
+	DisableInput bool
+	// MaxInputSize is the most bytes of form keys and values SaveInput
+	// stores in the session, larger inputs (e.g. big uploads) aren't saved.
+	// 0 means no limit.
+	MaxInputSize int
+	// ValueTypes maps session keys to an example of the type their values
+	// must have, see Manager.SetValueType.
+	ValueTypes map[interface{}]interface{}
+	// SkipReleaseOnPanic discards the session of a request whose handler
+	// panics, as by Store.Discard, so its half-made changes aren't saved.
+	// The panic goes on to the recover middleware.
+	SkipReleaseOnPanic bool
 }
 
 func init() {
 	gob.Register(url.Values{})
+	gob.Register(internalKey(""))
+	gob.Register(Meta{})
 }
 
 // setup 初始化并设置session配置
@@ -70,10 +690,18 @@ func setup(op ...Options) error {
 	log.Println("Macross session config:", option)
 
 	var err error
-	GlobalManager, err = NewManager(option.Provider, option.Config)
+	if option.ProviderConfig != nil {
+		GlobalManager, err = NewManagerWithConfig(option.Provider, option.Config, option.ProviderConfig)
+	} else {
+		GlobalManager, err = NewManager(option.Provider, option.Config)
+	}
 	if err != nil {
 		return err
 	}
+	GlobalManager.SetCookieCodec(option.CookieCodec)
+	for key, example := range option.ValueTypes {
+		GlobalManager.SetValueType(key, example)
+	}
 	go GlobalManager.GC()
 
 	return nil
@@ -86,67 +714,235 @@ func Sessioner(op ...Options) macross.Handler {
 			log.Fatalln("Sessioner() setup() errors:", err)
 		}
 	}
-	return func(c *macross.Context) error {
+	option := defaultOtions
+	if len(op) > 0 {
+		option = op[0]
+	}
+	return func(c *macross.Context) (err error) {
+		if option.Skipper != nil && option.Skipper(c) {
+			return c.Next()
+		}
+
 		if GlobalManager == nil {
-			return errors.New("session manager not found, use session middleware but not init ?")
+			return errNoManager
+		}
+		if GetStore(c) != nil {
+			// e.g. a nested router using the middleware again.
+			log.Printf("session: Sessioner used twice on %s, the session is started once", c.Path())
+			return c.Next()
 		}
 
-		sess, err := GlobalManager.Start(c)
+		sess, created, err := GlobalManager.start(c)
 		if err != nil {
 			return err
 		}
+		createdSID := ""
+		if created {
+			createdSID = sess.ID()
+		}
+		if sess, err = GlobalManager.expireIdle(c, sess); err != nil {
+			return err
+		}
+		if sess, err = GlobalManager.expirePending(c, sess); err != nil {
+			return err
+		}
+		if sess, err = GlobalManager.bindIP(c, sess); err != nil {
+			return err
+		}
 
-		c.Session = store{
+		s := &store{
 			RawStore: sess,
 			Manager:  GlobalManager,
+			noFlash:  option.DisableFlash,
+			noInput:  option.DisableInput,
+			maxInput: option.MaxInputSize,
 		}
+		c.Session = s
 
-		var has bool
-		flashVals := url.Values{}
-		flashIf := c.Session.Get(SESSION_FLASH_KEY)
-		if flashIf != nil {
-			//vals, _ := url.QueryUnescape(flashIf.(string))
-			if flasho, okay := flashIf.(*macross.Flash); okay {
-				if flashVals, _ = url.ParseQuery(flasho.Encode()); len(flashVals) > 0 {
-					flash := macross.Flash{Values: url.Values{}}
-					flash.ErrorMsg = flashVals.Get("error")
-					flash.WarningMsg = flashVals.Get("warning")
-					flash.InfoMsg = flashVals.Get("info")
-					flash.SuccessMsg = flashVals.Get("success")
-
-					flash.Ctx = c
-					if flasho.FlashNow {
-						flash.FlashNow = true
-						c.Set(CONTEXT_FLASH_KEY, flash)
-					} else {
-						flash.FlashNow = false
-						flash.Ctx.Set(CONTEXT_FLASH_KEY, flash)
-					}
-					c.Flash = &flash
-					has = true
-
-				}
+		meta := touchMeta(c, sess, GlobalManager.accessPrecision())
+		GlobalManager.setIdleHeader(c, meta)
+		// a flash bound to another path by FlashFor is kept for that request.
+		pendingFlash := len(meta.Flash) > 0 && !flashMatches(c, meta.Flash)
+		if !option.DisableFlash {
+			if len(meta.Flash) > 0 && !pendingFlash {
+				// rebuild the flash bound to this request from its stored messages.
+				c.Flash = newFlashFromValues(c, meta.Flash)
+				c.Flash.FlashNow = meta.FlashNow
+			} else {
+				c.Flash = NewFlash(c)
 			}
-
-		}
-
-		if !has {
-			c.Flash = NewFlash(new(macross.Context))
-			c.Set(CONTEXT_FLASH_KEY, c.Flash)
+			c.Set(CONTEXT_FLASH_KEY, *c.Flash)
 		}
 
 		c.Set(CONTEXT_SESSION_KEY, c.Session)
 
 		defer func() {
-			//log.Println("save session", sess)
-			//sess.Set(SESSION_FLASH_KEY, url.QueryEscape(f.Encode()))
-			c.Session.Set(SESSION_FLASH_KEY, c.Flash)
-			c.Session.Release(c)
+			if option.SkipReleaseOnPanic {
+				if p := recover(); p != nil {
+					s.discarded = true
+					defer panic(p)
+				}
+			}
+			if s.discarded {
+				// the session may have been rotated meanwhile.
+				if createdSID != "" && s.ID() == createdSID {
+					s.Manager.dropCreated(c, createdSID)
+				}
+				return
+			}
+			if !option.DisableFlash {
+				// the session may have been rotated meanwhile.
+				meta := getMeta(s.RawStore)
+				// an empty flash isn't written at all.
+				if !pendingFlash {
+					meta.Flash, meta.FlashNow = nil, false
+				}
+				if c.Flash != nil && hasFlashMessages(c.Flash.Values) {
+					meta.Flash, meta.FlashNow = flashValues(c), c.Flash.FlashNow
+				}
+				setMeta(s.RawStore, meta)
+			}
+			ctx := RequestContext(c)
+			release := func() error {
+				return s.Manager.retry(ctx, func() error {
+					return ReleaseContext(ctx, c, s.RawStore)
+				})
+			}
+			rerr := release()
+			if rerr != nil && ctx.Err() != nil {
+				log.Printf("session: release of %s aborted: %v", s.ID(), rerr)
+				return
+			}
+			if rerr == nil {
+				s.Manager.writeRepair(c, s.RawStore)
+				s.Manager.keepAlive(s.RawStore)
+				return
+			}
+			// a value changed after its Set can't be encoded.
+			eerr := s.Manager.unencodable(s.RawStore)
+			if eerr == nil {
+				// the backend failed, the changes of the request are lost.
+				log.Printf("session: release of %s: %v", s.ID(), rerr)
+				if err == nil {
+					err = rerr
+				}
+				return
+			}
+			if s.Manager.config.OnEncodeError != encodeErrorDrop {
+				log.Printf("session: release of %s: %v", s.ID(), eerr)
+				if err == nil {
+					err = eerr
+				}
+				return
+			}
+			for ; eerr != nil; eerr = s.Manager.unencodable(s.RawStore) {
+				log.Printf("%v, dropped", eerr)
+				if s.RawStore.Delete(eerr.Key) != nil {
+					return
+				}
+			}
+			if rerr = release(); rerr != nil {
+				log.Printf("session: release of %s: %v", s.ID(), rerr)
+			}
 		}()
 		return c.Next()
 	}
 }
 
+// FromHandshake reads the session of a websocket (or other upgraded connection)
+// handshake request and attaches it to c, unless Sessioner already did.
+// Call it in the upgrade handler while the request cookies are available and
+// keep the returned Store for the lifetime of the connection, instead of a
+// session round-trip per message. Call Release to persist changes.
+func FromHandshake(c *macross.Context) (Store, error) {
+	if s := GetStore(c); s != nil {
+		return s, nil
+	}
+	if GlobalManager == nil {
+		return nil, errNoManager
+	}
+	sess, err := GlobalManager.Start(c)
+	if err != nil {
+		return nil, err
+	}
+	touchMeta(c, sess, GlobalManager.accessPrecision())
+	s := &store{
+		RawStore: sess,
+		Manager:  GlobalManager,
+	}
+	c.Session = s
+	c.Set(CONTEXT_SESSION_KEY, s)
+	return s, nil
+}
+
+// WithContext sets the context of the request c, e.g. cancelled when the
+// client disconnects, the session of the request isn't saved once it's done.
+func WithContext(c *macross.Context, ctx context.Context) {
+	c.Set(CONTEXT_REQUEST_KEY, ctx)
+}
+
+// RequestContext returns the context of the request c set with WithContext,
+// by default the fasthttp request itself, done once the server shuts down.
+func RequestContext(c *macross.Context) context.Context {
+	if ctx, ok := c.Get(CONTEXT_REQUEST_KEY).(context.Context); ok {
+		return ctx
+	}
+	if c.RequestCtx != nil {
+		if ctx, ok := interface{}(c.RequestCtx).(context.Context); ok {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+// ReleaseContext saves session s unless ctx is done, with the
+// ReleaseContext of the store if it has one, see ContextReleaser.
+func ReleaseContext(ctx context.Context, c *macross.Context, s macross.RawStore) error {
+	if cr, ok := s.(ContextReleaser); ok {
+		return cr.ReleaseContext(ctx, c)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Release(c)
+}
+
+// Peek returns the existing session named by the request, e.g. for a rate
+// limiter by user running before Sessioner, and false if there is none.
+// It never creates a session nor writes a cookie, don't Release the store.
+// A session the middleware would replace, idle, pending past its ttl or
+// used from another network, is reported missing as is.
+func Peek(c *macross.Context) (Store, bool) {
+	if s := GetStore(c); s != nil {
+		return s, true
+	}
+	if GlobalManager == nil {
+		return nil, false
+	}
+	sid, _, err := GlobalManager.getSid(c)
+	if err != nil || sid == "" || !GlobalManager.provider.Exist(sid) {
+		return nil, false
+	}
+	sess, err := GlobalManager.read(RequestContext(c), sid)
+	if err != nil || !GlobalManager.valid(c, sess) {
+		return nil, false
+	}
+	return &store{RawStore: sess, Manager: GlobalManager}, true
+}
+
+// RequireAuth redirects the requests of sessions not marked authenticated
+// with SetAuthenticated to redirectURL, e.g. the login page.
+// It must be used after Sessioner.
+func RequireAuth(redirectURL string) macross.Handler {
+	return func(c *macross.Context) error {
+		if s := GetStore(c); s != nil && s.IsAuthenticated() {
+			return c.Next()
+		}
+		c.Abort()
+		return c.Redirect(redirectURL)
+	}
+}
+
 func GetStore(c *macross.Context) Store {
 	store := c.Get(CONTEXT_SESSION_KEY)
 	if store != nil {
@@ -158,42 +954,171 @@ func GetStore(c *macross.Context) Store {
 }
 
 func GetFlash(c *macross.Context) *macross.Flash {
-	if store := GetStore(c); store != nil {
-		if tmp := store.Get(SESSION_FLASH_KEY); tmp != nil {
-			if flash, okay := tmp.(*macross.Flash); okay {
-				return flash
-			}
+	if store := GetStore(c); store != nil && !disabled(store).noFlash {
+		if meta := store.Meta(); len(meta.Flash) > 0 {
+			flash := newFlashFromValues(c, meta.Flash)
+			flash.FlashNow = meta.FlashNow
+			return flash
 		}
 	}
 	return NewFlash(c)
 }
 
+// disabled returns the flash/input switches of s, all off for foreign stores.
+func disabled(s Store) store {
+	if st, ok := s.(*store); ok {
+		return *st
+	}
+	return store{}
+}
+
 func FlashValue(c *macross.Context) macross.Flash {
-	if tmp := c.Get(CONTEXT_FLASH_KEY); tmp != nil {
-		return tmp.(macross.Flash)
+	switch flash := c.Get(CONTEXT_FLASH_KEY).(type) {
+	case macross.Flash:
+		return flash
+	case *macross.Flash:
+		// macross stores a pointer when a flash is shown on the current request.
+		return *flash
 	}
 	return macross.Flash{}
 }
 
-func SaveInput(c *macross.Context) {
-	if store := GetStore(c); store != nil {
-		store.Set(SESSION_INPUT_KEY, url.Values(c.FormParams()))
+// SetOnce sets a one-time value of the session of c, e.g. a csrf nonce or a
+// post-redirect token, read back once with GetOnce.
+func SetOnce(c *macross.Context, key, value interface{}) error {
+	store := GetStore(c)
+	if store == nil {
+		return errNoManager
 	}
+	return store.Set(key, value)
 }
 
-func GetInput(c *macross.Context) url.Values {
-	if store := GetStore(c); store != nil {
-		input := store.Get(SESSION_INPUT_KEY)
+// GetOnce returns the value of key in the session of c and deletes it in
+// one step under the session lock, so concurrent uses of the store consume
+// it once: a second GetOnce returns nil. Requests running concurrently each
+// read their own copy of a stored session, except with the memory provider,
+// and could both consume a value set by an earlier request.
+func GetOnce(c *macross.Context, key interface{}) interface{} {
+	s := GetStore(c)
+	if s == nil {
+		return nil
+	}
+	var raw macross.RawStore = s
+	if st, ok := s.(*store); ok {
+		raw = st.RawStore
+	}
+	return fromStored(take(raw, key))
+}
+
+// SaveInput saves the form of c for GetInput on the next request, unless it's
+// larger than Options.MaxInputSize. An optional form name keeps the input
+// apart from the other forms, e.g. of the same page or of other tabs.
+func SaveInput(c *macross.Context, form ...string) {
+	if s := GetStore(c); s != nil && !disabled(s).noInput {
+		var saved url.Values
+		if input := url.Values(c.FormParams()); len(input) > 0 {
+			max := disabled(s).maxInput
+			if size := inputSize(input); max > 0 && size > max {
+				log.Printf("session: input of %d bytes not saved, more than MaxInputSize %d", size, max)
+			} else {
+				saved = input
+			}
+		}
+		setInput(s, formName(form), saved)
+		if st, ok := s.(*store); ok {
+			st.saved = true
+		}
+	}
+}
+
+// inputSize returns the bytes of the keys and values of input.
+func inputSize(input url.Values) int {
+	size := 0
+	for k, vs := range input {
+		size += len(k)
+		for _, v := range vs {
+			size += len(v)
+		}
+	}
+	return size
+}
+
+// formName returns the optional form name of SaveInput, GetInput and CleanInput.
+func formName(form []string) string {
+	if len(form) > 0 {
+		return form[0]
+	}
+	return ""
+}
+
+// setInput saves input as the input of form, "" for the unnamed one.
+// nil removes it.
+func setInput(store Store, form string, input url.Values) {
+	meta := store.Meta()
+	if form == "" {
+		meta.Input = input
+		setMeta(store, meta)
+		return
+	}
+	// copy the map, it may be shared with the stored metadata.
+	inputs := make(map[string]url.Values, len(meta.Inputs)+1)
+	for name, values := range meta.Inputs {
+		inputs[name] = values
+	}
+	if input != nil {
+		inputs[form] = input
+	} else {
+		delete(inputs, form)
+	}
+	meta.Inputs = nil
+	if len(inputs) > 0 {
+		meta.Inputs = inputs
+	}
+	setMeta(store, meta)
+}
+
+// GetInput returns the input saved by SaveInput for the optional form name.
+func GetInput(c *macross.Context, form ...string) url.Values {
+	if store := GetStore(c); store != nil && !disabled(store).noInput {
+		meta := store.Meta()
+		input := meta.Input
+		if name := formName(form); name != "" {
+			input = meta.Inputs[name]
+		}
 		if input != nil {
-			return input.(url.Values)
+			return input
 		}
 	}
 	return url.Values{}
 }
 
-func CleanInput(c *macross.Context) {
+// CleanInput removes the input saved by SaveInput for the optional form name.
+func CleanInput(c *macross.Context, form ...string) {
 	if store := GetStore(c); store != nil {
-		store.Set(SESSION_INPUT_KEY, url.Values{})
+		setInput(store, formName(form), nil)
+	}
+}
+
+// CleanInputOnSuccess clears the input of all forms saved by SaveInput once a
+// POST request succeeds with a 2xx or 3xx response, so a processed form isn't
+// repopulated on a later render. Input saved by the request itself is kept,
+// e.g. by a handler redirecting back to the form it failed to validate.
+// It must be used after Sessioner.
+func CleanInputOnSuccess() macross.Handler {
+	return func(c *macross.Context) error {
+		if err := c.Next(); err != nil || !c.IsPost() {
+			return err
+		}
+		if status := c.Response.StatusCode(); status < 200 || status >= 400 {
+			return nil
+		}
+		if s, ok := GetStore(c).(*store); ok && !s.saved {
+			if meta := s.Meta(); meta.Input != nil || meta.Inputs != nil {
+				meta.Input, meta.Inputs = nil, nil
+				setMeta(s, meta)
+			}
+		}
+		return nil
 	}
 }
 
@@ -0,0 +1,1765 @@
+package session
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insionng/macross"
+	"github.com/valyala/fasthttp"
+)
+
+const testCookieName = "MacrossSessionId"
+
+// newTestApp returns an app using a fresh memory backed Sessioner.
+func newTestApp(t *testing.T, op Options) *macross.Macross {
+	GlobalManager = nil
+	if len(op.Provider) == 0 {
+		op = Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`}
+	}
+	m := macross.New()
+	m.Use(Sessioner(op))
+	return m
+}
+
+// newWrappedTestApp returns an app like newTestApp whose manager stores the
+// sessions in the provider wrap returns around the provider of op. The
+// manager is built around it before any gc runs, and runs none.
+func newWrappedTestApp(t *testing.T, op Options, wrap func(Provider) Provider) *macross.Macross {
+	manager, err := NewManager(op.Provider, op.Config)
+	if err != nil {
+		t.Fatal("NewManager:", err)
+	}
+	manager.provider = wrap(manager.provider)
+	GlobalManager = manager
+	m := macross.New()
+	m.Use(Sessioner(op))
+	return m
+}
+
+// sessionCookies returns the request cookies carrying the session id set by ctx.
+func sessionCookies(t *testing.T, ctx *fasthttp.RequestCtx) map[string]string {
+	cookie := responseCookie(ctx, testCookieName)
+	if cookie == nil {
+		t.Fatal("session cookie not written")
+	}
+	return map[string]string{testCookieName: string(cookie.Value())}
+}
+
+// postForm serves a POST of the urlencoded form body to path.
+func postForm(m *macross.Macross, path, body string, cookies map[string]string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI(path)
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/x-www-form-urlencoded")
+	for name, value := range cookies {
+		ctx.Request.Header.SetCookie(name, value)
+	}
+	ctx.Request.SetBodyString(body)
+	m.ServeHTTP(ctx)
+	return ctx
+}
+
+func TestSessionerFlashBoundToRequest(t *testing.T) {
+	var got *macross.Flash
+	var gotCtx *macross.Context
+	m := newTestApp(t, Options{})
+	m.Get("/set", func(c *macross.Context) error {
+		c.Flash.Info("hello", false)
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, gotCtx = c.Flash, c
+		return nil
+	})
+
+	ctx := doRequest(m, "/set", nil)
+	doRequest(m, "/get", sessionCookies(t, ctx))
+	if got == nil || got.InfoMsg != "hello" {
+		t.Fatal("flash added on the previous request not retrievable")
+	}
+	if got.Ctx != gotCtx {
+		t.Fatal("flash not bound to the request context")
+	}
+}
+
+func TestSessionerFlashNow(t *testing.T) {
+	var got macross.Flash
+	m := newTestApp(t, Options{})
+	m.Get("/now", func(c *macross.Context) error {
+		if c.Flash.Ctx != c {
+			t.Error("new flash not bound to the request context")
+		}
+		c.Flash.Info("now", true)
+		got = FlashValue(c)
+		return nil
+	})
+	doRequest(m, "/now", nil)
+	if got.InfoMsg != "now" {
+		t.Fatalf("flash for the current request not retrievable, got %q", got.InfoMsg)
+	}
+}
+
+func TestSessionerFlashNowKept(t *testing.T) {
+	m := newTestApp(t, Options{})
+	m.Get("/set", func(c *macross.Context) error {
+		c.Flash.FlashNow = true
+		c.Flash.Info("saved", false)
+		return nil
+	})
+	var now bool
+	m.Get("/get", func(c *macross.Context) error {
+		now = c.Flash.FlashNow
+		return nil
+	})
+	ctx := doRequest(m, "/set", nil)
+	doRequest(m, "/get", sessionCookies(t, ctx))
+	if !now {
+		t.Fatal("FlashNow of the stored flash lost")
+	}
+}
+
+func TestSessionerReadOnlyCookieSession(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "cookie", Config: `{"cookieName":"` + testCookieName + `","enableSetCookie":false,"gcLifetime":3600,` +
+		`"providerConfig":"{\"cookieName\":\"` + testCookieName + `\",\"securityKey\":\"Macrosscookiehashkey\",\"maxAge\":3600}"}`})
+	m.Get("/set", func(c *macross.Context) error {
+		return c.Session.Set("user", "insionng")
+	})
+	var user interface{}
+	m.Get("/get", func(c *macross.Context) error {
+		user = c.Session.Get("user")
+		return nil
+	})
+	ctx := doRequest(m, "/set", nil)
+	cookie := responseCookie(ctx, testCookieName)
+	if cookie == nil {
+		t.Fatal("cookie session not written")
+	}
+	ctx = doRequest(m, "/get", map[string]string{testCookieName: string(cookie.Value())})
+	if user != "insionng" {
+		t.Fatal("cookie session not read")
+	}
+	// the metadata touched by the middleware alone doesn't rewrite the cookie.
+	if responseCookie(ctx, testCookieName) != nil {
+		t.Fatal("cookie of a read-only request written again")
+	}
+}
+
+func TestExposeSIDHeader(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"exposeSIDHeader":true}`})
+	m.Get("/", func(c *macross.Context) error { return nil })
+
+	ctx := doRequest(m, "/", nil)
+	sid := string(ctx.Response.Header.Peek("X-Session-Id"))
+	if sid == "" {
+		t.Fatal("sid header missing on new session")
+	}
+	if string(ctx.Response.Header.Peek("Access-Control-Expose-Headers")) != "X-Session-Id" {
+		t.Fatal("sid header not exposed to cors clients")
+	}
+
+	// the client echoes the sid back in the header, no new session is created.
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.Set("X-Session-Id", sid)
+	m.ServeHTTP(ctx)
+	if len(ctx.Response.Header.Peek("X-Session-Id")) != 0 {
+		t.Fatal("sid header written for an existing session")
+	}
+}
+
+func TestSIDHeaderDisabledByDefault(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`})
+	var sid string
+	m.Get("/", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return nil
+	})
+	ctx := doRequest(m, "/", nil)
+	if len(ctx.Response.Header.Peek("X-Session-Id")) != 0 {
+		t.Fatal("sid header written without exposeSIDHeader")
+	}
+
+	// nor is the sid read from the header.
+	old := sid
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.Set("X-Session-Id", old)
+	m.ServeHTTP(ctx)
+	if sid == old {
+		t.Fatal("sid read from the header without exposeSIDHeader")
+	}
+}
+
+// countingProvider is a memory provider counting the reads it serves.
+type countingProvider struct {
+	*MemProvider
+	reads int
+}
+
+func (cp *countingProvider) Read(sid string) (macross.RawStore, error) {
+	cp.reads++
+	return cp.MemProvider.Read(sid)
+}
+
+var countingpder = &countingProvider{MemProvider: &MemProvider{list: list.New(), sessions: make(map[string]*list.Element)}}
+
+func init() {
+	Register("counting", countingpder)
+}
+
+func TestSessionerSkipper(t *testing.T) {
+	m := newTestApp(t, Options{
+		Provider: "counting",
+		Config:   `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+		Skipper: func(c *macross.Context) bool {
+			return string(c.Path()) == "/health"
+		},
+	})
+	var skipped bool
+	m.Get("/health", func(c *macross.Context) error {
+		skipped = c.Session == nil
+		return nil
+	})
+	m.Get("/", func(c *macross.Context) error { return nil })
+
+	countingpder.reads = 0
+	ctx := doRequest(m, "/health", nil)
+	if !skipped {
+		t.Fatal("session started on a skipped route")
+	}
+	if countingpder.reads != 0 {
+		t.Fatalf("provider read %d times on a skipped route", countingpder.reads)
+	}
+	if responseCookie(ctx, testCookieName) != nil {
+		t.Fatal("session cookie written on a skipped route")
+	}
+
+	ctx = doRequest(m, "/", nil)
+	if countingpder.reads != 1 {
+		t.Fatalf("provider read %d times, want 1", countingpder.reads)
+	}
+	if responseCookie(ctx, testCookieName) == nil {
+		t.Fatal("session cookie missing on a non-skipped route")
+	}
+}
+
+func TestFromHandshake(t *testing.T) {
+	GlobalManager = nil
+	if err := setup(); err != nil {
+		t.Fatal("setup:", err)
+	}
+	var ws Store
+	m := macross.New()
+	m.Get("/ws", func(c *macross.Context) error {
+		var err error
+		if ws, err = FromHandshake(c); err != nil {
+			return err
+		}
+		ws.Set("user", "insionng")
+		return ws.Release(c)
+	})
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/ws")
+	ctx.Request.Header.Set("Connection", "Upgrade")
+	ctx.Request.Header.Set("Upgrade", "websocket")
+	m.ServeHTTP(ctx)
+	if ws == nil {
+		t.Fatal("no store read at handshake time")
+	}
+	sid := ws.ID()
+
+	// the request is over, the connection keeps using the store.
+	if ws.Get("user") != "insionng" {
+		t.Fatal("store not usable after the handshake")
+	}
+
+	// the next handshake of the same client finds the same session.
+	ws = nil
+	doRequest(m, "/ws", sessionCookies(t, ctx))
+	if ws == nil || ws.ID() != sid {
+		t.Fatal("handshake did not read the existing session")
+	}
+}
+
+func TestSessionCookieSameSite(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"sameSite":"Lax"}`})
+	m.Get("/", func(c *macross.Context) error { return nil })
+	cookie := responseCookie(doRequest(m, "/", nil), testCookieName)
+	if cookie == nil || cookie.SameSite() != fasthttp.CookieSameSiteLaxMode {
+		t.Fatal("sameSite not applied to the session cookie")
+	}
+}
+
+// base64Codec wraps the session cookie value in base64.
+type base64Codec struct{}
+
+func (base64Codec) Read(ctx *macross.Context, name string) (string, error) {
+	cookie, err := ctx.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.URLEncoding.DecodeString(cookie.Value())
+	return string(b), err
+}
+
+func (base64Codec) Write(ctx *macross.Context, cookie *macross.Cookie) {
+	cookie.SetValue(base64.URLEncoding.EncodeToString([]byte(cookie.Value())))
+	ctx.SetCookie(cookie)
+}
+
+func TestCustomCookieCodec(t *testing.T) {
+	m := newTestApp(t, Options{
+		Provider:    "memory",
+		Config:      `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+		CookieCodec: base64Codec{},
+	})
+	var sid, got string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, _ = c.Session.Get("user").(string)
+		return nil
+	})
+
+	cookies := sessionCookies(t, doRequest(m, "/set", nil))
+	if cookies[testCookieName] != base64.URLEncoding.EncodeToString([]byte(sid)) {
+		t.Fatalf("cookie not written through the codec, got %q", cookies[testCookieName])
+	}
+	doRequest(m, "/get", cookies)
+	if got != "insionng" {
+		t.Fatal("session not found through the codec")
+	}
+
+	// an unwrapped sid doesn't pass through the codec, a new session starts.
+	got = ""
+	doRequest(m, "/get", map[string]string{testCookieName: sid})
+	if got != "" {
+		t.Fatal("cookie read without the codec")
+	}
+}
+
+func TestSessionMetaKeptApartFromKeys(t *testing.T) {
+	m := newTestApp(t, Options{})
+	var keys []interface{}
+	var meta Meta
+	var input string
+	m.Post("/set", func(c *macross.Context) error {
+		c.Session.Set("user", "insionng")
+		c.Flash.Info("saved", false)
+		SaveInput(c)
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		s := GetStore(c)
+		keys, meta = s.Keys(), s.Meta()
+		input = GetInput(c).Get("name")
+		return nil
+	})
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/set")
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/x-www-form-urlencoded")
+	ctx.Request.SetBodyString("name=insion")
+	m.ServeHTTP(ctx)
+	doRequest(m, "/get", sessionCookies(t, ctx))
+	if len(keys) != 1 || keys[0] != "user" {
+		t.Fatalf("Keys() = %v, want only the user key", keys)
+	}
+	if meta.CreatedAt.IsZero() || meta.LastAccessed.Before(meta.CreatedAt) {
+		t.Fatalf("access times not recorded: %+v", meta)
+	}
+	if meta.Flash.Get("info") != "saved" {
+		t.Fatal("flash not kept in the metadata")
+	}
+	if input != "insion" {
+		t.Fatalf("saved input not kept in the metadata, got %q", input)
+	}
+}
+
+func TestSessionWritesNoEmptyFlashOrInput(t *testing.T) {
+	m := newTestApp(t, Options{})
+	var raw macross.RawStore
+	m.Get("/", func(c *macross.Context) error {
+		raw = GetStore(c).(*store).RawStore
+		c.Session.Set("user", "insionng")
+		SaveInput(c)
+		return nil
+	})
+	doRequest(m, "/", nil)
+
+	values := raw.(*MemSessionStore).value
+	for k := range values {
+		if k != "user" && k != metaKey {
+			t.Fatalf("internal key %v written to the provider", k)
+		}
+	}
+	meta := getMeta(raw)
+	if meta.Flash != nil || meta.Input != nil {
+		t.Fatalf("empty flash or input written: %+v", meta)
+	}
+}
+
+func TestLegacyInternalKeysMigrated(t *testing.T) {
+	m := newTestApp(t, Options{})
+	var keys []interface{}
+	var input, info string
+	m.Get("/", func(c *macross.Context) error {
+		keys = GetStore(c).Keys()
+		input = GetInput(c).Get("name")
+		info = c.Flash.InfoMsg
+		return nil
+	})
+
+	sid := "0123456789abcdef"
+	raw, _ := GlobalManager.Read(sid)
+	raw.Set(SESSION_FLASH_KEY, &macross.Flash{Values: url.Values{"info": {"legacy"}}})
+	raw.Set(SESSION_INPUT_KEY, url.Values{"name": {"insion"}})
+	doRequest(m, "/", map[string]string{testCookieName: sid})
+	if len(keys) != 0 {
+		t.Fatalf("legacy internal keys visible: %v", keys)
+	}
+	if input != "insion" {
+		t.Fatal("legacy saved input not migrated")
+	}
+	if info != "legacy" {
+		t.Fatalf("legacy flash not migrated, got %q", info)
+	}
+}
+
+func TestSessionerFlashWithFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newTestApp(t, Options{Provider: "file", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"providerConfig":"` + dir + `"}`})
+	var got string
+	m.Get("/set", func(c *macross.Context) error {
+		c.Flash.Info("saved", false)
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got = c.Flash.InfoMsg
+		return nil
+	})
+	ctx := doRequest(m, "/set", nil)
+	doRequest(m, "/get", sessionCookies(t, ctx))
+	if got != "saved" {
+		t.Fatalf("flash not persisted through a gob provider, got %q", got)
+	}
+}
+
+func TestDisableFlashAndInput(t *testing.T) {
+	m := newTestApp(t, Options{
+		Provider:     "memory",
+		Config:       `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+		DisableFlash: true,
+		DisableInput: true,
+	})
+	var raw macross.RawStore
+	var flash *macross.Flash
+	var input url.Values
+	m.Post("/", func(c *macross.Context) error {
+		raw = GetStore(c).(*store).RawStore
+		if c.Flash != nil {
+			t.Error("flash restored with DisableFlash")
+		}
+		AddFlash(c, "info", "dropped")
+		SaveInput(c)
+		flash, input = GetFlash(c), GetInput(c)
+		return nil
+	})
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/x-www-form-urlencoded")
+	ctx.Request.SetBodyString("name=insion")
+	m.ServeHTTP(ctx)
+
+	if flash == nil || flash.InfoMsg != "" || len(flash.Values) != 0 {
+		t.Fatal("GetFlash must return an empty flash with DisableFlash")
+	}
+	if len(input) != 0 {
+		t.Fatal("GetInput must return no values with DisableInput")
+	}
+	meta := getMeta(raw)
+	if meta.Flash != nil || meta.Input != nil {
+		t.Fatalf("flash or input written while disabled: %+v", meta)
+	}
+}
+
+func TestMaxInputSize(t *testing.T) {
+	m := newTestApp(t, Options{
+		Provider:     "memory",
+		Config:       `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+		MaxInputSize: 16,
+	})
+	var input url.Values
+	m.Post("/save", func(c *macross.Context) error {
+		SaveInput(c)
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		input = GetInput(c)
+		return nil
+	})
+	cookies := sessionCookies(t, postForm(m, "/save", "name=insion", nil))
+	doRequest(m, "/get", cookies)
+	if input.Get("name") != "insion" {
+		t.Fatalf("input within the cap not saved: %v", input)
+	}
+
+	postForm(m, "/save", "bio="+strings.Repeat("x", 100), cookies)
+	doRequest(m, "/get", cookies)
+	if len(input) != 0 {
+		t.Fatalf("input over the cap saved: %v", input)
+	}
+}
+
+func TestNamedFormInput(t *testing.T) {
+	m := newTestApp(t, Options{})
+	var login, signup, unnamed url.Values
+	m.Post("/login", func(c *macross.Context) error {
+		SaveInput(c, "login")
+		return nil
+	})
+	m.Post("/signup", func(c *macross.Context) error {
+		SaveInput(c, "signup")
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		login, signup, unnamed = GetInput(c, "login"), GetInput(c, "signup"), GetInput(c)
+		return nil
+	})
+	m.Get("/clean", func(c *macross.Context) error {
+		CleanInput(c, "login")
+		return nil
+	})
+	cookies := sessionCookies(t, postForm(m, "/login", "name=insion", nil))
+	postForm(m, "/signup", "name=macross&email=m@example.com", cookies)
+	doRequest(m, "/get", cookies)
+	if login.Get("name") != "insion" || login.Get("email") != "" {
+		t.Fatalf("login input = %v", login)
+	}
+	if signup.Get("name") != "macross" || signup.Get("email") != "m@example.com" {
+		t.Fatalf("signup input = %v", signup)
+	}
+	if len(unnamed) != 0 {
+		t.Fatalf("named inputs read as the unnamed one: %v", unnamed)
+	}
+
+	doRequest(m, "/clean", cookies)
+	doRequest(m, "/get", cookies)
+	if len(login) != 0 || signup.Get("name") != "macross" {
+		t.Fatalf("CleanInput of login left %v and signup %v", login, signup)
+	}
+}
+
+func TestCleanInputOnSuccess(t *testing.T) {
+	m := newTestApp(t, Options{})
+	m.Use(CleanInputOnSuccess())
+	var input url.Values
+	m.Post("/save", func(c *macross.Context) error {
+		SaveInput(c)
+		return c.Redirect("/form", fasthttp.StatusFound)
+	})
+	m.Post("/invalid", func(c *macross.Context) error {
+		return c.String("invalid", fasthttp.StatusBadRequest)
+	})
+	m.Post("/done", func(c *macross.Context) error {
+		return c.Redirect("/", fasthttp.StatusFound)
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		input = GetInput(c)
+		return nil
+	})
+	cookies := sessionCookies(t, postForm(m, "/save", "name=insion", nil))
+	doRequest(m, "/get", cookies)
+	if input.Get("name") != "insion" {
+		t.Fatalf("input saved by the redirecting request cleared: %v", input)
+	}
+
+	postForm(m, "/invalid", "name=", cookies)
+	doRequest(m, "/get", cookies)
+	if input.Get("name") != "insion" {
+		t.Fatalf("input cleared after a 4xx: %v", input)
+	}
+
+	postForm(m, "/done", "name=insion", cookies)
+	doRequest(m, "/get", cookies)
+	if len(input) != 0 {
+		t.Fatalf("input kept after a 3xx: %v", input)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var backend *writeCounter
+	m := newWrappedTestApp(t, Options{Provider: "file", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"providerConfig":"` + dir + `"}`},
+		func(p Provider) Provider {
+			backend = &writeCounter{Provider: p}
+			return backend
+		})
+	var sid string
+	var n interface{}
+	m.Get("/discard", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		c.Session.Set("n", 2)
+		GetStore(c).Discard()
+		return nil
+	})
+	m.Get("/save", func(c *macross.Context) error {
+		c.Session.Set("n", 1)
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		n = c.Session.Get("n")
+		return nil
+	})
+
+	ctx := doRequest(m, "/discard", nil)
+	if backend.writes != 0 {
+		t.Fatalf("discarded session written %d times", backend.writes)
+	}
+	if responseCookie(ctx, testCookieName) != nil {
+		t.Fatal("cookie of a discarded new session set")
+	}
+	if backend.Exist(sid) {
+		t.Fatal("discarded new session kept by the provider")
+	}
+
+	cookies := sessionCookies(t, doRequest(m, "/save", nil))
+	doRequest(m, "/discard", cookies)
+	doRequest(m, "/get", cookies)
+	if n != 1 {
+		t.Fatalf("session holds %v after a discarded request, want 1", n)
+	}
+	if backend.writes != 2 {
+		t.Fatalf("%d writes, want the save and the get", backend.writes)
+	}
+}
+
+func TestSessionerTwice(t *testing.T) {
+	op := Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`}
+	m := newTestApp(t, op)
+	var first, second macross.RawStore
+	m.Use(func(c *macross.Context) error {
+		first = c.Session
+		return c.Next()
+	})
+	m.Use(Sessioner(op))
+	m.Get("/", func(c *macross.Context) error {
+		second = c.Session
+		return c.Session.Set("user", "insionng")
+	})
+
+	count := GlobalManager.Count()
+	ctx := doRequest(m, "/", nil)
+	if first == nil || first != second {
+		t.Fatal("second Sessioner didn't reuse the store of the first")
+	}
+	if n := GlobalManager.Count() - count; n != 1 {
+		t.Fatalf("%d sessions started, want 1", n)
+	}
+	cookies := 0
+	ctx.Response.Header.VisitAllCookie(func(k, v []byte) {
+		if string(k) == testCookieName {
+			cookies++
+		}
+	})
+	if cookies != 1 {
+		t.Fatalf("%d session cookies written, want 1", cookies)
+	}
+	if cookie := responseCookie(ctx, testCookieName); string(cookie.Value()) != first.ID() {
+		t.Fatal("session cookie of another session written")
+	}
+}
+
+func TestSkipReleaseOnPanic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := newTestApp(t, Options{
+		Provider:           "file",
+		Config:             `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"providerConfig":"` + dir + `"}`,
+		SkipReleaseOnPanic: true,
+	})
+	var n interface{}
+	m.Get("/save", func(c *macross.Context) error {
+		c.Session.Set("n", 1)
+		return nil
+	})
+	m.Get("/panic", func(c *macross.Context) error {
+		c.Session.Set("n", 2)
+		panic("half written")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		n = c.Session.Get("n")
+		return nil
+	})
+	doPanic := func(cookies map[string]string) (p interface{}) {
+		defer func() { p = recover() }()
+		doRequest(m, "/panic", cookies)
+		return nil
+	}
+
+	cookies := sessionCookies(t, doRequest(m, "/save", nil))
+	if p := doPanic(cookies); p != "half written" {
+		t.Fatalf("panic not passed on, recovered %v", p)
+	}
+	doRequest(m, "/get", cookies)
+	if n != 1 {
+		t.Fatalf("session holds %v after a panicking request, want 1", n)
+	}
+}
+
+func TestSessionerBase64CookieEncoding(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"cookieEncoding":"base64"}`})
+	var sid, got string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		got, _ = c.Session.Get("user").(string)
+		return nil
+	})
+
+	cookies := sessionCookies(t, doRequest(m, "/set", nil))
+	if cookies[testCookieName] != base64.RawURLEncoding.EncodeToString([]byte(sid)) {
+		t.Fatalf("sid cookie not base64url encoded, got %q", cookies[testCookieName])
+	}
+	doRequest(m, "/get", cookies)
+	if got != "insionng" {
+		t.Fatal("session not found from a base64url cookie")
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	m := newTestApp(t, Options{})
+	var served bool
+	m.Get("/login", func(c *macross.Context) error {
+		return GetStore(c).SetAuthenticated(true)
+	})
+	m.Get("/logout", func(c *macross.Context) error {
+		return GetStore(c).SetAuthenticated(false)
+	})
+	m.Get("/private", RequireAuth("/login"), func(c *macross.Context) error {
+		served = true
+		return nil
+	})
+
+	ctx := doRequest(m, "/private", nil)
+	if served || ctx.Response.StatusCode() != fasthttp.StatusFound || string(ctx.Response.Header.Peek("Location")) != "/login" {
+		t.Fatal("unauthenticated request not redirected to the login page")
+	}
+
+	cookies := sessionCookies(t, ctx)
+	doRequest(m, "/login", cookies)
+	doRequest(m, "/private", cookies)
+	if !served {
+		t.Fatal("authenticated request not passed")
+	}
+
+	served = false
+	doRequest(m, "/logout", cookies)
+	doRequest(m, "/private", cookies)
+	if served {
+		t.Fatal("request passed after logout")
+	}
+}
+
+func TestCookieExpiryJitter(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","enableSetCookie":true,"gcLifetime":3600,"cookieLifetime":3600,"expiryJitter":10}`})
+	m.Get("/", func(c *macross.Context) error { return nil })
+
+	now := time.Now()
+	first := responseCookie(doRequest(m, "/", nil), testCookieName)
+	second := responseCookie(doRequest(m, "/", nil), testCookieName)
+	if first == nil || second == nil {
+		t.Fatal("session cookies not written")
+	}
+	if first.Expire().Equal(second.Expire()) || first.MaxAge() == second.MaxAge() {
+		t.Fatal("sessions created together expire together")
+	}
+	for _, cookie := range []*fasthttp.Cookie{first, second} {
+		lifetime := cookie.Expire().Sub(now)
+		if lifetime < 3240*time.Second || lifetime > 3961*time.Second {
+			t.Fatalf("cookie lifetime %v out of the ±10%% band", lifetime)
+		}
+		if maxAge := time.Duration(cookie.MaxAge()) * time.Second; lifetime < maxAge-time.Second || lifetime > maxAge+time.Second {
+			t.Fatalf("cookie expires in %v, Max-Age is %v", lifetime, maxAge)
+		}
+	}
+}
+
+func TestSessionValueTypes(t *testing.T) {
+	m := newTestApp(t, Options{
+		Provider:   "memory",
+		Config:     `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+		ValueTypes: map[interface{}]interface{}{"user_id": 0},
+	})
+	var mismatched, matched error
+	var got interface{}
+	m.Get("/", func(c *macross.Context) error {
+		mismatched = c.Session.Set("user_id", "42")
+		got = c.Session.Get("user_id")
+		matched = c.Session.Set("user_id", 42)
+		return c.Session.Set("name", "insionng")
+	})
+	doRequest(m, "/", nil)
+	if mismatched == nil || got != nil {
+		t.Fatal("value of the wrong type accepted")
+	}
+	if matched != nil {
+		t.Fatal("value of the registered type rejected:", matched)
+	}
+}
+
+func TestCookiePersistent(t *testing.T) {
+	for _, c := range []struct {
+		config     string
+		persistent bool
+	}{
+		{`"cookieLifetime":3600,"cookiePersistent":true`, true},
+		{`"cookieLifetime":3600,"cookiePersistent":false`, false},
+		{`"cookieLifetime":3600`, true},
+		{`"cookieLifetime":0`, false},
+	} {
+		m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","enableSetCookie":true,"gcLifetime":3600,` + c.config + `}`})
+		m.Get("/", func(c *macross.Context) error { return nil })
+		cookie := responseCookie(doRequest(m, "/", nil), testCookieName)
+		if cookie == nil {
+			t.Fatal("session cookie not written")
+		}
+		hasExpires, hasMaxAge := !cookie.Expire().Equal(fasthttp.CookieExpireUnlimited), cookie.MaxAge() != 0
+		if hasExpires != c.persistent || hasMaxAge != c.persistent {
+			t.Fatalf("%s: Expires %v, Max-Age %v, want persistent %v", c.config, hasExpires, hasMaxAge, c.persistent)
+		}
+	}
+	if _, err := NewManager("memory", `{"cookieName":"sid","gcLifetime":3600,"cookiePersistent":true}`); err == nil {
+		t.Fatal("persistent cookie without a lifetime accepted")
+	}
+}
+
+func TestCookieExpires(t *testing.T) {
+	for _, both := range []bool{false, true} {
+		m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","enableSetCookie":true,"gcLifetime":3600,"cookieLifetime":3600,"cookieExpires":` + strconv.FormatBool(both) + `}`})
+		m.Get("/", func(c *macross.Context) error { return nil })
+		now := time.Now()
+		var header string
+		doRequest(m, "/", nil).Response.Header.VisitAllCookie(func(k, v []byte) {
+			if string(k) == testCookieName {
+				header = string(v)
+			}
+		})
+		if !strings.Contains(header, "max-age=3600") {
+			t.Fatalf("cookieExpires %v: no Max-Age in %q", both, header)
+		}
+		i := strings.Index(header, "; expires=")
+		if (i >= 0) != both {
+			t.Fatalf("cookieExpires %v: Set-Cookie %q", both, header)
+		}
+		if !both {
+			continue
+		}
+		date := header[i+len("; expires="):]
+		if j := strings.Index(date, ";"); j >= 0 {
+			date = date[:j]
+		}
+		expires, err := time.Parse(time.RFC1123, date)
+		if err != nil {
+			t.Fatal("Expires:", err)
+		}
+		// clients honoring only Expires keep the cookie as long as Max-Age says.
+		if lifetime := expires.Sub(now); lifetime < 3599*time.Second || lifetime > 3601*time.Second {
+			t.Fatalf("Expires in %v, Max-Age is 3600s", lifetime)
+		}
+	}
+}
+
+func TestFlushAndRotate(t *testing.T) {
+	m := newTestApp(t, Options{})
+	var oldsid, sid string
+	var user interface{}
+	m.Get("/login", func(c *macross.Context) error {
+		oldsid = c.Session.ID()
+		GetStore(c).SetUserID("u1")
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/rotate", func(c *macross.Context) error {
+		if err := GetStore(c).FlushAndRotate(c); err != nil {
+			return err
+		}
+		sid = c.Session.ID()
+		c.Flash.Info("rotated", false)
+		return nil
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		user = c.Session.Get("user")
+		return nil
+	})
+
+	oldCookies := sessionCookies(t, doRequest(m, "/login", nil))
+	cookies := sessionCookies(t, doRequest(m, "/rotate", oldCookies))
+	if sid == oldsid || cookies[testCookieName] == oldCookies[testCookieName] {
+		t.Fatal("sid not rotated")
+	}
+	if GlobalManager.provider.Exist(oldsid) {
+		t.Fatal("old session still exists")
+	}
+	if sessions := GlobalManager.UserSessions("u1"); len(sessions) != 0 {
+		t.Fatalf("rotated session still bound to its user: %v", sessions)
+	}
+
+	store, _ := GlobalManager.Read(sid)
+	if meta := getMeta(store); meta.CreatedAt.IsZero() || meta.Flash.Get("info") != "rotated" {
+		t.Fatalf("meta not written to the rotated session: %+v", meta)
+	}
+	doRequest(m, "/get", cookies)
+	if user != nil {
+		t.Fatal("values survived FlushAndRotate")
+	}
+
+	doRequest(m, "/get", oldCookies)
+	if sid == oldsid || user != nil {
+		t.Fatal("old sid reused after FlushAndRotate")
+	}
+}
+
+func TestLegacyCookieNames(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"legacyCookieNames":["OldSessionId"]}`})
+	var sid, user string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		user, _ = c.Session.Get("user").(string)
+		return nil
+	})
+
+	value := sessionCookies(t, doRequest(m, "/set", nil))[testCookieName]
+	ctx := doRequest(m, "/get", map[string]string{"OldSessionId": value})
+	if user != "insionng" {
+		t.Fatal("session of the legacy cookie name not found")
+	}
+	if cookie := responseCookie(ctx, testCookieName); cookie == nil || string(cookie.Value()) != sid {
+		t.Fatal("sid not moved to the cookie name")
+	}
+	if cookie := responseCookie(ctx, "OldSessionId"); cookie == nil || cookie.Expire().After(time.Now()) {
+		t.Fatal("legacy cookie not expired")
+	}
+
+	// the cookie name wins, and isn't rewritten.
+	ctx = doRequest(m, "/get", map[string]string{testCookieName: value, "OldSessionId": "unknown"})
+	if user != "insionng" || responseCookie(ctx, testCookieName) != nil || responseCookie(ctx, "OldSessionId") != nil {
+		t.Fatal("legacy cookie name read along with the cookie name")
+	}
+
+	if _, err := NewManager("memory", `{"cookieName":"sid","gcLifetime":3600,"legacyCookieNames":["sid"]}`); err == nil {
+		t.Fatal("cookie name accepted as its own legacy name")
+	}
+}
+
+func TestPeek(t *testing.T) {
+	var peeked Store
+	var found bool
+	peek := func(c *macross.Context) error {
+		peeked, found = Peek(c)
+		return c.Next()
+	}
+	GlobalManager = nil
+	m := macross.New()
+	m.Use(peek)
+	m.Use(Sessioner(Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`}))
+	m.Get("/", func(c *macross.Context) error {
+		return c.Session.Set("user", "insionng")
+	})
+
+	ctx := doRequest(m, "/", nil)
+	if found || peeked != nil {
+		t.Fatal("Peek found a session without a cookie")
+	}
+	doRequest(m, "/", sessionCookies(t, ctx))
+	if !found || peeked.Get("user") != "insionng" {
+		t.Fatal("Peek didn't return the session of the cookie")
+	}
+
+	// without Sessioner nothing is created nor written.
+	m = macross.New()
+	m.Use(peek)
+	m.Get("/", func(c *macross.Context) error { return nil })
+	count := GlobalManager.Count()
+	for _, cookies := range []map[string]string{nil, {testCookieName: "unknownsid"}} {
+		ctx = doRequest(m, "/", cookies)
+		if found {
+			t.Fatalf("Peek found a session for cookies %v", cookies)
+		}
+		if responseCookie(ctx, testCookieName) != nil {
+			t.Fatal("Peek wrote a cookie")
+		}
+	}
+	if GlobalManager.Count() != count {
+		t.Fatal("Peek created a session")
+	}
+}
+
+func TestPeekChecks(t *testing.T) {
+	var found bool
+	GlobalManager = nil
+	m := macross.New()
+	m.Use(func(c *macross.Context) error {
+		_, found = Peek(c)
+		return c.Next()
+	})
+	m.Use(Sessioner(Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"idleTimeout":60}`}))
+	var sid string
+	m.Get("/", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return nil
+	})
+	cookies := sessionCookies(t, doRequest(m, "/", nil))
+	raw, _ := GlobalManager.Read(sid)
+	meta := getMeta(raw)
+	meta.LastAccessed = meta.LastAccessed.Add(-time.Hour)
+	setMeta(raw, meta)
+	raw.Release(nil)
+
+	// Peek runs before the middleware replaces the idle session.
+	doRequest(m, "/", cookies)
+	if found {
+		t.Fatal("Peek returned an idle session")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"idleTimeout":60}`})
+	var sid, user string
+	m.Get("/set", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		user, _ = c.Session.Get("user").(string)
+		return nil
+	})
+	// idle moves the last access of session sid back by d.
+	idle := func(d time.Duration) {
+		raw, _ := GlobalManager.Read(sid)
+		meta := getMeta(raw)
+		meta.LastAccessed = meta.LastAccessed.Add(-d)
+		setMeta(raw, meta)
+		raw.Release(nil)
+	}
+
+	ctx := doRequest(m, "/set", nil)
+	cookies := sessionCookies(t, ctx)
+	if got := string(ctx.Response.Header.Peek("X-Session-Expires-In")); got != "60" {
+		t.Fatalf("X-Session-Expires-In %q, want 60", got)
+	}
+
+	version := func() uint64 {
+		raw, _ := GlobalManager.Read(sid)
+		return store{RawStore: raw, Manager: GlobalManager}.Version()
+	}
+	written := version()
+
+	// a request within the timeout keeps the session and restarts the countdown.
+	idle(50 * time.Second)
+	ctx = doRequest(m, "/get", cookies)
+	if user != "insionng" {
+		t.Fatal("active session lost")
+	}
+	if got := string(ctx.Response.Header.Peek("X-Session-Expires-In")); got != "60" {
+		t.Fatalf("X-Session-Expires-In %q after activity, want 60", got)
+	}
+	if raw, _ := GlobalManager.Read(sid); time.Since(getMeta(raw).LastAccessed) > time.Second {
+		t.Fatal("last access not recorded")
+	}
+	// the last access alone isn't a change of the values.
+	if v := version(); v != written {
+		t.Fatalf("version %d after a read-only request, want %d", v, written)
+	}
+
+	idle(61 * time.Second)
+	old := sid
+	ctx = doRequest(m, "/get", cookies)
+	if user != "" || sid == old {
+		t.Fatal("idle session not replaced by a new one")
+	}
+	if GlobalManager.provider.Exist(old) {
+		t.Fatal("idle session not destroyed")
+	}
+	if cookie := responseCookie(ctx, testCookieName); cookie == nil || string(cookie.Value()) != sid {
+		t.Fatal("cookie of the new session not written")
+	}
+	if got := string(ctx.Response.Header.Peek("X-Session-Expires-In")); got != "60" {
+		t.Fatalf("X-Session-Expires-In %q for the new session, want 60", got)
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, op := range []Options{
+		{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"maxValueBytes":1024}`},
+		{Provider: "file", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"maxValueBytes":1024,"providerConfig":"` + dir + `"}`},
+	} {
+		m := newTestApp(t, op)
+		var errs []error
+		var got interface{}
+		m.Get("/", func(c *macross.Context) error {
+			errs = []error{
+				c.Session.Set("dump", strings.Repeat("x", 2048)),
+				c.Session.Set("rows", make([]int64, 1024)),
+			}
+			got = c.Session.Get("dump")
+			return c.Session.Set("name", "insionng")
+		})
+		m.Get("/get", func(c *macross.Context) error {
+			got = c.Session.Get("name")
+			return nil
+		})
+		ctx := doRequest(m, "/", nil)
+		for i, err := range errs {
+			if err == nil {
+				t.Fatalf("%s: oversized value %d accepted", op.Provider, i)
+			}
+		}
+		if got != nil {
+			t.Fatalf("%s: oversized value stored", op.Provider)
+		}
+		doRequest(m, "/get", sessionCookies(t, ctx))
+		if got != "insionng" {
+			t.Fatalf("%s: normal value not stored", op.Provider)
+		}
+	}
+	if _, err := NewManager("memory", `{"cookieName":"sid","gcLifetime":3600,"maxValueBytes":-1}`); err == nil {
+		t.Fatal("negative maxValueBytes accepted")
+	}
+}
+
+func TestReleaseCancelledRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := newTestApp(t, Options{Provider: "file", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"providerConfig":"` + dir + `"}`})
+	var user interface{}
+	var requestCtx context.Context
+	m.Get("/set", func(c *macross.Context) error {
+		requestCtx = RequestContext(c)
+		return c.Session.Set("user", "insionng")
+	})
+	m.Get("/gone", func(c *macross.Context) error {
+		// the client went away while the request was served.
+		ctx, cancel := context.WithCancel(context.Background())
+		WithContext(c, ctx)
+		cancel()
+		return c.Session.Set("user", "gone")
+	})
+	m.Get("/get", func(c *macross.Context) error {
+		user = c.Session.Get("user")
+		return nil
+	})
+
+	ctx := doRequest(m, "/set", nil)
+	if requestCtx != context.Context(ctx) {
+		t.Fatal("request context not derived from the request")
+	}
+	cookies := sessionCookies(t, ctx)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	doRequest(m, "/gone", cookies)
+	log.SetOutput(os.Stderr)
+	if !strings.Contains(buf.String(), "aborted: context canceled") {
+		t.Fatalf("aborted release not logged: %q", buf.String())
+	}
+	doRequest(m, "/get", cookies)
+	if user != "insionng" {
+		t.Fatalf("session of the cancelled request saved, user %v", user)
+	}
+
+	store, _ := GlobalManager.Read(strings.Repeat("b", 16))
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = ReleaseContext(cancelled, nil, store); err != context.Canceled {
+		t.Fatalf("ReleaseContext of a cancelled context returned %v", err)
+	}
+}
+
+func TestOnNearExpiry(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"nearExpiryWindow":300}`})
+	var sid string
+	m.Get("/", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return nil
+	})
+	var hooked []string
+	var remaining time.Duration
+	GlobalManager.OnNearExpiry(func(sid string, left time.Duration) {
+		hooked = append(hooked, sid)
+		remaining = left
+	})
+	// age moves the last access of session sid back by d.
+	age := func(d time.Duration) {
+		raw, _ := GlobalManager.Read(sid)
+		meta := getMeta(raw)
+		meta.LastAccessed = meta.LastAccessed.Add(-d)
+		setMeta(raw, meta)
+		raw.Release(nil)
+	}
+
+	cookies := sessionCookies(t, doRequest(m, "/", nil))
+	doRequest(m, "/", cookies)
+	if len(hooked) != 0 {
+		t.Fatalf("hook called for a fresh session: %v", hooked)
+	}
+
+	age(3400 * time.Second)
+	doRequest(m, "/", cookies)
+	if len(hooked) != 1 || hooked[0] != sid {
+		t.Fatalf("hook calls %v, want one for %s", hooked, sid)
+	}
+	if remaining <= 190*time.Second || remaining > 200*time.Second {
+		t.Fatalf("remaining %v, want about 200s", remaining)
+	}
+
+	if _, err := NewManager("memory", `{"cookieName":"sid","gcLifetime":3600,"nearExpiryWindow":-1}`); err == nil {
+		t.Fatal("negative nearExpiryWindow accepted")
+	}
+}
+
+func TestSessionTimestamps(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`})
+	var sid string
+	var created, accessed time.Time
+	m.Get("/", func(c *macross.Context) error {
+		s := GetStore(c)
+		sid = s.ID()
+		var err error
+		if created, err = s.CreatedAt(); err != nil {
+			return err
+		}
+		accessed, err = s.LastAccessedAt()
+		return err
+	})
+
+	cookies := sessionCookies(t, doRequest(m, "/", nil))
+	if time.Since(created) > time.Second || !accessed.Equal(created) {
+		t.Fatalf("new session created at %v, accessed at %v", created, accessed)
+	}
+	first := created
+
+	// move the last access back past its precision.
+	raw, _ := GlobalManager.Read(sid)
+	meta := getMeta(raw)
+	meta.LastAccessed = meta.LastAccessed.Add(-2 * time.Minute)
+	setMeta(raw, meta)
+	raw.Release(nil)
+
+	doRequest(m, "/", cookies)
+	if !created.Equal(first) {
+		t.Fatalf("CreatedAt moved from %v to %v", first, created)
+	}
+	if time.Since(accessed) > time.Second {
+		t.Fatalf("LastAccessedAt %v not advanced", accessed)
+	}
+
+	raw, _ = GlobalManager.Read("unknown")
+	if _, err := (store{RawStore: raw, Manager: GlobalManager}).CreatedAt(); err != ErrNoTimestamps {
+		t.Fatalf("CreatedAt of an untouched session: %v", err)
+	}
+}
+
+func TestSetClientCookie(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"cookieLifetime":600,"sameSite":"strict"}`})
+	m.Get("/", func(c *macross.Context) error {
+		return GlobalManager.SetClientCookie(c, "XSRF-TOKEN", "c2VjcmV0")
+	})
+	m.Get("/session", func(c *macross.Context) error {
+		if GlobalManager.SetClientCookie(c, testCookieName, "c2VjcmV0") == nil {
+			t.Error("client cookie replacing the session cookie")
+		}
+		return nil
+	})
+
+	ctx := doRequest(m, "/", nil)
+	client := responseCookie(ctx, "XSRF-TOKEN")
+	if client == nil || string(client.Value()) != "c2VjcmV0" {
+		t.Fatal("client cookie not written")
+	}
+	if client.HTTPOnly() {
+		t.Fatal("client cookie is HttpOnly")
+	}
+	sess := responseCookie(ctx, testCookieName)
+	if sess == nil || !sess.HTTPOnly() {
+		t.Fatal("session cookie isn't HttpOnly")
+	}
+	if client.SameSite() != sess.SameSite() || sess.Expire().Sub(client.Expire()) > time.Second {
+		t.Fatal("client cookie attributes differ from the session cookie")
+	}
+
+	ctx = doRequest(m, "/session", nil)
+	if sess = responseCookie(ctx, testCookieName); sess == nil || !sess.HTTPOnly() {
+		t.Fatal("session cookie changed")
+	}
+}
+
+func TestSetAll(t *testing.T) {
+	m := newTestApp(t, Options{
+		Provider:   "memory",
+		Config:     `{"cookieName":"` + testCookieName + `","gcLifetime":3600}`,
+		ValueTypes: map[interface{}]interface{}{"user_id": 0},
+	})
+	var sid string
+	var rejected error
+	m.Get("/", func(c *macross.Context) error {
+		s := GetStore(c)
+		sid = s.ID()
+		s.Set("user", "insionng")
+		s.Set("cart", 3)
+		rejected = s.SetAll(map[interface{}]interface{}{"lang": "en", "user_id": "42"})
+		return s.SetAll(map[interface{}]interface{}{"lang": "en", "user_id": 42})
+	})
+	doRequest(m, "/", nil)
+	if rejected == nil {
+		t.Fatal("SetAll accepted a value of the wrong type")
+	}
+
+	raw, _ := GlobalManager.Read(sid)
+	s := store{RawStore: raw, Manager: GlobalManager}
+	if keys := s.Keys(); len(keys) != 2 || s.Get("lang") != "en" || s.Get("user_id") != 42 || s.Get("user") != nil {
+		t.Fatalf("session holds %v after SetAll", keys)
+	}
+	if s.Meta().CreatedAt.IsZero() {
+		t.Fatal("SetAll dropped the session metadata")
+	}
+
+	// readers see the values of one SetAll or the other, never a mix.
+	a := map[interface{}]interface{}{"a1": 1, "a2": 2}
+	b := map[interface{}]interface{}{"b1": 1, "b2": 2, "b3": 3}
+	s.SetAll(a)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if i%2 == 0 {
+				s.SetAll(a)
+			} else {
+				s.SetAll(b)
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		keys := s.Keys()
+		prefixes := map[byte]bool{}
+		for _, key := range keys {
+			prefixes[key.(string)[0]] = true
+		}
+		if len(prefixes) != 1 || prefixes['a'] && len(keys) != len(a) || prefixes['b'] && len(keys) != len(b) {
+			t.Fatalf("session seen half replaced: %v", keys)
+		}
+	}
+}
+
+func TestIgnoreMalformedCookie(t *testing.T) {
+	for _, ignore := range []bool{false, true} {
+		m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","enableSetCookie":true,"gcLifetime":3600,` +
+			`"ignoreMalformedCookie":` + strconv.FormatBool(ignore) + `}`})
+		handled := false
+		m.Get("/", func(c *macross.Context) error {
+			handled = true
+			return nil
+		})
+		ctx := doRequest(m, "/", map[string]string{testCookieName: "%zz"})
+		if !ignore {
+			if handled {
+				t.Fatal("malformed cookie read as a sid")
+			}
+			continue
+		}
+		if !handled || ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("malformed cookie failed the request with %d", ctx.Response.StatusCode())
+		}
+		if cookie := responseCookie(ctx, testCookieName); cookie == nil || string(cookie.Value()) == "%zz" {
+			t.Fatal("no new session started for the malformed cookie")
+		}
+	}
+}
+
+func TestIPBinding(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"ipBindPrefix":24}`})
+	var sid string
+	m.Get("/", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return nil
+	})
+	// request requests / from ip with cookies.
+	request := func(ip string, cookies map[string]string) *fasthttp.RequestCtx {
+		req := new(fasthttp.Request)
+		req.SetRequestURI("/")
+		for k, v := range cookies {
+			req.Header.SetCookie(k, v)
+		}
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+		m.ServeHTTP(ctx)
+		return ctx
+	}
+
+	cookies := sessionCookies(t, request("203.0.113.7", nil))
+	first := sid
+	request("203.0.113.200", cookies)
+	if sid != first {
+		t.Fatal("session of a client within the network replaced")
+	}
+	ctx := request("198.51.100.7", cookies)
+	if sid == first || GlobalManager.provider.Exist(first) {
+		t.Fatal("session of a client outside the network kept")
+	}
+	if cookie := responseCookie(ctx, testCookieName); cookie == nil || string(cookie.Value()) == cookies[testCookieName] {
+		t.Fatal("no new session cookie for the client outside the network")
+	}
+
+	cookies = sessionCookies(t, request("2001:db8:1:2::7", nil))
+	first = sid
+	request("2001:db8:1:2::8", cookies)
+	if sid != first {
+		t.Fatal("session of an IPv6 client within the /64 replaced")
+	}
+	request("2001:db8:1:3::7", cookies)
+	if sid == first {
+		t.Fatal("session of an IPv6 client outside the /64 kept")
+	}
+
+	// a session without a client ip is bound to its next client.
+	cookies = sessionCookies(t, request("203.0.113.7", nil))
+	first = sid
+	raw, _ := GlobalManager.Read(first)
+	meta := getMeta(raw)
+	meta.ClientIP = ""
+	setMeta(raw, meta)
+	raw.Release(nil)
+	request("198.51.100.7", cookies)
+	if sid != first {
+		t.Fatal("session without a client ip replaced on first sight")
+	}
+	request("203.0.113.7", cookies)
+	if sid == first {
+		t.Fatal("session without a client ip not bound to the client which used it")
+	}
+}
+
+func TestValidateSID(t *testing.T) {
+	m := newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"validateSID":true}`})
+	var sid string
+	m.Get("/", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return nil
+	})
+	valid := "0123456789abcdef0123456789abcdef"
+	for _, c := range []struct {
+		sid    string
+		accept bool
+	}{
+		{valid, true},
+		{"0123456789abcdef", false},
+		{valid + "00", false},
+		{"0123456789ABCDEF0123456789ABCDEF", false},
+		{"0123456789abcdef0123456789abcde*", false},
+		{"session:*", false},
+	} {
+		// the session exists, only the format keeps it out.
+		GlobalManager.Read(c.sid)
+		doRequest(m, "/", map[string]string{testCookieName: c.sid})
+		if accepted := sid == c.sid; accepted != c.accept {
+			t.Fatalf("sid %q accepted %v, want %v", c.sid, accepted, c.accept)
+		}
+	}
+
+	m = newTestApp(t, Options{Provider: "memory", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"sidPattern":"[a-z]{4}"}`})
+	m.Get("/", func(c *macross.Context) error {
+		sid = c.Session.ID()
+		return nil
+	})
+	for _, c := range []struct {
+		sid    string
+		accept bool
+	}{{"abcd", true}, {"abcde", false}, {valid, false}} {
+		GlobalManager.Read(c.sid)
+		doRequest(m, "/", map[string]string{testCookieName: c.sid})
+		if accepted := sid == c.sid; accepted != c.accept {
+			t.Fatalf("sidPattern: sid %q accepted %v, want %v", c.sid, accepted, c.accept)
+		}
+	}
+
+	if _, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"sidPattern":"[a-z"}`); err == nil {
+		t.Fatal("invalid sidPattern accepted")
+	}
+	if _, err := NewManager("cookie", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"validateSID":true,`+
+		`"providerConfig":"{\"cookieName\":\"MacrossSessionId\",\"securityKey\":\"Macrosscookiehashkey\"}"}`); err == nil {
+		t.Fatal("validateSID accepted for the cookie provider")
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		name, provider, config string
+		hide                   bool // the raw store without its GetOrSet
+	}{
+		{"memory", "memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, false},
+		{"file", "file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"` + dir + `"}`, false},
+		{"fallback", "memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`, true},
+	} {
+		manager, err := NewManager(c.provider, c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid, _ := manager.sessionID()
+		raw, _ := manager.Read(sid)
+		if c.hide {
+			raw = struct{ macross.RawStore }{raw}
+		}
+		s := store{RawStore: raw, Manager: manager}
+
+		var calls int32
+		carts := make([]interface{}, 20)
+		var wg sync.WaitGroup
+		for i := range carts {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				carts[i] = s.GetOrSet("cart", func() interface{} {
+					atomic.AddInt32(&calls, 1)
+					return []string{"book"}
+				})
+			}(i)
+		}
+		wg.Wait()
+		if calls != 1 {
+			t.Fatalf("%s: factory called %d times", c.name, calls)
+		}
+		for _, cart := range carts {
+			if !reflect.DeepEqual(cart, []string{"book"}) || !reflect.DeepEqual(s.Get("cart"), cart) {
+				t.Fatalf("%s: GetOrSet returned %v, the session holds %v", c.name, cart, s.Get("cart"))
+			}
+		}
+
+		manager.SetValueType("user_id", 0)
+		if v := s.GetOrSet("user_id", func() interface{} { return "42" }); v != "42" || s.Get("user_id") != nil {
+			t.Fatalf("%s: value of the wrong type set by GetOrSet", c.name)
+		}
+		manager.provider.Destory(sid)
+	}
+}
+
+func TestGetOrSetFallbackPerSession(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sessions without a GetOrSet of their own, in different stripes.
+	open := func() store {
+		sid, _ := manager.sessionID()
+		raw, _ := manager.Read(sid)
+		return store{RawStore: struct{ macross.RawStore }{raw}, Manager: manager}
+	}
+	slow, fast := open(), open()
+	for storeLock(slow.ID()) == storeLock(fast.ID()) {
+		fast = open()
+	}
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	go slow.GetOrSet("cart", func() interface{} {
+		close(started)
+		<-unblock
+		return "slow"
+	})
+	<-started
+	defer close(unblock)
+	done := make(chan interface{})
+	go func() {
+		done <- fast.GetOrSet("cart", func() interface{} { return "fast" })
+	}()
+	select {
+	case v := <-done:
+		if v != "fast" {
+			t.Fatalf("GetOrSet = %v, want fast", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetOrSet held up by the factory of another session")
+	}
+}
+
+func TestGetOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := newTestApp(t, Options{Provider: "file", Config: `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"providerConfig":"` + dir + `"}`})
+	m.Get("/set", func(c *macross.Context) error {
+		return SetOnce(c, "nonce", "4f2a")
+	})
+	var got []interface{}
+	m.Get("/get", func(c *macross.Context) error {
+		got = make([]interface{}, 10)
+		var wg sync.WaitGroup
+		for i := range got {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				got[i] = GetOnce(c, "nonce")
+			}(i)
+		}
+		wg.Wait()
+		return nil
+	})
+	var hidden []interface{}
+	m.Get("/fallback", func(c *macross.Context) error {
+		s := GetStore(c).(*store)
+		s.RawStore = struct{ macross.RawStore }{s.RawStore}
+		hidden = []interface{}{GetOnce(c, "nonce"), GetOnce(c, "nonce")}
+		return nil
+	})
+
+	consumed := func() int {
+		n := 0
+		for _, v := range got {
+			if v != nil {
+				if v != "4f2a" {
+					t.Fatalf("GetOnce returned %v", v)
+				}
+				n++
+			}
+		}
+		return n
+	}
+	cookies := sessionCookies(t, doRequest(m, "/set", nil))
+	if doRequest(m, "/get", cookies); consumed() != 1 {
+		t.Fatalf("value consumed %d times", consumed())
+	}
+	// the consumption is saved.
+	if doRequest(m, "/get", cookies); consumed() != 0 {
+		t.Fatal("value consumed again by the next request")
+	}
+
+	doRequest(m, "/set", cookies)
+	if doRequest(m, "/fallback", cookies); hidden[0] != "4f2a" || hidden[1] != nil {
+		t.Fatalf("fallback GetOnce returned %v", hidden)
+	}
+}
+
+func TestUnencodableValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, mode := range []string{"", "drop"} {
+		GlobalManager = nil
+		var released error
+		m := macross.New()
+		m.Use(func(c *macross.Context) error {
+			released = c.Next()
+			return released
+		})
+		m.Use(Sessioner(Options{
+			Provider:       "file",
+			Config:         `{"cookieName":"` + testCookieName + `","gcLifetime":3600,"onEncodeError":"` + mode + `"}`,
+			ProviderConfig: FileConfig{SavePath: dir},
+		}))
+		var setErr error
+		m.Get("/set", func(c *macross.Context) error {
+			setErr = c.Session.Set("callback", func() {})
+			return nil
+		})
+		m.Get("/mutate", func(c *macross.Context) error {
+			prefs := map[string]interface{}{"theme": "dark"}
+			c.Session.Set("user", "insionng")
+			c.Session.Set("prefs", prefs)
+			// changed after its Set, only the release can tell.
+			prefs["onChange"] = make(chan int)
+			return nil
+		})
+		var user, prefs interface{}
+		m.Get("/get", func(c *macross.Context) error {
+			user, prefs = c.Session.Get("user"), c.Session.Get("prefs")
+			return nil
+		})
+
+		cookies := sessionCookies(t, doRequest(m, "/set", nil))
+		if mode == "" {
+			if eerr, ok := setErr.(*EncodeError); !ok || eerr.Key != "callback" || !strings.Contains(setErr.Error(), "callback") {
+				t.Fatalf("Set of a func: %v, want an EncodeError naming the key", setErr)
+			}
+		} else if setErr != nil {
+			t.Fatalf("Set of a func dropped with %v", setErr)
+		}
+
+		doRequest(m, "/mutate", cookies)
+		if mode == "" {
+			if eerr, ok := released.(*EncodeError); !ok || eerr.Key != "prefs" {
+				t.Fatalf("release of a changed value: %v, want an EncodeError naming the key", released)
+			}
+			continue
+		}
+		if released != nil {
+			t.Fatalf("request failed with %v although the value is dropped", released)
+		}
+		doRequest(m, "/get", cookies)
+		if user != "insionng" || prefs != nil {
+			t.Fatalf("read back user %v and prefs %v, want the unencodable prefs dropped", user, prefs)
+		}
+	}
+
+	if _, err = NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"onEncodeError":"ignore"}`); err == nil {
+		t.Fatal("unknown onEncodeError accepted")
+	}
+}
@@ -12,8 +12,8 @@ func main() {
 
 	v := macross.New()
 	v.Use(recover.Recover())
-	//v.Use(session.Sessioner(session.Options{"file", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"./data/session"}`}))
-	v.Use(session.Sessioner(session.Options{"redis", `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"127.0.0.1:6379"}`}))
+	//v.Use(session.Sessioner(session.Options{Provider: "file", Config: `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"./data/session"}`}))
+	v.Use(session.Sessioner(session.Options{Provider: "redis", Config: `{"cookieName":"MacrossSessionId","gcLifetime":3600,"providerConfig":"127.0.0.1:6379"}`}))
 
 	v.Get("/get", func(self *macross.Context) error {
 		value := "nil"
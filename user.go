@@ -0,0 +1,203 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// userIndex tracks which sessions belong to which user, for features like
+// "log out other devices". It lives in the manager, so it only sees the
+// sessions bound in this process, see Manager.userSessionsLocked for the
+// others.
+type userIndex struct {
+	lock  sync.Mutex
+	sids  map[string]map[string]binding // user id -> session ids -> binding
+	users map[string]string             // session id -> user id
+	binds uint64                        // binds so far, orders the bindings
+}
+
+// binding is when a session was bound to its user, at and as the order-th
+// binding of the index, 0 for the sessions bound in other processes.
+type binding struct {
+	at    time.Time
+	order uint64
+}
+
+// before reports whether b was bound before c.
+func (b binding) before(c binding) bool {
+	if !b.at.Equal(c.at) {
+		return b.at.Before(c.at)
+	}
+	return b.order < c.order
+}
+
+func newUserIndex() *userIndex {
+	return &userIndex{
+		sids:  make(map[string]map[string]binding),
+		users: make(map[string]string),
+	}
+}
+
+// bind binds sid to userID at, unbinding it from its previous user.
+func (ui *userIndex) bind(userID, sid string, at time.Time) {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+	ui.unbindLocked(sid)
+	if userID == "" {
+		return
+	}
+	ui.binds++
+	ui.bindLocked(userID, sid, binding{at: at, order: ui.binds})
+}
+
+// bindLocked binds sid to userID, the caller must hold the lock.
+func (ui *userIndex) bindLocked(userID, sid string, b binding) {
+	if ui.sids[userID] == nil {
+		ui.sids[userID] = make(map[string]binding)
+	}
+	ui.sids[userID][sid] = b
+	ui.users[sid] = userID
+}
+
+func (ui *userIndex) unbind(sid string) {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+	ui.unbindLocked(sid)
+}
+
+// unbindLocked drops sid from the index, the caller must hold the lock.
+func (ui *userIndex) unbindLocked(sid string) {
+	userID, ok := ui.users[sid]
+	if !ok {
+		return
+	}
+	delete(ui.users, sid)
+	delete(ui.sids[userID], sid)
+	if len(ui.sids[userID]) == 0 {
+		delete(ui.sids, userID)
+	}
+}
+
+// rename moves the binding of a regenerated session to its new id,
+// keeping its bind order.
+func (ui *userIndex) rename(oldsid, sid string) {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+	if userID, ok := ui.users[oldsid]; ok {
+		b := ui.sids[userID][oldsid]
+		ui.unbindLocked(oldsid)
+		ui.bindLocked(userID, sid, b)
+	}
+}
+
+// userSession is a live session of a user, see userSessionsLocked.
+type userSession struct {
+	sid string
+	binding
+}
+
+// userSessionsLocked returns the live sessions of userID, bound first first.
+// Those of a SIDLister provider whose metadata names userID are included,
+// e.g. bound by other instances or before a restart, the index alone only
+// knows the sessions bound in this process. The caller must hold the index
+// lock.
+func (manager *Manager) userSessionsLocked(userID string) ([]userSession, error) {
+	var sessions []userSession
+	for sid, b := range manager.users.sids[userID] {
+		if !manager.provider.Exist(sid) {
+			// expired meanwhile.
+			manager.users.unbindLocked(sid)
+			continue
+		}
+		sessions = append(sessions, userSession{sid, b})
+	}
+	sids, err := listSIDs(manager.provider)
+	if err == ErrSIDsUnsupported {
+		sids, err = nil, nil
+	}
+	ctx := context.Background()
+	for _, sid := range sids {
+		if _, indexed := manager.users.users[sid]; indexed || !manager.provider.Exist(sid) {
+			continue
+		}
+		raw, rerr := manager.read(ctx, sid)
+		if rerr != nil {
+			err = rerr
+			break
+		}
+		if meta := getMeta(raw); meta.UserID == userID && userID != "" {
+			sessions = append(sessions, userSession{sid, binding{at: meta.BoundAt}})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].before(sessions[j].binding)
+	})
+	return sessions, err
+}
+
+// UserSessions returns the ids of the live sessions bound to userID with
+// Store.SetUserID, sorted.
+func (manager *Manager) UserSessions(userID string) []string {
+	manager.users.lock.Lock()
+	defer manager.users.lock.Unlock()
+	sessions, err := manager.userSessionsLocked(userID)
+	if err != nil {
+		log.Printf("session: sessions of user %s: %v", userID, err)
+	}
+	var sids []string
+	for _, s := range sessions {
+		sids = append(sids, s.sid)
+	}
+	sort.Strings(sids)
+	return sids
+}
+
+// DestroyUserSessionsExcept destroys all sessions of userID but currentSID,
+// e.g. to log out the other devices of a user. The index stays locked
+// meanwhile, so sessions bound concurrently aren't missed half way and
+// currentSID is never touched.
+func (manager *Manager) DestroyUserSessionsExcept(userID, currentSID string) error {
+	manager.users.lock.Lock()
+	defer manager.users.lock.Unlock()
+	sessions, err := manager.userSessionsLocked(userID)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.sid == currentSID {
+			continue
+		}
+		if err := manager.destroy(context.Background(), s.sid); err != nil {
+			return err
+		}
+		manager.users.unbindLocked(s.sid)
+	}
+	return nil
+}
+
+// EnforceSessionLimit destroys the sessions of userID bound first until it
+// has max live sessions left, e.g. right after SetUserID on login so the
+// new session is kept and the oldest logins are signed out.
+func (manager *Manager) EnforceSessionLimit(userID string, max int) error {
+	if max < 1 {
+		return fmt.Errorf("session: session limit %d is less than 1", max)
+	}
+	manager.users.lock.Lock()
+	defer manager.users.lock.Unlock()
+	sessions, err := manager.userSessionsLocked(userID)
+	if err != nil {
+		return err
+	}
+	for len(sessions) > max {
+		if err := manager.destroy(context.Background(), sessions[0].sid); err != nil {
+			return err
+		}
+		manager.users.unbindLocked(sessions[0].sid)
+		sessions = sessions[1:]
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/insionng/macross"
+	"github.com/valyala/fasthttp"
+)
+
+func TestDestroyUserSessionsExcept(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the providers are shared with the other tests, start empty.
+	manager.DestroyAll()
+	bind := func(userID string) string {
+		sid, _ := manager.sessionID()
+		raw, _ := manager.Read(sid)
+		if err := (store{RawStore: raw, Manager: manager}).SetUserID(userID); err != nil {
+			t.Fatal("SetUserID:", err)
+		}
+		return sid
+	}
+	phone, laptop, tablet := bind("insion"), bind("insion"), bind("insion")
+	other := bind("ng")
+
+	if got := manager.UserSessions("insion"); len(got) != 3 {
+		t.Fatalf("UserSessions = %v, want 3 sessions", got)
+	}
+	if err = manager.DestroyUserSessionsExcept("insion", laptop); err != nil {
+		t.Fatal("DestroyUserSessionsExcept:", err)
+	}
+	for _, sid := range []string{phone, tablet} {
+		if manager.provider.Exist(sid) {
+			t.Fatalf("session %s of the user survived", sid)
+		}
+	}
+	if !manager.provider.Exist(laptop) {
+		t.Fatal("current session destroyed")
+	}
+	if !manager.provider.Exist(other) {
+		t.Fatal("session of another user destroyed")
+	}
+	if got := manager.UserSessions("insion"); !reflect.DeepEqual(got, []string{laptop}) {
+		t.Fatalf("UserSessions = %v, want only the current session", got)
+	}
+	raw, _ := manager.Read(laptop)
+	if (store{RawStore: raw, Manager: manager}).UserID() != "insion" {
+		t.Fatal("user id not kept in the session metadata")
+	}
+}
+
+func TestEnforceSessionLimit(t *testing.T) {
+	manager, err := NewManager("memory", `{"cookieName":"MacrossSessionId","gcLifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the providers are shared with the other tests, start empty.
+	manager.DestroyAll()
+	// login binds a new session to userID and enforces the limit of 3.
+	login := func(userID string) string {
+		sid, _ := manager.sessionID()
+		raw, _ := manager.Read(sid)
+		if err := (store{RawStore: raw, Manager: manager}).SetUserID(userID); err != nil {
+			t.Fatal("SetUserID:", err)
+		}
+		if err := manager.EnforceSessionLimit(userID, 3); err != nil {
+			t.Fatal("EnforceSessionLimit:", err)
+		}
+		return sid
+	}
+	first := login("insion")
+	other := login("ng")
+	second, third := login("insion"), login("insion")
+	if got := manager.UserSessions("insion"); len(got) != 3 {
+		t.Fatalf("UserSessions = %v, want 3 sessions within the limit", got)
+	}
+
+	// a regenerated session keeps its place in the login order.
+	raw, _ := manager.provider.Regenerate(first, "regenerated")
+	manager.users.rename(first, raw.ID())
+	fourth := login("insion")
+	if manager.provider.Exist(raw.ID()) {
+		t.Fatal("oldest session of the user survived the 4th login")
+	}
+	for _, sid := range []string{second, third, fourth, other} {
+		if !manager.provider.Exist(sid) {
+			t.Fatalf("session %s destroyed", sid)
+		}
+	}
+	if got := manager.UserSessions("insion"); len(got) != 3 {
+		t.Fatalf("UserSessions = %v, want 3 sessions", got)
+	}
+	if err = manager.EnforceSessionLimit("insion", 0); err == nil {
+		t.Fatal("limit of 0 accepted")
+	}
+}
+
+func TestUserSessionsOfOtherProcesses(t *testing.T) {
+	config := `{"cookieName":"MacrossSessionId","gcLifetime":3600}`
+	// two managers on the same provider, as two instances on a shared store.
+	this, err := NewManager("memory", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	this.DestroyAll()
+	that, err := NewManager("memory", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := func(manager *Manager, userID string) string {
+		sid, _ := manager.sessionID()
+		raw, _ := manager.Read(sid)
+		if err := (store{RawStore: raw, Manager: manager}).SetUserID(userID); err != nil {
+			t.Fatal("SetUserID:", err)
+		}
+		raw.Release(nil)
+		return sid
+	}
+	older := bind(that, "insion")
+	bind(that, "ng")
+	current := bind(this, "insion")
+
+	if got := this.UserSessions("insion"); len(got) != 2 {
+		t.Fatalf("UserSessions = %v, want the sessions of both instances", got)
+	}
+	if err = this.EnforceSessionLimit("insion", 1); err != nil {
+		t.Fatal("EnforceSessionLimit:", err)
+	}
+	if this.provider.Exist(older) || !this.provider.Exist(current) {
+		t.Fatal("oldest session of the user bound by another instance not destroyed first")
+	}
+	if err = this.RevokeUserSession("ng", current); err == nil {
+		t.Fatal("session of another user revoked")
+	}
+}
+
+func TestParseUserAgent(t *testing.T) {
+	for ua, want := range map[string]Device{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0": {Browser: "Edge", OS: "Windows"},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15":         {Browser: "Safari", OS: "macOS"},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0 Mobile/15E148":     {Browser: "Chrome", OS: "iOS", Mobile: true},
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36":         {Browser: "Chrome", OS: "Android", Mobile: true},
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                        {Browser: "Firefox", OS: "Linux"},
+		"curl/8.4.0": {},
+	} {
+		if got := ParseUserAgent(ua); got != want {
+			t.Errorf("ParseUserAgent(%q) = %+v, want %+v", ua, got, want)
+		}
+	}
+}
+
+func TestUserDevices(t *testing.T) {
+	m := newTestApp(t, Options{})
+	// the providers are shared with the other tests, whose sessions of the
+	// same users are found too.
+	GlobalManager.DestroyAll()
+	m.Get("/login", func(c *macross.Context) error {
+		return c.Session.(Store).SetUserID(c.QueryParam("user"))
+	})
+	login := func(user, ua string) string {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/login?user=" + user)
+		ctx.Request.Header.Set("User-Agent", ua)
+		m.ServeHTTP(ctx)
+		return sessionCookies(t, ctx)[testCookieName]
+	}
+	phone := login("insion", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1")
+	laptop := login("insion", "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+	other := login("ng", "curl/8.4.0")
+
+	devices, err := GlobalManager.UserDevices("insion")
+	if err != nil {
+		t.Fatal("UserDevices:", err)
+	}
+	got := map[string]Device{}
+	for _, d := range devices {
+		if d.CreatedAt.IsZero() || d.LastSeen.IsZero() {
+			t.Fatalf("device session %s without its times: %+v", d.SID, d)
+		}
+		got[d.SID] = d.Device
+	}
+	want := map[string]Device{
+		phone:  {Browser: "Safari", OS: "iOS", Mobile: true},
+		laptop: {Browser: "Firefox", OS: "Linux"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("UserDevices = %+v, want %+v", got, want)
+	}
+
+	if err = GlobalManager.RevokeUserSession("insion", other); err == nil {
+		t.Fatal("session of another user revoked")
+	}
+	if err = GlobalManager.RevokeUserSession("insion", phone); err != nil {
+		t.Fatal("RevokeUserSession:", err)
+	}
+	if GlobalManager.provider.Exist(phone) || !GlobalManager.provider.Exist(laptop) || !GlobalManager.provider.Exist(other) {
+		t.Fatal("RevokeUserSession destroyed other sessions than the revoked one")
+	}
+	if devices, _ = GlobalManager.UserDevices("insion"); len(devices) != 1 || devices[0].SID != laptop {
+		t.Fatalf("UserDevices after the revoke = %+v, want the laptop", devices)
+	}
+}